@@ -0,0 +1,341 @@
+// Command fake-restic imitates the restic CLI for demos and integration
+// tests. It answers the commands used by the monitor and the agent from the
+// scenario file named by FAKE_RESTIC_SCENARIO (see restic.Scenario), looking
+// up the repository given by RESTIC_REPOSITORY or -r.
+//
+// Every invocation starts from the scenario again, so unlock, forget and
+// backup are not remembered by the next call. Set FAKE_RESTIC_STATE to a
+// file to keep the repository state between calls instead.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/example/restic-monitor/internal/restic"
+)
+
+// valueFlags take an argument; all other flags are switches.
+var valueFlags = map[string]bool{
+	"-o": true, "--option": true, "-r": true, "--repo": true, "--repository-file": true,
+	"-p": true, "--password-file": true, "--password-command": true, "--cacert": true,
+	"--keep-last": true, "--keep-hourly": true, "--keep-daily": true, "--keep-weekly": true,
+	"--keep-monthly": true, "--keep-yearly": true, "--keep-within": true, "--keep-tag": true,
+	"--host": true, "-H": true, "--tag": true, "--path": true, "--exclude": true, "-e": true,
+	"--stdin-filename": true, "--mode": true, "--read-data-subset": true, "--cache-dir": true,
+}
+
+type invocation struct {
+	command    string
+	args       []string
+	repository string
+	json       bool
+	stdin      bool
+	stdinName  string
+	mode       string
+	removeAll  bool
+	policy     restic.Policy
+	tags       []string
+}
+
+func main() {
+	inv, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fail(err)
+	}
+	if inv.command == "version" {
+		fmt.Println("restic 0.17.3 (fake-restic)")
+		return
+	}
+
+	scenario, err := loadScenario()
+	if err != nil {
+		fail(err)
+	}
+	if inv.repository == "" {
+		inv.repository = os.Getenv("RESTIC_REPOSITORY")
+	}
+	if inv.repository == "" {
+		fail(errors.New("Fatal: Please specify repository location (-r or --repository-file)"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fake := restic.NewScenarioFake(scenario, time.Now())
+	statePath := os.Getenv("FAKE_RESTIC_STATE")
+	if statePath != "" {
+		if err := loadState(statePath, fake); err != nil {
+			fail(err)
+		}
+	}
+
+	repo := restic.Repo{Name: fake.Lookup(inv.repository)}
+	runErr := run(ctx, fake, repo, inv)
+	if statePath != "" {
+		if err := saveState(statePath, fake); err != nil {
+			fail(err)
+		}
+	}
+	if runErr != nil {
+		fail(runErr)
+	}
+}
+
+// loadState replaces the scenario repositories by the ones saved by an
+// earlier call.
+func loadState(path string, fake *restic.Fake) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &fake.Repos)
+}
+
+func saveState(path string, fake *restic.Fake) error {
+	data, err := json.MarshalIndent(fake.Repos, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadScenario() (restic.Scenario, error) {
+	path := os.Getenv("FAKE_RESTIC_SCENARIO")
+	if path == "" {
+		return restic.Scenario{}, nil
+	}
+	return restic.LoadScenario(path)
+}
+
+func parseArgs(args []string) (invocation, error) {
+	var inv invocation
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			if inv.command == "" {
+				inv.command = arg
+			} else {
+				inv.args = append(inv.args, arg)
+			}
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		if valueFlags[name] && !hasValue {
+			if i+1 >= len(args) {
+				return inv, fmt.Errorf("flag needs an argument: %s", name)
+			}
+			i++
+			value = args[i]
+		}
+		n, _ := strconv.Atoi(value)
+		switch name {
+		case "--json":
+			inv.json = true
+		case "--stdin":
+			inv.stdin = true
+		case "--remove-all":
+			inv.removeAll = true
+		case "--stdin-filename":
+			inv.stdinName = value
+		case "-r", "--repo":
+			inv.repository = value
+		case "--mode":
+			inv.mode = value
+		case "--tag":
+			inv.tags = append(inv.tags, value)
+		case "--keep-last":
+			inv.policy.KeepLast = n
+		case "--keep-daily":
+			inv.policy.KeepDaily = n
+		case "--keep-weekly":
+			inv.policy.KeepWeekly = n
+		case "--keep-monthly":
+			inv.policy.KeepMonthly = n
+		}
+	}
+	if inv.command == "" {
+		return inv, errors.New("no command given")
+	}
+	return inv, nil
+}
+
+func run(ctx context.Context, fake *restic.Fake, repo restic.Repo, inv invocation) error {
+	switch inv.command {
+	case "snapshots":
+		snapshots, err := fake.Snapshots(ctx, repo)
+		if err != nil {
+			return err
+		}
+		if !inv.json {
+			for _, s := range snapshots {
+				fmt.Printf("%s  %s  %s  %s\n", s.ShortID, s.Time.Format("2006-01-02 15:04:05"), s.Hostname, strings.Join(s.Paths, ","))
+			}
+			return nil
+		}
+		return printJSON(snapshots)
+
+	case "ls":
+		if len(inv.args) == 0 {
+			return errors.New("Fatal: no snapshot ID specified")
+		}
+		nodes, err := fake.Ls(ctx, repo, inv.args[0], 0)
+		if err != nil {
+			return err
+		}
+		if err := printJSON(map[string]any{"struct_type": "snapshot", "id": inv.args[0]}); err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if err := printJSON(struct {
+				StructType string `json:"struct_type"`
+				restic.Node
+			}{"node", node}); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "check":
+		out, err := fake.Check(ctx, repo)
+		if err != nil {
+			return err
+		}
+		fmt.Println(out)
+		return nil
+
+	case "forget":
+		out, err := fake.Forget(ctx, repo, inv.policy)
+		if err != nil {
+			return err
+		}
+		fmt.Println(out)
+		return nil
+
+	case "unlock":
+		out, err := fake.Unlock(ctx, repo, inv.removeAll)
+		if err != nil {
+			return err
+		}
+		fmt.Println(out)
+		return nil
+
+	case "list":
+		if len(inv.args) != 1 || inv.args[0] != "locks" {
+			return errors.New("Fatal: only \"list locks\" is supported")
+		}
+		locks, err := fake.Locks(ctx, repo)
+		if err != nil {
+			return err
+		}
+		for _, lock := range locks {
+			fmt.Println(lock.ID)
+		}
+		return nil
+
+	case "cat":
+		if len(inv.args) != 2 || inv.args[0] != "lock" {
+			return errors.New("Fatal: only \"cat lock ID\" is supported")
+		}
+		locks, err := fake.Locks(ctx, repo)
+		if err != nil {
+			return err
+		}
+		for _, lock := range locks {
+			if lock.ID == inv.args[1] {
+				lock.ID = ""
+				return printJSON(lock)
+			}
+		}
+		return &restic.Error{Command: "cat", ExitCode: 1, Err: errors.New("exit status 1"),
+			Output: fmt.Sprintf("Fatal: no matching ID found for prefix %q", inv.args[1])}
+
+	case "stats":
+		mode := inv.mode
+		if mode == "" {
+			mode = restic.StatsRestoreSize
+		}
+		stats, err := fake.Stats(ctx, repo, mode)
+		if err != nil {
+			return err
+		}
+		return printJSON(stats)
+
+	case "diff":
+		if len(inv.args) != 2 {
+			return errors.New("Fatal: specify two snapshot IDs")
+		}
+		stats, err := fake.Diff(ctx, repo, inv.args[0], inv.args[1])
+		if err != nil {
+			return err
+		}
+		return printJSON(struct {
+			MessageType string `json:"message_type"`
+			restic.DiffStats
+		}{"statistics", stats})
+
+	case "backup":
+		var processed int64
+		paths := inv.args
+		if inv.stdin {
+			n, err := io.Copy(io.Discard, os.Stdin)
+			if err != nil {
+				return err
+			}
+			processed = n
+			name := inv.stdinName
+			if name == "" {
+				name = "stdin"
+			}
+			paths = []string{"/" + name}
+		}
+		snapshot, err := fake.Backup(ctx, repo, paths, inv.tags)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]any{
+			"message_type":          "summary",
+			"snapshot_id":           snapshot.ID,
+			"total_bytes_processed": processed,
+			"files_new":             len(paths),
+		})
+	}
+	return fmt.Errorf("unknown command %q", inv.command)
+}
+
+func printJSON(v any) error {
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// fail prints err like restic and exits with its exit code.
+func fail(err error) {
+	var resticErr *restic.Error
+	if errors.As(err, &resticErr) {
+		if resticErr.Output != "" {
+			fmt.Fprintln(os.Stderr, resticErr.Output)
+		}
+		if resticErr.ExitCode > 0 {
+			os.Exit(resticErr.ExitCode)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,253 @@
+// Command mock-oidc is a minimal OpenID Connect provider for trying the
+// dashboard login without Keycloak. It signs every login in as the
+// configured user without asking for a password; login_hint in the
+// authorization request picks another username. Never expose it.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyID = "mock"
+
+type authCode struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+	username    string
+	expires     time.Time
+}
+
+type provider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	username     string
+	groups       []string
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9090", "listen address")
+	issuer := flag.String("issuer", "", "issuer URL (default http://<addr>)")
+	clientID := flag.String("client-id", "restic-monitor", "accepted client ID")
+	clientSecret := flag.String("client-secret", "secret", "accepted client secret")
+	username := flag.String("user", "alice", "username of the logged in user")
+	groups := flag.String("groups", "backup-admins", "comma separated groups of the user")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("generate key: %v", err)
+	}
+	p := &provider{
+		issuer:       strings.TrimSuffix(*issuer, "/"),
+		clientID:     *clientID,
+		clientSecret: *clientSecret,
+		username:     *username,
+		key:          key,
+		codes:        make(map[string]authCode),
+	}
+	if p.issuer == "" {
+		p.issuer = "http://" + *addr
+	}
+	for _, group := range strings.Split(*groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			p.groups = append(p.groups, group)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/logout", p.handleLogout)
+
+	log.Printf("mock OIDC provider %s for client %s, user %s with groups %v", p.issuer, p.clientID, p.username, p.groups)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (p *provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"end_session_endpoint":                  p.issuer + "/logout",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+	if query.Get("client_id") != p.clientID || redirectURI == "" || query.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	username := p.username
+	if hint := query.Get("login_hint"); hint != "" {
+		username = hint
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = authCode{
+		redirectURI: redirectURI,
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		username:    username,
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := target.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	target.RawQuery = params.Encode()
+	log.Printf("authorized %s, redirecting to %s", username, redirectURI)
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (p *provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1 {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	if !ok || time.Now().After(code.expires) || code.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	if code.challenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			tokenError(w, "invalid_grant")
+			return
+		}
+	}
+
+	now := time.Now()
+	idToken, err := p.sign(map[string]any{
+		"iss":                p.issuer,
+		"sub":                code.username,
+		"aud":                p.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              code.nonce,
+		"preferred_username": code.username,
+		"email":              code.username + "@example.com",
+		"groups":             p.groups,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (p *provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	public := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *provider) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if redirect := r.URL.Query().Get("post_logout_redirect_uri"); redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	_, _ = w.Write([]byte("logged out\n"))
+}
+
+func (p *provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	buf := make([]byte, 24)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,75 @@
+// Command restic-agent runs on a machine to be backed up. It registers with
+// the restic-monitor orchestrator, sends heartbeats, polls for tasks and runs
+// restic locally.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/example/restic-monitor/internal/agent"
+)
+
+func main() {
+	cfg := agent.Config{}
+	flag.StringVar(&cfg.ServerURL, "server", os.Getenv("AGENT_SERVER_URL"), "orchestrator base URL (AGENT_SERVER_URL)")
+	flag.StringVar(&cfg.Name, "name", os.Getenv("AGENT_NAME"), "agent name, defaults to the hostname (AGENT_NAME)")
+	flag.StringVar(&cfg.EnrollToken, "enroll-token", os.Getenv("AGENT_ENROLL_TOKEN"), "API token used for the first registration (AGENT_ENROLL_TOKEN)")
+	flag.StringVar(&cfg.StateDir, "state-dir", envOr("AGENT_STATE_DIR", defaultStateDir()), "directory for the agent token and state (AGENT_STATE_DIR)")
+	flag.StringVar(&cfg.ResticBinary, "restic", envOr("RESTIC_BINARY", "restic"), "path to the restic binary (RESTIC_BINARY)")
+	flag.StringVar(&cfg.CertificateFile, "cacert", os.Getenv("RESTIC_CERT_FILE"), "default CA certificate for repositories (RESTIC_CERT_FILE)")
+	certFile := flag.String("tls-cert", os.Getenv("AGENT_TLS_CERT_FILE"), "client certificate for mutual TLS with the orchestrator (AGENT_TLS_CERT_FILE)")
+	keyFile := flag.String("tls-key", os.Getenv("AGENT_TLS_KEY_FILE"), "key of the client certificate (AGENT_TLS_KEY_FILE)")
+	caFile := flag.String("server-ca", os.Getenv("AGENT_SERVER_CA_FILE"), "CA certificate of the orchestrator (AGENT_SERVER_CA_FILE)")
+	pgDump := flag.String("pg-dump", envOr("PG_DUMP_BINARY", agent.DefaultDumpTools[agent.SourcePostgres]), "dump tool of postgres sources (PG_DUMP_BINARY)")
+	mysqldump := flag.String("mysqldump", envOr("MYSQLDUMP_BINARY", agent.DefaultDumpTools[agent.SourceMySQL]), "dump tool of mysql sources (MYSQLDUMP_BINARY)")
+	sqlite3 := flag.String("sqlite3", envOr("SQLITE3_BINARY", agent.DefaultDumpTools[agent.SourceSQLite]), "sqlite3 binary for sqlite sources (SQLITE3_BINARY)")
+	flag.DurationVar(&cfg.PollWait, "poll-wait", 30*time.Second, "long-poll duration")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat", time.Minute, "heartbeat interval")
+	flag.Parse()
+
+	cfg.DumpTools = map[string]string{
+		agent.SourcePostgres: *pgDump,
+		agent.SourceMySQL:    *mysqldump,
+		agent.SourceSQLite:   *sqlite3,
+	}
+
+	if cfg.ServerURL == "" {
+		log.Fatal("orchestrator URL required (-server or AGENT_SERVER_URL)")
+	}
+	if *certFile != "" || *keyFile != "" || *caFile != "" {
+		httpClient, err := agent.NewTLSHTTPClient(*certFile, *keyFile, *caFile)
+		if err != nil {
+			log.Fatalf("agent: %v", err)
+		}
+		cfg.HTTPClient = httpClient
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := agent.New(cfg).Run(ctx); err != nil {
+		log.Fatalf("agent: %v", err)
+	}
+	log.Printf("agent stopped")
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func defaultStateDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "restic-agent")
+	}
+	return ".restic-agent"
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/secrets"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+func runExport(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	mode := fs.String("secrets", store.SecretsExcluded, "excluded, encrypted or plain")
+	key := fs.String("key", "", "key to encrypt secrets with instead of the master key (hex or base64)")
+	keyFile := fs.String("key-file", "", "file containing the key to encrypt secrets with")
+	output := fs.String("o", "", "write the bundle to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	cipher, err := secrets.Load(*key, *keyFile)
+	if err != nil {
+		return err
+	}
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	bundle, err := st.ExportBundle(ctx, *mode, cipher)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0o600); err != nil {
+		return err
+	}
+	log.Printf("exported %d targets and %d users to %s", len(bundle.Targets), len(bundle.Users), *output)
+	return nil
+}
+
+func runImport(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	key := fs.String("key", "", "key the secrets were encrypted with instead of the master key (hex or base64)")
+	keyFile := fs.String("key-file", "", "file containing the key the secrets were encrypted with")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [-key key | -key-file file] bundle.json")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var bundle store.Bundle
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&bundle); err != nil {
+		return fmt.Errorf("decode %s: %w", fs.Arg(0), err)
+	}
+
+	cipher, err := secrets.Load(*key, *keyFile)
+	if err != nil {
+		return err
+	}
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	result, err := st.ImportBundle(ctx, bundle, cipher)
+	if err != nil {
+		return err
+	}
+	log.Printf("imported %d targets and %d users from %s", result.Targets, result.Users, fs.Arg(0))
+	for _, name := range result.WithoutSecrets {
+		log.Printf("%s has no password yet", name)
+	}
+	return nil
+}
+
+func runBackup(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := fs.String("o", "", "file to write the copy of the database to")
+	_ = fs.Parse(args)
+	if *output == "" {
+		return errors.New("-o is required")
+	}
+
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := st.Backup(ctx, *output); err != nil {
+		return err
+	}
+	log.Printf("database backed up to %s", *output)
+	return nil
+}
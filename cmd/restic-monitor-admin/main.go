@@ -0,0 +1,128 @@
+// Command restic-monitor-admin performs maintenance on the restic-monitor
+// database. It reads the same environment variables as the server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/secrets"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, cfg config.Config, args []string) error
+}
+
+var commands = []command{
+	{"generate-key", "print a new random master key", runGenerateKey},
+	{"rotate-key", "re-encrypt stored secrets with a new master key", runRotateKey},
+	{"user-add", "create or update a user", runUserAdd},
+	{"user-list", "list users with their role and targets", runUserList},
+	{"user-delete", "delete a user", runUserDelete},
+	{"migrate-status", "show applied and pending database migrations", runMigrateStatus},
+	{"migrate-up", "apply pending database migrations", runMigrateUp},
+	{"migrate-down", "revert database migrations", runMigrateDown},
+	{"export", "export targets and users as a JSON bundle", runExport},
+	{"import", "create or update targets and users from a JSON bundle", runImport},
+	{"backup", "write a consistent copy of the SQLite database", runBackup},
+	{"validate-config", "check the configuration file, environment and targets", runValidateConfig},
+}
+
+// loadsConfig lists the commands reading the configuration themselves, so
+// errors in it do not stop them.
+var loadsConfig = map[string]bool{"generate-key": true, "validate-config": true}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			var cfg config.Config
+			if !loadsConfig[cmd.name] {
+				var err error
+				if cfg, err = config.Load(); err != nil {
+					log.Fatalf("load config: %v", err)
+				}
+			}
+			if err := cmd.run(context.Background(), cfg, os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", cmd.name, err)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// openStore opens the database with the master key from SECRET_KEY or
+// SECRET_KEY_FILE. Pending migrations are applied unless
+// DATABASE_AUTO_MIGRATE is false.
+func openStore(cfg config.Config) (*store.Store, error) {
+	cipher, err := secrets.Load(cfg.SecretKey, cfg.SecretKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return store.New(cfg.DatabaseDSN, store.WithCipher(cipher), store.WithAutoMigrate(cfg.DatabaseAutoMigrate))
+}
+
+func runGenerateKey(_ context.Context, _ config.Config, _ []string) error {
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func runRotateKey(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKey := fs.String("new-key", "", "new master key (hex or base64)")
+	newKeyFile := fs.String("new-key-file", "", "file containing the new master key")
+	decrypt := fs.Bool("decrypt", false, "store secrets in plaintext instead of re-encrypting")
+	_ = fs.Parse(args)
+
+	var next *secrets.Cipher
+	if !*decrypt {
+		var err error
+		next, err = secrets.Load(*newKey, *newKeyFile)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return fmt.Errorf("new key required (-new-key, -new-key-file or -decrypt)")
+		}
+	}
+
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := st.RotateSecrets(ctx, next); err != nil {
+		return err
+	}
+
+	if next == nil {
+		log.Printf("secrets decrypted; unset SECRET_KEY and SECRET_KEY_FILE before restarting")
+	} else {
+		log.Printf("secrets re-encrypted with key %s; update SECRET_KEY or SECRET_KEY_FILE before restarting", next.KeyID())
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+func runMigrateStatus(ctx context.Context, cfg config.Config, _ []string) error {
+	st, err := store.Open(cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	applied, err := st.AppliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	current := 0
+	appliedAt := make(map[int]string, len(applied))
+	for _, m := range applied {
+		current = m.Version
+		appliedAt[m.Version] = m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+	}
+
+	fmt.Printf("%s database, schema version %d of %d\n\n", st.Dialect(), current, store.LatestVersion())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range store.Migrations() {
+		at, ok := appliedAt[m.Version]
+		if !ok {
+			at = "pending"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, at)
+	}
+	return w.Flush()
+}
+
+func runMigrateUp(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate-up", flag.ExitOnError)
+	to := fs.Int("to", 0, "version to migrate to (default latest)")
+	_ = fs.Parse(args)
+
+	st, err := store.Open(cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	applied, err := st.MigrateUp(ctx, *to)
+	for _, m := range applied {
+		log.Printf("applied migration %d (%s)", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		log.Printf("schema is up to date")
+	}
+	return nil
+}
+
+func runMigrateDown(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate-down", flag.ExitOnError)
+	to := fs.Int("to", -1, "version to revert to; 0 drops all tables")
+	_ = fs.Parse(args)
+	if *to < 0 {
+		return fmt.Errorf("target version required (-to)")
+	}
+
+	st, err := store.Open(cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	reverted, err := st.MigrateDown(ctx, *to)
+	for _, m := range reverted {
+		log.Printf("reverted migration %d (%s)", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(reverted) == 0 {
+		log.Printf("nothing to revert")
+	}
+	return nil
+}
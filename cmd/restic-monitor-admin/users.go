@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+func runUserAdd(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("user-add", flag.ExitOnError)
+	username := fs.String("username", "", "username")
+	role := fs.String("role", store.RoleViewer, "role: viewer, operator or admin")
+	targets := fs.String("targets", "", "comma separated targets the user is limited to (default all)")
+	password := fs.String("password", "", "password (read from stdin when empty)")
+	disabled := fs.Bool("disabled", false, "create the user disabled")
+	_ = fs.Parse(args)
+
+	data := store.UserData{
+		Username: *username,
+		Password: *password,
+		Role:     *role,
+		Disabled: *disabled,
+	}
+	if *targets != "" {
+		for _, name := range strings.Split(*targets, ",") {
+			data.Targets = append(data.Targets, strings.TrimSpace(name))
+		}
+	}
+
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = st.GetUser(ctx, data.Username)
+	exists := err == nil
+	if err != nil && !errors.Is(err, store.ErrUserNotFound) {
+		return err
+	}
+
+	// Existing users keep their password unless one is given
+	if data.Password == "" && !exists {
+		if data.Password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+
+	if exists {
+		if _, err := st.UpdateUser(ctx, data); err != nil {
+			return err
+		}
+		log.Printf("user %s updated", data.Username)
+		return nil
+	}
+	if _, err := st.CreateUser(ctx, data); err != nil {
+		return err
+	}
+	log.Printf("user %s created with role %s", data.Username, data.Role)
+	return nil
+}
+
+// readPassword reads the first line of stdin.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runUserList(ctx context.Context, cfg config.Config, _ []string) error {
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	users, err := st.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tROLE\tTARGETS\tDISABLED")
+	for _, user := range users {
+		targets, err := user.TargetNames()
+		if err != nil {
+			return fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		scope := strings.Join(targets, ",")
+		if scope == "" {
+			scope = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\n", user.Username, user.Role, scope, user.Disabled)
+	}
+	return tw.Flush()
+}
+
+func runUserDelete(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("user-delete", flag.ExitOnError)
+	username := fs.String("username", "", "username")
+	_ = fs.Parse(args)
+
+	st, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := st.DeleteUser(ctx, *username); err != nil {
+		return err
+	}
+	log.Printf("user %s deleted", *username)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// runValidateConfig checks the configuration file, the environment and
+// the targets without starting the monitor, so CI can reject broken
+// configurations. Every problem is printed with its origin.
+func runValidateConfig(_ context.Context, _ config.Config, args []string) error {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	file := fs.String("file", os.Getenv("CONFIG_FILE"), "configuration file (default $CONFIG_FILE)")
+	_ = fs.Parse(args)
+
+	var problems []error
+	cfg, err := config.LoadFile(*file)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.OIDCDefaultRole != "" && !store.ValidRole(cfg.OIDCDefaultRole) {
+		problems = append(problems, fmt.Errorf("%s: unknown role %q", cfg.Describe("oidc_default_role"), cfg.OIDCDefaultRole))
+	}
+
+	source := cfg.TargetsFile
+	if len(cfg.Targets) > 0 {
+		source = *file
+	}
+	targets, err := cfg.LoadTargets()
+	if err != nil {
+		problems = append(problems, err)
+	}
+	for i, target := range targets {
+		if err := store.ValidateTarget(target); err != nil {
+			where := fmt.Sprintf("%s: target %d", source, i+1)
+			if len(cfg.Targets) > 0 {
+				where = cfg.Origin(fmt.Sprintf("targets[%d]", i))
+			}
+			problems = append(problems, fmt.Errorf("%s: target %q: %w", where, target.Name, err))
+		}
+	}
+
+	if err := errors.Join(problems...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errors.New("configuration is invalid")
+	}
+	fmt.Printf("configuration OK: %d targets from %s\n", len(targets), source)
+	return nil
+}
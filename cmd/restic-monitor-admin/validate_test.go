@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command instead of the tests when re-executed by
+// runAdmin, so the tests see its real exit status and output.
+func TestMain(m *testing.M) {
+	if os.Getenv("RESTIC_MONITOR_ADMIN_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runAdmin runs the command with args and returns its exit status and
+// combined output.
+func runAdmin(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RESTIC_MONITOR_ADMIN_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	} else if err != nil {
+		t.Fatalf("run %v: %v", args, err)
+	}
+	return 0, string(out)
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		env     []string
+		status  int
+		want    []string
+	}{
+		{
+			name: "valid",
+			content: `check_interval: 5m
+targets:
+  - name: home
+    repository: /srv/restic/home
+    password: secret
+`,
+			want: []string{"configuration OK: 1 targets from"},
+		},
+		{
+			name:    "unknown setting",
+			content: "check_interval: 5m\ncheck_intervall: 10m\n",
+			status:  1,
+			want:    []string{`config.yaml:2: unknown setting "check_intervall"`, "configuration is invalid"},
+		},
+		{
+			name:    "bad duration and enum",
+			content: "restic_timeout: soon\ntls_client_auth: maybe\n",
+			status:  1,
+			want: []string{
+				`config.yaml:1: restic_timeout: invalid duration "soon"`,
+				`config.yaml:2: tls_client_auth: must be none, optional or require, not "maybe"`,
+			},
+		},
+		{
+			name:    "unknown role",
+			content: "oidc_default_role: root\n",
+			status:  1,
+			want:    []string{`config.yaml:1: oidc_default_role: unknown role "root"`},
+		},
+		{
+			name: "invalid target",
+			content: `targets:
+  - name: home
+    repository: /srv/restic/home
+    env:
+      LD_PRELOAD: /tmp/evil.so
+`,
+			status: 1,
+			want:   []string{`config.yaml:2: target "home": environment variable LD_PRELOAD cannot be set`},
+		},
+		{
+			name:    "bad environment value",
+			content: "check_interval: 5m\n",
+			env:     []string{"CHECK_INTERVAL=often"},
+			status:  1,
+			want:    []string{`CHECK_INTERVAL: invalid duration "often"`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			for _, env := range tc.env {
+				key, value, _ := strings.Cut(env, "=")
+				t.Setenv(key, value)
+			}
+			status, out := runAdmin(t, "validate-config", "-file", path)
+			if status != tc.status {
+				t.Errorf("exit status = %d, want %d\n%s", status, tc.status, out)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output lacks %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
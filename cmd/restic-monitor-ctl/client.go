@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// client calls the restic-monitor API with a bearer token.
+type client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	// json prints the API responses instead of tables
+	json bool
+}
+
+// apiError is a response with an error status.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.message, e.status)
+}
+
+// do sends a request to path below /api/v1 and returns the response body.
+// body is sent as JSON unless nil.
+func (c *client) do(ctx context.Context, method, path string, query url.Values, body any) ([]byte, error) {
+	target := c.baseURL + "/api/v1/" + strings.TrimPrefix(path, "/")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		message := strings.TrimSpace(string(data))
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return nil, &apiError{status: resp.StatusCode, message: message}
+	}
+	return data, nil
+}
+
+// get decodes the response of a GET request into out.
+func (c *client) get(ctx context.Context, path string, query url.Values, out any) ([]byte, error) {
+	data, err := c.do(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return data, nil
+}
+
+// printJSON prints a response body indented.
+func printJSON(data []byte) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+// printTable prints rows aligned below header.
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
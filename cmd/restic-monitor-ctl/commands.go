@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// pollInterval is how often check -wait and jobs tail -f poll the server.
+const pollInterval = 2 * time.Second
+
+// Task states of the API.
+const (
+	taskSucceeded = "succeeded"
+	taskFailed    = "failed"
+)
+
+type status struct {
+	Name          string    `json:"name"`
+	Status        string    `json:"status"`
+	LatestBackup  time.Time `json:"latestBackup"`
+	SnapshotCount int       `json:"snapshotCount"`
+	StatusMessage string    `json:"statusMessage"`
+	CheckedAt     time.Time `json:"checkedAt"`
+}
+
+type target struct {
+	Name            string `json:"name"`
+	Repository      string `json:"repository"`
+	Disabled        bool   `json:"disabled"`
+	AutoUnlockAfter string `json:"autoUnlockAfter"`
+	KeepLast        int    `json:"keepLast"`
+	KeepDaily       int    `json:"keepDaily"`
+	KeepWeekly      int    `json:"keepWeekly"`
+	KeepMonthly     int    `json:"keepMonthly"`
+}
+
+type snapshot struct {
+	ShortID  string    `json:"short_id"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+}
+
+type task struct {
+	ID       uint   `json:"id"`
+	AgentID  uint   `json:"agentId"`
+	Target   string `json:"target"`
+	Type     string `json:"type"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error"`
+}
+
+type taskLog struct {
+	ID   uint      `json:"id"`
+	Line string    `json:"line"`
+	Time time.Time `json:"time"`
+}
+
+func runStatus(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	args = parseFlags(fs, args)
+
+	var statuses []status
+	var data []byte
+	var err error
+	switch len(args) {
+	case 0:
+		data, err = c.get(ctx, "status", nil, &statuses)
+	case 1:
+		var one status
+		data, err = c.get(ctx, "status/"+url.PathEscape(args[0]), nil, &one)
+		statuses = []status{one}
+	default:
+		return errors.New("usage: status [name]")
+	}
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+
+	rows := make([][]string, 0, len(statuses))
+	for _, s := range statuses {
+		rows = append(rows, []string{s.Name, s.Status, formatTime(s.LatestBackup), strconv.Itoa(s.SnapshotCount), formatTime(s.CheckedAt), s.StatusMessage})
+	}
+	return printTable([]string{"NAME", "STATUS", "LATEST BACKUP", "SNAPSHOTS", "CHECKED", "MESSAGE"}, rows)
+}
+
+func runTargets(ctx context.Context, c *client, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		return runTargetsList(ctx, c, args[1:])
+	case "add":
+		return runTargetsAdd(ctx, c, args[1:])
+	case "remove":
+		return runTargetsRemove(ctx, c, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand %q, use list, add or remove", args[0])
+}
+
+func runTargetsList(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("targets list", flag.ExitOnError)
+	parseFlags(fs, args)
+
+	var targets []target
+	data, err := c.get(ctx, "targets", nil, &targets)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+
+	rows := make([][]string, 0, len(targets))
+	for _, t := range targets {
+		keep := fmt.Sprintf("%d/%d/%d/%d", t.KeepLast, t.KeepDaily, t.KeepWeekly, t.KeepMonthly)
+		rows = append(rows, []string{t.Name, t.Repository, strconv.FormatBool(t.Disabled), keep, orDash(t.AutoUnlockAfter)})
+	}
+	return printTable([]string{"NAME", "REPOSITORY", "DISABLED", "KEEP L/D/W/M", "AUTO UNLOCK"}, rows)
+}
+
+// runTargetsAdd adds or replaces a target read from a JSON or YAML file
+// with the fields of targets.json, or built from flags. Flags override the
+// file.
+func runTargetsAdd(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("targets add", flag.ExitOnError)
+	file := fs.String("file", "", "JSON or YAML file with the target, - for stdin")
+	var t config.Target
+	fs.StringVar(&t.Name, "name", "", "target name")
+	fs.StringVar(&t.Repository, "repository", "", "restic repository")
+	fs.StringVar(&t.PasswordFile, "password-file", "", "file with the repository password")
+	fs.StringVar(&t.PasswordCommand, "password-command", "", "command printing the repository password")
+	fs.StringVar(&t.CertificateFile, "cacert", "", "CA certificate of the repository")
+	fs.StringVar(&t.AutoUnlockAfter, "auto-unlock-after", "", "remove locks older than this, e.g. 2h")
+	fs.IntVar(&t.KeepLast, "keep-last", 0, "snapshots to keep")
+	fs.IntVar(&t.KeepDaily, "keep-daily", 0, "daily snapshots to keep")
+	fs.IntVar(&t.KeepWeekly, "keep-weekly", 0, "weekly snapshots to keep")
+	fs.IntVar(&t.KeepMonthly, "keep-monthly", 0, "monthly snapshots to keep")
+	fs.BoolVar(&t.Disabled, "disabled", false, "add the target disabled")
+	parseFlags(fs, args)
+
+	if *file != "" {
+		var fromFile config.Target
+		if err := readTarget(*file, &fromFile); err != nil {
+			return err
+		}
+		t = mergeTarget(fromFile, t, fs)
+	}
+	if t.Name == "" || t.Repository == "" {
+		return errors.New("name and repository required (-name, -repository or -file)")
+	}
+
+	data, err := c.do(ctx, http.MethodPost, "targets", nil, t)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+	fmt.Printf("target %s saved, check queued\n", t.Name)
+	return nil
+}
+
+// mergeTarget returns base with the fields of the flags set on fs taken
+// from flags.
+func mergeTarget(base, flags config.Target, fs *flag.FlagSet) config.Target {
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			base.Name = flags.Name
+		case "repository":
+			base.Repository = flags.Repository
+		case "password-file":
+			base.PasswordFile = flags.PasswordFile
+		case "password-command":
+			base.PasswordCommand = flags.PasswordCommand
+		case "cacert":
+			base.CertificateFile = flags.CertificateFile
+		case "auto-unlock-after":
+			base.AutoUnlockAfter = flags.AutoUnlockAfter
+		case "keep-last":
+			base.KeepLast = flags.KeepLast
+		case "keep-daily":
+			base.KeepDaily = flags.KeepDaily
+		case "keep-weekly":
+			base.KeepWeekly = flags.KeepWeekly
+		case "keep-monthly":
+			base.KeepMonthly = flags.KeepMonthly
+		case "disabled":
+			base.Disabled = flags.Disabled
+		}
+	})
+	return base
+}
+
+// readTarget decodes a target from a JSON or YAML file, rejecting unknown
+// fields.
+func readTarget(path string, t *config.Target) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(t); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func runTargetsRemove(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("targets remove", flag.ExitOnError)
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		return errors.New("usage: targets remove <name>")
+	}
+	if _, err := c.do(ctx, http.MethodDelete, "targets/"+url.PathEscape(args[0]), nil, nil); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON([]byte(fmt.Sprintf(`{"status":"removed","target":%q}`, args[0])))
+	}
+	fmt.Printf("target %s removed\n", args[0])
+	return nil
+}
+
+func runCheck(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	wait := fs.Bool("wait", false, "wait for the check to finish and print the status")
+	timeout := fs.Duration("timeout", 10*time.Minute, "how long -wait waits")
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		return errors.New("usage: check [-wait] <name>")
+	}
+	name := args[0]
+
+	var before status
+	if *wait {
+		if _, err := c.get(ctx, "status/"+url.PathEscape(name), nil, &before); err != nil {
+			var apiErr *apiError
+			// Targets without a status yet are checked for the first time
+			if !errors.As(err, &apiErr) || apiErr.status != http.StatusNotFound {
+				return err
+			}
+		}
+	}
+	data, err := c.do(ctx, http.MethodPost, "check/"+url.PathEscape(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	if !*wait {
+		if c.json {
+			return printJSON(data)
+		}
+		fmt.Printf("check of %s queued\n", name)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("check of %s did not finish: %w", name, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+		var after status
+		data, err := c.get(ctx, "status/"+url.PathEscape(name), nil, &after)
+		if err != nil {
+			var apiErr *apiError
+			if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+				continue
+			}
+			return err
+		}
+		if after.CheckedAt.After(before.CheckedAt) {
+			if c.json {
+				return printJSON(data)
+			}
+			return printTable([]string{"NAME", "STATUS", "LATEST BACKUP", "SNAPSHOTS", "MESSAGE"},
+				[][]string{{after.Name, after.Status, formatTime(after.LatestBackup), strconv.Itoa(after.SnapshotCount), after.StatusMessage}})
+		}
+	}
+}
+
+func runUnlock(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	all := fs.Bool("all", false, "remove all locks, including the ones of running commands")
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		return errors.New("usage: unlock [-all] <name>")
+	}
+
+	query := url.Values{}
+	if *all {
+		query.Set("all", "true")
+	}
+	data, err := c.do(ctx, http.MethodPost, "unlock/"+url.PathEscape(args[0]), query, nil)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+	var resp struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(data, &resp)
+	fmt.Printf("target %s unlocked\n%s\n", args[0], resp.Message)
+	return nil
+}
+
+func runPrune(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only show the snapshots that would be removed")
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		return errors.New("usage: prune [-dry-run] <name|all>")
+	}
+
+	query := url.Values{}
+	if *dryRun {
+		query.Set("dry_run", "true")
+	}
+	data, err := c.do(ctx, http.MethodPost, "prune/"+url.PathEscape(args[0]), query, nil)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+	var resp struct {
+		Status  string            `json:"status"`
+		Output  string            `json:"output"`
+		Outputs map[string]string `json:"outputs"`
+		Failed  []string          `json:"failed"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	fmt.Println(resp.Status)
+	if resp.Output != "" {
+		fmt.Println(resp.Output)
+	}
+	for name, out := range resp.Outputs {
+		fmt.Printf("\n== %s\n%s\n", name, out)
+	}
+	if len(resp.Failed) > 0 {
+		return fmt.Errorf("failed for %s", strings.Join(resp.Failed, ", "))
+	}
+	return nil
+}
+
+func runSnapshots(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		return errors.New("usage: snapshots <name>")
+	}
+
+	var snapshots []snapshot
+	data, err := c.get(ctx, "snapshots/"+url.PathEscape(args[0]), nil, &snapshots)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+
+	rows := make([][]string, 0, len(snapshots))
+	for _, s := range snapshots {
+		rows = append(rows, []string{s.ShortID, formatTime(s.Time), s.Hostname, strings.Join(s.Paths, ","), strings.Join(s.Tags, ",")})
+	}
+	return printTable([]string{"ID", "TIME", "HOST", "PATHS", "TAGS"}, rows)
+}
+
+func runJobs(ctx context.Context, c *client, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list":
+		return runJobsList(ctx, c, args[1:])
+	case "tail":
+		return runJobsTail(ctx, c, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand %q, use list or tail", args[0])
+}
+
+func runJobsList(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("jobs list", flag.ExitOnError)
+	agentID := fs.Uint("agent", 0, "only tasks of this agent ID")
+	limit := fs.Int("limit", 20, "maximum number of tasks")
+	parseFlags(fs, args)
+
+	query := url.Values{"limit": {strconv.Itoa(*limit)}}
+	if *agentID > 0 {
+		query.Set("agent", strconv.FormatUint(uint64(*agentID), 10))
+	}
+	var tasks []task
+	data, err := c.get(ctx, "tasks", query, &tasks)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(data)
+	}
+
+	rows := make([][]string, 0, len(tasks))
+	for _, t := range tasks {
+		rows = append(rows, []string{strconv.FormatUint(uint64(t.ID), 10), strconv.FormatUint(uint64(t.AgentID), 10), t.Target, t.Type, t.Status, strconv.Itoa(t.Attempts), strconv.Itoa(t.ExitCode)})
+	}
+	return printTable([]string{"ID", "AGENT", "TARGET", "TYPE", "STATUS", "ATTEMPTS", "EXIT"}, rows)
+}
+
+// runJobsTail prints the output of a task. With -f it keeps printing new
+// lines until the task has finished and fails if the task failed.
+func runJobsTail(ctx context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("jobs tail", flag.ExitOnError)
+	follow := fs.Bool("f", false, "follow the output until the task has finished")
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		return errors.New("usage: jobs tail [-f] <task id>")
+	}
+	id := args[0]
+
+	var after uint
+	for {
+		// Read the state first so no lines written before it finished are
+		// missed
+		var t task
+		if *follow {
+			if _, err := c.get(ctx, "tasks/"+url.PathEscape(id), nil, &t); err != nil {
+				return err
+			}
+		}
+		var logs []taskLog
+		query := url.Values{"after": {strconv.FormatUint(uint64(after), 10)}}
+		if _, err := c.get(ctx, "tasks/"+url.PathEscape(id)+"/logs", query, &logs); err != nil {
+			return err
+		}
+		for _, entry := range logs {
+			if c.json {
+				line, _ := json.Marshal(entry)
+				fmt.Println(string(line))
+			} else {
+				fmt.Println(entry.Line)
+			}
+			after = entry.ID
+		}
+
+		if !*follow {
+			return nil
+		}
+		switch t.Status {
+		case taskSucceeded:
+			return nil
+		case taskFailed:
+			return fmt.Errorf("task %s failed with exit code %d: %s", id, t.ExitCode, t.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// parseFlags parses fs and returns the positional arguments. Unlike
+// fs.Parse, flags may also follow them, as in "unlock home -all".
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
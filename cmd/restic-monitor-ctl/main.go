@@ -0,0 +1,98 @@
+// Command restic-monitor-ctl lets operators query and control a running
+// restic-monitor through its HTTP API, from a terminal or scripts.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/example/restic-monitor/internal/agent"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, c *client, args []string) error
+}
+
+var commands = []command{
+	{"status", "show the status of all targets or of one target", runStatus},
+	{"targets", "list, add or remove targets (targets list|add|remove)", runTargets},
+	{"check", "check a target now", runCheck},
+	{"unlock", "remove stale locks of a target (-all removes every lock)", runUnlock},
+	{"prune", "apply the retention policy of a target or all (-dry-run only reports)", runPrune},
+	{"snapshots", "list the snapshots of a target", runSnapshots},
+	{"jobs", "list agent tasks or print the output of one (jobs list|tail)", runJobs},
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = usage
+	server := flag.String("server", envOr("RESTIC_MONITOR_URL", "http://localhost:8080"), "restic-monitor base URL (RESTIC_MONITOR_URL)")
+	token := flag.String("token", os.Getenv("RESTIC_MONITOR_TOKEN"), "API token (RESTIC_MONITOR_TOKEN)")
+	output := flag.String("o", envOr("RESTIC_MONITOR_OUTPUT", outputTable), "output format: table or json (RESTIC_MONITOR_OUTPUT)")
+	caFile := flag.String("ca-file", os.Getenv("RESTIC_MONITOR_CA_FILE"), "CA certificate of the server (RESTIC_MONITOR_CA_FILE)")
+	certFile := flag.String("tls-cert", os.Getenv("RESTIC_MONITOR_TLS_CERT_FILE"), "client certificate (RESTIC_MONITOR_TLS_CERT_FILE)")
+	keyFile := flag.String("tls-key", os.Getenv("RESTIC_MONITOR_TLS_KEY_FILE"), "key of the client certificate (RESTIC_MONITOR_TLS_KEY_FILE)")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *output != outputTable && *output != outputJSON {
+		log.Fatalf("unknown output format %q, use table or json", *output)
+	}
+
+	httpClient := http.DefaultClient
+	if *caFile != "" || *certFile != "" || *keyFile != "" {
+		var err error
+		if httpClient, err = agent.NewTLSHTTPClient(*certFile, *keyFile, *caFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	c := &client{
+		baseURL: strings.TrimRight(*server, "/"),
+		token:   *token,
+		http:    httpClient,
+		json:    *output == outputJSON,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, c, flag.Args()[1:]); err != nil {
+				log.Fatalf("%s: %v", cmd.name, err)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] <command> [arguments]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,262 @@
+// Package agent implements the backup agent that runs next to the data,
+// pulls tasks from the orchestrator and executes restic locally.
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Version is reported to the orchestrator on registration.
+const Version = "0.1.0"
+
+const (
+	logFlushInterval = 2 * time.Second
+	retryDelay       = 5 * time.Second
+)
+
+// Config holds the settings of an agent.
+type Config struct {
+	// ServerURL is the base URL of the orchestrator, e.g. https://monitor:8080.
+	ServerURL string
+	// Name identifies the agent; it defaults to the hostname.
+	Name string
+	// EnrollToken is the operator API token used for the initial
+	// registration. It is not needed once a token has been persisted.
+	EnrollToken string
+	// StateDir holds the persisted agent ID and token.
+	StateDir        string
+	ResticBinary    string
+	CertificateFile string
+	// DumpTools maps source types to the dump tool run for them; unset
+	// types use DefaultDumpTools.
+	DumpTools         map[string]string
+	PollWait          time.Duration
+	HeartbeatInterval time.Duration
+	HTTPClient        *http.Client
+	Logger            *log.Logger
+}
+
+// Agent pulls tasks from the orchestrator and executes them.
+type Agent struct {
+	cfg    Config
+	client *Client
+
+	mu    sync.Mutex
+	state State
+}
+
+// New constructs an agent, filling in defaults for unset fields.
+func New(cfg Config) *Agent {
+	if cfg.Name == "" {
+		cfg.Name, _ = os.Hostname()
+	}
+	if cfg.ResticBinary == "" {
+		cfg.ResticBinary = "restic"
+	}
+	if cfg.PollWait <= 0 {
+		cfg.PollWait = 30 * time.Second
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = time.Minute
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	return &Agent{cfg: cfg, client: NewClient(cfg.ServerURL, cfg.HTTPClient)}
+}
+
+// State returns the agent's current identity.
+func (a *Agent) State() State {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+// Run registers the agent if needed and processes tasks until ctx is done.
+func (a *Agent) Run(ctx context.Context) error {
+	if err := a.ensureRegistered(ctx, false); err != nil {
+		return err
+	}
+	a.logf("agent %s running as id %d against %s", a.cfg.Name, a.State().AgentID, a.cfg.ServerURL)
+
+	go a.heartbeatLoop(ctx)
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := a.RunOnce(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			a.logf("poll failed: %v", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retryDelay):
+			}
+		}
+	}
+}
+
+// RunOnce polls for a single task and executes it if one is available.
+func (a *Agent) RunOnce(ctx context.Context) error {
+	state := a.State()
+	task, err := a.client.Poll(ctx, state.AgentID, state.Token, a.cfg.PollWait)
+	if errors.Is(err, ErrUnauthorized) {
+		if err := a.ensureRegistered(ctx, true); err != nil {
+			return err
+		}
+		return nil
+	}
+	if err != nil || task == nil {
+		return err
+	}
+
+	a.logf("task %d: %s on %s (attempt %d/%d)", task.ID, task.Type, task.Target, task.Attempts, task.MaxAttempts)
+
+	streamer := newLogStreamer(a, state, task.ID)
+	streamCtx, stopStream := context.WithCancel(ctx)
+	go streamer.run(streamCtx)
+
+	result := a.execute(ctx, *task, streamer.add)
+
+	stopStream()
+	streamer.flush(context.WithoutCancel(ctx))
+
+	a.logf("task %d: finished success=%v exit=%d", task.ID, result.Success, result.ExitCode)
+	// Report even when shutting down so the task is not left to its lease
+	if err := a.client.Report(context.WithoutCancel(ctx), state.AgentID, state.Token, task.ID, result); err != nil {
+		return fmt.Errorf("report task %d: %w", task.ID, err)
+	}
+	return nil
+}
+
+// ensureRegistered loads the persisted identity or registers a new one. With
+// force it registers even when a persisted identity exists, e.g. after the
+// orchestrator rejected the stored token.
+func (a *Agent) ensureRegistered(ctx context.Context, force bool) error {
+	state, err := LoadState(a.cfg.StateDir)
+	if err != nil {
+		return err
+	}
+	current := ""
+	if state.ServerURL == a.cfg.ServerURL {
+		current = state.Token
+	}
+	if !force && current != "" {
+		a.mu.Lock()
+		a.state = state
+		a.mu.Unlock()
+		return nil
+	}
+
+	if a.cfg.EnrollToken == "" {
+		return errors.New("agent is not registered and no enrollment token is configured")
+	}
+
+	hostname, _ := os.Hostname()
+	id, token, err := a.client.Register(ctx, a.cfg.EnrollToken, Registration{
+		Name:     a.cfg.Name,
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Version:  Version,
+		Token:    current,
+	})
+	if err != nil {
+		return err
+	}
+
+	state = State{ServerURL: a.cfg.ServerURL, AgentID: id, Token: token}
+	if err := SaveState(a.cfg.StateDir, state); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.state = state
+	a.mu.Unlock()
+	a.logf("registered with orchestrator as agent %d", id)
+	return nil
+}
+
+func (a *Agent) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			state := a.State()
+			if err := a.client.Heartbeat(ctx, state.AgentID, state.Token); err != nil && ctx.Err() == nil {
+				a.logf("heartbeat failed: %v", err)
+			}
+		}
+	}
+}
+
+func (a *Agent) logf(format string, args ...any) {
+	a.cfg.Logger.Printf(format, args...)
+}
+
+// logStreamer batches task output and sends it to the orchestrator.
+type logStreamer struct {
+	agent  *Agent
+	state  State
+	taskID uint
+
+	mu      sync.Mutex
+	pending []string
+	// sendMu keeps batches in order when the final flush races the ticker
+	sendMu sync.Mutex
+}
+
+func newLogStreamer(a *Agent, state State, taskID uint) *logStreamer {
+	return &logStreamer{agent: a, state: state, taskID: taskID}
+}
+
+func (s *logStreamer) add(line string) {
+	s.mu.Lock()
+	s.pending = append(s.pending, line)
+	s.mu.Unlock()
+}
+
+func (s *logStreamer) run(ctx context.Context) {
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.flush(ctx)
+		}
+	}
+}
+
+func (s *logStreamer) flush(ctx context.Context) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	lines := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+	if err := s.agent.client.SendLogs(ctx, s.state.AgentID, s.state.Token, s.taskID, lines); err != nil {
+		s.agent.logf("task %d: sending %d log line(s) failed: %v", s.taskID, len(lines), err)
+	}
+}
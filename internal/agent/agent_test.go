@@ -0,0 +1,244 @@
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/restic-monitor/internal/agent"
+	"github.com/example/restic-monitor/internal/api"
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+const adminToken = "admin-token"
+
+const scenario = `{
+  "default": {"snapshotCount": 2, "interval": "24h", "files": 10},
+  "targets": {
+    "db":      {"repository": "/srv/restic/db"},
+    "corrupt": {"repository": "/srv/restic/corrupt", "checkError": "pack 3f4a8b2c is corrupted"}
+  }
+}`
+
+// buildFakeRestic builds cmd/fake-restic, which the agent runs as restic.
+func buildFakeRestic(t *testing.T) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found, cannot build fake-restic")
+	}
+	bin := filepath.Join(t.TempDir(), "restic")
+	out, err := exec.Command(goTool, "build", "-o", bin, "github.com/example/restic-monitor/cmd/fake-restic").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build fake-restic: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// orchestrator serves the API with a temporary SQLite store and the given
+// targets.
+func orchestrator(t *testing.T, targets ...store.TargetData) (*httptest.Server, *store.Store) {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "monitor.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if err := st.UpsertTargets(context.Background(), targets); err != nil {
+		t.Fatalf("create targets: %v", err)
+	}
+	cfg := config.Config{AuthToken: adminToken}
+	srv := httptest.NewServer(api.New(cfg, st, nil, restic.NewFake(), "").Handler())
+	t.Cleanup(srv.Close)
+	return srv, st
+}
+
+// call sends an admin request and decodes the JSON response into out.
+func call(t *testing.T, method, url string, body, out any) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		t.Fatalf("%s %s: %s: %s", method, url, resp.Status, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: decode %s: %v", method, url, data, err)
+		}
+	}
+}
+
+type task struct {
+	ID       uint   `json:"id"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	ExitCode int    `json:"exitCode"`
+	Output   string `json:"output"`
+	Error    string `json:"error"`
+	Hooks    []struct {
+		Name  string `json:"name"`
+		Phase string `json:"phase"`
+	} `json:"hooks"`
+}
+
+// waitTask returns the task once it has succeeded or failed.
+func waitTask(t *testing.T, serverURL string, id uint) task {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var got task
+		call(t, http.MethodGet, fmt.Sprintf("%s/api/v1/tasks/%d", serverURL, id), nil, &got)
+		if got.Status == store.TaskSucceeded || got.Status == store.TaskFailed {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %d still %s", id, got.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func taskLogs(t *testing.T, serverURL string, id uint) string {
+	t.Helper()
+	var lines []struct {
+		Line string `json:"line"`
+	}
+	call(t, http.MethodGet, fmt.Sprintf("%s/api/v1/tasks/%d/logs", serverURL, id), nil, &lines)
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line.Line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestAgentRunsTasks(t *testing.T) {
+	bin := buildFakeRestic(t)
+	scenarioFile := filepath.Join(t.TempDir(), "scenario.json")
+	if err := os.WriteFile(scenarioFile, []byte(scenario), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_RESTIC_SCENARIO", scenarioFile)
+
+	srv, st := orchestrator(t,
+		store.TargetData{Name: "db", Repository: "/srv/restic/db", Password: "secret"},
+		store.TargetData{Name: "corrupt", Repository: "/srv/restic/corrupt", Password: "secret"},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := agent.New(agent.Config{
+		ServerURL:         srv.URL,
+		Name:              "db1",
+		EnrollToken:       adminToken,
+		StateDir:          t.TempDir(),
+		ResticBinary:      bin,
+		PollWait:          time.Second,
+		HeartbeatInterval: time.Second,
+		Logger:            log.New(io.Discard, "", 0),
+	})
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+
+	var agentID uint
+	for deadline := time.Now().Add(10 * time.Second); agentID == 0; {
+		agents, err := st.ListAgents(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(agents) == 1 && agents[0].Name == "db1" {
+			agentID = agents[0].ID
+		} else if time.Now().After(deadline) {
+			t.Fatal("agent did not register")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	tasksURL := fmt.Sprintf("%s/api/v1/agents/%d/tasks", srv.URL, agentID)
+
+	t.Run("backup", func(t *testing.T) {
+		var queued task
+		call(t, http.MethodPost, tasksURL, map[string]any{
+			"target": "db",
+			"type":   store.TaskTypeBackup,
+			"payload": map[string]any{
+				"paths": []string{"/srv/data"},
+				"tags":  []string{"nightly"},
+				"hooks": map[string]any{
+					"pre": []map[string]any{{"name": "announce", "command": []string{"sh", "-c", "echo pre hook ran"}}},
+				},
+			},
+		}, &queued)
+
+		done := waitTask(t, srv.URL, queued.ID)
+		if done.Status != store.TaskSucceeded || done.ExitCode != 0 || done.Attempts != 1 {
+			t.Fatalf("backup task = %+v, want succeeded on the first attempt", done)
+		}
+		if !strings.Contains(done.Output, `"message_type":"summary"`) {
+			t.Errorf("output %q lacks the backup summary", done.Output)
+		}
+		if len(done.Hooks) != 1 || done.Hooks[0].Name != "announce" || done.Hooks[0].Phase != "pre" {
+			t.Errorf("hooks = %+v, want the pre hook", done.Hooks)
+		}
+		logs := taskLogs(t, srv.URL, queued.ID)
+		for _, want := range []string{"[pre hook announce] pre hook ran", `"snapshot_id"`} {
+			if !strings.Contains(logs, want) {
+				t.Errorf("logs lack %q:\n%s", want, logs)
+			}
+		}
+	})
+
+	t.Run("failed check", func(t *testing.T) {
+		var queued task
+		call(t, http.MethodPost, tasksURL, map[string]any{
+			"target":      "corrupt",
+			"type":        store.TaskTypeCheck,
+			"maxAttempts": 1,
+		}, &queued)
+
+		done := waitTask(t, srv.URL, queued.ID)
+		if done.Status != store.TaskFailed || done.ExitCode != 1 {
+			t.Fatalf("check task = %+v, want failed with exit code 1", done)
+		}
+		if !strings.Contains(done.Error, "restic check") {
+			t.Errorf("error = %q", done.Error)
+		}
+		if logs := taskLogs(t, srv.URL, queued.ID); !strings.Contains(logs, "pack 3f4a8b2c is corrupted") {
+			t.Errorf("logs lack the check error:\n%s", logs)
+		}
+	})
+}
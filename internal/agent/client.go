@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxPollTimeout leaves room for the longest server-side long-poll.
+const maxPollTimeout = 90 * time.Second
+
+// ErrUnauthorized is returned when the orchestrator rejects the agent token.
+var ErrUnauthorized = errors.New("orchestrator rejected agent token")
+
+// Task is a task leased from the orchestrator.
+type Task struct {
+	ID             uint            `json:"id"`
+	Target         string          `json:"target"`
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	Attempts       int             `json:"attempts"`
+	MaxAttempts    int             `json:"maxAttempts"`
+	TimeoutSeconds int             `json:"timeoutSeconds"`
+	Repository     *Repository     `json:"repository,omitempty"`
+	Retention      *Retention      `json:"retention,omitempty"`
+}
+
+// Repository holds the credentials delivered with a task.
+type Repository struct {
+	Repository      string `json:"repository"`
+	Password        string `json:"password,omitempty"`
+	PasswordFile    string `json:"passwordFile,omitempty"`
+	PasswordCommand string `json:"passwordCommand,omitempty"`
+	CertificateFile string `json:"certificateFile,omitempty"`
+	// Credentials are backend environment variables such as
+	// AWS_SECRET_ACCESS_KEY, already resolved by the server.
+	Credentials map[string]string `json:"credentials,omitempty"`
+	// Env holds non-secret backend settings and Options the extended
+	// "-o key=value" options of the repository.
+	Env     map[string]string `json:"env,omitempty"`
+	Options []string          `json:"options,omitempty"`
+}
+
+// Retention is the forget policy delivered with prune tasks.
+type Retention struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+}
+
+// Result is reported back once a task has finished.
+type Result struct {
+	Success  bool         `json:"success"`
+	ExitCode int          `json:"exitCode"`
+	Output   string       `json:"output"`
+	Error    string       `json:"error"`
+	Hooks    []HookResult `json:"hooks,omitempty"`
+}
+
+// Registration describes the agent to the orchestrator.
+type Registration struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Version  string `json:"version"`
+	// Token is the current agent token, which allows registering again
+	// under the same name with an enrollment token of the agent scope.
+	Token string `json:"token,omitempty"`
+}
+
+// Client talks to the orchestrator HTTP API.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewClient returns a client for the orchestrator at baseURL.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: maxPollTimeout}
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), http: httpClient}
+}
+
+// NewTLSHTTPClient returns an HTTP client that trusts the CA in caFile in
+// addition to the system roots and presents the client certificate in
+// certFile and keyFile. Empty names are skipped.
+func NewTLSHTTPClient(certFile, keyFile, caFile string) (*http.Client, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read server CA: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("server CA %s: no certificates found", caFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &http.Client{Timeout: maxPollTimeout, Transport: transport}, nil
+}
+
+// Register registers the agent using the operator credential and returns the
+// assigned ID and token.
+func (c *Client) Register(ctx context.Context, enrollToken string, reg Registration) (uint, string, error) {
+	var resp struct {
+		ID    uint   `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/agents/register", enrollToken, reg, &resp); err != nil {
+		return 0, "", fmt.Errorf("register agent: %w", err)
+	}
+	return resp.ID, resp.Token, nil
+}
+
+// Heartbeat tells the orchestrator the agent is alive.
+func (c *Client) Heartbeat(ctx context.Context, agentID uint, token string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/v1/agents/%d/heartbeat", agentID), token, nil, nil)
+}
+
+// Poll waits up to wait for the next task. It returns nil when no task is
+// available.
+func (c *Client) Poll(ctx context.Context, agentID uint, token string, wait time.Duration) (*Task, error) {
+	path := fmt.Sprintf("/api/v1/agents/%d/tasks?wait=%d", agentID, int(wait/time.Second))
+	var task Task
+	if err := c.do(ctx, http.MethodGet, path, token, nil, &task); err != nil {
+		return nil, err
+	}
+	if task.ID == 0 {
+		return nil, nil
+	}
+	return &task, nil
+}
+
+// SendLogs appends output lines to a running task.
+func (c *Client) SendLogs(ctx context.Context, agentID uint, token string, taskID uint, lines []string) error {
+	path := fmt.Sprintf("/api/v1/agents/%d/tasks/%d/logs", agentID, taskID)
+	return c.do(ctx, http.MethodPost, path, token, map[string][]string{"lines": lines}, nil)
+}
+
+// Report sends the result of a task.
+func (c *Client) Report(ctx context.Context, agentID uint, token string, taskID uint, result Result) error {
+	path := fmt.Sprintf("/api/v1/agents/%d/tasks/%d/result", agentID, taskID)
+	return c.do(ctx, http.MethodPost, path, token, result, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/restic-monitor/internal/restic"
+)
+
+// outputTailLines is how many trailing output lines are kept for the task
+// result; the full output is streamed as logs.
+const outputTailLines = 200
+
+// backupPayload configures a backup task.
+type backupPayload struct {
+	Paths   []string `json:"paths"`
+	Tags    []string `json:"tags"`
+	Exclude []string `json:"exclude"`
+	Host    string   `json:"host"`
+	// Source replaces Paths with a database dump streamed via --stdin.
+	Source *Source `json:"source"`
+}
+
+// validate rejects values that restic would parse as flags instead of the
+// value of the flag before them, such as a tag "--password-command=...".
+func (p backupPayload) validate() error {
+	if err := flagValues("tag", p.Tags...); err != nil {
+		return err
+	}
+	if err := flagValues("exclude", p.Exclude...); err != nil {
+		return err
+	}
+	return flagValues("host", p.Host)
+}
+
+// flagValues returns an error when one of the values of the named field
+// starts with "-".
+func flagValues(field string, values ...string) error {
+	for _, value := range values {
+		if strings.HasPrefix(value, "-") {
+			return fmt.Errorf("%s %q must not start with -", field, value)
+		}
+	}
+	return nil
+}
+
+// checkPayload configures a check task.
+type checkPayload struct {
+	ReadDataSubset string `json:"readDataSubset"`
+}
+
+// unlockPayload configures an unlock task.
+type unlockPayload struct {
+	RemoveAll bool `json:"removeAll"`
+}
+
+// resticArgs builds the restic command line for a task.
+func resticArgs(task Task) ([]string, error) {
+	switch task.Type {
+	case "backup":
+		var p backupPayload
+		if err := decodePayload(task.Payload, &p); err != nil {
+			return nil, err
+		}
+		if len(p.Paths) == 0 {
+			return nil, errors.New("backup task without paths")
+		}
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		args := []string{"backup"}
+		for _, tag := range p.Tags {
+			args = append(args, "--tag", tag)
+		}
+		for _, exclude := range p.Exclude {
+			args = append(args, "--exclude", exclude)
+		}
+		if p.Host != "" {
+			args = append(args, "--host", p.Host)
+		}
+		// Paths follow "--" so none of them is taken for a flag
+		args = append(args, "--")
+		return append(args, p.Paths...), nil
+	case "check":
+		var p checkPayload
+		if err := decodePayload(task.Payload, &p); err != nil {
+			return nil, err
+		}
+		if err := flagValues("readDataSubset", p.ReadDataSubset); err != nil {
+			return nil, err
+		}
+		args := []string{"check"}
+		if p.ReadDataSubset != "" {
+			args = append(args, "--read-data-subset", p.ReadDataSubset)
+		}
+		return args, nil
+	case "prune":
+		args := []string{"forget", "--prune"}
+		if r := task.Retention; r != nil {
+			policy := restic.Policy{KeepLast: r.KeepLast, KeepDaily: r.KeepDaily, KeepWeekly: r.KeepWeekly, KeepMonthly: r.KeepMonthly}
+			args = append(args, policy.Args()...)
+		}
+		if len(args) == 2 {
+			return nil, errors.New("prune task without retention policy")
+		}
+		return args, nil
+	case "unlock":
+		var p unlockPayload
+		if err := decodePayload(task.Payload, &p); err != nil {
+			return nil, err
+		}
+		args := []string{"unlock"}
+		if p.RemoveAll {
+			args = append(args, "--remove-all")
+		}
+		return args, nil
+	}
+	return nil, fmt.Errorf("unknown task type %q", task.Type)
+}
+
+func decodePayload(raw json.RawMessage, v any) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("parse task payload: %w", err)
+	}
+	return nil
+}
+
+// hooksPayload is the part of every task payload that defines hooks.
+type hooksPayload struct {
+	Hooks Hooks `json:"hooks"`
+}
+
+// execute runs the pre hooks, restic and the post hooks of the task, passing
+// every output line to logLine, and returns the result to report.
+func (a *Agent) execute(ctx context.Context, task Task, logLine func(string)) Result {
+	var p hooksPayload
+	if err := decodePayload(task.Payload, &p); err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+	if err := p.Hooks.validate(); err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+
+	pre, proceed, runPost := a.runPre(ctx, task.ID, p.Hooks.Pre, logLine)
+
+	var result Result
+	if proceed {
+		result = a.runRestic(ctx, task, logLine)
+	} else {
+		var failed HookResult
+		for _, res := range pre {
+			if res.Error != "" {
+				failed = res
+			}
+		}
+		result = Result{ExitCode: -1, Error: fmt.Sprintf("pre hook %s failed: %s", failed.Name, failed.Error)}
+	}
+	result.Hooks = pre
+
+	if !runPost {
+		result.Hooks = skipRemaining(result.Hooks, "post", p.Hooks.Post)
+		return result
+	}
+
+	// Post hooks run whenever restic was started or a pre hook asked for them,
+	// also after a failed backup, so services stopped by pre hooks come back.
+	post, err := a.runPost(ctx, task.ID, p.Hooks.Post, logLine)
+	result.Hooks = append(result.Hooks, post...)
+	if err != nil && result.Success {
+		result.Success = false
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// runRestic runs the restic command of the task.
+func (a *Agent) runRestic(ctx context.Context, task Task, logLine func(string)) Result {
+	if task.Type == "backup" {
+		var p backupPayload
+		if err := decodePayload(task.Payload, &p); err != nil {
+			return Result{ExitCode: -1, Error: err.Error()}
+		}
+		if p.Source != nil {
+			return a.runSourceBackup(ctx, task, p, logLine)
+		}
+	}
+
+	args, err := resticArgs(task)
+	if err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+	return a.restic(ctx, task, args, nil, logLine)
+}
+
+// restic runs restic with args against the task's repository, feeding stdin
+// if given, and streams the output to logLine.
+func (a *Agent) restic(ctx context.Context, task Task, args []string, stdin io.Reader, logLine func(string)) Result {
+	if task.Repository == nil {
+		return Result{ExitCode: -1, Error: "task has no repository"}
+	}
+
+	timeout := taskTimeout(task)
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	creds := restic.Credentials{
+		Repository:      task.Repository.Repository,
+		Password:        task.Repository.Password,
+		PasswordFile:    task.Repository.PasswordFile,
+		PasswordCommand: task.Repository.PasswordCommand,
+		CertificateFile: task.Repository.CertificateFile,
+		Secrets:         task.Repository.Credentials,
+		Env:             task.Repository.Env,
+		Options:         task.Repository.Options,
+	}
+	env := restic.Env(creds, a.cfg.CertificateFile)
+	args = append(creds.Args(), args...)
+
+	a.logf("task %d: executing: %s %s", task.ID, a.cfg.ResticBinary, strings.Join(restic.MaskArgs(args), " "))
+	cmd := exec.CommandContext(timeoutCtx, a.cfg.ResticBinary, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	var tail []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if isProgressLine(line) {
+				continue
+			}
+			logLine(line)
+			tail = append(tail, line)
+			if len(tail) > outputTailLines {
+				tail = tail[1:]
+			}
+		}
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+
+	err := cmd.Run()
+	_ = writer.Close()
+	wg.Wait()
+
+	result := Result{Output: strings.Join(tail, "\n")}
+	switch {
+	case timeoutCtx.Err() == context.DeadlineExceeded:
+		result.ExitCode = -1
+		result.Error = fmt.Sprintf("restic %s: timeout after %s", args[0], timeout)
+	case err != nil:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		} else {
+			result.ExitCode = -1
+		}
+		result.Error = fmt.Sprintf("restic %s: %v", args[0], err)
+	default:
+		result.Success = true
+	}
+	return result
+}
+
+// isProgressLine reports whether the line is a periodic JSON status message of
+// restic, which is too noisy to keep.
+func isProgressLine(line string) bool {
+	return strings.HasPrefix(line, "{") && strings.Contains(line, `"message_type":"status"`)
+}
+
+func taskTimeout(task Task) time.Duration {
+	if task.TimeoutSeconds <= 0 {
+		return time.Hour
+	}
+	return time.Duration(task.TimeoutSeconds) * time.Second
+}
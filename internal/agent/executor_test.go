@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestResticArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		typ     string
+		payload string
+		want    []string
+	}{
+		{
+			name:    "backup",
+			typ:     "backup",
+			payload: `{"paths": ["/srv/data", "-o sftp.command=sh"], "tags": ["nightly"], "exclude": ["*.tmp"], "host": "db1"}`,
+			want:    []string{"backup", "--tag", "nightly", "--exclude", "*.tmp", "--host", "db1", "--", "/srv/data", "-o sftp.command=sh"},
+		},
+		{name: "flag as tag", typ: "backup", payload: `{"paths": ["/srv"], "tags": ["--password-command=sh -c id"]}`},
+		{name: "flag as exclude", typ: "backup", payload: `{"paths": ["/srv"], "exclude": ["-o"]}`},
+		{name: "flag as host", typ: "backup", payload: `{"paths": ["/srv"], "host": "--insecure-tls"}`},
+		{name: "backup without paths", typ: "backup", payload: `{}`},
+		{
+			name:    "check",
+			typ:     "check",
+			payload: `{"readDataSubset": "10%"}`,
+			want:    []string{"check", "--read-data-subset", "10%"},
+		},
+		{name: "flag as subset", typ: "check", payload: `{"readDataSubset": "--option=x"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := resticArgs(Task{Type: tc.typ, Payload: json.RawMessage(tc.payload)})
+			if tc.want == nil {
+				if err == nil {
+					t.Errorf("resticArgs = %q, want an error", args)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(args, tc.want) {
+				t.Errorf("resticArgs = %q, %v, want %q", args, err, tc.want)
+			}
+		})
+	}
+}
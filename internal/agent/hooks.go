@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Hook failure policies.
+const (
+	// HookAbort stops the task when the hook fails; remaining hooks,
+	// including post hooks, are skipped.
+	HookAbort = "abort"
+	// HookContinue ignores the failure.
+	HookContinue = "continue"
+	// HookAlwaysRunPost stops the task when a pre hook fails but still runs
+	// the post hooks, e.g. to restart a service a pre hook stopped.
+	HookAlwaysRunPost = "always-run-post"
+)
+
+const (
+	defaultHookTimeout = 5 * time.Minute
+	// maxHookOutput caps the output stored per hook.
+	maxHookOutput = 16 * 1024
+)
+
+// Hook is a command run before or after restic.
+type Hook struct {
+	Name string `json:"name"`
+	// Command is the argv of the hook; use ["sh", "-c", "..."] for shell
+	// syntax.
+	Command        []string          `json:"command"`
+	TimeoutSeconds int               `json:"timeoutSeconds"`
+	Env            map[string]string `json:"env"`
+	OnFailure      string            `json:"onFailure"`
+}
+
+// Hooks are the ordered pre and post hooks of a task.
+type Hooks struct {
+	Pre  []Hook `json:"pre"`
+	Post []Hook `json:"post"`
+}
+
+// HookResult is recorded for every hook that ran or was skipped.
+type HookResult struct {
+	Name       string `json:"name"`
+	Phase      string `json:"phase"`
+	ExitCode   int    `json:"exitCode"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Skipped    bool   `json:"skipped,omitempty"`
+}
+
+func (h Hook) policy() string {
+	if h.OnFailure == "" {
+		return HookAbort
+	}
+	return h.OnFailure
+}
+
+func (h Hook) label(i int) string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if len(h.Command) > 0 {
+		return h.Command[0]
+	}
+	return fmt.Sprintf("hook-%d", i+1)
+}
+
+// validate checks the hook definitions before anything runs.
+func (hs Hooks) validate() error {
+	for phase, list := range map[string][]Hook{"pre": hs.Pre, "post": hs.Post} {
+		for i, h := range list {
+			if len(h.Command) == 0 {
+				return fmt.Errorf("%s hook %d has no command", phase, i+1)
+			}
+			switch h.policy() {
+			case HookAbort, HookContinue, HookAlwaysRunPost:
+			default:
+				return fmt.Errorf("%s hook %s: unknown onFailure policy %q", phase, h.label(i), h.OnFailure)
+			}
+		}
+	}
+	return nil
+}
+
+// runPre runs the pre hooks in order. It reports whether the task may
+// proceed and whether the post hooks must still run when it may not.
+func (a *Agent) runPre(ctx context.Context, taskID uint, hooks []Hook, logLine func(string)) (results []HookResult, proceed, runPost bool) {
+	for i, h := range hooks {
+		res := a.runHook(ctx, taskID, "pre", i, h, logLine)
+		results = append(results, res)
+		if res.Error == "" {
+			continue
+		}
+		switch h.policy() {
+		case HookContinue:
+			continue
+		case HookAlwaysRunPost:
+			return skipRemaining(results, "pre", hooks[i+1:]), false, true
+		default:
+			return skipRemaining(results, "pre", hooks[i+1:]), false, false
+		}
+	}
+	return results, true, true
+}
+
+// runPost runs the post hooks in order and returns an error describing the
+// first failing hook whose policy is not "continue".
+func (a *Agent) runPost(ctx context.Context, taskID uint, hooks []Hook, logLine func(string)) ([]HookResult, error) {
+	var results []HookResult
+	var failed error
+	for i, h := range hooks {
+		res := a.runHook(ctx, taskID, "post", i, h, logLine)
+		results = append(results, res)
+		if res.Error == "" || h.policy() == HookContinue {
+			continue
+		}
+		if failed == nil {
+			failed = fmt.Errorf("post hook %s: %s", res.Name, res.Error)
+		}
+		if h.policy() == HookAbort {
+			return skipRemaining(results, "post", hooks[i+1:]), failed
+		}
+	}
+	return results, failed
+}
+
+func skipRemaining(results []HookResult, phase string, rest []Hook) []HookResult {
+	for i, h := range rest {
+		results = append(results, HookResult{Name: h.label(i), Phase: phase, Skipped: true})
+	}
+	return results
+}
+
+func (a *Agent) runHook(ctx context.Context, taskID uint, phase string, i int, h Hook, logLine func(string)) HookResult {
+	res := HookResult{Name: h.label(i), Phase: phase}
+
+	timeout := time.Duration(h.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	a.logf("task %d: running %s hook %s", taskID, phase, res.Name)
+	cmd := exec.CommandContext(timeoutCtx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), hookEnv(h.Env)...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	started := time.Now()
+	err := cmd.Run()
+	res.DurationMs = time.Since(started).Milliseconds()
+	res.Output = truncateOutput(out.String())
+
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			logLine(fmt.Sprintf("[%s hook %s] %s", phase, res.Name, line))
+		}
+	}
+
+	switch {
+	case timeoutCtx.Err() == context.DeadlineExceeded:
+		res.ExitCode = -1
+		res.Error = fmt.Sprintf("timeout after %s", timeout)
+	case err != nil:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			res.ExitCode = exitErr.ExitCode()
+		} else {
+			res.ExitCode = -1
+		}
+		res.Error = err.Error()
+	}
+	if res.Error != "" {
+		a.logf("task %d: %s hook %s failed: %s", taskID, phase, res.Name, res.Error)
+	}
+	return res
+}
+
+func hookEnv(vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", key, vars[key]))
+	}
+	return env
+}
+
+// truncateOutput keeps the last maxHookOutput bytes of out, starting at a
+// rune boundary.
+func truncateOutput(out string) string {
+	if len(out) <= maxHookOutput {
+		return out
+	}
+	start := len(out) - maxHookOutput
+	for start < len(out) && !utf8.RuneStart(out[start]) {
+		start++
+	}
+	return out[start:]
+}
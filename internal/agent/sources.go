@@ -0,0 +1,280 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Source types that can be backed up via restic --stdin.
+const (
+	SourcePostgres = "postgres"
+	SourceMySQL    = "mysql"
+	SourceSQLite   = "sqlite"
+)
+
+// Source describes a database dump that is streamed into restic instead of
+// backing up files.
+type Source struct {
+	Type     string `json:"type"`
+	Database string `json:"database"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	// Password or PasswordFile are handed to the dump tool through its own
+	// environment variable (PGPASSWORD, MYSQL_PWD), never on the command line.
+	Password     string `json:"password"`
+	PasswordFile string `json:"passwordFile"`
+	// Path is the database file for sqlite sources.
+	Path string `json:"path"`
+	// Filename is the name of the dump inside the snapshot.
+	Filename string `json:"filename"`
+	// Args are appended to the arguments of pg_dump and mysqldump; sqlite
+	// sources take none.
+	Args []string `json:"args"`
+	// Binary is refused: tasks may not choose the program the agent runs,
+	// the dump tools are set in the agent's Config.DumpTools.
+	Binary string `json:"binary"`
+}
+
+// DefaultDumpTools are the dump tools run when Config.DumpTools names none
+// for a source type.
+var DefaultDumpTools = map[string]string{
+	SourcePostgres: "pg_dump",
+	SourceMySQL:    "mysqldump",
+	SourceSQLite:   "sqlite3",
+}
+
+func (s Source) filename() string {
+	if s.Filename != "" {
+		return s.Filename
+	}
+	switch s.Type {
+	case SourceSQLite:
+		return filepath.Base(s.Path)
+	default:
+		return s.Database + ".sql"
+	}
+}
+
+func (s Source) password() (string, error) {
+	if s.PasswordFile == "" {
+		return s.Password, nil
+	}
+	data, err := os.ReadFile(s.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("read source password file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// dumpCommand returns the command that writes the dump to stdout, running
+// the dump tool for the source type from tools or DefaultDumpTools.
+func (s Source) dumpCommand(ctx context.Context, tools map[string]string) (*exec.Cmd, error) {
+	if s.Binary != "" {
+		return nil, errors.New("source binary is not accepted from tasks, set the dump tool on the agent")
+	}
+	tool := tools[s.Type]
+	if tool == "" {
+		tool = DefaultDumpTools[s.Type]
+	}
+	password, err := s.password()
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	switch s.Type {
+	case SourcePostgres:
+		if s.Database == "" {
+			return nil, errors.New("postgres source without database")
+		}
+		args := []string{"--no-password"}
+		if s.Host != "" {
+			args = append(args, "--host", s.Host)
+		}
+		if s.Port != 0 {
+			args = append(args, "--port", strconv.Itoa(s.Port))
+		}
+		if s.User != "" {
+			args = append(args, "--username", s.User)
+		}
+		args = append(append(args, s.Args...), s.Database)
+		cmd = exec.CommandContext(ctx, tool, args...)
+		cmd.Env = os.Environ()
+		if password != "" {
+			cmd.Env = append(cmd.Env, "PGPASSWORD="+password)
+		}
+	case SourceMySQL:
+		if s.Database == "" {
+			return nil, errors.New("mysql source without database")
+		}
+		args := []string{"--single-transaction"}
+		if s.Host != "" {
+			args = append(args, "--host", s.Host)
+		}
+		if s.Port != 0 {
+			args = append(args, "--port", strconv.Itoa(s.Port))
+		}
+		if s.User != "" {
+			args = append(args, "--user", s.User)
+		}
+		args = append(append(args, s.Args...), s.Database)
+		cmd = exec.CommandContext(ctx, tool, args...)
+		cmd.Env = os.Environ()
+		if password != "" {
+			cmd.Env = append(cmd.Env, "MYSQL_PWD="+password)
+		}
+	case SourceSQLite:
+		if s.Path == "" {
+			return nil, errors.New("sqlite source without path")
+		}
+		if len(s.Args) > 0 {
+			return nil, errors.New("sqlite sources take no args")
+		}
+		// .backup needs a file, so the online backup goes to a temporary
+		// file which is then written to stdout and removed.
+		script := `tmp=$(mktemp) && trap 'rm -f "$tmp"' EXIT && "$0" "$1" ".backup '$tmp'" && cat "$tmp"`
+		cmd = exec.CommandContext(ctx, "sh", "-c", script, tool, s.Path)
+	default:
+		return nil, fmt.Errorf("unknown source type %q", s.Type)
+	}
+	return cmd, nil
+}
+
+// runSourceBackup streams a database dump into restic backup --stdin and
+// verifies that the resulting snapshot contains a non-empty file.
+func (a *Agent) runSourceBackup(ctx context.Context, task Task, p backupPayload, logLine func(string)) Result {
+	src := *p.Source
+	filename := src.filename()
+	if err := p.validate(); err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+	if err := flagValues("filename", filename); err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, taskTimeout(task))
+	defer cancel()
+
+	dump, err := src.dumpCommand(timeoutCtx, a.cfg.DumpTools)
+	if err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+	var dumpErr bytes.Buffer
+	dump.Stderr = &dumpErr
+	stdout, err := dump.StdoutPipe()
+	if err != nil {
+		return Result{ExitCode: -1, Error: err.Error()}
+	}
+
+	a.logf("task %d: streaming %s dump into %s", task.ID, src.Type, filename)
+	if err := dump.Start(); err != nil {
+		return Result{ExitCode: -1, Error: fmt.Sprintf("start %s dump: %v", src.Type, err)}
+	}
+
+	args := []string{"backup", "--json", "--stdin", "--stdin-filename", filename}
+	for _, tag := range p.Tags {
+		args = append(args, "--tag", tag)
+	}
+	if p.Host != "" {
+		args = append(args, "--host", p.Host)
+	}
+	result := a.restic(timeoutCtx, task, args, stdout, logLine)
+
+	// Unblock the dump if restic stopped reading early
+	_ = stdout.Close()
+	dumpWaitErr := dump.Wait()
+	for _, line := range strings.Split(strings.TrimSpace(dumpErr.String()), "\n") {
+		if line != "" {
+			logLine(fmt.Sprintf("[%s dump] %s", src.Type, line))
+		}
+	}
+
+	snapshotID := snapshotIDFromOutput(result.Output)
+
+	if dumpWaitErr != nil {
+		result.Success = false
+		result.ExitCode = -1
+		result.Error = fmt.Sprintf("%s dump failed: %v: %s", src.Type, dumpWaitErr, strings.TrimSpace(dumpErr.String()))
+		if snapshotID != "" {
+			// The snapshot only contains a truncated dump, do not keep it
+			a.logf("task %d: removing snapshot %s of failed dump", task.ID, snapshotID)
+			a.restic(context.WithoutCancel(ctx), task, []string{"forget", snapshotID}, nil, logLine)
+		}
+		return result
+	}
+	if !result.Success {
+		return result
+	}
+	if snapshotID == "" {
+		result.Success = false
+		result.Error = "restic backup did not report a snapshot ID"
+		return result
+	}
+
+	if err := a.verifySnapshotFile(timeoutCtx, task, snapshotID, filename); err != nil {
+		result.Success = false
+		result.Error = fmt.Sprintf("verify snapshot %s: %v", snapshotID, err)
+		return result
+	}
+	logLine(fmt.Sprintf("verified snapshot %s contains non-empty %s", snapshotID, filename))
+	return result
+}
+
+// snapshotIDFromOutput extracts the snapshot ID from the summary message of
+// restic backup --json.
+func snapshotIDFromOutput(output string) string {
+	lines := strings.Split(output, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var msg struct {
+			MessageType string `json:"message_type"`
+			SnapshotID  string `json:"snapshot_id"`
+		}
+		if json.Unmarshal([]byte(lines[i]), &msg) == nil && msg.MessageType == "summary" {
+			return msg.SnapshotID
+		}
+	}
+	return ""
+}
+
+// verifySnapshotFile checks that the snapshot contains filename with a
+// non-zero size.
+func (a *Agent) verifySnapshotFile(ctx context.Context, task Task, snapshotID, filename string) error {
+	var listing bytes.Buffer
+	res := a.restic(ctx, task, []string{"ls", "--json", snapshotID}, nil, func(line string) {
+		listing.WriteString(line)
+		listing.WriteByte('\n')
+	})
+	if !res.Success {
+		return errors.New(res.Error)
+	}
+
+	scanner := bufio.NewScanner(&listing)
+	for scanner.Scan() {
+		var node struct {
+			Type string `json:"type"`
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &node) != nil || node.Type != "file" {
+			continue
+		}
+		if node.Path != "/"+filename {
+			continue
+		}
+		if node.Size == 0 {
+			return fmt.Errorf("%s is empty", filename)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s not found in snapshot", filename)
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const stateFileName = "agent.json"
+
+// State is what the agent remembers between restarts.
+type State struct {
+	ServerURL string `json:"server_url"`
+	AgentID   uint   `json:"agent_id"`
+	Token     string `json:"token"`
+}
+
+// LoadState reads the persisted state from dir. A missing state file is not
+// an error and yields an empty state.
+func LoadState(dir string) (State, error) {
+	var state State
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read agent state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("parse agent state: %w", err)
+	}
+	return state, nil
+}
+
+// SaveState writes the state to dir, readable only by the current user since
+// it contains the agent token.
+func SaveState(dir string, state State) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated token
+	tmp := filepath.Join(dir, stateFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write agent state: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, stateFileName))
+}
@@ -0,0 +1,904 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+	"gorm.io/gorm"
+)
+
+const (
+	// taskLeaseGrace is added to a task's timeout before its lease expires
+	// and the task is handed out again.
+	taskLeaseGrace = time.Minute
+	// defaultPollWait and maxPollWait bound the long-poll duration of
+	// GET /api/v1/agents/{id}/tasks.
+	defaultPollWait = 30 * time.Second
+	maxPollWait     = 60 * time.Second
+	pollInterval    = time.Second
+)
+
+type registerAgentRequest struct {
+	store.AgentData
+	// Token is the current token of the agent, needed to register again
+	// under an existing name without the admin role.
+	Token string `json:"token,omitempty"`
+}
+
+type registerAgentResponse struct {
+	ID    uint   `json:"id" example:"1"`
+	Name  string `json:"name" example:"web-01"`
+	Token string `json:"token" example:"9f86d081884c7d659a2feaa0c55ad015"`
+}
+
+type agentResponse struct {
+	ID            uint      `json:"id" example:"1"`
+	Name          string    `json:"name" example:"web-01"`
+	Hostname      string    `json:"hostname" example:"web-01.example.com"`
+	OS            string    `json:"os" example:"linux"`
+	Arch          string    `json:"arch" example:"amd64"`
+	Version       string    `json:"version" example:"0.1.0"`
+	LastHeartbeat time.Time `json:"lastHeartbeat" example:"2025-11-23T15:00:00Z"`
+}
+
+type enqueueTaskRequest struct {
+	Target         string          `json:"target" example:"home"`
+	Type           string          `json:"type" example:"backup"`
+	Payload        json.RawMessage `json:"payload,omitempty" swaggertype:"object"`
+	MaxAttempts    int             `json:"maxAttempts,omitempty" example:"3"`
+	TimeoutSeconds int             `json:"timeoutSeconds,omitempty" example:"3600"`
+}
+
+type taskResultRequest struct {
+	Success  bool            `json:"success" example:"true"`
+	ExitCode int             `json:"exitCode" example:"0"`
+	Output   string          `json:"output" example:"snapshot 1a2b3c4d saved"`
+	Error    string          `json:"error" example:""`
+	Hooks    json.RawMessage `json:"hooks,omitempty" swaggertype:"array,object"`
+}
+
+type taskRepository struct {
+	Repository      string            `json:"repository"`
+	Password        string            `json:"password,omitempty"`
+	PasswordFile    string            `json:"passwordFile,omitempty"`
+	PasswordCommand string            `json:"passwordCommand,omitempty"`
+	CertificateFile string            `json:"certificateFile,omitempty"`
+	Credentials     map[string]string `json:"credentials,omitempty"`
+	Env             map[string]string `json:"env,omitempty"`
+	Options         []string          `json:"options,omitempty"`
+}
+
+type taskRetention struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+}
+
+type taskLogsRequest struct {
+	Lines []string `json:"lines"`
+}
+
+type taskLogResponse struct {
+	ID   uint      `json:"id" example:"7"`
+	Line string    `json:"line" example:"processed 1234 files"`
+	Time time.Time `json:"time" example:"2025-11-23T15:00:00Z"`
+}
+
+type taskResponse struct {
+	ID             uint            `json:"id" example:"42"`
+	AgentID        uint            `json:"agentId" example:"1"`
+	Target         string          `json:"target" example:"home"`
+	Type           string          `json:"type" example:"backup"`
+	Payload        json.RawMessage `json:"payload,omitempty" swaggertype:"object"`
+	Status         string          `json:"status" example:"leased"`
+	Attempts       int             `json:"attempts" example:"1"`
+	MaxAttempts    int             `json:"maxAttempts" example:"3"`
+	TimeoutSeconds int             `json:"timeoutSeconds" example:"3600"`
+	LeaseExpiresAt time.Time       `json:"leaseExpiresAt,omitempty"`
+	ExitCode       int             `json:"exitCode" example:"0"`
+	Output         string          `json:"output,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	Hooks          json.RawMessage `json:"hooks,omitempty" swaggertype:"array,object"`
+	Repository     *taskRepository `json:"repository,omitempty"`
+	Retention      *taskRetention  `json:"retention,omitempty"`
+}
+
+func agentPayload(agent store.Agent) agentResponse {
+	return agentResponse{
+		ID:            agent.ID,
+		Name:          agent.Name,
+		Hostname:      agent.Hostname,
+		OS:            agent.OS,
+		Arch:          agent.Arch,
+		Version:       agent.Version,
+		LastHeartbeat: agent.LastHeartbeat,
+	}
+}
+
+func taskPayload(task store.Task) taskResponse {
+	resp := taskResponse{
+		ID:             task.ID,
+		AgentID:        task.AgentID,
+		Target:         task.TargetName,
+		Type:           task.Type,
+		Status:         task.Status,
+		Attempts:       task.Attempts,
+		MaxAttempts:    task.MaxAttempts,
+		TimeoutSeconds: task.TimeoutSeconds,
+		LeaseExpiresAt: task.LeaseExpiresAt,
+		ExitCode:       task.ExitCode,
+		Output:         task.Output,
+		Error:          task.Error,
+	}
+	if task.Payload != "" {
+		resp.Payload = redactSecrets(json.RawMessage(task.Payload))
+	}
+	if task.Hooks != "" {
+		resp.Hooks = json.RawMessage(task.Hooks)
+	}
+	return resp
+}
+
+// secretKeys are payload fields whose values are never returned to
+// operators.
+var secretKeys = []string{"password", "secret", "token", "key"}
+
+// redactSecrets replaces the values of secret-looking fields in a JSON
+// document with "***". Only the agent that executes a task receives its
+// payload unredacted.
+func redactSecrets(raw json.RawMessage) json.RawMessage {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redactValue(doc))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, inner := range v {
+			if isSecretKey(key) {
+				if s, ok := inner.(string); ok && s != "" {
+					v[key] = "***"
+				}
+				continue
+			}
+			v[key] = redactValue(inner)
+		}
+	case []any:
+		for i, inner := range v {
+			v[i] = redactValue(inner)
+		}
+	}
+	return value
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "file") {
+		return false
+	}
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAgentRoute reports whether the request is made by an agent with its own
+// token rather than by an operator.
+func isAgentRoute(r *http.Request) bool {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/api/v1/agents/")
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "heartbeat":
+		return true
+	case len(parts) == 2 && parts[1] == "tasks":
+		return r.Method == http.MethodGet
+	case len(parts) == 4 && parts[1] == "tasks" && (parts[3] == "result" || parts[3] == "logs"):
+		return true
+	}
+	return false
+}
+
+// authenticateAgent verifies the bearer token of the agent with the given
+// ID. A verified client certificate named like the agent authenticates it
+// without a token; a certificate of another name is refused.
+func (a *API) authenticateAgent(r *http.Request, agentID uint) (store.Agent, bool) {
+	agent, err := a.store.GetAgent(r.Context(), agentID)
+	if err != nil {
+		return store.Agent{}, false
+	}
+	if name, ok := clientCertName(r); ok {
+		return agent, name == agent.Name
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return store.Agent{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(agent.TokenHash)) != 1 {
+		return store.Agent{}, false
+	}
+	return agent, true
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleAgents dispatches /api/v1/agents and its sub-routes.
+func (a *API) handleAgents(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/agents"), "/")
+	if rest == "" {
+		a.require(store.RoleViewer, store.ScopeReadStatus, a.handleListAgents)(w, r)
+		return
+	}
+	if rest == "register" {
+		a.require(store.RoleAdmin, store.ScopeAgent, a.handleRegisterAgent)(w, r)
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid agent id", http.StatusBadRequest)
+		return
+	}
+	agentID := uint(id)
+
+	switch {
+	case len(parts) == 2 && parts[1] == "heartbeat":
+		a.handleAgentHeartbeat(w, r, agentID)
+	case len(parts) == 2 && parts[1] == "tasks" && r.Method == http.MethodGet:
+		a.handlePollTasks(w, r, agentID)
+	case len(parts) == 2 && parts[1] == "tasks":
+		if a.authorize(w, r, store.RoleOperator, noScope) {
+			a.handleEnqueueTask(w, r, agentID)
+		}
+	case len(parts) == 4 && parts[1] == "tasks" && (parts[3] == "result" || parts[3] == "logs"):
+		taskID, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid task id", http.StatusBadRequest)
+			return
+		}
+		if parts[3] == "logs" {
+			a.handleAppendTaskLogs(w, r, agentID, uint(taskID))
+			return
+		}
+		a.handleTaskResult(w, r, agentID, uint(taskID))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleListAgents godoc
+// @Summary List registered agents
+// @Description Returns all agents that have registered with the orchestrator
+// @Tags Agents
+// @Produce json
+// @Success 200 {array} agentResponse "List of agents"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /agents [get]
+func (a *API) handleListAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agents, err := a.store.ListAgents(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list agents: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]agentResponse, 0, len(agents))
+	for _, agent := range agents {
+		payloads = append(payloads, agentPayload(agent))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payloads)
+}
+
+// handleRegisterAgent godoc
+// @Summary Register an agent
+// @Description Registers (or re-registers) an agent by name and issues a new agent token. Re-registering invalidates the previous token and requires the admin role, the current agent token or the agent's client certificate.
+// @Tags Agents
+// @Accept json
+// @Produce json
+// @Param agent body registerAgentRequest true "Agent description"
+// @Success 200 {object} registerAgentResponse "Agent registered"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /agents/register [post]
+func (a *API) handleRegisterAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req registerAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	data := req.AgentData
+	auditFrom(r).setParam("agent", data.Name)
+	if data.Name == "" {
+		http.Error(w, "agent name required", http.StatusBadRequest)
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("generate token: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Taking over an existing name hands its leased tasks and their
+	// credentials to the caller
+	caller := principalFrom(r)
+	replace := func(existing store.Agent) bool {
+		if caller.Scopes == nil && store.RoleAllows(caller.Role, store.RoleAdmin) {
+			return true
+		}
+		if name, ok := clientCertName(r); ok {
+			return name == existing.Name
+		}
+		return req.Token != "" && subtle.ConstantTimeCompare([]byte(hashToken(req.Token)), []byte(existing.TokenHash)) == 1
+	}
+	agent, err := a.store.RegisterAgent(r.Context(), data, hashToken(token), replace)
+	if errors.Is(err, store.ErrAgentExists) {
+		http.Error(w, fmt.Sprintf("Forbidden: agent %s is already registered", data.Name), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("register agent: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("registered agent %s (id %d, host %s)", agent.Name, agent.ID, agent.Hostname)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(registerAgentResponse{ID: agent.ID, Name: agent.Name, Token: token})
+}
+
+// handleAgentHeartbeat godoc
+// @Summary Send an agent heartbeat
+// @Description Records that the agent is alive. Authenticated with the agent token.
+// @Tags Agents
+// @Produce json
+// @Param id path int true "Agent ID"
+// @Success 200 {object} map[string]string "Heartbeat recorded"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Security BearerAuth
+// @Router /agents/{id}/heartbeat [post]
+func (a *API) handleAgentHeartbeat(w http.ResponseWriter, r *http.Request, agentID uint) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.authenticateAgent(r, agentID); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := a.store.TouchAgent(r.Context(), agentID, time.Now()); err != nil {
+		http.Error(w, fmt.Sprintf("record heartbeat: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handlePollTasks godoc
+// @Summary Poll for the next task
+// @Description Long-polls for the next pending task of the agent and leases it. The lease lasts for the task timeout plus one minute; tasks whose lease expires without a result are re-queued. Returns 204 when no task became available within the wait time. Authenticated with the agent token.
+// @Tags Agents
+// @Produce json
+// @Param id path int true "Agent ID"
+// @Param wait query int false "Seconds to wait for a task (default 30, max 60)"
+// @Success 200 {object} taskResponse "Leased task"
+// @Success 204 {string} string "No task available"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 500 {string} string "Internal server error"
+// @Security BearerAuth
+// @Router /agents/{id}/tasks [get]
+func (a *API) handlePollTasks(w http.ResponseWriter, r *http.Request, agentID uint) {
+	if _, ok := a.authenticateAgent(r, agentID); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	wait := defaultPollWait
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		seconds, err := strconv.Atoi(waitStr)
+		if err != nil || seconds < 0 {
+			http.Error(w, "invalid wait parameter, must be non-negative integer", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxPollWait)
+	}
+
+	ctx := r.Context()
+	_ = a.store.TouchAgent(ctx, agentID, time.Now())
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		task, err := a.store.LeaseTask(ctx, agentID, taskLeaseGrace)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("lease task: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if task != nil {
+			log.Printf("leased task %d (%s on %s) to agent %d, attempt %d/%d",
+				task.ID, task.Type, task.TargetName, agentID, task.Attempts, task.MaxAttempts)
+			resp := taskPayload(*task)
+			// The executing agent needs the secrets in the payload and the
+			// repository credentials; this is the only response carrying them.
+			if task.Payload != "" {
+				resp.Payload = json.RawMessage(task.Payload)
+			}
+			if task.TargetName != "" {
+				if target, err := a.store.GetTarget(ctx, task.TargetName); err == nil {
+					// Secret references are resolved here so agents never
+					// need access to the secret providers.
+					creds, err := a.resolveCredentials(ctx, target)
+					if err != nil {
+						log.Printf("task %d: %v", task.ID, err)
+						_, _ = a.store.CompleteTask(ctx, agentID, task.ID, store.TaskResult{ExitCode: -1, Error: err.Error()})
+						continue
+					}
+					resp.Repository = &taskRepository{
+						Repository:      creds.Repository,
+						Password:        creds.Password,
+						PasswordFile:    creds.PasswordFile,
+						PasswordCommand: creds.PasswordCommand,
+						CertificateFile: creds.CertificateFile,
+						Credentials:     creds.Secrets,
+						Env:             creds.Env,
+						Options:         creds.Options,
+					}
+					if task.Type == store.TaskTypePrune {
+						resp.Retention = &taskRetention{
+							KeepLast:    target.KeepLast,
+							KeepDaily:   target.KeepDaily,
+							KeepWeekly:  target.KeepWeekly,
+							KeepMonthly: target.KeepMonthly,
+						}
+					}
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleEnqueueTask godoc
+// @Summary Queue a task for an agent
+// @Description Queues a backup, check, prune or unlock task for the agent. Failed tasks are retried until maxAttempts is reached. Payloads with hooks or a dump source run commands on the agent host and require the admin role.
+// @Tags Agents
+// @Accept json
+// @Produce json
+// @Param id path int true "Agent ID"
+// @Param task body enqueueTaskRequest true "Task definition"
+// @Success 201 {object} taskResponse "Task queued"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Agent or target not found"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /agents/{id}/tasks [post]
+func (a *API) handleEnqueueTask(w http.ResponseWriter, r *http.Request, agentID uint) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	if _, err := a.store.GetAgent(ctx, agentID); err != nil {
+		http.Error(w, fmt.Sprintf("agent %d not found", agentID), http.StatusNotFound)
+		return
+	}
+
+	var req enqueueTaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !store.ValidTaskType(req.Type) {
+		http.Error(w, fmt.Sprintf("unknown task type %q", req.Type), http.StatusBadRequest)
+		return
+	}
+	if req.Target == "" {
+		http.Error(w, "target name required", http.StatusBadRequest)
+		return
+	}
+	auditFrom(r).setTarget(req.Target)
+	auditFrom(r).setParam("agent", agentID)
+	auditFrom(r).setParam("type", req.Type)
+	if !a.authorizeTarget(w, r, req.Target) {
+		return
+	}
+	// Hooks run arbitrary commands on the agent host, whatever the target,
+	// and dump sources pass arguments to the dump tools and read password
+	// files on it.
+	commands, err := payloadRunsCommands(req.Payload)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if commands && !a.authorize(w, r, store.RoleAdmin, noScope) {
+		return
+	}
+	if _, err := a.store.GetTarget(ctx, req.Target); err != nil {
+		http.Error(w, fmt.Sprintf("target %s not found", req.Target), http.StatusNotFound)
+		return
+	}
+
+	task, err := a.store.EnqueueTask(ctx, store.TaskData{
+		AgentID:     agentID,
+		TargetName:  req.Target,
+		Type:        req.Type,
+		Payload:     string(req.Payload),
+		MaxAttempts: req.MaxAttempts,
+		Timeout:     time.Duration(req.TimeoutSeconds) * time.Second,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("enqueue task: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("queued %s task %d for agent %d on target %s", task.Type, task.ID, agentID, task.TargetName)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(taskPayload(task))
+}
+
+// payloadRunsCommands reports whether a task payload defines pre or post
+// hooks or a dump source.
+func payloadRunsCommands(payload json.RawMessage) (bool, error) {
+	if len(payload) == 0 {
+		return false, nil
+	}
+	var p struct {
+		Hooks *struct {
+			Pre  []json.RawMessage `json:"pre"`
+			Post []json.RawMessage `json:"post"`
+		} `json:"hooks"`
+		Source json.RawMessage `json:"source"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return false, err
+	}
+	hooks := p.Hooks != nil && len(p.Hooks.Pre)+len(p.Hooks.Post) > 0
+	source := len(p.Source) > 0 && string(p.Source) != "null"
+	return hooks || source, nil
+}
+
+// handleTaskResult godoc
+// @Summary Report a task result
+// @Description Reports the outcome of a leased task. Failed tasks are re-queued while attempts remain. Authenticated with the agent token.
+// @Tags Agents
+// @Accept json
+// @Produce json
+// @Param id path int true "Agent ID"
+// @Param task path int true "Task ID"
+// @Param result body taskResultRequest true "Task result"
+// @Success 200 {object} taskResponse "Result recorded"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Task not found"
+// @Failure 409 {string} string "Task is not leased by this agent"
+// @Failure 500 {string} string "Internal server error"
+// @Security BearerAuth
+// @Router /agents/{id}/tasks/{task}/result [post]
+func (a *API) handleTaskResult(w http.ResponseWriter, r *http.Request, agentID, taskID uint) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.authenticateAgent(r, agentID); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req taskResultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	task, err := a.store.CompleteTask(r.Context(), agentID, taskID, store.TaskResult{
+		Success:  req.Success,
+		ExitCode: req.ExitCode,
+		Output:   req.Output,
+		Error:    req.Error,
+		Hooks:    string(req.Hooks),
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, fmt.Sprintf("task %d not found", taskID), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrTaskNotLeased) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("record result: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("agent %d reported task %d (%s on %s): success=%v exit=%d, status now %s",
+		agentID, task.ID, task.Type, task.TargetName, req.Success, req.ExitCode, task.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(taskPayload(task))
+}
+
+// handleTasks godoc
+// @Summary List tasks
+// @Description Returns the most recent agent tasks, newest first
+// @Tags Agents
+// @Produce json
+// @Param agent query int false "Only tasks of this agent ID"
+// @Param limit query int false "Maximum number of tasks (default 100)"
+// @Success 200 {array} taskResponse "List of tasks"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /tasks [get]
+func (a *API) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var agentID uint
+	if agentStr := r.URL.Query().Get("agent"); agentStr != "" {
+		id, err := strconv.ParseUint(agentStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid agent parameter", http.StatusBadRequest)
+			return
+		}
+		agentID = uint(id)
+	}
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit parameter, must be positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	tasks, err := a.store.ListTasks(r.Context(), agentID, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list tasks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	caller := principalFrom(r)
+	payloads := make([]taskResponse, 0, len(tasks))
+	for _, task := range tasks {
+		if !caller.allows(task.TargetName) {
+			continue
+		}
+		payloads = append(payloads, taskPayload(task))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payloads)
+}
+
+// handleAppendTaskLogs godoc
+// @Summary Stream task output
+// @Description Appends output lines of a running task. Authenticated with the agent token.
+// @Tags Agents
+// @Accept json
+// @Produce json
+// @Param id path int true "Agent ID"
+// @Param task path int true "Task ID"
+// @Param logs body taskLogsRequest true "Output lines"
+// @Success 200 {object} map[string]string "Lines stored"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Task not found"
+// @Failure 500 {string} string "Internal server error"
+// @Security BearerAuth
+// @Router /agents/{id}/tasks/{task}/logs [post]
+func (a *API) handleAppendTaskLogs(w http.ResponseWriter, r *http.Request, agentID, taskID uint) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := a.authenticateAgent(r, agentID); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	task, err := a.store.GetTask(ctx, taskID)
+	if err != nil || task.AgentID != agentID {
+		http.Error(w, fmt.Sprintf("task %d not found", taskID), http.StatusNotFound)
+		return
+	}
+
+	var req taskLogsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.store.AppendTaskLogs(ctx, taskID, req.Lines); err != nil {
+		http.Error(w, fmt.Sprintf("store logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleTask godoc
+// @Summary Get a task
+// @Description Returns a single agent task, for example to wait until it has finished
+// @Tags Agents
+// @Produce json
+// @Param id path int true "Task ID"
+// @Success 200 {object} taskResponse "Task"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Task not found"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /tasks/{id} [get]
+func (a *API) handleTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	taskID, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid task id", http.StatusBadRequest)
+		return
+	}
+	task, err := a.store.GetTask(r.Context(), uint(taskID))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("task %d not found", taskID), http.StatusNotFound)
+		return
+	}
+	if !a.authorizeTarget(w, r, task.TargetName) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(taskPayload(task))
+}
+
+// handleTaskLogs godoc
+// @Summary Get task output
+// @Description Returns the output lines streamed by the agent for a task. Pass the last seen line ID as "after" to follow a running task.
+// @Tags Agents
+// @Produce json
+// @Param id path int true "Task ID"
+// @Param after query int false "Only lines with a greater ID"
+// @Success 200 {array} taskLogResponse "Output lines"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Task not found"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /tasks/{id}/logs [get]
+func (a *API) handleTaskLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract task ID from path: /api/v1/tasks/{id}/logs
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
+	idStr, ok := strings.CutSuffix(rest, "/logs")
+	if !ok {
+		a.handleTask(w, r, rest)
+		return
+	}
+	taskID, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid task id", http.StatusBadRequest)
+		return
+	}
+
+	var after uint64
+	if afterStr := r.URL.Query().Get("after"); afterStr != "" {
+		after, err = strconv.ParseUint(afterStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid after parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	task, err := a.store.GetTask(ctx, uint(taskID))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("task %d not found", taskID), http.StatusNotFound)
+		return
+	}
+	if !a.authorizeTarget(w, r, task.TargetName) {
+		return
+	}
+
+	logs, err := a.store.ListTaskLogs(ctx, uint(taskID), uint(after))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list logs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]taskLogResponse, 0, len(logs))
+	for _, entry := range logs {
+		payloads = append(payloads, taskLogResponse{ID: entry.ID, Line: entry.Line, Time: entry.CreatedAt})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payloads)
+}
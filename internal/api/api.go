@@ -3,34 +3,105 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/oidc"
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/secrets"
 	"github.com/example/restic-monitor/internal/store"
 )
 
-// Run starts the HTTP API and shuts it down when the context is canceled.
-func Run(ctx context.Context, addr string, cfg config.Config, st *store.Store, mon Monitor, staticDir string) error {
+// Run starts the HTTP API. When the context is canceled it stops accepting
+// requests, waits up to cfg.ShutdownGracePeriod for running requests and
+// restic commands, interrupts the rest and returns once they exited.
+func Run(ctx context.Context, addr string, cfg config.Config, st *store.Store, mon Monitor, runner restic.Runner, staticDir string) error {
 	srv := &http.Server{
 		Addr:    addr,
-		Handler: New(cfg, st, mon, staticDir).Handler(),
+		Handler: New(cfg, st, mon, runner, staticDir).Handler(),
 	}
 
+	if cfg.TLSCertFile != "" {
+		tlsCfg, err := tlsConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		srv.TLSConfig = tlsCfg
+	}
+
+	stopped := make(chan error, 1)
 	go func() {
 		<-ctx.Done()
-		_ = srv.Shutdown(context.Background())
+		stopped <- shutdown(srv, runner, cfg.ShutdownGracePeriod)
 	}()
 
-	log.Printf("listening on %s", addr)
-	return srv.ListenAndServe()
+	var err error
+	if srv.TLSConfig == nil {
+		log.Printf("listening on %s", addr)
+		err = srv.ListenAndServe()
+	} else {
+		if cfg.TLSRedirectAddr != "" {
+			go runRedirect(ctx, cfg.TLSRedirectAddr, addr)
+		}
+		log.Printf("listening on %s with TLS", addr)
+		err = srv.ListenAndServeTLS("", "")
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-stopped
+}
+
+// drainer is implemented by runners that can wait for their running
+// commands, see restic.Drainer.
+type drainer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown stops srv in order: no new requests, then no new restic
+// commands, then waiting for the running ones until grace is over, when
+// restic is interrupted so it releases its locks.
+func shutdown(srv *http.Server, runner restic.Runner, grace time.Duration) error {
+	log.Printf("shutting down, waiting up to %s for running requests and restic commands", grace)
+
+	// Requests often wait for restic commands, so both drain at once, each
+	// with its own deadline: waiting for the requests must not use up the
+	// time the commands have before they are interrupted.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		d, ok := runner.(drainer)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := d.Shutdown(ctx); err != nil {
+			log.Printf("interrupted running restic commands")
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown grace period over with requests still running")
+	}
+	<-drained
+	// Cancel the requests still waiting for their interrupted commands
+	err := srv.Close()
+	log.Printf("shutdown complete")
+	return err
 }
 
 // Monitor provides trigger mechanism for immediate checks
@@ -43,12 +114,52 @@ type API struct {
 	config    config.Config
 	store     *store.Store
 	monitor   Monitor
+	runner    restic.Runner
+	resolver  *secrets.Resolver
 	staticDir string
+
+	// verified caches successful password checks, see verifyPassword
+	verified sync.Map
+
+	// oidc is nil unless the OIDC login is configured; logins holds the
+	// loginState of logins in progress by state
+	oidc      *oidc.Provider
+	oidcRoles map[string]string
+	logins    sync.Map
+
+	// failedLogins locks out clients guessing credentials; resticLimiter
+	// limits how often each caller may run restic
+	failedLogins   *loginGuard
+	resticLimiter  *rateLimiter
+	trustedProxies []*net.IPNet
 }
 
-// New constructs a new API handler.
-func New(cfg config.Config, st *store.Store, mon Monitor, staticDir string) *API {
-	return &API{config: cfg, store: st, monitor: mon, staticDir: staticDir}
+// New constructs a new API handler. Restic commands run through runner,
+// which should be shared with the monitor.
+func New(cfg config.Config, st *store.Store, mon Monitor, runner restic.Runner, staticDir string) *API {
+	a := &API{
+		config:    cfg,
+		store:     st,
+		monitor:   mon,
+		runner:    runner,
+		resolver:  secrets.NewResolver(cfg.VaultAddr, cfg.VaultToken),
+		staticDir: staticDir,
+
+		failedLogins:   newLoginGuard(cfg.LoginMaxFailures, cfg.LoginLockout, cfg.LoginLockoutMax),
+		resticLimiter:  newRateLimiter(cfg.ResticRateLimit),
+		trustedProxies: parseTrustedProxies(cfg.TrustedProxies),
+	}
+	if cfg.OIDCIssuerURL != "" {
+		a.oidc = oidc.New(oidc.Config{
+			IssuerURL:    cfg.OIDCIssuerURL,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       strings.Fields(cfg.OIDCScopes),
+		})
+		a.oidcRoles = parseRoleMapping(cfg.OIDCRoleMapping)
+	}
+	return a
 }
 
 // Handler registers routes.
@@ -56,13 +167,41 @@ func (a *API) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	// API routes under /api/v1/
-	mux.HandleFunc("/api/v1/status", a.handleStatus)
-	mux.HandleFunc("/api/v1/status/", a.handleStatusByName)
-	mux.HandleFunc("/api/v1/snapshots/", a.handleSnapshots)
-	mux.HandleFunc("/api/v1/snapshot/", a.handleSnapshotFiles)
-	mux.HandleFunc("/api/v1/unlock/", a.handleUnlock)
-	mux.HandleFunc("/api/v1/prune/", a.handlePrune)
-	mux.HandleFunc("/api/v1/toggle/", a.handleToggleDisabled)
+	// Handlers check access to individual targets; agents are authorized
+	// per sub-route in handleAgents
+	mux.HandleFunc("/api/v1/status", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleStatus))
+	mux.HandleFunc("/api/v1/status/", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleStatusByName))
+	mux.HandleFunc("/api/v1/stats/", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleStats))
+	mux.HandleFunc("/api/v1/snapshots/", a.require(store.RoleViewer, store.ScopeReadStatus, a.throttle(a.handleSnapshots)))
+	mux.HandleFunc("/api/v1/snapshot/", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleSnapshotFiles))
+	mux.HandleFunc("/api/v1/unlock/", a.require(store.RoleOperator, store.ScopeWriteUnlock, a.throttle(a.handleUnlock)))
+	mux.HandleFunc("/api/v1/locks/", a.require(store.RoleViewer, store.ScopeReadStatus, a.throttle(a.handleLocks)))
+	mux.HandleFunc("/api/v1/prune/", a.require(store.RoleOperator, store.ScopeWritePrune, a.throttle(a.handlePrune)))
+	mux.HandleFunc("/api/v1/toggle/", a.require(store.RoleOperator, noScope, a.handleToggleDisabled))
+	mux.HandleFunc("/api/v1/check/", a.require(store.RoleOperator, store.ScopeWriteCheck, a.handleCheck))
+	mux.HandleFunc("/api/v1/targets", a.handleTargets)
+	mux.HandleFunc("/api/v1/targets/", a.handleTargets)
+	mux.HandleFunc("/api/v1/agents", a.handleAgents)
+	mux.HandleFunc("/api/v1/agents/", a.handleAgents)
+	mux.HandleFunc("/api/v1/tasks", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleTasks))
+	mux.HandleFunc("/api/v1/tasks/", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleTaskLogs))
+	mux.HandleFunc("/api/v1/users", a.require(store.RoleAdmin, noScope, a.handleUsers))
+	mux.HandleFunc("/api/v1/users/", a.require(store.RoleAdmin, noScope, a.handleUsers))
+	mux.HandleFunc("/api/v1/tokens", a.require(store.RoleAdmin, noScope, a.handleTokens))
+	mux.HandleFunc("/api/v1/tokens/", a.require(store.RoleAdmin, noScope, a.handleTokens))
+	mux.HandleFunc("/api/v1/audit", a.require(store.RoleAdmin, noScope, a.handleAudit))
+	mux.HandleFunc("/api/v1/audit/", a.require(store.RoleAdmin, noScope, a.handleAudit))
+	mux.HandleFunc("/api/v1/export", a.require(store.RoleAdmin, noScope, a.handleExport))
+	mux.HandleFunc("/api/v1/import", a.require(store.RoleAdmin, noScope, a.handleImport))
+	mux.HandleFunc("/api/v1/backup", a.require(store.RoleAdmin, noScope, a.handleBackup))
+	mux.HandleFunc("/api/v1/me", a.require(store.RoleViewer, store.ScopeReadStatus, a.handleMe))
+
+	// Dashboard login through OpenID Connect
+	if a.oidc != nil {
+		mux.HandleFunc("/auth/login", a.handleLogin)
+		mux.HandleFunc("/auth/callback", a.handleCallback)
+		mux.HandleFunc("/auth/logout", a.handleLogout)
+	}
 
 	// Serve Swagger UI if enabled
 	if a.config.ShowSwagger {
@@ -73,7 +212,13 @@ func (a *API) Handler() http.Handler {
 	// Serve file lists from public directory
 	if a.config.PublicDir != "" {
 		publicFS := http.FileServer(http.Dir(a.config.PublicDir))
-		mux.Handle("/api/v1/files/", http.StripPrefix("/api/v1/files/", publicFS))
+		mux.Handle("/api/v1/files/", a.require(store.RoleViewer, store.ScopeReadStatus, func(w http.ResponseWriter, r *http.Request) {
+			snapshotID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/files/"), ".txt")
+			if !a.authorizeSnapshot(w, r, snapshotID) {
+				return
+			}
+			http.StripPrefix("/api/v1/files/", publicFS).ServeHTTP(w, r)
+		}))
 	}
 
 	// Serve static files from frontend/dist
@@ -89,26 +234,50 @@ func (a *API) Handler() http.Handler {
 		}))
 	}
 
-	var handler http.Handler = mux
-
-	// Wrap API routes with auth middleware if credentials are configured
-	if (a.config.AuthUsername != "" && a.config.AuthPassword != "") || a.config.AuthToken != "" {
-		handler = a.authMiddleware(handler)
-	}
+	// Authenticate API routes when credentials or users are configured,
+	// check CSRF tokens of browser requests and record state-changing
+	// requests, including denied ones
+	handler := a.auditMiddleware(a.authMiddleware(a.csrfMiddleware(mux)))
 
 	// Wrap with CORS middleware (must be outermost)
 	return a.corsMiddleware(handler)
 }
 
-// corsMiddleware adds CORS headers to all responses
+// corsMiddleware allows cross-origin requests from CORS_ALLOWED_ORIGINS.
+// Only a matching origin is echoed; other origins get no CORS headers, so
+// browsers keep them from reading responses or sending preflighted
+// requests. "*" allows every origin but never with credentials.
 func (a *API) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
+		wildcard := slices.Contains(a.config.CORSAllowedOrigins, "*")
+		if !wildcard && !slices.Contains(a.config.CORSAllowedOrigins, origin) {
+			if preflight {
+				http.Error(w, "Forbidden: origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wildcard {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", a.config.CORSAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", a.config.CORSAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
@@ -129,8 +298,11 @@ func fileExists(staticDir, path string) bool {
 	return !info.IsDir()
 }
 
-// authMiddleware wraps a handler with HTTP Basic Authentication and Bearer token support
-// Only protects /api/ routes, excludes swagger endpoints
+// authMiddleware authenticates API routes with an OIDC session cookie, HTTP
+// Basic Authentication (AUTH_USERNAME or a stored user) or a bearer token
+// and records the caller for the role checks of the routes. Without AUTH_*
+// settings, users and OIDC every caller is an admin. Swagger and agent
+// routes are excluded.
 func (a *API) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only require auth for API routes
@@ -145,27 +317,55 @@ func (a *API) authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Check for Bearer token first
-		if a.config.AuthToken != "" {
-			authHeader := r.Header.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				token := strings.TrimPrefix(authHeader, "Bearer ")
-				if token == a.config.AuthToken {
-					next.ServeHTTP(w, r)
-					return
-				}
-			}
+		// Agents authenticate with their own token in the handler
+		if isAgentRoute(r) {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		// Fall back to Basic Auth if configured
-		if a.config.AuthUsername != "" && a.config.AuthPassword != "" {
-			username, password, ok := r.BasicAuth()
-			if ok && username == a.config.AuthUsername && password == a.config.AuthPassword {
-				next.ServeHTTP(w, r)
+		if !a.authRequired(r.Context()) {
+			auditFrom(r).setActor(anonymous.Name)
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), anonymous)))
+			return
+		}
+
+		if p, ok := a.sessionPrincipal(r); ok {
+			auditFrom(r).setActor(p.Name)
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+			return
+		}
+		// Throttle guessing of passwords and tokens
+		hasCredentials := r.Header.Get("Authorization") != ""
+		var loginKeys []string
+		if hasCredentials {
+			loginKeys = a.loginKeys(r)
+			if wait := a.failedLogins.lockedFor(time.Now(), loginKeys...); wait > 0 {
+				tooManyRequests(w, wait, "Too many failed logins")
 				return
 			}
 		}
+		if p, ok := a.authenticate(r); ok {
+			a.failedLogins.succeed(loginKeys...)
+			auditFrom(r).setActor(p.Name)
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+			return
+		}
+		if hasCredentials {
+			a.recordLoginFailure(r, loginKeys)
+		}
+		if p, ok := a.certPrincipal(r); ok {
+			auditFrom(r).setActor(p.Name)
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+			return
+		}
+		if username, _, ok := r.BasicAuth(); ok {
+			auditFrom(r).setActor(username)
+		}
 
+		// Tell the dashboard where to log in
+		if a.oidc != nil {
+			w.Header().Set("X-Login-URL", "/auth/login")
+		}
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restic Monitor"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 	})
@@ -181,6 +381,7 @@ func (a *API) authMiddleware(next http.Handler) http.Handler {
 // @Success 200 {object} statusResponse "Single status when name parameter is provided"
 // @Success 200 {array} statusResponse "Array of statuses when no name parameter"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Target not found"
 // @Failure 500 {string} string "Internal server error"
 // @Security BasicAuth
@@ -205,12 +406,18 @@ func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if name != "" {
+		if !a.authorizeTarget(w, r, name) {
+			return
+		}
 		status, err := a.store.GetStatus(ctx, name)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		_ = json.NewEncoder(w).Encode(statusPayload(status, targetMap[status.Name], status.Health))
+		payload := statusPayload(status, targetMap[status.Name], status.Health)
+		payload.Stats = a.latestStats(ctx, status.Name)
+		payload.Warnings = a.snapshotWarnings(ctx, status.Name)
+		_ = json.NewEncoder(w).Encode(payload)
 		return
 	}
 
@@ -220,9 +427,16 @@ func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	caller := principalFrom(r)
 	payloads := make([]statusResponse, 0, len(statuses))
 	for _, status := range statuses {
-		payloads = append(payloads, statusPayload(status, targetMap[status.Name], status.Health))
+		if !caller.allows(status.Name) {
+			continue
+		}
+		payload := statusPayload(status, targetMap[status.Name], status.Health)
+		payload.Stats = a.latestStats(ctx, status.Name)
+		payload.Warnings = a.snapshotWarnings(ctx, status.Name)
+		payloads = append(payloads, payload)
 	}
 	_ = json.NewEncoder(w).Encode(payloads)
 }
@@ -238,6 +452,7 @@ func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
 // @Success 200 {object} statusResponse "Successful response with backup status"
 // @Failure 400 {string} string "Bad request - invalid maxage parameter"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Target not found"
 // @Failure 500 {string} string "Internal server error"
 // @Security BasicAuth
@@ -253,6 +468,9 @@ func (a *API) handleStatusByName(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "target name required", http.StatusBadRequest)
 		return
 	}
+	if !a.authorizeTarget(w, r, name) {
+		return
+	}
 
 	// Parse maxage query parameter (in hours)
 	var maxAgeHours int
@@ -292,13 +510,22 @@ func (a *API) handleStatusByName(w http.ResponseWriter, r *http.Request) {
 		maxAge := time.Duration(maxAgeHours) * time.Hour
 		age := time.Since(status.LatestBackup)
 		healthWithAge = status.Health && age <= maxAge
+		// The reachability check found the latest snapshot; rate it against maxage
+		if reachable(status) {
+			if err := status.SetComponent(store.Freshness(status.LatestBackup, time.Now(), 0, maxAge)); err != nil {
+				log.Printf("target %s: apply maxage: %v", name, err)
+			}
+		}
 	}
 
-	_ = json.NewEncoder(w).Encode(statusPayload(status, disabled, healthWithAge))
+	payload := statusPayload(status, disabled, healthWithAge)
+	payload.Stats = a.latestStats(ctx, name)
+	payload.Warnings = a.snapshotWarnings(ctx, name)
+	_ = json.NewEncoder(w).Encode(payload)
 }
 
 func statusPayload(status store.BackupStatus, disabled bool, health bool) statusResponse {
-	return statusResponse{
+	payload := statusResponse{
 		Name:             status.Name,
 		LatestBackup:     status.LatestBackup,
 		LatestSnapshotID: status.LatestSnapshotID,
@@ -308,7 +535,38 @@ func statusPayload(status store.BackupStatus, disabled bool, health bool) status
 		StatusMessage:    status.StatusMessage,
 		CheckedAt:        status.CheckedAt,
 		Disabled:         disabled,
+		Status:           status.Status,
+		Components:       []componentResponse{},
 	}
+	components, err := status.StatusComponents()
+	if err != nil {
+		log.Printf("target %s: decode status components: %v", status.Name, err)
+	}
+	for _, component := range components {
+		payload.Components = append(payload.Components, componentResponse(component))
+	}
+	if payload.Status == "" {
+		payload.Status = store.StatusUnknown
+	}
+	if disabled {
+		payload.Status = store.StatusDisabled
+	}
+	return payload
+}
+
+// reachable reports whether the last check could list the snapshots of the
+// target.
+func reachable(status store.BackupStatus) bool {
+	components, err := status.StatusComponents()
+	if err != nil {
+		return false
+	}
+	for _, component := range components {
+		if component.Name == store.ComponentReachability {
+			return component.Status == store.StatusOK
+		}
+	}
+	return false
 }
 
 type statusResponse struct {
@@ -321,6 +579,23 @@ type statusResponse struct {
 	StatusMessage    string    `json:"statusMessage" example:"restic check succeeded"`
 	CheckedAt        time.Time `json:"checkedAt" example:"2025-11-23T15:00:00Z"`
 	Disabled         bool      `json:"disabled" example:"false"`
+	// Status is ok, warning, critical, unknown or disabled: the worst of
+	// Components, or disabled for disabled targets. Health is kept for
+	// existing clients and only reflects restic check.
+	Status string `json:"status" example:"ok" enums:"ok,warning,critical,unknown,disabled"`
+	// Components rate reachability, integrity, freshness and lock state.
+	Components []componentResponse `json:"components"`
+	// Stats is the latest repository size sample, if any.
+	Stats *statsResponse `json:"stats,omitempty"`
+	// Warnings lists recent snapshots whose file count or size deviates
+	// from the ones before them. They do not affect Health.
+	Warnings []warningResponse `json:"warnings"`
+}
+
+type componentResponse struct {
+	Name    string `json:"name" example:"integrity" enums:"reachability,integrity,freshness,lock"`
+	Status  string `json:"status" example:"ok" enums:"ok,warning,critical,unknown"`
+	Message string `json:"message,omitempty" example:"check timed out"`
 }
 
 type snapshotResponse struct {
@@ -348,7 +623,9 @@ type fileResponse struct {
 // @Param name path string true "Name of the backup target"
 // @Success 200 {array} snapshotResponse "List of snapshots"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Target not found"
+// @Failure 429 {string} string "Too many requests"
 // @Failure 500 {string} string "Internal server error"
 // @Security BasicAuth
 // @Security BearerAuth
@@ -363,6 +640,9 @@ func (a *API) handleSnapshots(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "target name required", http.StatusBadRequest)
 		return
 	}
+	if !a.authorizeTarget(w, r, name) {
+		return
+	}
 
 	// Get target from database
 	targets, err := a.store.ListTargets(ctx)
@@ -384,22 +664,15 @@ func (a *API) handleSnapshots(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Execute restic snapshots command
-	cmd := exec.CommandContext(ctx, a.config.ResticBinary, "snapshots", "--json", "--no-lock")
-	cmd.Env = append(os.Environ(), a.envForTarget(*target)...)
-
-	out, err := cmd.CombinedOutput()
+	repo, err := target.ResticRepo()
 	if err != nil {
-		log.Printf("snapshots failed for %s: %v, output: %s", name, err, string(out))
-		http.Error(w, fmt.Sprintf("failed to get snapshots: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// Parse and return snapshots
-	var snapshots []map[string]interface{}
-	if err := json.Unmarshal(out, &snapshots); err != nil {
-		log.Printf("failed to parse snapshots JSON: %v", err)
-		http.Error(w, fmt.Sprintf("failed to parse snapshots: %v", err), http.StatusInternalServerError)
+	snapshots, err := a.runner.Snapshots(ctx, repo)
+	if err != nil {
+		log.Printf("snapshots failed for %s: %v", name, err)
+		http.Error(w, fmt.Sprintf("failed to get snapshots: %v", err), http.StatusInternalServerError)
 		return
 	}
 
@@ -415,6 +688,7 @@ func (a *API) handleSnapshots(w http.ResponseWriter, r *http.Request) {
 // @Param id path string true "Snapshot ID"
 // @Success 200 {array} fileResponse "List of files"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Snapshot file list not found"
 // @Failure 500 {string} string "Internal server error"
 // @Security BasicAuth
@@ -429,6 +703,9 @@ func (a *API) handleSnapshotFiles(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "snapshot ID required", http.StatusBadRequest)
 		return
 	}
+	if !a.authorizeSnapshot(w, r, snapshotID) {
+		return
+	}
 
 	// Read file list from public directory
 	filePath := fmt.Sprintf("%s/%s.txt", a.config.PublicDir, snapshotID)
@@ -461,15 +738,18 @@ func (a *API) handleSnapshotFiles(w http.ResponseWriter, r *http.Request) {
 
 // handleUnlock godoc
 // @Summary Unlock a repository
-// @Description Removes stale locks from a Restic repository
+// @Description Removes stale locks from a Restic repository, or every lock with all=true. The unlock is recorded in the target's unlock history.
 // @Tags Maintenance
 // @Accept json
 // @Produce json
 // @Param name path string true "Name of the backup target"
+// @Param all query bool false "Remove all locks, including the ones of running commands"
 // @Success 200 {object} map[string]string "Repository unlocked successfully"
 // @Failure 400 {string} string "Bad request"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Target not found"
+// @Failure 429 {string} string "Too many requests"
 // @Failure 500 {string} string "Unlock failed"
 // @Security BasicAuth
 // @Security BearerAuth
@@ -487,6 +767,9 @@ func (a *API) handleUnlock(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "target name required", http.StatusBadRequest)
 		return
 	}
+	if !a.authorizeTarget(w, r, name) {
+		return
+	}
 
 	// Get target from database
 	targets, err := a.store.ListTargets(ctx)
@@ -509,25 +792,31 @@ func (a *API) handleUnlock(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Run restic unlock
-	var unlockOutput string
-	if a.config.MockMode {
-		log.Printf("MOCK MODE - skipping restic unlock for target %s", name)
-		unlockOutput = "mock unlock successful"
-	} else {
-		log.Printf("unlocking repository for target %s", name)
-		cmd := exec.CommandContext(ctx, a.config.ResticBinary, "unlock")
-		cmd.Env = append(os.Environ(), a.envForTarget(*target)...)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("unlock failed for %s: %v, output: %s", name, err, string(out))
-			http.Error(w, fmt.Sprintf("unlock failed: %v\\n%s", err, string(out)), http.StatusInternalServerError)
-			return
-		}
-
-		log.Printf("successfully unlocked repository for target %s", name)
-		unlockOutput = strings.TrimSpace(string(out))
+	removeAll := r.URL.Query().Get("all") == "true"
+	log.Printf("unlocking repository for target %s (remove all: %v)", name, removeAll)
+	repo, err := target.ResticRepo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	locks, err := a.runner.Locks(ctx, repo)
+	if err != nil {
+		log.Printf("list locks of %s before unlock: %v", name, err)
+	}
+	unlockOutput, err := a.runner.Unlock(ctx, repo, removeAll)
+	event := store.UnlockData{TargetName: name, RemoveAll: removeAll, Locks: locks, Output: unlockOutput}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if _, recordErr := a.store.RecordUnlock(ctx, event); recordErr != nil {
+		log.Printf("record unlock of %s: %v", name, recordErr)
+	}
+	if err != nil {
+		log.Printf("unlock failed for %s: %v", name, err)
+		http.Error(w, fmt.Sprintf("unlock failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("successfully unlocked repository for target %s", name)
 
 	// Trigger immediate re-check of the repository
 	a.monitor.TriggerCheck(name)
@@ -542,15 +831,18 @@ func (a *API) handleUnlock(w http.ResponseWriter, r *http.Request) {
 
 // handlePrune godoc
 // @Summary Prune snapshots for a target or all targets
-// @Description Applies retention policy (restic forget) to remove old snapshots. Use "all" as the name to prune all targets.
+// @Description Applies retention policy (restic forget) to remove old snapshots. Use "all" as the name to prune all targets. With dry_run=true the output lists the snapshots that would be removed and nothing is changed.
 // @Tags Maintenance
 // @Accept json
 // @Produce json
 // @Param name path string true "Name of the backup target or 'all' for all targets"
+// @Param dry_run query bool false "Only report the snapshots that would be removed"
 // @Success 200 {object} map[string]interface{} "Prune operation completed successfully"
 // @Failure 400 {string} string "Bad request"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Target not found"
+// @Failure 429 {string} string "Too many requests"
 // @Failure 500 {string} string "Prune operation failed"
 // @Security BasicAuth
 // @Security BearerAuth
@@ -569,20 +861,45 @@ func (a *API) handlePrune(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if name != "all" && !a.authorizeTarget(w, r, name) {
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
 	w.Header().Set("Content-Type", "application/json")
 
 	if name == "all" {
-		// Prune all targets
+		// Prune all targets the caller may access
 		targets, err := a.store.ListTargets(ctx)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("list targets: %v", err), http.StatusInternalServerError)
 			return
 		}
+		caller := principalFrom(r)
+		targets = slices.DeleteFunc(targets, func(t store.Target) bool { return !caller.allows(t.Name) })
+		names := make([]string, 0, len(targets))
+		for _, target := range targets {
+			names = append(names, target.Name)
+		}
+		auditFrom(r).setParam("targets", names)
 
+		var failed []string
+		outputs := make(map[string]string, len(targets))
 		for _, target := range targets {
-			if err := a.pruneTarget(ctx, target); err != nil {
+			out, err := a.pruneTarget(ctx, target, dryRun)
+			if err != nil {
 				log.Printf("prune failed for %s: %v", target.Name, err)
+				failed = append(failed, target.Name)
+				continue
 			}
+			outputs[target.Name] = out
+		}
+		if len(failed) > 0 {
+			auditFrom(r).setParam("failed", failed)
+		}
+		if dryRun {
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": "dry run", "outputs": outputs, "failed": failed})
+			return
 		}
 
 		// Trigger re-check for all targets
@@ -614,21 +931,43 @@ func (a *API) handlePrune(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.pruneTarget(ctx, *target); err != nil {
+	out, err := a.pruneTarget(ctx, *target, dryRun)
+	if err != nil {
 		log.Printf("prune failed for %s: %v", name, err)
 		http.Error(w, fmt.Sprintf("prune failed: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if dryRun {
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "dry run", "output": out})
+		return
+	}
 
 	// Trigger immediate re-check
 	a.monitor.TriggerCheck(name)
 
-	_ = json.NewEncoder(w).Encode(map[string]string{"status": "pruned"})
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "pruned", "output": out})
 }
 
-func (a *API) pruneTarget(ctx context.Context, target store.Target) error {
-	log.Printf("pruning target %s with policy: keep-last=%d keep-daily=%d keep-weekly=%d keep-monthly=%d",
-		target.Name, target.KeepLast, target.KeepDaily, target.KeepWeekly, target.KeepMonthly)
+// pruneTarget runs restic forget on target and removes the file lists of
+// forgotten snapshots. A dry run only returns the output of forget.
+func (a *API) pruneTarget(ctx context.Context, target store.Target, dryRun bool) (string, error) {
+	log.Printf("pruning target %s with policy: keep-last=%d keep-daily=%d keep-weekly=%d keep-monthly=%d dry-run=%v",
+		target.Name, target.KeepLast, target.KeepDaily, target.KeepWeekly, target.KeepMonthly, dryRun)
+
+	repo, err := target.ResticRepo()
+	if err != nil {
+		return "", err
+	}
+	policy := restic.Policy{
+		KeepLast:    target.KeepLast,
+		KeepDaily:   target.KeepDaily,
+		KeepWeekly:  target.KeepWeekly,
+		KeepMonthly: target.KeepMonthly,
+		DryRun:      dryRun,
+	}
+	if dryRun {
+		return a.runner.Forget(ctx, repo, policy)
+	}
 
 	// Get snapshot IDs before pruning
 	snapshotsBefore, err := a.getSnapshotIDs(ctx, target)
@@ -638,39 +977,12 @@ func (a *API) pruneTarget(ctx context.Context, target store.Target) error {
 	}
 
 	// Execute restic forget with prune policy
-	if a.config.MockMode {
-		log.Printf("MOCK MODE - skipping restic forget for target %s", target.Name)
-	} else {
-		timeoutCtx, cancel := context.WithTimeout(ctx, a.config.ResticTimeout*3) // Prune can take longer
-		defer cancel()
-
-		args := []string{"forget", "--verbose"}
-
-		// Add retention policy flags
-		if target.KeepLast > 0 {
-			args = append(args, "--keep-last", fmt.Sprintf("%d", target.KeepLast))
-		}
-		if target.KeepDaily > 0 {
-			args = append(args, "--keep-daily", fmt.Sprintf("%d", target.KeepDaily))
-		}
-		if target.KeepWeekly > 0 {
-			args = append(args, "--keep-weekly", fmt.Sprintf("%d", target.KeepWeekly))
-		}
-		if target.KeepMonthly > 0 {
-			args = append(args, "--keep-monthly", fmt.Sprintf("%d", target.KeepMonthly))
-		}
-
-		cmd := exec.CommandContext(timeoutCtx, a.config.ResticBinary, args...)
-		cmd.Env = append(os.Environ(), a.envForTarget(target)...)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			log.Printf("forget failed for %s: %v, output: %s", target.Name, err, string(out))
-			return fmt.Errorf("restic forget: %w", err)
-		}
-
-		log.Printf("forget completed for %s, output: %s", target.Name, string(out))
+	out, err := a.runner.Forget(ctx, repo, policy)
+	if err != nil {
+		log.Printf("forget failed for %s: %v", target.Name, err)
+		return "", err
 	}
+	log.Printf("forget completed for %s, output: %s", target.Name, out)
 
 	// Get snapshot IDs after pruning
 	snapshotsAfter, err := a.getSnapshotIDs(ctx, target)
@@ -722,32 +1034,24 @@ func (a *API) pruneTarget(ctx context.Context, target store.Target) error {
 		}
 	}
 
-	return nil
+	return out, nil
 }
 
-// getSnapshotIDs returns all snapshot IDs for a target
+// getSnapshotIDs returns the short IDs of all snapshots of a target, which
+// name the file lists in the public directory.
 func (a *API) getSnapshotIDs(ctx context.Context, target store.Target) ([]string, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, a.config.ResticTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(timeoutCtx, a.config.ResticBinary, "snapshots", "--json", "--no-lock")
-	cmd.Env = append(os.Environ(), a.envForTarget(target)...)
-
-	out, err := cmd.CombinedOutput()
+	repo, err := target.ResticRepo()
 	if err != nil {
-		return nil, fmt.Errorf("restic snapshots: %w", err)
+		return nil, err
 	}
-
-	var snapshots []struct {
-		ID string `json:"id"`
-	}
-	if err := json.Unmarshal(out, &snapshots); err != nil {
-		return nil, fmt.Errorf("unmarshal snapshots: %w", err)
+	snapshots, err := a.runner.Snapshots(ctx, repo)
+	if err != nil {
+		return nil, err
 	}
 
 	ids := make([]string, len(snapshots))
 	for i, s := range snapshots {
-		ids[i] = s.ID
+		ids[i] = s.ShortID
 	}
 
 	return ids, nil
@@ -763,6 +1067,7 @@ func (a *API) getSnapshotIDs(ctx context.Context, target store.Target) ([]string
 // @Success 200 {object} map[string]interface{} "Target state toggled successfully"
 // @Failure 400 {string} string "Bad request"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 404 {string} string "Target not found"
 // @Failure 500 {string} string "Internal server error"
 // @Security BasicAuth
@@ -781,6 +1086,9 @@ func (a *API) handleToggleDisabled(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "target name required", http.StatusBadRequest)
 		return
 	}
+	if !a.authorizeTarget(w, r, name) {
+		return
+	}
 
 	if err := a.store.ToggleTargetDisabled(ctx, name); err != nil {
 		log.Printf("toggle disabled failed for %s: %v", name, err)
@@ -794,22 +1102,18 @@ func (a *API) handleToggleDisabled(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"status": "toggled"})
 }
 
-func (a *API) envForTarget(target store.Target) []string {
-	env := []string{fmt.Sprintf("RESTIC_REPOSITORY=%s", target.Repository)}
-	if target.Password != "" {
-		env = append(env, fmt.Sprintf("RESTIC_PASSWORD=%s", target.Password))
-	}
-	if target.PasswordFile != "" {
-		env = append(env, fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", target.PasswordFile))
-	}
-	cert := target.CertificateFile
-	if cert == "" {
-		cert = a.config.CertificateFile
+// resolveCredentials returns the repository credentials of target with every
+// secret reference replaced by the secret it points to.
+func (a *API) resolveCredentials(ctx context.Context, target store.Target) (restic.Credentials, error) {
+	creds, err := target.ResticCredentials()
+	if err != nil {
+		return creds, err
 	}
-	if cert != "" {
-		env = append(env, fmt.Sprintf("RESTIC_CACERT=%s", cert))
+	creds, err = restic.Resolve(ctx, a.resolver, creds)
+	if err != nil {
+		return creds, fmt.Errorf("target %s: resolve credentials: %w", target.Name, err)
 	}
-	return env
+	return creds, nil
 }
 
 func (a *API) handleSwaggerSpec(w http.ResponseWriter, r *http.Request) {
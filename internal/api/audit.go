@@ -0,0 +1,409 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	// auditErrorLimit truncates recorded error responses.
+	auditErrorLimit = 500
+)
+
+// auditRecord collects the details of an audited request. authMiddleware
+// sets the actor; handlers add the target and parameters from the body.
+// All methods accept a nil record, for requests that are not audited.
+type auditRecord struct {
+	actor  string
+	target string
+	params map[string]any
+}
+
+type auditKey struct{}
+
+func auditFrom(r *http.Request) *auditRecord {
+	rec, _ := r.Context().Value(auditKey{}).(*auditRecord)
+	return rec
+}
+
+func (rec *auditRecord) setActor(actor string) {
+	if rec != nil {
+		rec.actor = actor
+	}
+}
+
+func (rec *auditRecord) setTarget(target string) {
+	if rec != nil {
+		rec.target = target
+	}
+}
+
+func (rec *auditRecord) setParam(key string, value any) {
+	if rec != nil {
+		rec.params[key] = value
+	}
+}
+
+// auditedAction returns the audit action and target of a request, or false
+// for requests that do not change state. Agent traffic is recorded in the
+// tasks instead.
+func auditedAction(r *http.Request) (action, target string, ok bool) {
+	switch r.URL.Path {
+	case "/auth/callback":
+		return "login", "", true
+	case "/auth/logout":
+		return "logout", "", true
+	case "/api/v1/export", "/api/v1/backup":
+		return strings.TrimPrefix(r.URL.Path, "/api/v1/"), "", true
+	}
+
+	rest, isAPI := strings.CutPrefix(r.URL.Path, "/api/v1/")
+	if !isAPI || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || isAgentRoute(r) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	name := ""
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+
+	switch parts[0] {
+	case "unlock", "prune", "toggle", "check", "import":
+		return parts[0], name, true
+	case "targets":
+		if r.Method == http.MethodDelete {
+			return "target.delete", name, true
+		}
+		return "target.save", "", true
+	case "agents":
+		if name == "register" {
+			return "agent.register", "", true
+		}
+		return "task.enqueue", "", true
+	case "users":
+		return "user." + map[string]string{
+			http.MethodPost:   "create",
+			http.MethodPut:    "update",
+			http.MethodDelete: "delete",
+		}[r.Method], "", true
+	case "tokens":
+		if r.Method == http.MethodDelete {
+			return "token.revoke", "", true
+		}
+		return "token.create", "", true
+	}
+	return strings.ToLower(r.Method) + "." + parts[0], name, true
+}
+
+// auditMiddleware records every state-changing request with its actor,
+// source, outcome and duration.
+func (a *API) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, target, ok := auditedAction(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &auditRecord{target: target, params: make(map[string]any)}
+		for key, values := range r.URL.Query() {
+			// OAuth codes and states are single-use secrets
+			if key == "code" || key == "state" {
+				continue
+			}
+			rec.params[key] = strings.Join(values, ",")
+		}
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+
+		data := store.AuditData{
+			Time:         start,
+			Actor:        rec.actor,
+			Source:       remoteHost(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Action:       action,
+			Target:       rec.target,
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Parameters:   rec.params,
+			Outcome:      auditOutcome(recorder.status),
+			StatusCode:   recorder.status,
+			Duration:     time.Since(start),
+		}
+		if recorder.status >= http.StatusBadRequest {
+			data.Error = strings.TrimSpace(recorder.body.String())
+		}
+		if _, err := a.store.RecordAudit(context.WithoutCancel(r.Context()), data); err != nil {
+			log.Printf("record audit entry for %s: %v", action, err)
+		}
+	})
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return store.OutcomeDenied
+	case status >= http.StatusBadRequest:
+		return store.OutcomeFailure
+	}
+	return store.OutcomeSuccess
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditResponseWriter captures the status and the start of error responses.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   strings.Builder
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	if w.status >= http.StatusBadRequest && w.body.Len() < auditErrorLimit {
+		w.body.Write(p[:min(len(p), auditErrorLimit-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type auditResponse struct {
+	ID           uint           `json:"id" example:"42"`
+	Time         time.Time      `json:"time" example:"2025-11-23T14:30:00Z"`
+	Actor        string         `json:"actor" example:"alice"`
+	Source       string         `json:"source" example:"192.0.2.10"`
+	ForwardedFor string         `json:"forwardedFor,omitempty" example:"198.51.100.7"`
+	Action       string         `json:"action" example:"prune"`
+	Target       string         `json:"target,omitempty" example:"home"`
+	Method       string         `json:"method,omitempty" example:"POST"`
+	Path         string         `json:"path,omitempty" example:"/api/v1/prune/home"`
+	Parameters   map[string]any `json:"parameters,omitempty"`
+	Outcome      string         `json:"outcome" example:"success"`
+	StatusCode   int            `json:"statusCode,omitempty" example:"200"`
+	Error        string         `json:"error,omitempty"`
+	DurationMs   int64          `json:"durationMs" example:"5230"`
+}
+
+type auditPageResponse struct {
+	Total   int64           `json:"total" example:"1234"`
+	Limit   int             `json:"limit" example:"100"`
+	Offset  int             `json:"offset" example:"0"`
+	Entries []auditResponse `json:"entries"`
+}
+
+func auditPayload(entry store.AuditEntry) auditResponse {
+	params, err := entry.AuditParameters()
+	if err != nil {
+		log.Printf("decode parameters of audit entry %d: %v", entry.ID, err)
+	}
+	return auditResponse{
+		ID:           entry.ID,
+		Time:         entry.Time,
+		Actor:        entry.Actor,
+		Source:       entry.Source,
+		ForwardedFor: entry.ForwardedFor,
+		Action:       entry.Action,
+		Target:       entry.Target,
+		Method:       entry.Method,
+		Path:         entry.Path,
+		Parameters:   params,
+		Outcome:      entry.Outcome,
+		StatusCode:   entry.StatusCode,
+		Error:        entry.Error,
+		DurationMs:   entry.DurationMs,
+	}
+}
+
+// parseAuditFilter reads the filter query parameters shared by the audit
+// list and export.
+func parseAuditFilter(r *http.Request) (store.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := store.AuditFilter{
+		Actor:   query.Get("actor"),
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+	}
+	now := time.Now()
+	if since := query.Get("since"); since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since parameter: %w", err)
+		}
+		filter.Since = t
+	}
+	if until := query.Get("until"); until != "" {
+		t, err := parseSince(until, now)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until parameter: %w", err)
+		}
+		filter.Until = t
+	}
+	return filter, nil
+}
+
+// handleAudit godoc
+// @Summary List audit entries
+// @Description Returns state-changing requests and background actions, newest first. Filter by actor, action, target, outcome and time range; page with limit and offset. Requires the admin role.
+// @Tags Audit
+// @Produce json
+// @Param actor query string false "Only entries of this actor"
+// @Param action query string false "Only this action, e.g. prune"
+// @Param target query string false "Only entries for this target"
+// @Param outcome query string false "success, failure or denied"
+// @Param since query string false "Start as RFC 3339 time or duration before now (e.g. 24h)"
+// @Param until query string false "End as RFC 3339 time or duration before now"
+// @Param limit query int false "Maximum number of entries (default 100, at most 1000)"
+// @Param offset query int false "Number of entries to skip"
+// @Success 200 {object} auditPageResponse "Audit entries"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /audit [get]
+func (a *API) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.TrimPrefix(r.URL.Path, "/api/v1/audit") == "/export" {
+		a.handleAuditExport(w, r)
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = defaultAuditLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 || parsed > maxAuditLimit {
+			http.Error(w, fmt.Sprintf("invalid limit parameter, must be between 1 and %d", maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		parsed, err := strconv.Atoi(offsetStr)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid offset parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = parsed
+	}
+
+	entries, total, err := a.store.ListAudit(r.Context(), filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list audit entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	page := auditPageResponse{
+		Total:   total,
+		Limit:   filter.Limit,
+		Offset:  filter.Offset,
+		Entries: make([]auditResponse, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		page.Entries = append(page.Entries, auditPayload(entry))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// handleAuditExport godoc
+// @Summary Export audit entries
+// @Description Downloads all matching audit entries as a JSON array, newest first. Takes the same filters as /audit without paging. Requires the admin role.
+// @Tags Audit
+// @Produce json
+// @Param actor query string false "Only entries of this actor"
+// @Param action query string false "Only this action, e.g. prune"
+// @Param target query string false "Only entries for this target"
+// @Param outcome query string false "success, failure or denied"
+// @Param since query string false "Start as RFC 3339 time or duration before now (e.g. 720h)"
+// @Param until query string false "End as RFC 3339 time or duration before now"
+// @Success 200 {array} auditResponse "Audit entries"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /audit/export [get]
+func (a *API) handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Read in pages so large exports do not load the whole log at once.
+	// Entries recorded during the export would shift the pages, so the
+	// export ends at its start.
+	ctx := r.Context()
+	if filter.Until.IsZero() {
+		filter.Until = time.Now()
+	}
+	filter.Limit = maxAuditLimit
+	entries, _, err := a.store.ListAudit(ctx, filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list audit entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.json"`, time.Now().UTC().Format("20060102-150405")))
+	enc := json.NewEncoder(w)
+	_, _ = w.Write([]byte("["))
+	for first := true; ; {
+		for _, entry := range entries {
+			if !first {
+				_, _ = w.Write([]byte(","))
+			}
+			_ = enc.Encode(auditPayload(entry))
+			first = false
+		}
+		if len(entries) < filter.Limit {
+			break
+		}
+		filter.Offset += filter.Limit
+		if entries, _, err = a.store.ListAudit(ctx, filter); err != nil {
+			// Headers are sent; end with invalid JSON rather than a silently
+			// truncated export
+			log.Printf("export audit entries: %v", err)
+			return
+		}
+	}
+	_, _ = w.Write([]byte("]\n"))
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Name string
+	Role string
+	// Targets limits the caller to these targets; empty means all.
+	Targets []string
+	// Scopes are set for API tokens, which are authorized by scope instead
+	// of role.
+	Scopes []string
+}
+
+// allows reports whether the principal may access the named target.
+func (p principal) allows(target string) bool {
+	return len(p.Targets) == 0 || slices.Contains(p.Targets, target)
+}
+
+type principalKey struct{}
+
+// anonymous is the principal of requests when authentication is not
+// configured: everything is allowed, as before users existed.
+var anonymous = principal{Name: "anonymous", Role: store.RoleAdmin}
+
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller of r as set by authMiddleware. Requests
+// that did not pass through it have no role.
+func principalFrom(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+// authRequired reports whether requests must authenticate: AUTH_* or OIDC
+// is set or at least one user exists.
+func (a *API) authRequired(ctx context.Context) bool {
+	if (a.config.AuthUsername != "" && a.config.AuthPassword != "") || a.config.AuthToken != "" || a.oidc != nil {
+		return true
+	}
+	count, err := a.store.CountUsers(ctx)
+	if err != nil {
+		// Fail closed
+		log.Printf("count users: %v", err)
+		return true
+	}
+	return count > 0
+}
+
+// authenticate returns the principal of the request's credentials. The
+// AUTH_TOKEN bearer token and the AUTH_USERNAME user are admins; other
+// bearer tokens are API tokens.
+func (a *API) authenticate(r *http.Request) (principal, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.config.AuthToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AuthToken)) == 1 {
+			return principal{Name: "token", Role: store.RoleAdmin}, true
+		}
+		return a.authenticateToken(r.Context(), token)
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return principal{}, false
+	}
+	if a.config.AuthUsername != "" && a.config.AuthPassword != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(a.config.AuthUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(a.config.AuthPassword)) == 1 {
+		return principal{Name: username, Role: store.RoleAdmin}, true
+	}
+
+	user, err := a.store.GetUser(r.Context(), username)
+	if err != nil {
+		if !errors.Is(err, store.ErrUserNotFound) {
+			log.Printf("load user %s: %v", username, err)
+		}
+		return principal{}, false
+	}
+	if user.Disabled || !a.verifyPassword(user, password) {
+		return principal{}, false
+	}
+	targets, err := user.TargetNames()
+	if err != nil {
+		log.Printf("decode targets of user %s: %v", username, err)
+		return principal{}, false
+	}
+	return principal{Name: user.Username, Role: user.Role, Targets: targets}, true
+}
+
+// verifyPassword checks password against the user's hash. Successful
+// checks are remembered by a digest of hash and password, so the dashboard
+// polling with Basic Auth does not pay for the key derivation every time.
+func (a *API) verifyPassword(user store.User, password string) bool {
+	digest := sha256.Sum256([]byte(user.PasswordHash + "\x00" + password))
+	if cached, ok := a.verified.Load(user.Username); ok {
+		want := cached.([sha256.Size]byte)
+		if subtle.ConstantTimeCompare(digest[:], want[:]) == 1 {
+			return true
+		}
+	}
+	if !store.VerifyPassword(user.PasswordHash, password) {
+		return false
+	}
+	a.verified.Store(user.Username, digest)
+	return true
+}
+
+// noScope marks routes that API tokens cannot use.
+const noScope = ""
+
+// require wraps a handler that needs at least the given role, or the given
+// scope for API tokens.
+func (a *API) require(role, scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorize(w, r, role, scope) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorize writes 403 and returns false unless the caller has role, or
+// is an API token with scope.
+func (a *API) authorize(w http.ResponseWriter, r *http.Request, role, scope string) bool {
+	p := principalFrom(r)
+	if p.Scopes != nil {
+		if scope == noScope {
+			http.Error(w, "Forbidden: not available to API tokens", http.StatusForbidden)
+			return false
+		}
+		if !slices.Contains(p.Scopes, scope) {
+			http.Error(w, fmt.Sprintf("Forbidden: %s scope required", scope), http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if !store.RoleAllows(p.Role, role) {
+		http.Error(w, fmt.Sprintf("Forbidden: %s role required", role), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeTarget writes 403 and returns false unless the caller may access
+// the named target.
+func (a *API) authorizeTarget(w http.ResponseWriter, r *http.Request, name string) bool {
+	if !principalFrom(r).allows(name) {
+		http.Error(w, fmt.Sprintf("Forbidden: no access to target %s", name), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeSnapshot writes 403 and returns false unless the snapshot is the
+// latest of a target the caller may access; file lists are only kept for
+// the latest snapshots.
+func (a *API) authorizeSnapshot(w http.ResponseWriter, r *http.Request, snapshotID string) bool {
+	p := principalFrom(r)
+	if len(p.Targets) == 0 {
+		return true
+	}
+	statuses, err := a.store.ListStatuses(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	for _, status := range statuses {
+		if status.LatestSnapshotID == snapshotID && p.allows(status.Name) {
+			return true
+		}
+	}
+	http.Error(w, fmt.Sprintf("Forbidden: no access to snapshot %s", snapshotID), http.StatusForbidden)
+	return false
+}
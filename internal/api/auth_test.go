@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// fakeMonitor records the checks the API triggers.
+type fakeMonitor struct {
+	mu     sync.Mutex
+	checks []string
+}
+
+func (m *fakeMonitor) TriggerCheck(targetName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks = append(m.checks, targetName)
+}
+
+// testUsers are created by newTestAPI; every password is
+// "<username>-password".
+var testUsers = []store.UserData{
+	{Username: "ada", Role: store.RoleAdmin},
+	{Username: "otto", Role: store.RoleOperator, Targets: []string{"home"}},
+	{Username: "vera", Role: store.RoleViewer},
+}
+
+// newTestAPI returns the handler of an API with a temporary SQLite store
+// holding the testUsers and the targets home and away with a status.
+func newTestAPI(t *testing.T, cfg config.Config) (*API, http.Handler, *store.Store) {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "monitor.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	ctx := context.Background()
+	err = st.UpsertTargets(ctx, []store.TargetData{
+		{Name: "home", Repository: "/srv/restic/home", Password: "secret"},
+		{Name: "away", Repository: "/srv/restic/away", Password: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("create targets: %v", err)
+	}
+	for _, name := range []string{"home", "away"} {
+		if err := st.SaveStatus(ctx, store.StatusData{Name: name, Repository: "/srv/restic/" + name, Health: true}); err != nil {
+			t.Fatalf("save status of %s: %v", name, err)
+		}
+	}
+	for _, user := range testUsers {
+		user.Password = user.Username + "-password"
+		if _, err := st.CreateUser(ctx, user); err != nil {
+			t.Fatalf("create user %s: %v", user.Username, err)
+		}
+	}
+	a := New(cfg, st, &fakeMonitor{}, restic.NewFake(), "")
+	return a, a.Handler(), st
+}
+
+// request builds an API request; a user name authenticates it with Basic
+// Auth and the password of testUsers.
+func request(method, path, user, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, path, reader)
+	if user != "" {
+		r.SetBasicAuth(user, user+"-password")
+	}
+	return r
+}
+
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRoles(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{})
+
+	for _, tc := range []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"", http.MethodGet, "/api/v1/status", "", http.StatusUnauthorized},
+		{"vera", http.MethodGet, "/api/v1/status", "", http.StatusOK},
+		{"vera", http.MethodGet, "/api/v1/status/away", "", http.StatusOK},
+
+		// Viewers cannot change anything
+		{"vera", http.MethodPost, "/api/v1/check/home", "", http.StatusForbidden},
+		{"vera", http.MethodPost, "/api/v1/prune/home", "", http.StatusForbidden},
+		{"vera", http.MethodPost, "/api/v1/unlock/home", "", http.StatusForbidden},
+		{"vera", http.MethodPost, "/api/v1/toggle/home", "", http.StatusForbidden},
+		{"vera", http.MethodPost, "/api/v1/targets", `{"name": "new", "repository": "/srv/restic/new", "password": "secret"}`, http.StatusForbidden},
+		{"vera", http.MethodDelete, "/api/v1/targets/home", "", http.StatusForbidden},
+
+		// Operators are limited to their targets
+		{"otto", http.MethodPost, "/api/v1/check/home", "", http.StatusAccepted},
+		{"otto", http.MethodPost, "/api/v1/check/away", "", http.StatusForbidden},
+		{"otto", http.MethodGet, "/api/v1/status/home", "", http.StatusOK},
+		{"otto", http.MethodGet, "/api/v1/status/away", "", http.StatusForbidden},
+		{"otto", http.MethodPost, "/api/v1/toggle/away", "", http.StatusForbidden},
+		{"otto", http.MethodDelete, "/api/v1/targets/home", "", http.StatusForbidden},
+
+		// Admin-only routes
+		{"otto", http.MethodGet, "/api/v1/users", "", http.StatusForbidden},
+		{"otto", http.MethodGet, "/api/v1/tokens", "", http.StatusForbidden},
+		{"otto", http.MethodGet, "/api/v1/audit", "", http.StatusForbidden},
+		{"otto", http.MethodGet, "/api/v1/export", "", http.StatusForbidden},
+		{"vera", http.MethodGet, "/api/v1/users", "", http.StatusForbidden},
+		{"ada", http.MethodGet, "/api/v1/users", "", http.StatusOK},
+		{"ada", http.MethodGet, "/api/v1/tokens", "", http.StatusOK},
+		{"ada", http.MethodGet, "/api/v1/audit", "", http.StatusOK},
+		{"ada", http.MethodGet, "/api/v1/export", "", http.StatusOK},
+		{"ada", http.MethodPost, "/api/v1/check/away", "", http.StatusAccepted},
+		{"ada", http.MethodPost, "/api/v1/targets", `{"name": "new", "repository": "/srv/restic/new", "password": "secret"}`, http.StatusOK},
+	} {
+		t.Run(tc.user+" "+tc.method+" "+tc.path, func(t *testing.T) {
+			w := serve(h, request(tc.method, tc.path, tc.user, tc.body))
+			if w.Code != tc.want {
+				t.Errorf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tc.want)
+			}
+		})
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{})
+
+	r := request(http.MethodGet, "/api/v1/status", "", "")
+	r.SetBasicAuth("ada", "guess")
+	if w := serve(h, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
+
+func TestTargetListingFollowsAssignment(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{})
+
+	for user, want := range map[string][]string{"otto": {"home"}, "vera": {"away", "home"}} {
+		w := serve(h, request(http.MethodGet, "/api/v1/targets", user, ""))
+		var targets []targetResponse
+		if err := json.NewDecoder(w.Body).Decode(&targets); err != nil {
+			t.Fatalf("%s: decode targets: %v", user, err)
+		}
+		var names []string
+		for _, target := range targets {
+			names = append(names, target.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Errorf("%s sees targets %v, want %v", user, names, want)
+		}
+	}
+}
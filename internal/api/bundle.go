@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// handleExport godoc
+// @Summary Export the configuration
+// @Description Downloads targets with their retention and unlock policies and users with their roles as a versioned JSON bundle. Secrets are excluded by default; "encrypted" seals them with the master key of the server. Plaintext exports are only available through restic-monitor-admin. Requires the admin role.
+// @Tags Backup
+// @Produce json
+// @Param secrets query string false "excluded (default) or encrypted"
+// @Success 200 {object} store.Bundle "Configuration bundle"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /export [get]
+func (a *API) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.URL.Query().Get("secrets")
+	if mode == "" {
+		mode = store.SecretsExcluded
+	}
+	auditFrom(r).setParam("secrets", mode)
+	// A response would carry every password and credential in the clear
+	if mode != store.SecretsExcluded && mode != store.SecretsEncrypted {
+		http.Error(w, fmt.Sprintf("secrets must be %s or %s; use restic-monitor-admin export for plaintext", store.SecretsExcluded, store.SecretsEncrypted), http.StatusBadRequest)
+		return
+	}
+
+	bundle, err := a.store.ExportBundle(r.Context(), mode, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("export: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("configuration exported by %s with secrets %s", principalFrom(r).Name, mode)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="restic-monitor-%s.json"`, bundle.ExportedAt.Format("20060102-150405")))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(bundle)
+}
+
+// handleImport godoc
+// @Summary Import the configuration
+// @Description Creates or updates the targets and users of a bundle from /export in one transaction; other targets and users are kept. Encrypted bundles must be sealed with the master key of the server. Without secrets in the bundle the stored ones are kept. Requires the admin role.
+// @Tags Backup
+// @Accept json
+// @Produce json
+// @Param bundle body store.Bundle true "Configuration bundle"
+// @Success 200 {object} store.ImportResult "Bundle imported"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /import [post]
+func (a *API) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var bundle store.Bundle
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&bundle); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	auditFrom(r).setParam("secrets", bundle.Secrets)
+
+	ctx := r.Context()
+	result, err := a.store.ImportBundle(ctx, bundle, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("import: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("configuration imported by %s: %d targets, %d users", principalFrom(r).Name, result.Targets, result.Users)
+	for _, target := range bundle.Targets {
+		if !target.Disabled {
+			a.monitor.TriggerCheck(target.Name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleBackup godoc
+// @Summary Back up the database
+// @Description Downloads a consistent copy of the SQLite database taken with the online backup API while the monitor keeps running. PostgreSQL databases are backed up with pg_dump instead. Requires the admin role.
+// @Tags Backup
+// @Produce octet-stream
+// @Success 200 {file} file "SQLite database"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Failure 501 {string} string "Database is not SQLite"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /backup [get]
+func (a *API) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if dialect := a.store.Dialect(); dialect != "sqlite" {
+		http.Error(w, fmt.Sprintf("online backup supports SQLite only, back up %s databases with pg_dump", dialect), http.StatusNotImplemented)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "restic-monitor-backup")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("backup: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.db")
+	if err := a.store.Backup(r.Context(), path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("backup: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	log.Printf("database backup downloaded by %s", principalFrom(r).Name)
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="restic-monitor-%s.db"`, now.Format("20060102-150405")))
+	http.ServeContent(w, r, "", now, file)
+}
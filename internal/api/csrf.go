@@ -0,0 +1,74 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/example/restic-monitor/internal/oidc"
+)
+
+const (
+	// csrfCookie holds the CSRF token the dashboard echoes in csrfHeader.
+	// It is readable by scripts of the dashboard's origin only.
+	csrfCookie = "rm_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfMiddleware protects browser sessions against cross-site requests with
+// a double-submit token: every response sets the rm_csrf cookie if missing,
+// and state-changing API requests from browsers must repeat it in the
+// X-CSRF-Token header. A foreign page can make the browser send cookies and
+// cached Basic Auth credentials, but can neither read the cookie nor set
+// the header. Bearer tokens are never sent automatically and are exempt,
+// as are clients that are not browsers.
+func (a *API) csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookie)
+		if err != nil || cookie.Value == "" {
+			token, err := oidc.RandomString()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookie,
+				Value:    token,
+				Path:     "/",
+				Secure:   a.secureCookies(r),
+				SameSite: http.SameSiteStrictMode,
+			})
+			cookie = nil
+		}
+
+		if needsCSRFToken(r) {
+			header := r.Header.Get(csrfHeader)
+			if cookie == nil || header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+				http.Error(w, "Forbidden: missing or invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// needsCSRFToken reports whether r is a state-changing API request sent by
+// a browser without a bearer token. Browsers send Origin with every POST,
+// PUT and DELETE and Sec-Fetch-Site with every request; session cookies
+// only come from browsers.
+func needsCSRFToken(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/") || isAgentRoute(r) {
+		return false
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return false
+	}
+	if _, err := r.Cookie(sessionCookie); err == nil {
+		return true
+	}
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != ""
+}
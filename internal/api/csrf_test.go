@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+const dashboardOrigin = "https://monitor.example.com"
+
+func TestCSRF(t *testing.T) {
+	_, h, st := newTestAPI(t, config.Config{AuthToken: "admin-token"})
+	session := "session-token"
+	if _, err := st.CreateSession(context.Background(), store.SessionData{Username: "ada", Role: store.RoleAdmin, TTL: time.Hour}, hashToken(session)); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	withSession := func(r *http.Request) *http.Request {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+		return r
+	}
+	withCSRF := func(r *http.Request, cookie, header string) *http.Request {
+		r.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+		if header != "" {
+			r.Header.Set(csrfHeader, header)
+		}
+		return r
+	}
+	check := func() *http.Request { return request(http.MethodPost, "/api/v1/check/home", "", "") }
+
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"session without token", withSession(check()), http.StatusForbidden},
+		{"session with the cookie only", withCSRF(withSession(check()), "abc", ""), http.StatusForbidden},
+		{"session with a mismatched token", withCSRF(withSession(check()), "abc", "abd"), http.StatusForbidden},
+		{"session with the token", withCSRF(withSession(check()), "abc", "abc"), http.StatusAccepted},
+		{"session reading", withSession(request(http.MethodGet, "/api/v1/status", "", "")), http.StatusOK},
+		{"bearer from a browser", func() *http.Request {
+			r := bearer(check(), "admin-token")
+			r.Header.Set("Origin", "https://evil.example.com")
+			return r
+		}(), http.StatusAccepted},
+		{"basic from a script", request(http.MethodPost, "/api/v1/check/home", "ada", ""), http.StatusAccepted},
+		{"basic from a browser", func() *http.Request {
+			r := request(http.MethodPost, "/api/v1/check/home", "ada", "")
+			r.Header.Set("Sec-Fetch-Site", "cross-site")
+			return r
+		}(), http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(h, tc.req); w.Code != tc.want {
+				t.Errorf("status = %d (%s), want %d", w.Code, w.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestCSRFCookieIssued(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{})
+
+	w := serve(h, request(http.MethodGet, "/api/v1/status", "vera", ""))
+	var issued *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == csrfCookie {
+			issued = cookie
+		}
+	}
+	if issued == nil || issued.Value == "" || issued.HttpOnly || issued.SameSite != http.SameSiteStrictMode {
+		t.Errorf("CSRF cookie = %+v, want a strict cookie readable by the dashboard", issued)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{
+		CORSAllowedOrigins: []string{dashboardOrigin},
+		CORSAllowedMethods: "GET, POST",
+		CORSAllowedHeaders: "Authorization, Content-Type, X-CSRF-Token",
+	})
+	fromOrigin := func(method, origin string) *http.Request {
+		r := request(method, "/api/v1/status", "vera", "")
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		return r
+	}
+
+	w := serve(h, fromOrigin(http.MethodGet, dashboardOrigin))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != dashboardOrigin {
+		t.Errorf("allowed origin echoed as %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("credentials not allowed for the dashboard origin")
+	}
+
+	w = serve(h, fromOrigin(http.MethodOptions, dashboardOrigin))
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") != "GET, POST" {
+		t.Errorf("preflight = %d %v", w.Code, w.Header())
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		w := serve(h, fromOrigin(method, "https://evil.example.com"))
+		for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Allow-Methods"} {
+			if got := w.Header().Get(header); got != "" {
+				t.Errorf("%s from a disallowed origin: %s = %q", method, header, got)
+			}
+		}
+		if method == http.MethodOptions && w.Code != http.StatusForbidden {
+			t.Errorf("preflight from a disallowed origin = %d, want 403", w.Code)
+		}
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{CORSAllowedOrigins: []string{"*"}})
+
+	r := request(http.MethodGet, "/api/v1/status", "vera", "")
+	r.Header.Set("Origin", "https://any.example.com")
+	w := serve(h, r)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("wildcard headers = %v, want * without credentials", w.Header())
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/restic"
+)
+
+// unlockHistoryLimit is the number of unlock events returned with the locks.
+const unlockHistoryLimit = 20
+
+type locksResponse struct {
+	Target string `json:"target" example:"home"`
+	// AutoUnlockAfter is the stale lock threshold, empty when disabled.
+	AutoUnlockAfter string           `json:"autoUnlockAfter" example:"2h0m0s"`
+	Locks           []lockResponse   `json:"locks"`
+	Unlocks         []unlockResponse `json:"unlocks"`
+}
+
+type lockResponse struct {
+	ID         string    `json:"id" example:"5f2a9c1d"`
+	Time       time.Time `json:"time" example:"2025-11-23T14:30:00Z"`
+	AgeSeconds int64     `json:"ageSeconds" example:"7200"`
+	Exclusive  bool      `json:"exclusive" example:"true"`
+	Hostname   string    `json:"hostname" example:"myserver"`
+	Username   string    `json:"username" example:"root"`
+	PID        int       `json:"pid" example:"4242"`
+}
+
+type unlockResponse struct {
+	ID        uint           `json:"id" example:"7"`
+	Automatic bool           `json:"automatic" example:"true"`
+	RemoveAll bool           `json:"removeAll" example:"true"`
+	Locks     []lockResponse `json:"locks"`
+	Output    string         `json:"output" example:"1 locks have been removed"`
+	Error     string         `json:"error,omitempty"`
+	Time      time.Time      `json:"time" example:"2025-11-23T16:30:00Z"`
+}
+
+func lockPayloads(locks []restic.Lock, now time.Time) []lockResponse {
+	payloads := make([]lockResponse, 0, len(locks))
+	for _, lock := range locks {
+		id := lock.ID
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		payloads = append(payloads, lockResponse{
+			ID:         id,
+			Time:       lock.Time,
+			AgeSeconds: int64(now.Sub(lock.Time).Seconds()),
+			Exclusive:  lock.Exclusive,
+			Hostname:   lock.Hostname,
+			Username:   lock.Username,
+			PID:        lock.PID,
+		})
+	}
+	return payloads
+}
+
+// handleLocks godoc
+// @Summary List the locks of a repository
+// @Description Returns the current locks of a target's repository (restic list locks and cat lock) with holder host, PID, exclusive flag and age, the stale lock policy and the recent manual and automatic unlocks
+// @Tags Maintenance
+// @Produce json
+// @Param name path string true "Name of the backup target"
+// @Success 200 {object} locksResponse "Locks and unlock history"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Target not found"
+// @Failure 429 {string} string "Too many requests"
+// @Failure 500 {string} string "Listing locks failed"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /locks/{name} [get]
+func (a *API) handleLocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract name from path: /api/v1/locks/{name}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/locks/")
+	if name == "" {
+		http.Error(w, "target name required", http.StatusBadRequest)
+		return
+	}
+	if !a.authorizeTarget(w, r, name) {
+		return
+	}
+
+	ctx := r.Context()
+	target, err := a.store.GetTarget(ctx, name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("target %s not found", name), http.StatusNotFound)
+		return
+	}
+	repo, err := target.ResticRepo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	locks, err := a.runner.Locks(ctx, repo)
+	if err != nil {
+		log.Printf("list locks failed for %s: %v", name, err)
+		http.Error(w, fmt.Sprintf("list locks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	events, err := a.store.ListUnlockEvents(ctx, name, unlockHistoryLimit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list unlocks: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	payload := locksResponse{
+		Target:  name,
+		Locks:   lockPayloads(locks, now),
+		Unlocks: make([]unlockResponse, 0, len(events)),
+	}
+	if target.AutoUnlockAfter > 0 {
+		payload.AutoUnlockAfter = target.AutoUnlockAfter.String()
+	}
+	for _, event := range events {
+		removed, err := event.UnlockedLocks()
+		if err != nil {
+			log.Printf("target %s: decode locks of unlock %d: %v", name, event.ID, err)
+		}
+		payload.Unlocks = append(payload.Unlocks, unlockResponse{
+			ID:        event.ID,
+			Automatic: event.Automatic,
+			RemoveAll: event.RemoveAll,
+			Locks:     lockPayloads(removed, event.CreatedAt),
+			Output:    event.Output,
+			Error:     event.Error,
+			Time:      event.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/oidc"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+const (
+	// sessionCookie holds the token of an OIDC login session.
+	sessionCookie = "rm_session"
+	// oidcStateCookie binds a login in progress to the browser that
+	// started it.
+	oidcStateCookie = "rm_oidc_state"
+	// loginStateTTL bounds the time between login and callback.
+	loginStateTTL = 10 * time.Minute
+)
+
+// loginState is kept between the redirect to the provider and the
+// callback.
+type loginState struct {
+	nonce    string
+	verifier string
+	returnTo string
+	expires  time.Time
+}
+
+// parseRoleMapping parses "group=role,..." pairs. Invalid entries are
+// logged and skipped.
+func parseRoleMapping(value string) map[string]string {
+	mapping := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(entry, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || !store.ValidRole(role) {
+			log.Printf("OIDC_ROLE_MAPPING: ignoring invalid entry %q", entry)
+			continue
+		}
+		mapping[strings.TrimPrefix(group, "/")] = role
+	}
+	return mapping
+}
+
+// roleForGroups returns the most privileged role mapped from groups, the
+// default role, or an empty string when the user may not log in. Group
+// paths such as Keycloak's "/backup-admins" match without the slash.
+func (a *API) roleForGroups(groups []string) string {
+	role := ""
+	for _, group := range groups {
+		mapped, ok := a.oidcRoles[strings.TrimPrefix(group, "/")]
+		if ok && (role == "" || !store.RoleAllows(role, mapped)) {
+			role = mapped
+		}
+	}
+	if role == "" && store.ValidRole(a.config.OIDCDefaultRole) {
+		role = a.config.OIDCDefaultRole
+	}
+	return role
+}
+
+// sessionPrincipal returns the principal of the request's session cookie.
+func (a *API) sessionPrincipal(r *http.Request) (principal, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return principal{}, false
+	}
+	session, ok, err := a.store.GetSession(r.Context(), hashToken(cookie.Value), time.Now())
+	if err != nil {
+		log.Printf("load session: %v", err)
+		return principal{}, false
+	}
+	if !ok {
+		return principal{}, false
+	}
+	return principal{Name: session.Username, Role: session.Role}, true
+}
+
+func (a *API) secureCookies(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(a.config.OIDCRedirectURL, "https://")
+}
+
+// handleLogin redirects to the provider's login page. return_to is the
+// dashboard path to open after the login.
+func (a *API) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := a.oidc.AuthCodeURL(r.Context(), state, nonce, oidc.CodeChallenge(verifier))
+	if err != nil {
+		log.Printf("oidc login: %v", err)
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	a.logins.Range(func(key, value any) bool {
+		if value.(loginState).expires.Before(now) {
+			a.logins.Delete(key)
+		}
+		return true
+	})
+	a.logins.Store(state, loginState{
+		nonce:    nonce,
+		verifier: verifier,
+		returnTo: safeReturnTo(r.URL.Query().Get("return_to")),
+		expires:  now.Add(loginStateTTL),
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   int(loginStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// safeReturnTo only allows local paths to prevent open redirects.
+func safeReturnTo(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// handleCallback completes the login: it exchanges the code, verifies the
+// ID token, maps the groups to a role and starts a session.
+func (a *API) handleCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("oidc callback: %s: %s", errCode, query.Get("error_description"))
+		http.Error(w, "login failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	value, ok := a.logins.LoadAndDelete(state)
+	cookie, err := r.Cookie(oidcStateCookie)
+	if !ok || err != nil || cookie.Value != state {
+		http.Error(w, "login failed: unknown or expired state", http.StatusBadRequest)
+		return
+	}
+	login := value.(loginState)
+	if time.Now().After(login.expires) {
+		http.Error(w, "login failed: unknown or expired state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/", MaxAge: -1})
+
+	tokens, err := a.oidc.Exchange(ctx, query.Get("code"), login.verifier)
+	if err != nil {
+		log.Printf("oidc callback: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := a.oidc.VerifyIDToken(ctx, tokens.IDToken, login.nonce)
+	if err != nil {
+		log.Printf("oidc callback: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	username := claims.String(a.config.OIDCUsernameClaim)
+	if username == "" {
+		username = claims.String("sub")
+	}
+	groups := claims.Strings(a.config.OIDCGroupsClaim)
+	role := a.roleForGroups(groups)
+	auditFrom(r).setActor(username)
+	auditFrom(r).setParam("groups", groups)
+	auditFrom(r).setParam("role", role)
+	if role == "" {
+		log.Printf("oidc login of %s refused: no role mapped for groups %v", username, groups)
+		http.Error(w, "Forbidden: no role for your groups", http.StatusForbidden)
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ttl := a.config.SessionTTL
+	if _, err := a.store.CreateSession(ctx, store.SessionData{Username: username, Role: role, TTL: ttl}, hashToken(token)); err != nil {
+		http.Error(w, "create session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, err := a.store.DeleteExpiredSessions(ctx, time.Now()); err != nil {
+		log.Printf("delete expired sessions: %v", err)
+	} else if n > 0 {
+		log.Printf("deleted %d expired sessions", n)
+	}
+	log.Printf("oidc login of %s with role %s", username, role)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, login.returnTo, http.StatusFound)
+}
+
+// handleLogout ends the session and, if the provider supports it, the
+// login at the provider.
+func (a *API) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if p, ok := a.sessionPrincipal(r); ok {
+		auditFrom(r).setActor(p.Name)
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		if err := a.store.DeleteSession(r.Context(), hashToken(cookie.Value)); err != nil {
+			log.Printf("delete session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	target := "/"
+	if logoutURL := a.oidc.LogoutURL(r.Context(), dashboardURL(a.config.OIDCRedirectURL)); logoutURL != "" {
+		target = logoutURL
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// dashboardURL returns the root URL of the dashboard serving redirectURL.
+func dashboardURL(redirectURL string) string {
+	u, err := url.Parse(redirectURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/"
+}
@@ -0,0 +1,352 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+)
+
+// testProvider is an OpenID Connect provider issuing ID tokens with the
+// claims a test asks for.
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testGrant
+}
+
+// testGrant is an authorization code with the login it was issued for.
+type testGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{key: key, codes: make(map[string]testGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.handleToken)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize stands in for the login page: it checks the authorization
+// request and returns a code for an ID token with claims, which override
+// the standard ones.
+func (p *testProvider) authorize(t *testing.T, authURL string, claims map[string]any) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "monitor" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	code = "code-" + query.Get("state")
+	p.mu.Lock()
+	p.codes[code] = testGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	p.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (p *testProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	grant, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   p.URL,
+		"sub":   "subject",
+		"aud":   "monitor",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": grant.nonce,
+	}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"token_type": "Bearer",
+		"id_token":   signed + "." + base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// newOIDCTestAPI returns an API logging in through p. Groups map as in
+// OIDC_ROLE_MAPPING.
+func newOIDCTestAPI(t *testing.T, p *testProvider, mapping, defaultRole string, ttl time.Duration) http.Handler {
+	t.Helper()
+	_, h, _ := newTestAPI(t, config.Config{
+		OIDCIssuerURL:     p.URL,
+		OIDCClientID:      "monitor",
+		OIDCClientSecret:  "client-secret",
+		OIDCRedirectURL:   "http://monitor.example.com/auth/callback",
+		OIDCUsernameClaim: "preferred_username",
+		OIDCGroupsClaim:   "groups",
+		OIDCRoleMapping:   mapping,
+		OIDCDefaultRole:   defaultRole,
+		SessionTTL:        ttl,
+	})
+	return h
+}
+
+// startLogin requests /auth/login and returns the provider URL it
+// redirects to and the state cookie.
+func startLogin(t *testing.T, h http.Handler, returnTo string) (string, *http.Cookie) {
+	t.Helper()
+	w := serve(h, request(http.MethodGet, "/auth/login?return_to="+url.QueryEscape(returnTo), "", ""))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login = %d (%s), want a redirect", w.Code, w.Body)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return w.Header().Get("Location"), cookie
+		}
+	}
+	t.Fatal("login set no state cookie")
+	return "", nil
+}
+
+// callback returns from the provider with code and state.
+func callback(h http.Handler, code, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := request(http.MethodGet, "/auth/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), "", "")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return serve(h, r)
+}
+
+// sessionCookieOf returns the session cookie set by a callback.
+func sessionCookieOf(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// me returns the status and principal of GET /api/v1/me with session.
+func me(t *testing.T, h http.Handler, session *http.Cookie) (int, meResponse) {
+	t.Helper()
+	r := request(http.MethodGet, "/api/v1/me", "", "")
+	r.AddCookie(session)
+	w := serve(h, r)
+	var resp meResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newTestProvider(t)
+	h := newOIDCTestAPI(t, p, "/backup-admins=admin, backup-operators=operator, staff=viewer", "", time.Hour)
+
+	for _, tc := range []struct {
+		name   string
+		groups any
+		want   string
+	}{
+		{"admin group", []string{"backup-admins"}, "admin"},
+		{"group path", []string{"/backup-operators"}, "operator"},
+		{"single group", "staff", "viewer"},
+		{"most privileged group", []string{"staff", "backup-admins", "backup-operators"}, "admin"},
+		{"unmapped group", []string{"sales"}, ""},
+		{"no groups", nil, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authURL, cookie := startLogin(t, h, "/targets/home")
+			code, state := p.authorize(t, authURL, map[string]any{"preferred_username": "grace", "groups": tc.groups})
+			w := callback(h, code, state, cookie)
+			if tc.want == "" {
+				if w.Code != http.StatusForbidden || sessionCookieOf(w) != nil {
+					t.Errorf("callback = %d, want 403 without a session", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusFound || w.Header().Get("Location") != "/targets/home" {
+				t.Fatalf("callback = %d to %q (%s), want a redirect to /targets/home", w.Code, w.Header().Get("Location"), w.Body)
+			}
+			session := sessionCookieOf(w)
+			if session == nil || !session.HttpOnly {
+				t.Fatalf("session cookie = %+v", session)
+			}
+			if code, principal := me(t, h, session); code != http.StatusOK || principal.Username != "grace" || principal.Role != tc.want {
+				t.Errorf("me = %d %+v, want grace with role %s", code, principal, tc.want)
+			}
+		})
+	}
+}
+
+func TestOIDCDefaultRole(t *testing.T) {
+	p := newTestProvider(t)
+	h := newOIDCTestAPI(t, p, "backup-admins=admin", "viewer", time.Hour)
+
+	authURL, cookie := startLogin(t, h, "//evil.example.com")
+	code, state := p.authorize(t, authURL, map[string]any{"groups": []string{"sales"}})
+	w := callback(h, code, state, cookie)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback = %d to %q, want a redirect to /", w.Code, w.Header().Get("Location"))
+	}
+	// Without preferred_username the subject names the user
+	if code, principal := me(t, h, sessionCookieOf(w)); code != http.StatusOK || principal.Username != "subject" || principal.Role != "viewer" {
+		t.Errorf("me = %d %+v, want subject with the default role", code, principal)
+	}
+}
+
+func TestOIDCStateAndNonce(t *testing.T) {
+	p := newTestProvider(t)
+	h := newOIDCTestAPI(t, p, "staff=viewer", "", time.Hour)
+	staff := map[string]any{"groups": []string{"staff"}}
+
+	t.Run("unknown state", func(t *testing.T) {
+		authURL, _ := startLogin(t, h, "/")
+		code, _ := p.authorize(t, authURL, staff)
+		forged := &http.Cookie{Name: oidcStateCookie, Value: "forged"}
+		if w := callback(h, code, "forged", forged); w.Code != http.StatusBadRequest {
+			t.Errorf("callback with an unknown state = %d, want 400", w.Code)
+		}
+	})
+	t.Run("state of another browser", func(t *testing.T) {
+		authURL, _ := startLogin(t, h, "/")
+		code, state := p.authorize(t, authURL, staff)
+		if w := callback(h, code, state, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("callback without the state cookie = %d, want 400", w.Code)
+		}
+		// The state was used up by the failed attempt
+		if w := callback(h, code, state, &http.Cookie{Name: oidcStateCookie, Value: state}); w.Code != http.StatusBadRequest {
+			t.Errorf("retried callback = %d, want 400", w.Code)
+		}
+	})
+	t.Run("replayed state", func(t *testing.T) {
+		authURL, cookie := startLogin(t, h, "/")
+		code, state := p.authorize(t, authURL, staff)
+		if w := callback(h, code, state, cookie); w.Code != http.StatusFound {
+			t.Fatalf("callback = %d (%s), want a redirect", w.Code, w.Body)
+		}
+		if w := callback(h, code, state, cookie); w.Code != http.StatusBadRequest {
+			t.Errorf("replayed callback = %d, want 400", w.Code)
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		claims map[string]any
+	}{
+		{"nonce mismatch", map[string]any{"nonce": "other"}},
+		{"missing nonce", map[string]any{"nonce": nil}},
+		{"other audience", map[string]any{"aud": "other-client"}},
+		{"other issuer", map[string]any{"iss": "https://evil.example.com"}},
+		{"expired token", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authURL, cookie := startLogin(t, h, "/")
+			claims := map[string]any{"groups": []string{"staff"}}
+			for name, value := range tc.claims {
+				claims[name] = value
+			}
+			code, state := p.authorize(t, authURL, claims)
+			if w := callback(h, code, state, cookie); w.Code != http.StatusUnauthorized || sessionCookieOf(w) != nil {
+				t.Errorf("callback = %d, want 401 without a session", w.Code)
+			}
+		})
+	}
+}
+
+func TestOIDCSessionExpiry(t *testing.T) {
+	p := newTestProvider(t)
+	h := newOIDCTestAPI(t, p, "staff=viewer", "", 100*time.Millisecond)
+
+	authURL, cookie := startLogin(t, h, "/")
+	code, state := p.authorize(t, authURL, map[string]any{"groups": []string{"staff"}})
+	session := sessionCookieOf(callback(h, code, state, cookie))
+	if session == nil {
+		t.Fatal("no session")
+	}
+	if code, _ := me(t, h, session); code != http.StatusOK {
+		t.Fatalf("me with a fresh session = %d, want 200", code)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if code, _ := me(t, h, session); code != http.StatusUnauthorized {
+		t.Errorf("me with an expired session = %d, want 401", code)
+	}
+}
+
+func TestOIDCLogout(t *testing.T) {
+	p := newTestProvider(t)
+	h := newOIDCTestAPI(t, p, "staff=viewer", "", time.Hour)
+
+	authURL, cookie := startLogin(t, h, "/")
+	code, state := p.authorize(t, authURL, map[string]any{"groups": []string{"staff"}})
+	session := sessionCookieOf(callback(h, code, state, cookie))
+	if session == nil {
+		t.Fatal("no session")
+	}
+	r := request(http.MethodGet, "/auth/logout", "", "")
+	r.AddCookie(session)
+	if w := serve(h, r); w.Code != http.StatusFound {
+		t.Fatalf("logout = %d, want a redirect", w.Code)
+	}
+	if code, _ := me(t, h, session); code != http.StatusUnauthorized {
+		t.Errorf("me after logout = %d, want 401", code)
+	}
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// pruneInterval bounds how often idle limiter entries are dropped.
+const pruneInterval = time.Minute
+
+// loginFailures tracks the failed logins of one IP address or username.
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginGuard locks out IP addresses and usernames after repeated failed
+// logins. Every failure past maxFailures doubles the lockout, up to
+// maxLockout; failures are forgotten after maxLockout without one.
+type loginGuard struct {
+	maxFailures int
+	lockout     time.Duration
+	maxLockout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*loginFailures
+	pruned  time.Time
+}
+
+func newLoginGuard(maxFailures int, lockout, maxLockout time.Duration) *loginGuard {
+	return &loginGuard{
+		maxFailures: maxFailures,
+		lockout:     lockout,
+		maxLockout:  max(maxLockout, lockout),
+		entries:     make(map[string]*loginFailures),
+	}
+}
+
+// lockedFor returns how long the longest lockout of keys lasts.
+func (g *loginGuard) lockedFor(now time.Time, keys ...string) time.Duration {
+	if g.maxFailures <= 0 {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if entry, ok := g.entries[key]; ok {
+			wait = max(wait, entry.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed login for key and returns the lockout it starts,
+// or zero.
+func (g *loginGuard) fail(now time.Time, key string) time.Duration {
+	if g.maxFailures <= 0 {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prune(now)
+
+	entry, ok := g.entries[key]
+	if !ok {
+		entry = &loginFailures{}
+		g.entries[key] = entry
+	}
+	entry.count++
+	entry.last = now
+	if entry.count < g.maxFailures {
+		return 0
+	}
+	lockout := g.maxLockout
+	if exp := entry.count - g.maxFailures; exp < 32 {
+		lockout = min(g.lockout*time.Duration(1<<exp), g.maxLockout)
+	}
+	entry.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// succeed forgets the failures of keys.
+func (g *loginGuard) succeed(keys ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		delete(g.entries, key)
+	}
+}
+
+func (g *loginGuard) prune(now time.Time) {
+	if now.Sub(g.pruned) < pruneInterval {
+		return
+	}
+	g.pruned = now
+	for key, entry := range g.entries {
+		if now.Sub(entry.last) > g.maxLockout && now.After(entry.lockedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// rateLimiter is a token bucket per caller allowing perMinute requests a
+// minute with bursts of the same size.
+type rateLimiter struct {
+	perMinute int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token for key. If none is left it returns false and the
+// time until the next one.
+func (l *rateLimiter) allow(now time.Time, key string) (bool, time.Duration) {
+	if l.perMinute <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := float64(l.perMinute)
+	perSecond := capacity / 60
+	if now.Sub(l.pruned) >= pruneInterval {
+		l.pruned = now
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*perSecond >= capacity {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// throttle limits how often each caller may use a handler that runs
+// restic.
+func (a *API) throttle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := principalFrom(r).Name
+		if key == "" || key == anonymous.Name {
+			key = "ip:" + a.clientIP(r)
+		}
+		if ok, wait := a.resticLimiter.allow(time.Now(), key); !ok {
+			tooManyRequests(w, wait, "Too many requests running restic")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("%s, retry in %ds", message, seconds), http.StatusTooManyRequests)
+}
+
+// clientIP returns the address of the client. Behind a trusted proxy the
+// last address of X-Forwarded-For not added by a trusted proxy is used.
+func (a *API) clientIP(r *http.Request) string {
+	ip := remoteHost(r)
+	if !a.trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !a.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (a *API) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range a.trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses IP addresses and CIDR ranges. Invalid entries
+// are logged and skipped.
+func parseTrustedProxies(values []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range values {
+		cidr := value
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("TRUSTED_PROXIES: ignoring invalid entry %q", value)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// loginKeys returns the keys of the failed login tracking of r.
+func (a *API) loginKeys(r *http.Request) []string {
+	keys := []string{"ip:" + a.clientIP(r)}
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+// recordLoginFailure counts a failed login of r and records an audit
+// entry when it locks out the client or the username.
+func (a *API) recordLoginFailure(r *http.Request, keys []string) {
+	now := time.Now()
+	for _, key := range keys {
+		lockout := a.failedLogins.fail(now, key)
+		if lockout == 0 {
+			continue
+		}
+		kind, value, _ := strings.Cut(key, ":")
+		log.Printf("login: locked out %s %s for %s after repeated failures", kind, value, lockout)
+		username, _, _ := r.BasicAuth()
+		data := store.AuditData{
+			Time:         now,
+			Actor:        username,
+			Source:       remoteHost(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			Action:       "login.lockout",
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Parameters: map[string]any{
+				"locked":   kind,
+				"client":   a.clientIP(r),
+				"duration": lockout.String(),
+			},
+			Outcome:    store.OutcomeDenied,
+			StatusCode: http.StatusUnauthorized,
+		}
+		if _, err := a.store.RecordAudit(context.WithoutCancel(r.Context()), data); err != nil {
+			log.Printf("record audit entry for login.lockout: %v", err)
+		}
+	}
+}
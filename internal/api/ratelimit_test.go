@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+)
+
+func TestLoginGuard(t *testing.T) {
+	g := newLoginGuard(3, time.Minute, 4*time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if lockout := g.fail(now, "ip:203.0.113.5"); lockout != 0 {
+			t.Fatalf("failure %d locked out for %s", i+1, lockout)
+		}
+	}
+	if lockout := g.fail(now, "ip:203.0.113.5"); lockout != time.Minute {
+		t.Fatalf("third failure locked out for %s, want 1m", lockout)
+	}
+	if wait := g.lockedFor(now.Add(20*time.Second), "ip:203.0.113.5", "user:ada"); wait != 40*time.Second {
+		t.Errorf("lockedFor = %s, want 40s", wait)
+	}
+	if wait := g.lockedFor(now, "ip:198.51.100.7"); wait != 0 {
+		t.Errorf("other client locked for %s", wait)
+	}
+
+	// Every further failure doubles the lockout up to the maximum
+	now = now.Add(time.Minute)
+	if wait := g.lockedFor(now, "ip:203.0.113.5"); wait > 0 {
+		t.Errorf("still locked for %s after the lockout", wait)
+	}
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		if lockout := g.fail(now, "ip:203.0.113.5"); lockout != want {
+			t.Errorf("lockout = %s, want %s", lockout, want)
+		}
+	}
+
+	// Failures are forgotten once the maximum lockout passed without one
+	now = now.Add(4*time.Minute + pruneInterval + time.Second)
+	if lockout := g.fail(now, "ip:203.0.113.5"); lockout != 0 {
+		t.Errorf("first failure after the window locked out for %s", lockout)
+	}
+
+	g.fail(now, "user:ada")
+	g.fail(now, "user:ada")
+	g.succeed("user:ada")
+	if lockout := g.fail(now, "user:ada"); lockout != 0 {
+		t.Errorf("failure after a successful login locked out for %s", lockout)
+	}
+}
+
+func TestLoginGuardDisabled(t *testing.T) {
+	g := newLoginGuard(0, time.Minute, time.Hour)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		g.fail(now, "ip:203.0.113.5")
+	}
+	if wait := g.lockedFor(now, "ip:203.0.113.5"); wait != 0 {
+		t.Errorf("disabled guard locked out for %s", wait)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(now, "ada"); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait := l.allow(now, "ada")
+	if ok || wait != 30*time.Second {
+		t.Errorf("third request = %v, wait %s, want refused for 30s", ok, wait)
+	}
+	if ok, _ := l.allow(now, "otto"); !ok {
+		t.Error("another caller was refused")
+	}
+
+	// Two a minute refill one token every 30 seconds
+	if ok, _ := l.allow(now.Add(15*time.Second), "ada"); ok {
+		t.Error("request allowed before a token was refilled")
+	}
+	if ok, _ := l.allow(now.Add(45*time.Second), "ada"); !ok {
+		t.Error("request refused after a token was refilled")
+	}
+	if ok, _ := l.allow(now.Add(45*time.Second), "ada"); ok {
+		t.Error("refill gave more than one token")
+	}
+	if ok, _ := newRateLimiter(0).allow(now, "ada"); !ok {
+		t.Error("disabled limiter refused a request")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	a := &API{trustedProxies: parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "not-an-ip"})}
+
+	for _, tc := range []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"203.0.113.5:4711", "", "203.0.113.5"},
+		// Untrusted peers cannot choose their address
+		{"203.0.113.5:4711", "198.51.100.7", "203.0.113.5"},
+		{"10.0.0.1:4711", "198.51.100.7", "198.51.100.7"},
+		{"192.0.2.1:4711", "198.51.100.7", "198.51.100.7"},
+		// Addresses left of the first untrusted hop were set by the client
+		{"10.0.0.1:4711", "6.6.6.6, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"10.0.0.1:4711", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:4711", "", "10.0.0.1"},
+	} {
+		r := request(http.MethodGet, "/api/v1/status", "", "")
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := a.clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	_, h, _ := newTestAPI(t, config.Config{
+		LoginMaxFailures: 2,
+		LoginLockout:     time.Minute,
+		LoginLockoutMax:  time.Hour,
+		TrustedProxies:   []string{"10.0.0.1"},
+	})
+	login := func(password, remote, forwarded string) *http.Request {
+		r := request(http.MethodGet, "/api/v1/status", "", "")
+		r.SetBasicAuth("ada", password)
+		r.RemoteAddr = remote
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return r
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serve(h, login("guess", "203.0.113.5:4711", "")); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d = %d, want 401", i+1, w.Code)
+		}
+	}
+	w := serve(h, login("ada-password", "203.0.113.5:4711", ""))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("login during the lockout = %d, Retry-After %q, want 429", w.Code, w.Header().Get("Retry-After"))
+	}
+	// A forged X-Forwarded-For from an untrusted peer does not help
+	if w := serve(h, login("ada-password", "203.0.113.5:4711", "198.51.100.7")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("login with a spoofed X-Forwarded-For = %d, want 429", w.Code)
+	}
+	// The username stays locked from other addresses too
+	if w := serve(h, login("ada-password", "10.0.0.1:4711", "198.51.100.7")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("login of the locked user from another client = %d, want 429", w.Code)
+	}
+	if w := serve(h, request(http.MethodGet, "/api/v1/status", "vera", "")); w.Code != http.StatusOK {
+		t.Errorf("login of another user = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+type statsResponse struct {
+	SnapshotCount    int       `json:"snapshotCount" example:"42"`
+	RawSize          uint64    `json:"rawSize" example:"53687091200"`
+	UncompressedSize uint64    `json:"uncompressedSize" example:"85899345920"`
+	CompressionRatio float64   `json:"compressionRatio" example:"1.6"`
+	BlobCount        uint64    `json:"blobCount" example:"912345"`
+	RestoreSize      uint64    `json:"restoreSize" example:"1099511627776"`
+	RestoreFileCount uint64    `json:"restoreFileCount" example:"5400000"`
+	DedupRatio       float64   `json:"dedupRatio" example:"12.8"`
+	CollectedAt      time.Time `json:"collectedAt" example:"2025-11-23T15:00:00Z"`
+}
+
+func statsPayload(stats store.RepositoryStats) statsResponse {
+	return statsResponse{
+		SnapshotCount:    stats.SnapshotCount,
+		RawSize:          stats.RawSize,
+		UncompressedSize: stats.UncompressedSize,
+		CompressionRatio: stats.CompressionRatio,
+		BlobCount:        stats.BlobCount,
+		RestoreSize:      stats.RestoreSize,
+		RestoreFileCount: stats.RestoreFileCount,
+		DedupRatio:       stats.DedupRatio(),
+		CollectedAt:      stats.CollectedAt,
+	}
+}
+
+// latestStats returns the newest statistics of a target, or nil when none
+// were collected yet.
+func (a *API) latestStats(ctx context.Context, name string) *statsResponse {
+	stats, err := a.store.LatestRepositoryStats(ctx, name)
+	if err != nil {
+		log.Printf("target %s: load latest stats: %v", name, err)
+		return nil
+	}
+	if stats.CollectedAt.IsZero() {
+		return nil
+	}
+	payload := statsPayload(stats)
+	return &payload
+}
+
+type warningResponse struct {
+	SnapshotID   string    `json:"snapshotID" example:"a1b2c3d4"`
+	SnapshotTime time.Time `json:"snapshotTime" example:"2025-11-23T14:30:00Z"`
+	Metric       string    `json:"metric" example:"files"`
+	Value        uint64    `json:"value" example:"1210"`
+	Baseline     uint64    `json:"baseline" example:"120400"`
+	Ratio        float64   `json:"ratio" example:"0.01"`
+	Message      string    `json:"message" example:"file count dropped by 99% (1210, baseline 120400)"`
+	DetectedAt   time.Time `json:"detectedAt" example:"2025-11-23T15:00:00Z"`
+}
+
+// snapshotWarnings returns the growth anomalies of a target's recent
+// snapshots.
+func (a *API) snapshotWarnings(ctx context.Context, name string) []warningResponse {
+	warnings, err := a.store.ListSnapshotWarnings(ctx, name)
+	if err != nil {
+		log.Printf("target %s: load snapshot warnings: %v", name, err)
+		return nil
+	}
+	payloads := make([]warningResponse, 0, len(warnings))
+	for _, warning := range warnings {
+		payloads = append(payloads, warningResponse{
+			SnapshotID:   warning.SnapshotID,
+			SnapshotTime: warning.SnapshotTime,
+			Metric:       warning.Metric,
+			Value:        warning.Value,
+			Baseline:     warning.Baseline,
+			Ratio:        warning.Ratio,
+			Message:      warning.Message,
+			DetectedAt:   warning.CreatedAt,
+		})
+	}
+	return payloads
+}
+
+// handleStats godoc
+// @Summary Get repository size history of a backup target
+// @Description Returns the repository statistics collected every STATS_INTERVAL, oldest first: stored (raw-data) size, compression, restore size and the resulting deduplication ratio
+// @Tags Status
+// @Produce json
+// @Param name path string true "Name of the backup target"
+// @Param since query string false "Only samples collected at or after this RFC 3339 time, or within this duration such as 720h"
+// @Param limit query int false "Only the newest samples" minimum(1)
+// @Success 200 {array} statsResponse "Statistics samples"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Target not found"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /stats/{name} [get]
+func (a *API) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract name from path: /api/v1/stats/{name}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/stats/")
+	if name == "" {
+		http.Error(w, "target name required", http.StatusBadRequest)
+		return
+	}
+	if !a.authorizeTarget(w, r, name) {
+		return
+	}
+
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		parsed, err := parseSince(sinceStr, time.Now())
+		if err != nil {
+			http.Error(w, "invalid since parameter, must be RFC 3339 time or duration", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	var limit int
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit parameter, must be positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	ctx := r.Context()
+	if _, err := a.store.GetTarget(ctx, name); err != nil {
+		http.Error(w, "target not found", http.StatusNotFound)
+		return
+	}
+
+	samples, err := a.store.ListRepositoryStats(ctx, name, since, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]statsResponse, 0, len(samples))
+	for _, sample := range samples {
+		payloads = append(payloads, statsPayload(sample))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payloads)
+}
+
+// parseSince reads an RFC 3339 time or a duration back from now.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// Client certificate modes of TLS_CLIENT_AUTH.
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// certReloadInterval bounds how often the certificate files are checked
+// for changes.
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the certificate and client CA files, reloading them
+// when they change on disk so rotated certificates apply without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// latestModTime returns the newest modification time of the files.
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return fmt.Errorf("read client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client CA %s: no certificates found", c.caFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.pool, c.modTime, c.checked = &cert, pool, modTime, time.Now()
+	return nil
+}
+
+// reloadIfChanged reloads the files if they changed since the last load.
+// Errors keep the previous certificate, as files are often replaced in
+// several steps.
+func (c *certReloader) reloadIfChanged() {
+	c.mu.Lock()
+	if time.Since(c.checked) < certReloadInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.checked = time.Now()
+	loaded := c.modTime
+	c.mu.Unlock()
+
+	modTime, err := c.latestModTime()
+	if err != nil || !modTime.After(loaded) {
+		return
+	}
+	if err := c.load(); err != nil {
+		log.Printf("reload TLS certificate: %v", err)
+		return
+	}
+	log.Printf("reloaded TLS certificate %s", c.certFile)
+}
+
+func (c *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	c.reloadIfChanged()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, c.pool
+}
+
+// tlsConfig returns the server TLS configuration of cfg.
+func tlsConfig(cfg config.Config) (*tls.Config, error) {
+	clientAuth := tls.NoClientCert
+	switch cfg.TLSClientAuth {
+	case "", clientAuthNone:
+	case clientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH: unknown mode %q", cfg.TLSClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && cfg.TLSClientCAFile == "" {
+		return nil, errors.New("TLS_CLIENT_AUTH requires TLS_CLIENT_CA_FILE")
+	}
+
+	reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	// The client CA pool is part of the configuration, so the whole
+	// configuration is rebuilt per handshake to pick up rotated files.
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := reloader.current()
+		conf := base.Clone()
+		conf.GetConfigForClient = nil
+		conf.Certificates = []tls.Certificate{*cert}
+		conf.ClientAuth = clientAuth
+		conf.ClientCAs = pool
+		return conf, nil
+	}
+	return base, nil
+}
+
+// clientCertName returns the common name of the verified client
+// certificate of r, if any.
+func clientCertName(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+// certPrincipal maps the verified client certificate of r to the database
+// user named like the certificate's common name.
+func (a *API) certPrincipal(r *http.Request) (principal, bool) {
+	name, ok := clientCertName(r)
+	if !ok {
+		return principal{}, false
+	}
+	user, err := a.store.GetUser(r.Context(), name)
+	if err != nil {
+		if !errors.Is(err, store.ErrUserNotFound) {
+			log.Printf("load user %s: %v", name, err)
+		}
+		return principal{}, false
+	}
+	if user.Disabled {
+		return principal{}, false
+	}
+	targets, err := user.TargetNames()
+	if err != nil {
+		log.Printf("decode targets of user %s: %v", name, err)
+		return principal{}, false
+	}
+	return principal{Name: user.Username, Role: user.Role, Targets: targets}, true
+}
+
+// redirectHandler sends plain HTTP requests to the HTTPS listener on
+// httpsAddr.
+func redirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// runRedirect serves redirectHandler on addr until ctx is canceled.
+func runRedirect(ctx context.Context, addr, httpsAddr string) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           redirectHandler(httpsAddr),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	log.Printf("redirecting HTTP on %s to HTTPS", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP redirect listener: %v", err)
+	}
+}
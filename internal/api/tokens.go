@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+const (
+	// apiTokenPrefix starts every API token so they can be told apart from
+	// AUTH_TOKEN and agent tokens.
+	apiTokenPrefix = "rmt_"
+	// apiTokenLookupLen is the length of the stored, non-secret start of a
+	// token used to find it.
+	apiTokenLookupLen = len(apiTokenPrefix) + 8
+)
+
+type tokenResponse struct {
+	ID         uint       `json:"id" example:"3"`
+	Name       string     `json:"name" example:"grafana"`
+	Prefix     string     `json:"prefix" example:"rmt_9f86d081"`
+	Scopes     []string   `json:"scopes" example:"read:status"`
+	CreatedBy  string     `json:"createdBy" example:"alice"`
+	CreatedAt  time.Time  `json:"createdAt" example:"2025-11-23T14:30:00Z"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty" example:"2026-11-23T14:30:00Z"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" example:"2025-11-24T08:00:00Z"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	Active     bool       `json:"active" example:"true"`
+}
+
+type createTokenResponse struct {
+	tokenResponse
+	// Token is only returned once, on creation.
+	Token string `json:"token" example:"rmt_9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`
+}
+
+func tokenPayload(token store.APIToken, now time.Time) tokenResponse {
+	scopes, err := token.TokenScopes()
+	if err != nil {
+		log.Printf("decode scopes of token %d: %v", token.ID, err)
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return tokenResponse{
+		ID:         token.ID,
+		Name:       token.Name,
+		Prefix:     token.Prefix,
+		Scopes:     scopes,
+		CreatedBy:  token.CreatedBy,
+		CreatedAt:  token.CreatedAt,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+		RevokedAt:  token.RevokedAt,
+		Active:     token.Active(now),
+	}
+}
+
+// authenticateToken returns the principal of an active API token. Tokens
+// are looked up by their prefix and compared by hash in constant time.
+func (a *API) authenticateToken(ctx context.Context, token string) (principal, bool) {
+	if !strings.HasPrefix(token, apiTokenPrefix) || len(token) <= apiTokenLookupLen {
+		return principal{}, false
+	}
+	candidates, err := a.store.FindAPITokens(ctx, token[:apiTokenLookupLen])
+	if err != nil {
+		log.Printf("find api token: %v", err)
+		return principal{}, false
+	}
+
+	hash := hashToken(token)
+	now := time.Now()
+	for _, candidate := range candidates {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(candidate.TokenHash)) != 1 || !candidate.Active(now) {
+			continue
+		}
+		scopes, err := candidate.TokenScopes()
+		if err != nil || len(scopes) == 0 {
+			log.Printf("decode scopes of token %d: %v", candidate.ID, err)
+			return principal{}, false
+		}
+		if err := a.store.TouchAPIToken(ctx, candidate, now); err != nil {
+			log.Printf("record use of token %d: %v", candidate.ID, err)
+		}
+		return principal{Name: "token:" + candidate.Name, Scopes: scopes}, true
+	}
+	return principal{}, false
+}
+
+// handleTokens dispatches /api/v1/tokens and /api/v1/tokens/{id}.
+func (a *API) handleTokens(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens"), "/")
+	switch {
+	case idStr == "" && r.Method == http.MethodGet:
+		a.handleListTokens(w, r)
+	case idStr == "" && r.Method == http.MethodPost:
+		a.handleCreateToken(w, r)
+	case idStr != "" && r.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid token id", http.StatusBadRequest)
+			return
+		}
+		a.handleRevokeToken(w, r, uint(id))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListTokens godoc
+// @Summary List API tokens
+// @Description Returns all API tokens including expired and revoked ones, without their secrets. Requires the admin role.
+// @Tags Tokens
+// @Produce json
+// @Success 200 {array} tokenResponse "List of tokens"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /tokens [get]
+func (a *API) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := a.store.ListAPITokens(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list tokens: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	payloads := make([]tokenResponse, 0, len(tokens))
+	for _, token := range tokens {
+		payloads = append(payloads, tokenPayload(token, now))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payloads)
+}
+
+// handleCreateToken godoc
+// @Summary Create an API token
+// @Description Issues a named bearer token with scopes (read:status, write:prune, write:unlock, write:check, write:targets, agent) and an optional lifetime such as "720h". The token is only returned in this response. Requires the admin role.
+// @Tags Tokens
+// @Accept json
+// @Produce json
+// @Param token body store.TokenData true "Token"
+// @Success 201 {object} createTokenResponse "Token created"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /tokens [post]
+func (a *API) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var data store.TokenData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	auditFrom(r).setParam("name", data.Name)
+	auditFrom(r).setParam("scopes", data.Scopes)
+	auditFrom(r).setParam("expires_in", data.ExpiresIn)
+
+	secret, err := generateToken()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("generate token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	secret = apiTokenPrefix + secret
+
+	caller := principalFrom(r).Name
+	token, err := a.store.CreateAPIToken(r.Context(), data, secret[:apiTokenLookupLen], hashToken(secret), caller)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("create token: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("api token %d (%s) created by %s", token.ID, token.Name, caller)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(createTokenResponse{tokenResponse: tokenPayload(token, time.Now()), Token: secret})
+}
+
+// handleRevokeToken godoc
+// @Summary Revoke an API token
+// @Description Revokes a token immediately. Revoked tokens stay listed. Requires the admin role.
+// @Tags Tokens
+// @Produce json
+// @Param id path int true "Token ID"
+// @Success 200 {object} tokenResponse "Token revoked"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Token not found"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /tokens/{id} [delete]
+func (a *API) handleRevokeToken(w http.ResponseWriter, r *http.Request, id uint) {
+	auditFrom(r).setParam("id", id)
+	token, err := a.store.RevokeAPIToken(r.Context(), id)
+	if errors.Is(err, store.ErrTokenNotFound) {
+		http.Error(w, fmt.Sprintf("token %d not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("revoke token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("api token %d (%s) revoked by %s", token.ID, token.Name, principalFrom(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tokenPayload(token, time.Now()))
+}
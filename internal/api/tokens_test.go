@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// issueToken stores an API token like handleCreateToken and returns it.
+func issueToken(t *testing.T, st *store.Store, data store.TokenData) string {
+	t.Helper()
+	secret, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = apiTokenPrefix + secret
+	if _, err := st.CreateAPIToken(context.Background(), data, secret[:apiTokenLookupLen], hashToken(secret), "ada"); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	return secret
+}
+
+func bearer(r *http.Request, token string) *http.Request {
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestTokenScopes(t *testing.T) {
+	_, h, st := newTestAPI(t, config.Config{})
+
+	tokens := make(map[string]string)
+	for _, scope := range store.Scopes {
+		tokens[scope] = issueToken(t, st, store.TokenData{Name: scope, Scopes: []string{scope}})
+	}
+
+	target := `{"name": "new", "repository": "/srv/restic/new", "password": "secret"}`
+	routes := []struct {
+		method string
+		path   string
+		body   string
+		scope  string
+	}{
+		{http.MethodGet, "/api/v1/status", "", store.ScopeReadStatus},
+		{http.MethodGet, "/api/v1/tasks", "", store.ScopeReadStatus},
+		{http.MethodPost, "/api/v1/check/home", "", store.ScopeWriteCheck},
+		{http.MethodPost, "/api/v1/prune/home", "", store.ScopeWritePrune},
+		{http.MethodPost, "/api/v1/unlock/home", "", store.ScopeWriteUnlock},
+		{http.MethodPost, "/api/v1/targets", target, store.ScopeWriteTargets},
+		{http.MethodPost, "/api/v1/agents/register", `{"name": "db1"}`, store.ScopeAgent},
+		// Not available to tokens at all
+		{http.MethodPost, "/api/v1/toggle/home", "", noScope},
+		{http.MethodGet, "/api/v1/users", "", noScope},
+		{http.MethodGet, "/api/v1/tokens", "", noScope},
+		{http.MethodGet, "/api/v1/export", "", noScope},
+	}
+	for _, route := range routes {
+		for _, scope := range store.Scopes {
+			t.Run(fmt.Sprintf("%s %s %s", scope, route.method, route.path), func(t *testing.T) {
+				w := serve(h, bearer(request(route.method, route.path, "", route.body), tokens[scope]))
+				if scope == route.scope {
+					if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+						t.Errorf("status = %d (%s), want the route allowed", w.Code, strings.TrimSpace(w.Body.String()))
+					}
+				} else if w.Code != http.StatusForbidden {
+					t.Errorf("status = %d, want 403", w.Code)
+				}
+			})
+		}
+	}
+}
+
+func TestTokenTargetsNeedAdminForCommandsAndReferences(t *testing.T) {
+	_, h, st := newTestAPI(t, config.Config{})
+	token := issueToken(t, st, store.TokenData{Name: "ci", Scopes: []string{store.ScopeWriteTargets}})
+
+	for _, body := range []string{
+		`{"name": "new", "repository": "/srv/restic/new", "password_command": "cat /etc/restic/pass"}`,
+		`{"name": "new", "repository": "sftp:backup@host:/srv", "password": "secret", "options": ["sftp.command=ssh -i key host"]}`,
+		`{"name": "new", "repository": "/srv/restic/new", "password": "ref+env://AUTH_PASSWORD"}`,
+		`{"name": "new", "repository": "s3:host/bucket", "password": "secret", "credentials": {"AWS_SECRET_ACCESS_KEY": "ref+file:///etc/shadow"}}`,
+	} {
+		if w := serve(h, bearer(request(http.MethodPost, "/api/v1/targets", "", body), token)); w.Code != http.StatusForbidden {
+			t.Errorf("saving %s with a token: status %d, want 403", body, w.Code)
+		}
+		if w := serve(h, request(http.MethodPost, "/api/v1/targets", "ada", body)); w.Code != http.StatusOK {
+			t.Errorf("saving %s as admin: status %d (%s), want 200", body, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+}
+
+func TestExpiredAndRevokedTokens(t *testing.T) {
+	_, h, st := newTestAPI(t, config.Config{})
+	status := func(token string) int {
+		return serve(h, bearer(request(http.MethodGet, "/api/v1/status", "", ""), token)).Code
+	}
+
+	expiring := issueToken(t, st, store.TokenData{Name: "short", Scopes: []string{store.ScopeReadStatus}, ExpiresIn: "50ms"})
+	if code := status(expiring); code != http.StatusOK {
+		t.Fatalf("status with a fresh token = %d, want 200", code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if code := status(expiring); code != http.StatusUnauthorized {
+		t.Errorf("status with an expired token = %d, want 401", code)
+	}
+
+	w := serve(h, request(http.MethodPost, "/api/v1/tokens", "ada", `{"name": "grafana", "scopes": ["read:status"]}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create token: %d %s", w.Code, w.Body)
+	}
+	var created struct {
+		ID    uint   `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if code := status(created.Token); code != http.StatusOK {
+		t.Fatalf("status with the new token = %d, want 200", code)
+	}
+	if w := serve(h, request(http.MethodDelete, fmt.Sprintf("/api/v1/tokens/%d", created.ID), "ada", "")); w.Code != http.StatusOK {
+		t.Fatalf("revoke token: %d %s", w.Code, w.Body)
+	}
+	if code := status(created.Token); code != http.StatusUnauthorized {
+		t.Errorf("status with a revoked token = %d, want 401", code)
+	}
+	if code := status(created.Token[:len(created.Token)-1] + "x"); code != http.StatusUnauthorized {
+		t.Errorf("status with a wrong token = %d, want 401", code)
+	}
+}
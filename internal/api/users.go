@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/store"
+)
+
+type userResponse struct {
+	Username string `json:"username" example:"alice"`
+	Role     string `json:"role" example:"operator"`
+	// Targets limits the user to these targets; empty means all.
+	Targets   []string  `json:"targets" example:"home,nas"`
+	Disabled  bool      `json:"disabled" example:"false"`
+	CreatedAt time.Time `json:"createdAt" example:"2025-11-23T14:30:00Z"`
+	UpdatedAt time.Time `json:"updatedAt" example:"2025-11-23T14:30:00Z"`
+}
+
+type meResponse struct {
+	Username string   `json:"username" example:"alice"`
+	Role     string   `json:"role" example:"operator"`
+	Targets  []string `json:"targets" example:"home,nas"`
+	// Scopes are set when the caller is an API token.
+	Scopes []string `json:"scopes,omitempty" example:"read:status"`
+}
+
+func userPayload(user store.User) userResponse {
+	targets, err := user.TargetNames()
+	if err != nil {
+		log.Printf("decode targets of user %s: %v", user.Username, err)
+	}
+	if targets == nil {
+		targets = []string{}
+	}
+	return userResponse{
+		Username:  user.Username,
+		Role:      user.Role,
+		Targets:   targets,
+		Disabled:  user.Disabled,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+}
+
+// handleUsers dispatches /api/v1/users and /api/v1/users/{name}.
+func (a *API) handleUsers(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/users"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		a.handleListUsers(w, r)
+	case name == "" && r.Method == http.MethodPost:
+		a.handleCreateUser(w, r)
+	case name != "" && r.Method == http.MethodGet:
+		a.handleGetUser(w, r, name)
+	case name != "" && r.Method == http.MethodPut:
+		a.handleUpdateUser(w, r, name)
+	case name != "" && r.Method == http.MethodDelete:
+		a.handleDeleteUser(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListUsers godoc
+// @Summary List users
+// @Description Returns all users with their role and target scope. Requires the admin role.
+// @Tags Users
+// @Produce json
+// @Success 200 {array} userResponse "List of users"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 500 {string} string "Internal server error"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /users [get]
+func (a *API) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := a.store.ListUsers(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list users: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payloads := make([]userResponse, 0, len(users))
+	for _, user := range users {
+		payloads = append(payloads, userPayload(user))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(payloads)
+}
+
+// handleCreateUser godoc
+// @Summary Create a user
+// @Description Creates a user with a role (viewer, operator or admin) and an optional list of targets the user is limited to. Requires the admin role.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param user body store.UserData true "User"
+// @Success 201 {object} userResponse "User created"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /users [post]
+func (a *API) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var data store.UserData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	auditUser(r, data)
+	user, err := a.store.CreateUser(r.Context(), data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("create user: %v", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("user %s created with role %s by %s", user.Username, user.Role, principalFrom(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(userPayload(user))
+}
+
+// handleGetUser godoc
+// @Summary Get a user
+// @Description Returns a single user. Requires the admin role.
+// @Tags Users
+// @Produce json
+// @Param name path string true "Username"
+// @Success 200 {object} userResponse "User"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "User not found"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /users/{name} [get]
+func (a *API) handleGetUser(w http.ResponseWriter, r *http.Request, name string) {
+	user, err := a.store.GetUser(r.Context(), name)
+	if err != nil {
+		writeUserError(w, name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(userPayload(user))
+}
+
+// handleUpdateUser godoc
+// @Summary Update a user
+// @Description Replaces the role, targets and disabled flag of a user. The password is only changed when given. Requires the admin role.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param name path string true "Username"
+// @Param user body store.UserData true "User"
+// @Success 200 {object} userResponse "User updated"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "User not found"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /users/{name} [put]
+func (a *API) handleUpdateUser(w http.ResponseWriter, r *http.Request, name string) {
+	var data store.UserData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	data.Username = name
+	auditUser(r, data)
+
+	// Keep admins from locking themselves out
+	if name == principalFrom(r).Name && (data.Role != store.RoleAdmin || data.Disabled) {
+		http.Error(w, "cannot demote or disable your own user", http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.store.UpdateUser(r.Context(), data)
+	if err != nil {
+		writeUserError(w, name, err)
+		return
+	}
+	a.verified.Delete(name)
+	log.Printf("user %s updated by %s", name, principalFrom(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(userPayload(user))
+}
+
+// handleDeleteUser godoc
+// @Summary Delete a user
+// @Description Removes a user. Requires the admin role.
+// @Tags Users
+// @Produce json
+// @Param name path string true "Username"
+// @Success 200 {object} map[string]string "User deleted"
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "User not found"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /users/{name} [delete]
+func (a *API) handleDeleteUser(w http.ResponseWriter, r *http.Request, name string) {
+	auditFrom(r).setParam("username", name)
+	if name == principalFrom(r).Name {
+		http.Error(w, "cannot delete your own user", http.StatusBadRequest)
+		return
+	}
+	if err := a.store.DeleteUser(r.Context(), name); err != nil {
+		writeUserError(w, name, err)
+		return
+	}
+	a.verified.Delete(name)
+	log.Printf("user %s deleted by %s", name, principalFrom(r).Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// auditUser records the user change without the password.
+func auditUser(r *http.Request, data store.UserData) {
+	rec := auditFrom(r)
+	rec.setParam("username", data.Username)
+	rec.setParam("role", data.Role)
+	rec.setParam("targets", data.Targets)
+	rec.setParam("disabled", data.Disabled)
+	rec.setParam("password_changed", data.Password != "")
+}
+
+func writeUserError(w http.ResponseWriter, name string, err error) {
+	if errors.Is(err, store.ErrUserNotFound) {
+		http.Error(w, fmt.Sprintf("user %s not found", name), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// handleMe godoc
+// @Summary Get the current user
+// @Description Returns the name, role and target scope of the authenticated caller, or the scopes of an API token
+// @Tags Users
+// @Produce json
+// @Success 200 {object} meResponse "Current user"
+// @Failure 401 {string} string "Unauthorized"
+// @Security BasicAuth
+// @Security BearerAuth
+// @Router /me [get]
+func (a *API) handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := principalFrom(r)
+	targets := p.Targets
+	if targets == nil {
+		targets = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(meResponse{Username: p.Name, Role: p.Role, Targets: targets, Scopes: p.Scopes})
+}
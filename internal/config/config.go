@@ -1,8 +1,11 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,6 +17,7 @@ type Config struct {
 	PasswordFile    string
 	CertificateFile string
 	CheckInterval   time.Duration
+	StatsInterval   time.Duration
 	ResticTimeout   time.Duration
 	DatabaseDSN     string
 	APIListenAddr   string
@@ -22,63 +26,272 @@ type Config struct {
 	AuthUsername    string
 	AuthPassword    string
 	AuthToken       string
+	SecretKey       string
+	SecretKeyFile   string
+	VaultAddr       string
+	VaultToken      string
+	NotifyWebhook   string
 	PublicDir       string
 	ShowSwagger     bool
 	MockMode        bool
+	MockScenario    string
+
+	// AnomalyWindow is the number of earlier snapshots forming the baseline
+	// of the growth anomaly detection; zero disables it.
+	AnomalyWindow      int
+	AnomalyShrinkRatio float64
+	AnomalyGrowthRatio float64
+
+	// FreshnessWarning and FreshnessCritical are the ages of the latest
+	// snapshot at which a target turns warning and critical.
+	FreshnessWarning  time.Duration
+	FreshnessCritical time.Duration
+
+	// OIDCIssuerURL enables the OpenID Connect dashboard login.
+	// OIDCRoleMapping maps groups to roles as "group=role,..."; users
+	// without a mapped group get OIDCDefaultRole or are refused.
+	OIDCIssuerURL     string
+	OIDCClientID      string
+	OIDCClientSecret  string
+	OIDCRedirectURL   string
+	OIDCScopes        string
+	OIDCUsernameClaim string
+	OIDCGroupsClaim   string
+	OIDCRoleMapping   string
+	OIDCDefaultRole   string
+	SessionTTL        time.Duration
+
+	// CORSAllowedOrigins lists the origins of cross-origin browser clients;
+	// empty allows none.
+	CORSAllowedOrigins []string
+	CORSAllowedMethods string
+	CORSAllowedHeaders string
+
+	// TLSCertFile and TLSKeyFile enable HTTPS; both files are reloaded when
+	// they change. TLSClientAuth is "none", "optional" or "require" and
+	// verifies client certificates against TLSClientCAFile.
+	// TLSRedirectAddr serves redirects from HTTP to HTTPS.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	TLSClientAuth   string
+	TLSRedirectAddr string
+
+	// LoginMaxFailures failed logins from an IP address or for a username
+	// lock it out for LoginLockout, doubling with every further failure up
+	// to LoginLockoutMax; zero disables the lockout. ResticRateLimit is the
+	// number of requests running restic each caller may send a minute.
+	// TrustedProxies are the proxies whose X-Forwarded-For is believed.
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	LoginLockoutMax  time.Duration
+	ResticRateLimit  int
+	TrustedProxies   []string
+
+	// ShutdownGracePeriod is how long shutdown waits for running requests
+	// and restic commands, such as a prune, before interrupting them.
+	ShutdownGracePeriod time.Duration
+
+	// DatabaseAutoMigrate applies pending schema migrations on startup;
+	// when false, startup fails until they are applied with migrate-up.
+	DatabaseAutoMigrate bool
+
+	// File is the configuration file the settings were read from, if any;
+	// Targets are the targets it defines.
+	File    string
+	Targets []Target
+
+	// origins records where each setting came from for error messages
+	origins map[string]string
 }
 
-// Load reads configuration values from environment variables.
+// Load reads the configuration file named by CONFIG_FILE, if set, and
+// the environment variables, which override the file.
 func Load() (Config, error) {
-	cfg := Config{
-		ResticBinary:    firstNonEmpty(os.Getenv("RESTIC_BINARY"), "restic"),
-		Repository:      os.Getenv("RESTIC_REPOSITORY"),
-		Password:        os.Getenv("RESTIC_PASSWORD"),
-		PasswordFile:    os.Getenv("RESTIC_PASSWORD_FILE"),
-		CertificateFile: os.Getenv("RESTIC_CERT_FILE"),
-		DatabaseDSN:     firstNonEmpty(os.Getenv("DATABASE_DSN"), "restic-monitor.db"),
-		APIListenAddr:   firstNonEmpty(os.Getenv("API_LISTEN_ADDR"), ":8080"),
-		CheckInterval:   mustParseDuration(os.Getenv("CHECK_INTERVAL"), 5*time.Minute),
-		ResticTimeout:   mustParseDuration(os.Getenv("RESTIC_TIMEOUT"), 60*time.Second),
-		SnapshotLimit:   mustParseInt(os.Getenv("SNAPSHOT_FILE_LIMIT"), 200),
-		TargetsFile:     firstNonEmpty(os.Getenv("TARGETS_FILE"), "targets.json"),
-		AuthUsername:    os.Getenv("AUTH_USERNAME"),
-		AuthPassword:    os.Getenv("AUTH_PASSWORD"),
-		AuthToken:       os.Getenv("AUTH_TOKEN"),
-		PublicDir:       firstNonEmpty(os.Getenv("PUBLIC_DIR"), "public"),
-		ShowSwagger:     os.Getenv("SHOW_SWAGGER") == "true",
-		MockMode:        os.Getenv("MOCK_MODE") == "true",
-	}
-
-	return cfg, nil
+	return LoadFile(os.Getenv("CONFIG_FILE"))
 }
 
-func firstNonEmpty(values ...string) string {
-	for _, value := range values {
-		if value != "" {
-			return value
+// LoadFile reads the configuration file at path, which may be empty, and
+// the environment variables, which override the file. All syntax and
+// validation errors are returned together.
+func LoadFile(path string) (Config, error) {
+	cfg := Config{File: path, origins: make(map[string]string)}
+	for _, s := range settings {
+		if err := s.set(&cfg, s.def); err != nil {
+			panic(fmt.Sprintf("default of %s: %v", s.env, err))
 		}
 	}
-	return ""
-}
 
-func mustParseDuration(value string, fallback time.Duration) time.Duration {
-	if value == "" {
-		return fallback
+	var errs []error
+	if path != "" {
+		errs = append(errs, cfg.readFile(path)...)
 	}
-	duration, err := time.ParseDuration(value)
-	if err != nil {
-		return fallback
+	for _, s := range settings {
+		value := os.Getenv(s.env)
+		if value == "" {
+			continue
+		}
+		if err := s.set(&cfg, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			continue
+		}
+		cfg.origins[s.key()] = s.env
 	}
-	return duration
+	errs = append(errs, cfg.Validate())
+	return cfg, errors.Join(errs...)
+}
+
+// setting is a configuration value. It is read from the environment
+// variable env and from the lower case key of the same name in the
+// configuration file.
+type setting struct {
+	env  string
+	def  string
+	list bool
+	set  func(c *Config, value string) error
+}
+
+func (s setting) key() string {
+	return strings.ToLower(s.env)
 }
 
-func mustParseInt(value string, fallback int) int {
-	if value == "" {
-		return fallback
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key() == key {
+			return s, true
+		}
 	}
-	n, err := strconv.Atoi(value)
-	if err != nil {
-		return fallback
+	return setting{}, false
+}
+
+func stringSetting(env, def string, field func(*Config) *string) setting {
+	return setting{env: env, def: def, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func durationSetting(env, def string, field func(*Config) *time.Duration) setting {
+	return setting{env: env, def: def, set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+func intSetting(env, def string, field func(*Config) *int) setting {
+	return setting{env: env, def: def, set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func floatSetting(env, def string, field func(*Config) *float64) setting {
+	return setting{env: env, def: def, set: func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(c) = f
+		return nil
+	}}
+}
+
+func boolSetting(env, def string, field func(*Config) *bool) setting {
+	return setting{env: env, def: def, set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, use true or false", value)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func listSetting(env, def string, field func(*Config) *[]string) setting {
+	return setting{env: env, def: def, list: true, set: func(c *Config, value string) error {
+		*field(c) = splitList(value)
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("RESTIC_BINARY", "restic", func(c *Config) *string { return &c.ResticBinary }),
+	stringSetting("RESTIC_REPOSITORY", "", func(c *Config) *string { return &c.Repository }),
+	stringSetting("RESTIC_PASSWORD", "", func(c *Config) *string { return &c.Password }),
+	stringSetting("RESTIC_PASSWORD_FILE", "", func(c *Config) *string { return &c.PasswordFile }),
+	stringSetting("RESTIC_CERT_FILE", "", func(c *Config) *string { return &c.CertificateFile }),
+	stringSetting("DATABASE_DSN", "restic-monitor.db", func(c *Config) *string { return &c.DatabaseDSN }),
+	boolSetting("DATABASE_AUTO_MIGRATE", "true", func(c *Config) *bool { return &c.DatabaseAutoMigrate }),
+	stringSetting("API_LISTEN_ADDR", ":8080", func(c *Config) *string { return &c.APIListenAddr }),
+	durationSetting("CHECK_INTERVAL", "5m", func(c *Config) *time.Duration { return &c.CheckInterval }),
+	durationSetting("STATS_INTERVAL", "6h", func(c *Config) *time.Duration { return &c.StatsInterval }),
+	durationSetting("RESTIC_TIMEOUT", "60s", func(c *Config) *time.Duration { return &c.ResticTimeout }),
+	durationSetting("SHUTDOWN_GRACE_PERIOD", "2m", func(c *Config) *time.Duration { return &c.ShutdownGracePeriod }),
+	intSetting("SNAPSHOT_FILE_LIMIT", "200", func(c *Config) *int { return &c.SnapshotLimit }),
+	stringSetting("TARGETS_FILE", "targets.json", func(c *Config) *string { return &c.TargetsFile }),
+	stringSetting("AUTH_USERNAME", "", func(c *Config) *string { return &c.AuthUsername }),
+	stringSetting("AUTH_PASSWORD", "", func(c *Config) *string { return &c.AuthPassword }),
+	stringSetting("AUTH_TOKEN", "", func(c *Config) *string { return &c.AuthToken }),
+	stringSetting("SECRET_KEY", "", func(c *Config) *string { return &c.SecretKey }),
+	stringSetting("SECRET_KEY_FILE", "", func(c *Config) *string { return &c.SecretKeyFile }),
+	stringSetting("VAULT_ADDR", "", func(c *Config) *string { return &c.VaultAddr }),
+	stringSetting("VAULT_TOKEN", "", func(c *Config) *string { return &c.VaultToken }),
+	stringSetting("NOTIFY_WEBHOOK_URL", "", func(c *Config) *string { return &c.NotifyWebhook }),
+	stringSetting("PUBLIC_DIR", "public", func(c *Config) *string { return &c.PublicDir }),
+	boolSetting("SHOW_SWAGGER", "false", func(c *Config) *bool { return &c.ShowSwagger }),
+	boolSetting("MOCK_MODE", "false", func(c *Config) *bool { return &c.MockMode }),
+	stringSetting("MOCK_SCENARIO", "", func(c *Config) *string { return &c.MockScenario }),
+
+	intSetting("ANOMALY_WINDOW", "7", func(c *Config) *int { return &c.AnomalyWindow }),
+	floatSetting("ANOMALY_SHRINK_RATIO", "0.5", func(c *Config) *float64 { return &c.AnomalyShrinkRatio }),
+	floatSetting("ANOMALY_GROWTH_RATIO", "3", func(c *Config) *float64 { return &c.AnomalyGrowthRatio }),
+
+	durationSetting("FRESHNESS_WARNING", "26h", func(c *Config) *time.Duration { return &c.FreshnessWarning }),
+	durationSetting("FRESHNESS_CRITICAL", "72h", func(c *Config) *time.Duration { return &c.FreshnessCritical }),
+
+	stringSetting("OIDC_ISSUER_URL", "", func(c *Config) *string { return &c.OIDCIssuerURL }),
+	stringSetting("OIDC_CLIENT_ID", "", func(c *Config) *string { return &c.OIDCClientID }),
+	stringSetting("OIDC_CLIENT_SECRET", "", func(c *Config) *string { return &c.OIDCClientSecret }),
+	stringSetting("OIDC_REDIRECT_URL", "", func(c *Config) *string { return &c.OIDCRedirectURL }),
+	stringSetting("OIDC_SCOPES", "openid profile email", func(c *Config) *string { return &c.OIDCScopes }),
+	stringSetting("OIDC_USERNAME_CLAIM", "preferred_username", func(c *Config) *string { return &c.OIDCUsernameClaim }),
+	stringSetting("OIDC_GROUPS_CLAIM", "groups", func(c *Config) *string { return &c.OIDCGroupsClaim }),
+	stringSetting("OIDC_ROLE_MAPPING", "", func(c *Config) *string { return &c.OIDCRoleMapping }),
+	stringSetting("OIDC_DEFAULT_ROLE", "", func(c *Config) *string { return &c.OIDCDefaultRole }),
+	durationSetting("SESSION_TTL", "12h", func(c *Config) *time.Duration { return &c.SessionTTL }),
+
+	listSetting("CORS_ALLOWED_ORIGINS", "", func(c *Config) *[]string { return &c.CORSAllowedOrigins }),
+	stringSetting("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE, OPTIONS", func(c *Config) *string { return &c.CORSAllowedMethods }),
+	stringSetting("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-CSRF-Token", func(c *Config) *string { return &c.CORSAllowedHeaders }),
+
+	stringSetting("TLS_CERT_FILE", "", func(c *Config) *string { return &c.TLSCertFile }),
+	stringSetting("TLS_KEY_FILE", "", func(c *Config) *string { return &c.TLSKeyFile }),
+	stringSetting("TLS_CLIENT_CA_FILE", "", func(c *Config) *string { return &c.TLSClientCAFile }),
+	stringSetting("TLS_CLIENT_AUTH", "none", func(c *Config) *string { return &c.TLSClientAuth }),
+	stringSetting("TLS_REDIRECT_ADDR", "", func(c *Config) *string { return &c.TLSRedirectAddr }),
+
+	intSetting("LOGIN_MAX_FAILURES", "5", func(c *Config) *int { return &c.LoginMaxFailures }),
+	durationSetting("LOGIN_LOCKOUT", "1m", func(c *Config) *time.Duration { return &c.LoginLockout }),
+	durationSetting("LOGIN_LOCKOUT_MAX", "1h", func(c *Config) *time.Duration { return &c.LoginLockoutMax }),
+	intSetting("RESTIC_RATE_LIMIT", "30", func(c *Config) *int { return &c.ResticRateLimit }),
+	listSetting("TRUSTED_PROXIES", "", func(c *Config) *[]string { return &c.TrustedProxies }),
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return n
+	return items
 }
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a configuration file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    []string
+	}{
+		{
+			name:    "unknown setting",
+			content: "check_interval: 5m\n\ncheck_intervall: 10m\n",
+			want:    []string{`config.yaml:3: unknown setting "check_intervall"`},
+		},
+		{
+			name: "unknown target field",
+			content: `targets:
+  - name: home
+    repository: /srv/restic/home
+    pasword: secret
+`,
+			want: []string{"config.yaml:4: unknown target field pasword"},
+		},
+		{
+			name:    "bad duration",
+			content: "database_dsn: monitor.db\nrestic_timeout: soon\n",
+			want:    []string{`config.yaml:2: restic_timeout: invalid duration "soon"`},
+		},
+		{
+			name:    "bad integer and boolean",
+			content: "snapshot_file_limit: many\nshow_swagger: yes please\n",
+			want: []string{
+				`config.yaml:1: snapshot_file_limit: invalid integer "many"`,
+				`config.yaml:2: show_swagger: invalid boolean "yes please"`,
+			},
+		},
+		{
+			name:    "bad enum",
+			content: "tls_client_auth: maybe\n",
+			want:    []string{`config.yaml:1: tls_client_auth: must be none, optional or require, not "maybe"`},
+		},
+		{
+			name:    "list for a single value",
+			content: "api_listen_addr:\n  - :8080\n  - :8081\n",
+			want:    []string{"config.yaml:1: api_listen_addr: expected a single value, not a list"},
+		},
+		{
+			name:    "invalid value",
+			content: "anomaly_growth_ratio: 0.5\n",
+			want:    []string{"config.yaml:1: anomaly_growth_ratio: must be greater than 1"},
+		},
+		{
+			name:    "duplicate target",
+			content: "targets:\n  - name: home\n  - name: home\n",
+			want:    []string{`config.yaml:3: duplicate target "home"`},
+		},
+		{
+			name:    "syntax error",
+			content: "check_interval: 5m\n  restic_timeout: 1m\n",
+			want:    []string{"config.yaml:2: "},
+		},
+		{
+			name: "invalid environment value",
+			env:  map[string]string{"CHECK_INTERVAL": "often"},
+			want: []string{`CHECK_INTERVAL: invalid duration "often"`},
+		},
+		{
+			name:    "validation error from the environment",
+			content: "freshness_critical: 48h\n",
+			env:     map[string]string{"FRESHNESS_WARNING": "50h"},
+			want:    []string{"FRESHNESS_WARNING: must be positive and shorter than freshness_critical (48h0m0s)"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			path := ""
+			if tc.content != "" {
+				path = writeConfig(t, tc.content)
+			}
+			_, err := LoadFile(path)
+			if err == nil {
+				t.Fatal("LoadFile succeeded")
+			}
+			message := strings.ReplaceAll(err.Error(), filepath.Dir(path)+string(filepath.Separator), "")
+			for _, want := range tc.want {
+				if !strings.Contains(message, want) {
+					t.Errorf("errors lack %q:\n%s", want, message)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `check_interval: 10m
+restic_timeout: 2m
+cors_allowed_origins:
+  - https://a.example.com
+  - https://b.example.com
+auth_token:
+targets:
+  - name: home
+    repository: /srv/restic/home
+    password: secret
+    keep_daily: 7
+`)
+	t.Setenv("CHECK_INTERVAL", "1m")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, 10.0.0.2")
+
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if cfg.CheckInterval != time.Minute {
+		t.Errorf("check interval = %s, want the environment to win", cfg.CheckInterval)
+	}
+	if cfg.ResticTimeout != 2*time.Minute || cfg.StatsInterval != 6*time.Hour {
+		t.Errorf("restic timeout %s, stats interval %s, want the file value and the default", cfg.ResticTimeout, cfg.StatsInterval)
+	}
+	if strings.Join(cfg.CORSAllowedOrigins, " ") != "https://a.example.com https://b.example.com" {
+		t.Errorf("CORS origins = %q", cfg.CORSAllowedOrigins)
+	}
+	if strings.Join(cfg.TrustedProxies, " ") != "10.0.0.1 10.0.0.2" {
+		t.Errorf("trusted proxies = %q", cfg.TrustedProxies)
+	}
+	if len(cfg.Targets) != 1 || cfg.Targets[0].Name != "home" || cfg.Targets[0].KeepDaily != 7 {
+		t.Errorf("targets = %+v", cfg.Targets)
+	}
+
+	for key, want := range map[string]string{
+		"check_interval":  "CHECK_INTERVAL",
+		"restic_timeout":  filepath.Base(path) + ":2",
+		"stats_interval":  "stats_interval",
+		"targets[0]":      filepath.Base(path) + ":8",
+		"trusted_proxies": "TRUSTED_PROXIES",
+	} {
+		if got := cfg.Origin(key); !strings.HasSuffix(got, want) {
+			t.Errorf("Origin(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestLoadTargets(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.json")
+	if err := os.WriteFile(file, []byte("[\n  {\"name\": \"home\", \"repository\": \"/srv\"},\n  {\"name\": \"away\", \"repo\": \"/srv\"}\n]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Config{TargetsFile: file}.LoadTargets()
+	if err == nil || !strings.Contains(err.Error(), "targets.json:3:") || !strings.Contains(err.Error(), `unknown field "repo"`) {
+		t.Errorf("LoadTargets = %v, want the unknown field with its line", err)
+	}
+
+	targets, err := Config{TargetsFile: filepath.Join(dir, "missing.json")}.LoadTargets()
+	if err != nil || len(targets) != 0 {
+		t.Errorf("LoadTargets of a missing file = %v, %v, want none", targets, err)
+	}
+}
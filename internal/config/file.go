@@ -0,0 +1,250 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Target is a backup target of targets.json or the configuration file.
+type Target struct {
+	Name            string `json:"name" yaml:"name"`
+	Repository      string `json:"repository" yaml:"repository"`
+	Password        string `json:"password" yaml:"password"`
+	PasswordFile    string `json:"password_file" yaml:"password_file"`
+	PasswordCommand string `json:"password_command" yaml:"password_command"`
+	CertificateFile string `json:"certificate_file" yaml:"certificate_file"`
+	// Credentials maps the backend environment variables passed to restic,
+	// such as AWS_SECRET_ACCESS_KEY or AWS_DEFAULT_REGION, to values or
+	// secret references.
+	Credentials map[string]string `json:"credentials" yaml:"credentials"`
+	// Env is the former field for non-secret variables. It is merged into
+	// Credentials when the target is saved; Credentials wins when both set
+	// a variable. Options are passed to restic as "-o key=value".
+	Env      map[string]string `json:"env" yaml:"env"`
+	Options  []string          `json:"options" yaml:"options"`
+	Disabled bool              `json:"disabled" yaml:"disabled"`
+	// AutoUnlockAfter is a duration such as "2h", at least
+	// store.MinAutoUnlockAfter.
+	AutoUnlockAfter string `json:"auto_unlock_after" yaml:"auto_unlock_after"`
+	// Prune policy
+	KeepLast    int `json:"keep_last" yaml:"keep_last"`
+	KeepDaily   int `json:"keep_daily" yaml:"keep_daily"`
+	KeepWeekly  int `json:"keep_weekly" yaml:"keep_weekly"`
+	KeepMonthly int `json:"keep_monthly" yaml:"keep_monthly"`
+}
+
+// fileTargets decodes the targets of the configuration file strictly;
+// the other keys are checked against the settings.
+type fileTargets struct {
+	Targets []Target       `yaml:"targets"`
+	Other   map[string]any `yaml:",inline"`
+}
+
+// readFile applies the settings of the YAML configuration file at path.
+// Keys are the environment variable names in lower case; "targets" lists
+// targets like targets.json.
+func (c *Config) readFile(path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return yamlErrors(path, err)
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return []error{fmt.Errorf("%s:%d: expected a mapping of settings", path, doc.Line)}
+	}
+
+	var errs []error
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		where := fmt.Sprintf("%s:%d", path, key.Line)
+		if key.Value == "targets" {
+			c.origins["targets"] = where
+			continue
+		}
+		s, ok := lookupSetting(key.Value)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", where, key.Value))
+			continue
+		}
+		raw, err := scalarValue(value, s.list)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", where, key.Value, err))
+			continue
+		}
+		if value.Tag == "!!null" {
+			continue
+		}
+		if err := s.set(c, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", where, key.Value, err))
+			continue
+		}
+		c.origins[s.key()] = where
+	}
+
+	var targets fileTargets
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&targets); err != nil {
+		errs = append(errs, yamlErrors(path, err)...)
+	} else {
+		c.Targets = targets.Targets
+		for i, line := range targetLines(doc) {
+			c.origins[fmt.Sprintf("targets[%d]", i)] = fmt.Sprintf("%s:%d", path, line)
+		}
+	}
+	return errs
+}
+
+// scalarValue returns the value of a setting; lists may also be written
+// as YAML sequences.
+func scalarValue(node *yaml.Node, list bool) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		if !list {
+			return "", errors.New("expected a single value, not a list")
+		}
+		items := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("line %d: expected a single value", item.Line)
+			}
+			items = append(items, item.Value)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errors.New("expected a single value")
+}
+
+// targetLines returns the line of each entry of the targets key.
+func targetLines(doc *yaml.Node) []int {
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value != "targets" || doc.Content[i+1].Kind != yaml.SequenceNode {
+			continue
+		}
+		var lines []int
+		for _, item := range doc.Content[i+1].Content {
+			lines = append(lines, item.Line)
+		}
+		return lines
+	}
+	return nil
+}
+
+var unknownField = regexp.MustCompile(`field (\S+) not found in type config\.Target`)
+
+// yamlErrors turns the errors of the YAML decoder, which start with
+// "line N:", into errors starting with "path:N:".
+func yamlErrors(path string, err error) []error {
+	messages := []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	errs := make([]error, 0, len(messages))
+	for _, message := range messages {
+		message = unknownField.ReplaceAllString(message, "unknown target field $1")
+		var line int
+		if _, err := fmt.Sscanf(message, "line %d:", &line); err == nil {
+			_, message, _ = strings.Cut(message, ": ")
+			errs = append(errs, fmt.Errorf("%s:%d: %s", path, line, message))
+			continue
+		}
+		errs = append(errs, fmt.Errorf("%s: %s", path, message))
+	}
+	return errs
+}
+
+// LoadTargets returns the targets of the configuration file or, if it
+// defines none, of TargetsFile. A missing TargetsFile yields no targets.
+// Unknown fields are rejected in both.
+func (c Config) LoadTargets() ([]Target, error) {
+	if len(c.Targets) > 0 {
+		return c.Targets, nil
+	}
+	data, err := os.ReadFile(c.TargetsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&targets); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, fmt.Errorf("%s:%d: %w", c.TargetsFile, lineOf(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return nil, fmt.Errorf("%s:%d: %w", c.TargetsFile, lineOf(data, typeErr.Offset), err)
+		}
+		offset := decoder.InputOffset()
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if name, err := strconv.Unquote(field); err == nil {
+				offset = keyOffset(data, name, offset)
+			}
+		}
+		return nil, fmt.Errorf("%s:%d: %w", c.TargetsFile, lineOf(data, offset), err)
+	}
+	if err := validateTargets(targets, func(i int) string {
+		return fmt.Sprintf("%s: target %d", c.TargetsFile, i+1)
+	}); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// keyOffset returns the offset just past the first object key called name,
+// or fallback if there is none. The decoder reports unknown fields only after
+// reading the whole value.
+func keyOffset(data []byte, name string, fallback int64) int64 {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// open holds the delimiters of the enclosing objects and arrays
+	var open []json.Delim
+	wantKey := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return fallback
+		}
+		if key, ok := token.(string); ok && wantKey {
+			if key == name {
+				return decoder.InputOffset()
+			}
+			wantKey = false
+			continue
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			open = append(open, token.(json.Delim))
+		case json.Delim('}'), json.Delim(']'):
+			open = open[:len(open)-1]
+		}
+		// Objects expect a key after they open and after every value
+		wantKey = len(open) > 0 && open[len(open)-1] == '{'
+	}
+}
+
+func lineOf(data []byte, offset int64) int {
+	return bytes.Count(data[:min(int(offset), len(data))], []byte("\n")) + 1
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Validate checks the settings for values the monitor cannot work with
+// and returns all problems together.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		errs = append(errs, fmt.Errorf("%s: %s", c.Describe(key), message))
+	}
+
+	if c.DatabaseDSN == "" {
+		fail("database_dsn", "must not be empty")
+	}
+	if c.APIListenAddr == "" {
+		fail("api_listen_addr", "must not be empty")
+	}
+	for key, d := range map[string]int64{
+		"check_interval": int64(c.CheckInterval),
+		"stats_interval": int64(c.StatsInterval),
+		"restic_timeout": int64(c.ResticTimeout),
+		"session_ttl":    int64(c.SessionTTL),
+	} {
+		if d <= 0 {
+			fail(key, "must be positive")
+		}
+	}
+	if c.ShutdownGracePeriod < 0 {
+		fail("shutdown_grace_period", "must not be negative")
+	}
+	if c.SnapshotLimit < 0 {
+		fail("snapshot_file_limit", "must not be negative")
+	}
+
+	if (c.AuthUsername == "") != (c.AuthPassword == "") {
+		fail("auth_username", "auth_username and auth_password must be set together")
+	}
+	if c.SecretKey != "" && c.SecretKeyFile != "" {
+		fail("secret_key", "set either secret_key or secret_key_file")
+	}
+	if c.NotifyWebhook != "" && !isHTTPURL(c.NotifyWebhook) {
+		fail("notify_webhook_url", "must be an http or https URL")
+	}
+	if c.VaultAddr != "" && !isHTTPURL(c.VaultAddr) {
+		fail("vault_addr", "must be an http or https URL")
+	}
+
+	if c.AnomalyWindow < 0 {
+		fail("anomaly_window", "must not be negative")
+	}
+	if c.AnomalyShrinkRatio <= 0 || c.AnomalyShrinkRatio >= 1 {
+		fail("anomaly_shrink_ratio", "must be between 0 and 1")
+	}
+	if c.AnomalyGrowthRatio <= 1 {
+		fail("anomaly_growth_ratio", "must be greater than 1")
+	}
+	if c.FreshnessWarning <= 0 || c.FreshnessWarning >= c.FreshnessCritical {
+		fail("freshness_warning", "must be positive and shorter than freshness_critical (%s)", c.FreshnessCritical)
+	}
+
+	if c.OIDCIssuerURL != "" {
+		if !isHTTPURL(c.OIDCIssuerURL) {
+			fail("oidc_issuer_url", "must be an http or https URL")
+		}
+		if c.OIDCClientID == "" {
+			fail("oidc_client_id", "required with oidc_issuer_url")
+		}
+		if !isHTTPURL(c.OIDCRedirectURL) {
+			fail("oidc_redirect_url", "required with oidc_issuer_url as an http or https URL")
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		fail("tls_cert_file", "tls_cert_file and tls_key_file must be set together")
+	}
+	switch c.TLSClientAuth {
+	case "none":
+	case "optional", "require":
+		if c.TLSClientCAFile == "" {
+			fail("tls_client_auth", "requires tls_client_ca_file")
+		}
+		if c.TLSCertFile == "" {
+			fail("tls_client_auth", "requires tls_cert_file")
+		}
+	default:
+		fail("tls_client_auth", "must be none, optional or require, not %q", c.TLSClientAuth)
+	}
+	if c.TLSRedirectAddr != "" && c.TLSCertFile == "" {
+		fail("tls_redirect_addr", "requires tls_cert_file")
+	}
+
+	if c.LoginMaxFailures < 0 {
+		fail("login_max_failures", "must not be negative")
+	}
+	if c.LoginMaxFailures > 0 && (c.LoginLockout <= 0 || c.LoginLockoutMax < c.LoginLockout) {
+		fail("login_lockout", "must be positive and at most login_lockout_max (%s)", c.LoginLockoutMax)
+	}
+	if c.ResticRateLimit < 0 {
+		fail("restic_rate_limit", "must not be negative")
+	}
+
+	if err := validateTargets(c.Targets, func(i int) string {
+		return c.Origin(fmt.Sprintf("targets[%d]", i))
+	}); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// validateTargets checks that targets are named uniquely; where names the
+// location of a target in error messages. The store validates the rest of
+// each target.
+func validateTargets(targets []Target, where func(i int) string) error {
+	var errs []error
+	seen := make(map[string]bool, len(targets))
+	for i, target := range targets {
+		if target.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: target without name", where(i)))
+			continue
+		}
+		if seen[target.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate target %q", where(i), target.Name))
+		}
+		seen[target.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// Origin returns where a setting came from: the file and line, the
+// environment variable or the key for defaults.
+func (c Config) Origin(key string) string {
+	if origin, ok := c.origins[key]; ok {
+		return origin
+	}
+	return key
+}
+
+// Describe names a setting in error messages: the key prefixed by the
+// file and line, the environment variable, or the key for defaults.
+func (c Config) Describe(key string) string {
+	origin := c.Origin(key)
+	if strings.Contains(origin, ":") {
+		return origin + ": " + key
+	}
+	return origin
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,117 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// minBaseline is the number of earlier snapshots needed before a snapshot
+// is compared against them.
+const minBaseline = 3
+
+// recordAnomalies compares the newest snapshots of the target against the
+// snapshots before them and stores the deviations as warnings. Warnings stay
+// until their snapshot is no longer among the newest AnomalyWindow ones.
+func (m *Monitor) recordAnomalies(ctx context.Context, target store.Target, snapshots []restic.Snapshot) {
+	if m.cfg.AnomalyWindow <= 0 {
+		return
+	}
+	warnings := detectAnomalies(snapshots, m.cfg.AnomalyWindow, m.cfg.AnomalyShrinkRatio, m.cfg.AnomalyGrowthRatio)
+	created, err := m.store.ReplaceSnapshotWarnings(ctx, target.Name, warnings)
+	if err != nil {
+		log.Printf("target %s: persist snapshot warnings: %v", target.Name, err)
+		return
+	}
+	for _, warning := range created {
+		log.Printf("target %s: snapshot %s: %s", target.Name, warning.SnapshotID, warning.Message)
+	}
+}
+
+// detectAnomalies checks the newest window snapshots of every host and path
+// set. The file count and size of each are compared with the median of up
+// to window earlier snapshots of the same host and paths; a ratio below
+// shrink or above growth is reported. Snapshots without a backup summary
+// (restic before 0.17) are skipped.
+func detectAnomalies(snapshots []restic.Snapshot, window int, shrink, growth float64) []store.WarningData {
+	groups := make(map[string][]restic.Snapshot)
+	for _, snapshot := range snapshots {
+		if snapshot.Summary == nil {
+			continue
+		}
+		paths := slices.Clone(snapshot.Paths)
+		sort.Strings(paths)
+		key := snapshot.Hostname + "\x00" + strings.Join(paths, "\x00")
+		groups[key] = append(groups[key], snapshot)
+	}
+
+	var warnings []store.WarningData
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool { return group[i].Time.Before(group[j].Time) })
+		for i := max(len(group)-window, 0); i < len(group); i++ {
+			baseline := group[max(i-window, 0):i]
+			if len(baseline) < minBaseline {
+				continue
+			}
+			snapshot := group[i]
+			for _, metric := range []struct {
+				name  string
+				value func(*restic.SnapshotSummary) uint64
+			}{
+				{store.MetricFiles, func(s *restic.SnapshotSummary) uint64 { return s.TotalFilesProcessed }},
+				{store.MetricSize, func(s *restic.SnapshotSummary) uint64 { return s.TotalBytesProcessed }},
+			} {
+				values := make([]uint64, len(baseline))
+				for j, earlier := range baseline {
+					values[j] = metric.value(earlier.Summary)
+				}
+				base := median(values)
+				if base == 0 {
+					continue
+				}
+				value := metric.value(snapshot.Summary)
+				ratio := float64(value) / float64(base)
+				if ratio >= shrink && ratio <= growth {
+					continue
+				}
+				warnings = append(warnings, store.WarningData{
+					SnapshotID:   snapshot.ShortID,
+					SnapshotTime: snapshot.Time,
+					Metric:       metric.name,
+					Value:        value,
+					Baseline:     base,
+					Ratio:        ratio,
+					Message:      anomalyMessage(metric.name, value, base, ratio),
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+func anomalyMessage(metric string, value, baseline uint64, ratio float64) string {
+	what := "file count"
+	if metric == store.MetricSize {
+		what = "size"
+	}
+	if ratio < 1 {
+		return fmt.Sprintf("%s dropped by %.0f%% (%d, baseline %d)", what, (1-ratio)*100, value, baseline)
+	}
+	return fmt.Sprintf("%s grew %.1fx (%d, baseline %d)", what, ratio, value, baseline)
+}
+
+func median(values []uint64) uint64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,95 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/example/restic-monitor/internal/notify"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// unlockStale applies the stale lock policy of the target: when every lock
+// is older than AutoUnlockAfter, restic unlock removes the stale ones. It
+// runs without --remove-all, so a lock taken by a backup or prune after the
+// locks were listed is kept. Every automatic unlock is recorded and
+// notified.
+func (m *Monitor) unlockStale(ctx context.Context, target store.Target) {
+	if target.AutoUnlockAfter <= 0 {
+		return
+	}
+	repo, err := target.ResticRepo()
+	if err != nil {
+		log.Printf("target %s: stale lock policy: %v", target.Name, err)
+		return
+	}
+	locks, err := m.runner.Locks(commandContext(ctx), repo)
+	if err != nil {
+		log.Printf("target %s: list locks: %v", target.Name, err)
+		return
+	}
+	if len(locks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, lock := range locks {
+		if age := now.Sub(lock.Time); age < target.AutoUnlockAfter {
+			log.Printf("target %s: keeping %d lock(s), lock %s of %s PID %d is only %s old",
+				target.Name, len(locks), shortLockID(lock.ID), lock.Hostname, lock.PID, age.Round(time.Second))
+			return
+		}
+	}
+
+	log.Printf("target %s: removing stale locks, %d lock(s) older than %s", target.Name, len(locks), target.AutoUnlockAfter)
+	start := time.Now()
+	out, unlockErr := m.runner.Unlock(commandContext(ctx), repo, false)
+	audit := store.AuditData{
+		Time:   start,
+		Actor:  store.ActorSystem,
+		Action: "auto_unlock",
+		Target: target.Name,
+		Parameters: map[string]any{
+			"locks":             len(locks),
+			"auto_unlock_after": target.AutoUnlockAfter.String(),
+		},
+		Outcome:  store.OutcomeSuccess,
+		Duration: time.Since(start),
+	}
+	data := store.UnlockData{
+		TargetName: target.Name,
+		Automatic:  true,
+		RemoveAll:  false,
+		Locks:      locks,
+		Output:     out,
+	}
+	message := fmt.Sprintf("removed stale locks, %d lock(s) were older than %s", len(locks), target.AutoUnlockAfter)
+	if unlockErr != nil {
+		data.Error = unlockErr.Error()
+		message = fmt.Sprintf("failed to remove stale locks, %d lock(s) were older than %s: %v", len(locks), target.AutoUnlockAfter, unlockErr)
+		audit.Outcome = store.OutcomeFailure
+		audit.Error = unlockErr.Error()
+	}
+	if _, err := m.store.RecordUnlock(ctx, data); err != nil {
+		log.Printf("target %s: record unlock: %v", target.Name, err)
+	}
+	if _, err := m.store.RecordAudit(ctx, audit); err != nil {
+		log.Printf("target %s: record audit entry: %v", target.Name, err)
+	}
+	if err := m.notifier.Notify(ctx, notify.Event{
+		Type:    notify.EventAutoUnlock,
+		Target:  target.Name,
+		Message: message,
+		Details: map[string]any{"locks": locks, "output": out},
+	}); err != nil {
+		log.Printf("target %s: %v", target.Name, err)
+	}
+}
+
+func shortLockID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -3,29 +3,35 @@ package monitor
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"strings"
 	"time"
 
 	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/notify"
+	"github.com/example/restic-monitor/internal/restic"
 	"github.com/example/restic-monitor/internal/store"
 )
 
 type Monitor struct {
-	cfg     config.Config
-	store   *store.Store
-	trigger chan string
+	cfg      config.Config
+	store    *store.Store
+	runner   restic.Runner
+	notifier *notify.Notifier
+	trigger  chan string
 }
 
-func New(cfg config.Config, str *store.Store) *Monitor {
+// New returns a monitor that runs restic commands through runner, see
+// restic.NewRunner.
+func New(cfg config.Config, str *store.Store, runner restic.Runner) *Monitor {
 	return &Monitor{
-		cfg:     cfg,
-		store:   str,
-		trigger: make(chan string, 10),
+		cfg:      cfg,
+		store:    str,
+		runner:   runner,
+		notifier: notify.New(cfg.NotifyWebhook),
+		trigger:  make(chan string, 10),
 	}
 }
 
@@ -64,6 +70,10 @@ func (m *Monitor) runOnce(ctx context.Context) {
 
 	log.Printf("checking %d target(s)", len(targets))
 	for _, target := range targets {
+		if ctx.Err() != nil {
+			log.Printf("monitor stopping, skipping remaining targets")
+			return
+		}
 		if target.Disabled {
 			log.Printf("skipping disabled target %s", target.Name)
 			continue
@@ -81,10 +91,15 @@ func (m *Monitor) runTarget(ctx context.Context, target store.Target) {
 	}
 
 	snapshots, err := m.listSnapshots(ctx, target)
+	if ctx.Err() != nil {
+		log.Printf("target %s: check interrupted by shutdown", target.Name)
+		return
+	}
 	if err != nil {
 		msg := fmt.Sprintf("list snapshots: %v", err)
 		data.Health = false
 		data.StatusMessage = joinStatus(data.StatusMessage, msg)
+		data.Components = unreachable(err)
 		_ = m.store.SaveStatus(ctx, data)
 		log.Printf("target %s snapshots error: %v", target.Name, err)
 		return
@@ -92,10 +107,11 @@ func (m *Monitor) runTarget(ctx context.Context, target store.Target) {
 
 	log.Printf("target %s: found %d snapshot(s)", target.Name, len(snapshots))
 	data.SnapshotCount = len(snapshots)
+	m.recordAnomalies(ctx, target, snapshots)
 	if latest := latestSnapshot(snapshots); latest != nil {
 		data.LatestBackup = latest.Time
-		data.LatestSnapshotID = latest.ID
-		log.Printf("target %s: latest snapshot %s from %s", target.Name, latest.ID, latest.Time.Format(time.RFC3339))
+		data.LatestSnapshotID = latest.ShortID
+		log.Printf("target %s: latest snapshot %s from %s", target.Name, latest.ShortID, latest.Time.Format(time.RFC3339))
 
 		// Only load files if this is a new snapshot
 		previousLatest, err := m.store.GetLatestBackupTime(ctx, target.Name)
@@ -106,7 +122,7 @@ func (m *Monitor) runTarget(ctx context.Context, target store.Target) {
 		isNewSnapshot := previousLatest.IsZero() || latest.Time.After(previousLatest)
 		if isNewSnapshot {
 			log.Printf("target %s: new snapshot detected, saving file list", target.Name)
-			fileCount, err := m.saveSnapshotFileList(ctx, target, latest.ID)
+			fileCount, err := m.saveSnapshotFileList(ctx, target, latest.ShortID)
 			if err != nil {
 				log.Printf("target %s: error saving file list: %v", target.Name, err)
 			} else {
@@ -115,25 +131,42 @@ func (m *Monitor) runTarget(ctx context.Context, target store.Target) {
 		} else {
 			log.Printf("target %s: no new snapshot, skipping file list save", target.Name)
 			// Get file count from existing file if available
-			if fileCount, err := m.getFileCount(latest.ID); err == nil {
+			if fileCount, err := m.getFileCount(latest.ShortID); err == nil {
 				data.FileCount = fileCount
 			}
 		}
 	}
 
+	m.unlockStale(ctx, target)
+
 	log.Printf("target %s: running health check", target.Name)
-	healthy, msg := m.checkHealth(ctx, target)
-	data.Health = healthy
+	checkErr := m.checkHealth(ctx, target)
+	data.Health = checkErr == nil
 
 	// Only mark as locked if health check specifically failed due to lock
-	if !healthy && strings.Contains(msg, "repository is already locked") {
+	if restic.IsLocked(checkErr) {
 		log.Printf("target %s: repository locked during health check", target.Name)
 		data.StatusMessage = joinStatus(data.StatusMessage, "repository locked")
-	} else if msg != "" && !healthy {
-		data.StatusMessage = joinStatus(data.StatusMessage, msg)
+	} else if checkErr != nil {
+		data.StatusMessage = joinStatus(data.StatusMessage, checkErr.Error())
 	}
-	log.Printf("target %s: health=%v", target.Name, data.Health)
+	integrity, lock := checkComponents(checkErr)
+	data.Components = []store.Component{
+		{Name: store.ComponentReachability, Status: store.StatusOK},
+		integrity,
+		store.Freshness(data.LatestBackup, data.CheckedAt, m.cfg.FreshnessWarning, m.cfg.FreshnessCritical),
+		lock,
+	}
+	log.Printf("target %s: health=%v status=%s", target.Name, data.Health, store.WorstStatus(data.Components))
+
+	m.collectStats(ctx, target, data.CheckedAt)
 
+	// The commands of an interrupted check failed because of the shutdown,
+	// not the repository
+	if ctx.Err() != nil {
+		log.Printf("target %s: check interrupted by shutdown", target.Name)
+		return
+	}
 	if err := m.store.SaveStatus(ctx, data); err != nil {
 		log.Printf("persist status for %s: %v", target.Name, err)
 	} else {
@@ -141,6 +174,13 @@ func (m *Monitor) runTarget(ctx context.Context, target store.Target) {
 	}
 }
 
+// commandContext detaches restic commands from the shutdown of the monitor:
+// the Drainer of the runner decides when to interrupt them, so a running
+// check is not killed the moment the process is asked to stop.
+func commandContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
+
 func joinStatus(previous, addition string) string {
 	if previous == "" {
 		return addition
@@ -148,81 +188,25 @@ func joinStatus(previous, addition string) string {
 	return fmt.Sprintf("%s | %s", previous, addition)
 }
 
-func (m *Monitor) listSnapshots(ctx context.Context, target store.Target) ([]resticSnapshot, error) {
-	// Mock mode: return fake snapshots
-	if m.cfg.MockMode {
-		log.Printf("target %s: MOCK MODE - returning fake snapshots", target.Name)
-		now := time.Now()
-		return []resticSnapshot{
-			{
-				ID:   "mock1234",
-				Time: now.Add(-24 * time.Hour),
-			},
-			{
-				ID:   "mock0987",
-				Time: now.Add(-48 * time.Hour),
-			},
-		}, nil
-	}
-
-	// Validate certificate file if specified
-	certFile := target.CertificateFile
-	if certFile == "" {
-		certFile = m.cfg.CertificateFile
-	}
-	if certFile != "" {
-		if _, err := os.Stat(certFile); err != nil {
-			log.Printf("target %s: certificate file %s not accessible: %v", target.Name, certFile, err)
-			return nil, fmt.Errorf("certificate file %s: %w", certFile, err)
-		}
-		log.Printf("target %s: using certificate file: %s", target.Name, certFile)
-	}
-
-	// Create timeout context using configured timeout
-	timeoutCtx, cancel := context.WithTimeout(ctx, m.cfg.ResticTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(timeoutCtx, m.cfg.ResticBinary, "snapshots", "--json", "--no-lock")
-	cmd.Env = append(os.Environ(), m.envForTarget(target)...)
-
-	log.Printf("target %s: executing: %s snapshots --json (timeout: 30s)", target.Name, m.cfg.ResticBinary)
-	out, err := cmd.CombinedOutput()
+func (m *Monitor) listSnapshots(ctx context.Context, target store.Target) ([]restic.Snapshot, error) {
+	repo, err := target.ResticRepo()
 	if err != nil {
-		if timeoutCtx.Err() == context.DeadlineExceeded {
-			log.Printf("target %s: restic snapshots timed out after 30s", target.Name)
-			return nil, fmt.Errorf("restic snapshots: timeout")
-		}
-		log.Printf("target %s: restic snapshots failed: %v, output: %s", target.Name, err, string(out))
-		return nil, fmt.Errorf("restic snapshots: %w", err)
+		return nil, err
 	}
-
-	log.Printf("target %s: restic snapshots output length: %d bytes", target.Name, len(out))
-
-	var snapshots []resticSnapshot
-	if err := json.Unmarshal(out, &snapshots); err != nil {
-		log.Printf("target %s: failed to parse snapshots JSON: %v", target.Name, err)
-		return nil, fmt.Errorf("parse snapshots: %w", err)
+	snapshots, err := m.runner.Snapshots(commandContext(ctx), repo)
+	if err != nil {
+		log.Printf("target %s: restic snapshots failed: %v", target.Name, err)
+		return nil, err
 	}
-
 	return snapshots, nil
 }
 
 func (m *Monitor) saveSnapshotFileList(ctx context.Context, target store.Target, snapshotID string) (int, error) {
-	// Mock mode: return fake file count without calling restic
-	if m.cfg.MockMode {
-		log.Printf("target %s: MOCK MODE - returning fake file count for snapshot %s", target.Name, snapshotID)
-		return 1234, nil
+	files, err := m.listSnapshotFiles(ctx, target, snapshotID)
+	if err != nil {
+		return 0, err
 	}
 
-	log.Printf("target %s: executing: %s ls %s --json", target.Name, m.cfg.ResticBinary, snapshotID)
-
-	// Create timeout context using configured timeout
-	timeoutCtx, cancel := context.WithTimeout(ctx, m.cfg.ResticTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(timeoutCtx, m.cfg.ResticBinary, "ls", snapshotID, "--json", "--no-lock")
-	cmd.Env = append(os.Environ(), m.envForTarget(target)...)
-
 	// Ensure public directory exists
 	if err := os.MkdirAll(m.cfg.PublicDir, 0755); err != nil {
 		return 0, fmt.Errorf("create public directory: %w", err)
@@ -236,27 +220,8 @@ func (m *Monitor) saveSnapshotFileList(ctx context.Context, target store.Target,
 	}
 	defer outFile.Close()
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return 0, err
-	}
-
-	if err := cmd.Start(); err != nil {
-		return 0, err
-	}
-
-	scanner := bufio.NewScanner(stdout)
 	fileCount := 0
-
-	for scanner.Scan() {
-		if fileCount >= m.cfg.SnapshotLimit {
-			break
-		}
-		var entry resticLsEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			continue
-		}
-
+	for _, entry := range files {
 		// Write as JSON line
 		line := fmt.Sprintf("{\"path\":%q,\"name\":%q,\"type\":%q,\"size\":%d,\"mtime\":%q}\n",
 			entry.Path, entry.Name, entry.Type, entry.Size, entry.Mtime)
@@ -267,20 +232,6 @@ func (m *Monitor) saveSnapshotFileList(ctx context.Context, target store.Target,
 		fileCount++
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("target %s: scanner error reading ls output: %v", target.Name, err)
-		return fileCount, err
-	}
-
-	if err := cmd.Wait(); err != nil {
-		if timeoutCtx.Err() == context.DeadlineExceeded {
-			log.Printf("target %s: restic ls timed out after configured timeout, saved partial results (%d files)", target.Name, fileCount)
-			return fileCount, nil // Partial results are OK on timeout
-		}
-		log.Printf("target %s: restic ls failed: %v", target.Name, err)
-		return fileCount, err
-	}
-
 	log.Printf("target %s: successfully saved %d files to %s", target.Name, fileCount, outputPath)
 	return fileCount, nil
 }
@@ -301,122 +252,85 @@ func (m *Monitor) getFileCount(snapshotID string) (int, error) {
 	return count, scanner.Err()
 }
 
-func (m *Monitor) listSnapshotFiles(ctx context.Context, target store.Target, snapshotID string) ([]store.SnapshotFileData, error) {
-	log.Printf("target %s: executing: %s ls %s --json", target.Name, m.cfg.ResticBinary, snapshotID)
-
-	// Create timeout context using configured timeout
-	timeoutCtx, cancel := context.WithTimeout(ctx, m.cfg.ResticTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(timeoutCtx, m.cfg.ResticBinary, "ls", snapshotID, "--json", "--no-lock")
-	cmd.Env = append(os.Environ(), m.envForTarget(target)...)
-
-	stdout, err := cmd.StdoutPipe()
+func (m *Monitor) listSnapshotFiles(ctx context.Context, target store.Target, snapshotID string) ([]restic.Node, error) {
+	repo, err := target.ResticRepo()
 	if err != nil {
 		return nil, err
 	}
-
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
-
-	scanner := bufio.NewScanner(stdout)
-	files := make([]store.SnapshotFileData, 0, m.cfg.SnapshotLimit)
-
-	for scanner.Scan() {
-		if len(files) >= m.cfg.SnapshotLimit {
-			break
-		}
-		var entry resticLsEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
-			continue
-		}
-		files = append(files, store.SnapshotFileData{
-			Path: entry.Path,
-			Name: entry.Name,
-			Type: entry.Type,
-			Size: entry.Size,
-		})
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("target %s: scanner error reading ls output: %v", target.Name, err)
-		return files, err
+	files, err := m.runner.Ls(commandContext(ctx), repo, snapshotID, m.cfg.SnapshotLimit)
+	if errors.Is(err, restic.ErrTimeout) {
+		log.Printf("target %s: restic ls timed out, returning partial results (%d files)", target.Name, len(files))
+		return files, nil // Partial results are OK on timeout
 	}
-
-	if err := cmd.Wait(); err != nil {
-		if timeoutCtx.Err() == context.DeadlineExceeded {
-			log.Printf("target %s: restic ls timed out after 60s, returning partial results (%d files)", target.Name, len(files))
-			return files, nil // Return partial results on timeout
-		}
+	if err != nil {
 		log.Printf("target %s: restic ls failed: %v", target.Name, err)
 		return files, err
 	}
-
 	log.Printf("target %s: successfully listed %d files", target.Name, len(files))
 	return files, nil
 }
 
-func (m *Monitor) checkHealth(ctx context.Context, target store.Target) (bool, string) {
-	if m.cfg.MockMode {
-		log.Printf("target %s: MOCK MODE - skipping restic check", target.Name)
-		// Make one specific target unhealthy in mock mode
-		if target.Name == "bitwarden" {
-			return false, "mock error: pack 3f4a8b2c is corrupted - data integrity check failed"
-		}
-		return true, "mock health check - repository is healthy"
-	}
-
-	log.Printf("target %s: executing: %s check --json", target.Name, m.cfg.ResticBinary)
-
-	// Create timeout context using configured timeout
-	timeoutCtx, cancel := context.WithTimeout(ctx, m.cfg.ResticTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(timeoutCtx, m.cfg.ResticBinary, "check", "--json", "--no-lock")
-	cmd.Env = append(os.Environ(), m.envForTarget(target)...)
-	out, err := cmd.CombinedOutput()
+func (m *Monitor) checkHealth(ctx context.Context, target store.Target) error {
+	repo, err := target.ResticRepo()
 	if err != nil {
-		if timeoutCtx.Err() == context.DeadlineExceeded {
-			log.Printf("target %s: restic check timed out after %s", target.Name, m.cfg.ResticTimeout)
-			return false, "restic check: timeout"
-		}
-		log.Printf("target %s: restic check failed: %v, output: %s", target.Name, err, strings.TrimSpace(string(out)))
-		return false, fmt.Sprintf("restic check failed: %v %s", err, strings.TrimSpace(string(out)))
+		return err
+	}
+	if _, err := m.runner.Check(commandContext(ctx), repo); err != nil {
+		log.Printf("target %s: restic check failed: %v", target.Name, err)
+		return err
 	}
 	log.Printf("target %s: restic check succeeded", target.Name)
-	return true, strings.TrimSpace(string(out))
+	return nil
 }
 
-func (m *Monitor) envForTarget(target store.Target) []string {
-	env := []string{fmt.Sprintf("RESTIC_REPOSITORY=%s", target.Repository)}
-	if target.Password != "" {
-		env = append(env, fmt.Sprintf("RESTIC_PASSWORD=%s", "***")) // log as masked
-	}
-	if target.PasswordFile != "" {
-		env = append(env, fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", target.PasswordFile))
+// collectStats records the repository size of the target when the last
+// sample is older than the stats interval. Failures are logged and do not
+// affect the health of the target.
+func (m *Monitor) collectStats(ctx context.Context, target store.Target, now time.Time) {
+	if m.cfg.StatsInterval <= 0 {
+		return
 	}
-	cert := target.CertificateFile
-	if cert == "" {
-		cert = m.cfg.CertificateFile
+	latest, err := m.store.LatestRepositoryStats(ctx, target.Name)
+	if err != nil {
+		log.Printf("target %s: load latest stats: %v", target.Name, err)
+		return
 	}
-	if cert != "" {
-		env = append(env, fmt.Sprintf("RESTIC_CACERT=%s", cert))
+	if !latest.CollectedAt.IsZero() && now.Sub(latest.CollectedAt) < m.cfg.StatsInterval {
+		return
 	}
-	log.Printf("target %s: env vars: %v", target.Name, env)
 
-	// Build actual env with real password
-	actualEnv := []string{fmt.Sprintf("RESTIC_REPOSITORY=%s", target.Repository)}
-	if target.Password != "" {
-		actualEnv = append(actualEnv, fmt.Sprintf("RESTIC_PASSWORD=%s", target.Password))
+	repo, err := target.ResticRepo()
+	if err != nil {
+		log.Printf("target %s: collect stats: %v", target.Name, err)
+		return
 	}
-	if target.PasswordFile != "" {
-		actualEnv = append(actualEnv, fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", target.PasswordFile))
+	raw, err := m.runner.Stats(commandContext(ctx), repo, restic.StatsRawData)
+	if err != nil {
+		log.Printf("target %s: restic stats (raw-data) failed: %v", target.Name, err)
+		return
+	}
+	restore, err := m.runner.Stats(commandContext(ctx), repo, restic.StatsRestoreSize)
+	if err != nil {
+		log.Printf("target %s: restic stats (restore-size) failed: %v", target.Name, err)
+		return
 	}
-	if cert != "" {
-		actualEnv = append(actualEnv, fmt.Sprintf("RESTIC_CACERT=%s", cert))
+
+	data := store.StatsData{
+		TargetName:       target.Name,
+		SnapshotCount:    raw.SnapshotsCount,
+		RawSize:          raw.TotalSize,
+		UncompressedSize: raw.TotalUncompressedSize,
+		CompressionRatio: raw.CompressionRatio,
+		BlobCount:        raw.TotalBlobCount,
+		RestoreSize:      restore.TotalSize,
+		RestoreFileCount: restore.TotalFileCount,
+		CollectedAt:      now,
 	}
-	return actualEnv
+	if err := m.store.SaveRepositoryStats(ctx, data); err != nil {
+		log.Printf("target %s: persist stats: %v", target.Name, err)
+		return
+	}
+	log.Printf("target %s: repository size %d bytes, restore size %d bytes", target.Name, data.RawSize, data.RestoreSize)
 }
 
 // TriggerCheck triggers an immediate check for a specific target
@@ -447,7 +361,7 @@ func (m *Monitor) runTargetByName(ctx context.Context, targetName string) {
 	log.Printf("target %s not found for immediate check", targetName)
 }
 
-func latestSnapshot(list []resticSnapshot) *resticSnapshot {
+func latestSnapshot(list []restic.Snapshot) *restic.Snapshot {
 	if len(list) == 0 {
 		return nil
 	}
@@ -459,16 +373,3 @@ func latestSnapshot(list []resticSnapshot) *resticSnapshot {
 	}
 	return &latest
 }
-
-type resticSnapshot struct {
-	ID   string    `json:"short_id"`
-	Time time.Time `json:"time"`
-}
-
-type resticLsEntry struct {
-	Path  string `json:"path"`
-	Name  string `json:"name"`
-	Type  string `json:"type"`
-	Size  int64  `json:"size"`
-	Mtime string `json:"mtime"`
-}
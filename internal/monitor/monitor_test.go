@@ -0,0 +1,300 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// newTestMonitor returns a monitor checking the targets against a fake
+// serving scenario, with a temporary SQLite store.
+func newTestMonitor(t *testing.T, scenario string, targets ...store.TargetData) (*Monitor, *store.Store, *restic.Fake) {
+	t.Helper()
+	var s restic.Scenario
+	if err := json.Unmarshal([]byte(scenario), &s); err != nil {
+		t.Fatalf("parse scenario: %v", err)
+	}
+	fake := restic.NewScenarioFake(s, time.Now())
+	fake.Timeout = 200 * time.Millisecond
+
+	st, err := store.New(filepath.Join(t.TempDir(), "monitor.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if err := st.UpsertTargets(context.Background(), targets); err != nil {
+		t.Fatalf("create targets: %v", err)
+	}
+	cfg := config.Config{
+		PublicDir:          t.TempDir(),
+		SnapshotLimit:      100,
+		AnomalyWindow:      5,
+		AnomalyShrinkRatio: 0.5,
+		AnomalyGrowthRatio: 3,
+		FreshnessWarning:   26 * time.Hour,
+		FreshnessCritical:  72 * time.Hour,
+	}
+	return New(cfg, st, fake), st, fake
+}
+
+// check runs one check of the named target and returns its saved status
+// by component.
+func check(t *testing.T, m *Monitor, st *store.Store, name string) (store.BackupStatus, map[string]store.Component) {
+	t.Helper()
+	ctx := context.Background()
+	target, err := st.GetTarget(ctx, name)
+	if err != nil {
+		t.Fatalf("GetTarget: %v", err)
+	}
+	m.runTarget(ctx, target)
+
+	status, err := st.GetStatus(ctx, name)
+	if err != nil {
+		t.Fatalf("GetStatus: %v", err)
+	}
+	components, err := status.StatusComponents()
+	if err != nil {
+		t.Fatalf("StatusComponents: %v", err)
+	}
+	byName := make(map[string]store.Component, len(components))
+	for _, component := range components {
+		byName[component.Name] = component
+	}
+	return status, byName
+}
+
+func TestStatusComponents(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		scenario string
+		health   bool
+		want     map[string]string
+	}{
+		{
+			name:     "healthy",
+			scenario: `{"snapshotCount": 3, "latestAge": "1h"}`,
+			health:   true,
+			want: map[string]string{
+				store.ComponentReachability: store.StatusOK,
+				store.ComponentIntegrity:    store.StatusOK,
+				store.ComponentFreshness:    store.StatusOK,
+				store.ComponentLock:         store.StatusOK,
+			},
+		},
+		{
+			name:     "overdue",
+			scenario: `{"snapshotCount": 3, "latestAge": "30h"}`,
+			health:   true,
+			want:     map[string]string{store.ComponentFreshness: store.StatusWarning},
+		},
+		{
+			name:     "stale",
+			scenario: `{"snapshotCount": 3, "latestAge": "80h"}`,
+			health:   true,
+			want:     map[string]string{store.ComponentFreshness: store.StatusCritical},
+		},
+		{
+			name:     "no snapshots",
+			scenario: `{"snapshotCount": 0}`,
+			health:   true,
+			want:     map[string]string{store.ComponentFreshness: store.StatusCritical},
+		},
+		{
+			name:     "corrupt",
+			scenario: `{"latestAge": "1h", "checkError": "pack 3f4a8b2c is corrupted"}`,
+			want: map[string]string{
+				store.ComponentIntegrity: store.StatusCritical,
+				store.ComponentLock:      store.StatusOK,
+			},
+		},
+		{
+			name:     "locked",
+			scenario: `{"latestAge": "1h", "locked": true}`,
+			want: map[string]string{
+				store.ComponentIntegrity: store.StatusUnknown,
+				store.ComponentLock:      store.StatusWarning,
+			},
+		},
+		{
+			name:     "check timeout",
+			scenario: `{"latestAge": "1h", "timeout": ["check"]}`,
+			want:     map[string]string{store.ComponentIntegrity: store.StatusWarning},
+		},
+		{
+			name:     "unreachable",
+			scenario: `{"errors": {"snapshots": "connection refused"}}`,
+			want: map[string]string{
+				store.ComponentReachability: store.StatusCritical,
+				store.ComponentIntegrity:    store.StatusUnknown,
+				store.ComponentFreshness:    store.StatusUnknown,
+				store.ComponentLock:         store.StatusUnknown,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, st, _ := newTestMonitor(t, `{"targets": {"home": `+tc.scenario+`}}`,
+				store.TargetData{Name: "home", Repository: "/srv/restic/home", Password: "secret"})
+
+			status, components := check(t, m, st, "home")
+			if status.Health != tc.health {
+				t.Errorf("health = %v, want %v (%s)", status.Health, tc.health, status.StatusMessage)
+			}
+			if len(components) != 4 {
+				t.Errorf("components = %+v, want all four", components)
+			}
+			for name, want := range tc.want {
+				if got := components[name]; got.Status != want {
+					t.Errorf("%s = %s (%s), want %s", name, got.Status, got.Message, want)
+				}
+			}
+			worst := store.WorstStatus(mapValues(components))
+			if status.Status != worst {
+				t.Errorf("overall status = %s, want the worst component %s", status.Status, worst)
+			}
+		})
+	}
+}
+
+func mapValues(components map[string]store.Component) []store.Component {
+	values := make([]store.Component, 0, len(components))
+	for _, component := range components {
+		values = append(values, component)
+	}
+	return values
+}
+
+func TestRecordAnomalies(t *testing.T) {
+	m, st, _ := newTestMonitor(t, `{"targets": {
+		"home": {"snapshots": [
+			{"age": "120h", "files": 1000, "size": 50000},
+			{"age": "96h",  "files": 1010, "size": 50000},
+			{"age": "72h",  "files": 990,  "size": 50000},
+			{"age": "48h",  "files": 1005, "size": 50000},
+			{"age": "24h",  "files": 100,  "size": 50000}
+		]},
+		"steady": {"snapshotCount": 6, "latestAge": "1h"}
+	}}`,
+		store.TargetData{Name: "home", Repository: "/srv/restic/home", Password: "secret"},
+		store.TargetData{Name: "steady", Repository: "/srv/restic/steady", Password: "secret"},
+	)
+	ctx := context.Background()
+
+	check(t, m, st, "home")
+	warnings, err := st.ListSnapshotWarnings(ctx, "home")
+	if err != nil {
+		t.Fatalf("ListSnapshotWarnings: %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("warnings = %+v, want the dropped file count only", warnings)
+	}
+	warning := warnings[0]
+	if warning.Metric != store.MetricFiles || warning.Value != 100 || warning.Baseline != 1002 {
+		t.Errorf("warning = %+v, want files 100 against baseline 1002", warning)
+	}
+
+	// A second check keeps the warning instead of recording it again
+	check(t, m, st, "home")
+	if again, err := st.ListSnapshotWarnings(ctx, "home"); err != nil || len(again) != 1 || again[0].ID != warning.ID {
+		t.Errorf("warnings after the second check = %+v, %v, want the first one kept", again, err)
+	}
+
+	check(t, m, st, "steady")
+	if warnings, err := st.ListSnapshotWarnings(ctx, "steady"); err != nil || len(warnings) != 0 {
+		t.Errorf("warnings of steady snapshots = %+v, %v, want none", warnings, err)
+	}
+}
+
+func TestUnlockStale(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name            string
+		locks           string
+		autoUnlockAfter time.Duration
+		unlocked        bool
+		locksLeft       int
+	}{
+		{
+			name:            "all locks stale",
+			locks:           `[{"age": "3h", "exclusive": true}, {"age": "5h"}]`,
+			autoUnlockAfter: 2 * time.Hour,
+			unlocked:        true,
+		},
+		{
+			name:            "one lock recent",
+			locks:           `[{"age": "3h"}, {"age": "1h"}]`,
+			autoUnlockAfter: 2 * time.Hour,
+			locksLeft:       2,
+		},
+		{
+			name:      "policy disabled",
+			locks:     `[{"age": "72h"}]`,
+			locksLeft: 1,
+		},
+		{
+			// The threshold is below restic's own 30 minutes, so unlock
+			// without --remove-all keeps the locks
+			name:            "locks younger than restic considers stale",
+			locks:           `[{"age": "20m"}]`,
+			autoUnlockAfter: 10 * time.Minute,
+			unlocked:        true,
+			locksLeft:       1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, st, fake := newTestMonitor(t, `{"targets": {"home": {"locks": `+tc.locks+`}}}`)
+			target := store.Target{Name: "home", Repository: "/srv/restic/home", AutoUnlockAfter: tc.autoUnlockAfter}
+
+			m.unlockStale(ctx, target)
+
+			left, err := fake.Locks(ctx, restic.Repo{Name: "home"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != tc.locksLeft {
+				t.Errorf("%d lock(s) left, want %d", len(left), tc.locksLeft)
+			}
+			events, err := st.ListUnlockEvents(ctx, "home", 0)
+			if err != nil {
+				t.Fatalf("ListUnlockEvents: %v", err)
+			}
+			audit, _, err := st.ListAudit(ctx, store.AuditFilter{Action: "auto_unlock", Target: "home"})
+			if err != nil {
+				t.Fatalf("ListAudit: %v", err)
+			}
+			if !tc.unlocked {
+				if len(events) != 0 || len(audit) != 0 {
+					t.Errorf("unlock recorded: events %+v, audit %+v", events, audit)
+				}
+				return
+			}
+			if len(events) != 1 || len(audit) != 1 {
+				t.Fatalf("events %+v, audit %+v, want one of each", events, audit)
+			}
+			event := events[0]
+			if !event.Automatic || event.RemoveAll || event.Error != "" {
+				t.Errorf("event = %+v, want an automatic unlock without --remove-all", event)
+			}
+			if locks, err := event.UnlockedLocks(); err != nil || len(locks) == 0 {
+				t.Errorf("recorded locks = %+v, %v", locks, err)
+			}
+			if audit[0].Actor != store.ActorSystem || audit[0].Outcome != store.OutcomeSuccess {
+				t.Errorf("audit entry = %+v", audit[0])
+			}
+		})
+	}
+}
+
+func TestAutoUnlockBeforeCheck(t *testing.T) {
+	m, st, _ := newTestMonitor(t, `{"targets": {"home": {"latestAge": "1h", "locked": true}}}`,
+		store.TargetData{Name: "home", Repository: "/srv/restic/home", Password: "secret", AutoUnlockAfter: "1h"})
+
+	status, components := check(t, m, st, "home")
+	if !status.Health || components[store.ComponentLock].Status != store.StatusOK {
+		t.Errorf("status = %+v, components %+v, want the stale lock removed before the check", status, components)
+	}
+}
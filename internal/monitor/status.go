@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"errors"
+
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/store"
+)
+
+// unreachable returns the components of a target whose snapshots could not
+// be listed; nothing else is known about it.
+func unreachable(err error) []store.Component {
+	return []store.Component{
+		{Name: store.ComponentReachability, Status: store.StatusCritical, Message: err.Error()},
+		{Name: store.ComponentIntegrity, Status: store.StatusUnknown},
+		{Name: store.ComponentFreshness, Status: store.StatusUnknown},
+		{Name: store.ComponentLock, Status: store.StatusUnknown},
+	}
+}
+
+// checkComponents rates the integrity and lock state from the result of
+// restic check. A check that timed out or was blocked by a lock says nothing
+// about the integrity of the repository.
+func checkComponents(err error) (integrity, lock store.Component) {
+	integrity = store.Component{Name: store.ComponentIntegrity, Status: store.StatusOK}
+	lock = store.Component{Name: store.ComponentLock, Status: store.StatusOK}
+	switch {
+	case err == nil:
+	case restic.IsLocked(err):
+		integrity.Status = store.StatusUnknown
+		integrity.Message = "check skipped: repository locked"
+		lock.Status = store.StatusWarning
+		lock.Message = "repository locked"
+	case errors.Is(err, restic.ErrTimeout):
+		integrity.Status = store.StatusWarning
+		integrity.Message = "check timed out"
+	default:
+		integrity.Status = store.StatusCritical
+		integrity.Message = err.Error()
+	}
+	return integrity, lock
+}
@@ -0,0 +1,79 @@
+// Package notify delivers events that need an operator's attention.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event types.
+const (
+	EventAutoUnlock = "auto_unlock"
+)
+
+// Event is posted as JSON to the webhook.
+type Event struct {
+	Type    string    `json:"type"`
+	Target  string    `json:"target"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	Details any       `json:"details,omitempty"`
+}
+
+// Notifier posts events to a webhook. Events are always logged; without a
+// webhook URL nothing else happens.
+type Notifier struct {
+	WebhookURL string
+	HTTPClient *http.Client
+}
+
+// New returns a notifier posting to webhookURL, which may be empty.
+func New(webhookURL string) *Notifier {
+	return &Notifier{
+		WebhookURL: webhookURL,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify logs the event and posts it to the webhook.
+func (n *Notifier) Notify(ctx context.Context, event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	log.Printf("notify %s: target %s: %s", event.Type, event.Target, event.Message)
+	if n == nil || n.WebhookURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("notify: webhook returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
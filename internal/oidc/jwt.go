@@ -0,0 +1,238 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// clockSkew is the tolerance for the time claims of ID tokens.
+const clockSkew = time.Minute
+
+// Claims are the claims of a verified ID token.
+type Claims map[string]any
+
+// String returns a string claim, or an empty string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that is a list of strings or a single string,
+// such as groups.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (Claims, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token: malformed")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("id token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id token signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("id token claims: %w", err)
+	}
+	if iss := claims.String("iss"); iss != metadata.Issuer {
+		return nil, fmt.Errorf("id token: issuer %q does not match %q", iss, metadata.Issuer)
+	}
+	if !slices.Contains(claims.Strings("aud"), p.config.ClientID) {
+		return nil, errors.New("id token: not issued for this client")
+	}
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok || now.After(exp.Add(clockSkew)) {
+		return nil, errors.New("id token: expired")
+	}
+	if iat, ok := claims.time("iat"); ok && iat.After(now.Add(clockSkew)) {
+		return nil, errors.New("id token: issued in the future")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, errors.New("id token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// key returns the signing key with the given ID. The key set is fetched
+// again once for unknown IDs, as providers rotate keys.
+func (p *Provider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set jwks
+	if err := p.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		public, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = public
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	// Tokens without a key ID work with providers publishing a single key
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("id token: unknown signing key %q", kid)
+}
+
+func verifySignature(alg string, key any, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("id token: RS256 requires an RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("id token: invalid signature")
+		}
+		return nil
+	case "ES256":
+		public, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return errors.New("id token: ES256 requires a P-256 key")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(public, digest[:], r, s) {
+			return errors.New("id token: invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("id token: unsupported algorithm %q", alg)
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,215 @@
+// Package oidc implements the OpenID Connect authorization code flow with
+// PKCE for the dashboard login: discovery, the token exchange and the
+// verification of RS256 and ES256 signed ID tokens.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes the client registration at the provider.
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Metadata is the subset of the provider's discovery document in use.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// Tokens is the response of the token endpoint.
+type Tokens struct {
+	IDToken     string `json:"id_token"`
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Provider talks to an OpenID Connect provider. Discovery happens on first
+// use and is retried until it succeeds, so the provider may be down when
+// the monitor starts.
+type Provider struct {
+	config     Config
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]any
+}
+
+// New returns a provider for cfg. Without scopes, "openid profile email"
+// is requested.
+func New(cfg Config) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	cfg.IssuerURL = strings.TrimSuffix(cfg.IssuerURL, "/")
+	return &Provider{
+		config:     cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ClientID returns the client ID of the registration.
+func (p *Provider) ClientID() string {
+	return p.config.ClientID
+}
+
+// Metadata returns the discovery document, fetching it on first use.
+func (p *Provider) Metadata(ctx context.Context) (Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+
+	var metadata Metadata
+	if err := p.getJSON(ctx, p.config.IssuerURL+"/.well-known/openid-configuration", &metadata); err != nil {
+		return Metadata{}, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if metadata.Issuer != p.config.IssuerURL {
+		return Metadata{}, fmt.Errorf("oidc discovery: issuer %q does not match %q", metadata.Issuer, p.config.IssuerURL)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return Metadata{}, errors.New("oidc discovery: incomplete provider metadata")
+	}
+	p.metadata = &metadata
+	return metadata, nil
+}
+
+// AuthCodeURL returns the URL of the provider's login page.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	return withQuery(metadata.AuthorizationEndpoint, params), nil
+}
+
+// Exchange trades an authorization code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (Tokens, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return Tokens{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Tokens{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Tokens{}, fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Tokens{}, fmt.Errorf("oidc token exchange: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tokens Tokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return Tokens{}, fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return Tokens{}, errors.New("oidc token exchange: no id_token in response")
+	}
+	return tokens, nil
+}
+
+// LogoutURL returns the provider's end session URL, or an empty string if
+// the provider has none.
+func (p *Provider) LogoutURL(ctx context.Context, postLogoutRedirect string) string {
+	metadata, err := p.Metadata(ctx)
+	if err != nil || metadata.EndSessionEndpoint == "" {
+		return ""
+	}
+	params := url.Values{"client_id": {p.config.ClientID}}
+	if postLogoutRedirect != "" {
+		params.Set("post_logout_redirect_uri", postLogoutRedirect)
+	}
+	return withQuery(metadata.EndSessionEndpoint, params)
+}
+
+func (p *Provider) getJSON(ctx context.Context, rawURL string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func withQuery(endpoint string, params url.Values) string {
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + params.Encode()
+}
+
+// RandomString returns a URL safe random string for states, nonces and
+// PKCE verifiers.
+func RandomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
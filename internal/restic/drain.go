@@ -0,0 +1,152 @@
+package restic
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrShuttingDown is returned for commands started after shutdown began.
+var ErrShuttingDown = errors.New("shutting down")
+
+// Drainer wraps a Runner so shutdown can wait for running commands instead
+// of killing them halfway through, e.g. while forget rewrites the index.
+type Drainer struct {
+	runner Runner
+
+	mu      sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+	// abort interrupts the running commands once the grace period is over
+	aborted context.Context
+	abort   context.CancelFunc
+}
+
+// NewDrainer returns a Drainer running commands through runner.
+func NewDrainer(runner Runner) *Drainer {
+	aborted, abort := context.WithCancel(context.Background())
+	return &Drainer{runner: runner, aborted: aborted, abort: abort}
+}
+
+// begin registers a command. The returned context is canceled with ctx or
+// when Shutdown gives up waiting; done must be called once the command
+// returned.
+func (d *Drainer) begin(ctx context.Context) (context.Context, func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, nil, ErrShuttingDown
+	}
+	d.running.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(d.aborted, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		d.running.Done()
+	}, nil
+}
+
+// Shutdown refuses new commands and waits for the running ones. When ctx
+// is done first, they are canceled, which sends restic SIGINT so it
+// removes its locks, and Shutdown waits for them to exit and returns the
+// error of ctx.
+func (d *Drainer) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	d.abort()
+	<-done
+	return ctx.Err()
+}
+
+// Snapshots implements Runner.
+func (d *Drainer) Snapshots(ctx context.Context, repo Repo) ([]Snapshot, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return d.runner.Snapshots(ctx, repo)
+}
+
+// Ls implements Runner.
+func (d *Drainer) Ls(ctx context.Context, repo Repo, snapshotID string, limit int) ([]Node, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return d.runner.Ls(ctx, repo, snapshotID, limit)
+}
+
+// Check implements Runner.
+func (d *Drainer) Check(ctx context.Context, repo Repo) (string, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return d.runner.Check(ctx, repo)
+}
+
+// Forget implements Runner.
+func (d *Drainer) Forget(ctx context.Context, repo Repo, policy Policy) (string, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return d.runner.Forget(ctx, repo, policy)
+}
+
+// Unlock implements Runner.
+func (d *Drainer) Unlock(ctx context.Context, repo Repo, removeAll bool) (string, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	return d.runner.Unlock(ctx, repo, removeAll)
+}
+
+// Locks implements Runner.
+func (d *Drainer) Locks(ctx context.Context, repo Repo) ([]Lock, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return d.runner.Locks(ctx, repo)
+}
+
+// Stats implements Runner.
+func (d *Drainer) Stats(ctx context.Context, repo Repo, mode string) (Stats, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer done()
+	return d.runner.Stats(ctx, repo, mode)
+}
+
+// Diff implements Runner.
+func (d *Drainer) Diff(ctx context.Context, repo Repo, from, to string) (DiffStats, error) {
+	ctx, done, err := d.begin(ctx)
+	if err != nil {
+		return DiffStats{}, err
+	}
+	defer done()
+	return d.runner.Diff(ctx, repo, from, to)
+}
@@ -0,0 +1,276 @@
+// Package restic contains helpers shared by everything that runs the restic
+// binary: the monitor, the API and the agent.
+package restic
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/example/restic-monitor/internal/secrets"
+)
+
+// Credentials describe how to open a repository.
+type Credentials struct {
+	Repository      string
+	Password        string
+	PasswordFile    string
+	PasswordCommand string
+	CertificateFile string
+	// Secrets are backend credentials passed as environment variables, e.g.
+	// AWS_SECRET_ACCESS_KEY or B2_ACCOUNT_KEY. Their values are always masked
+	// in logs.
+	Secrets map[string]string
+	// Env holds the backend settings of targets saved before they were
+	// merged into Secrets; Secrets win when both set a variable.
+	Env map[string]string
+	// Options are extended options passed as "-o key=value", e.g.
+	// "s3.storage-class=STANDARD_IA".
+	Options []string
+}
+
+// reservedVars are derived from the dedicated credential fields and may not
+// be set through Env or Secrets.
+var reservedVars = map[string]bool{
+	"RESTIC_REPOSITORY":       true,
+	"RESTIC_REPOSITORY_FILE":  true,
+	"RESTIC_PASSWORD":         true,
+	"RESTIC_PASSWORD_FILE":    true,
+	"RESTIC_PASSWORD_COMMAND": true,
+	"RESTIC_CACERT":           true,
+}
+
+// execVars change how the restic binary is loaded or which programs it
+// starts, so a target setting them could run code on the host.
+var execVars = map[string]bool{
+	"PATH":       true,
+	"SHELL":      true,
+	"IFS":        true,
+	"GCONV_PATH": true,
+}
+
+// execVarPrefixes are the prefixes of dynamic loader variables.
+var execVarPrefixes = []string{"LD_", "DYLD_"}
+
+// isExecVar reports whether the variable controls loading or running
+// programs.
+func isExecVar(key string) bool {
+	key = strings.ToUpper(key)
+	if execVars[key] {
+		return true
+	}
+	for _, prefix := range execVarPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	varName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	optionKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// Validate checks the per-target environment and options: variable names
+// must be valid and must not override the RESTIC_* variables built from the
+// credential fields or the loader and exec variables such as LD_PRELOAD and
+// PATH. Options must have the form key=value.
+func (c Credentials) Validate() error {
+	for _, vars := range []map[string]string{c.Env, c.Secrets} {
+		for key := range vars {
+			if !varName.MatchString(key) {
+				return fmt.Errorf("invalid environment variable name %q", key)
+			}
+			if reservedVars[strings.ToUpper(key)] {
+				return fmt.Errorf("environment variable %s is set from the target fields and cannot be overridden", key)
+			}
+			if isExecVar(key) {
+				return fmt.Errorf("environment variable %s cannot be set for a target", key)
+			}
+		}
+	}
+	for _, option := range c.Options {
+		key, _, ok := strings.Cut(option, "=")
+		if !ok || !optionKey.MatchString(key) {
+			return fmt.Errorf("invalid option %q, expected key=value", option)
+		}
+	}
+	return nil
+}
+
+// Args returns the "-o key=value" flags for the extended options, to be
+// placed in front of the restic sub-command.
+func (c Credentials) Args() []string {
+	args := make([]string, 0, 2*len(c.Options))
+	for _, option := range c.Options {
+		args = append(args, "-o", option)
+	}
+	return args
+}
+
+// Resolve returns a copy of creds with every secret reference replaced by
+// the secret it points to.
+func Resolve(ctx context.Context, resolver *secrets.Resolver, creds Credentials) (Credentials, error) {
+	if err := creds.Validate(); err != nil {
+		return creds, err
+	}
+
+	password, err := resolver.Resolve(ctx, creds.Password)
+	if err != nil {
+		return creds, fmt.Errorf("password: %w", err)
+	}
+	creds.Password = password
+
+	if creds.Secrets, err = resolveVars(ctx, resolver, creds.Secrets); err != nil {
+		return creds, err
+	}
+	if creds.Env, err = resolveVars(ctx, resolver, creds.Env); err != nil {
+		return creds, err
+	}
+	return creds, nil
+}
+
+func resolveVars(ctx context.Context, resolver *secrets.Resolver, vars map[string]string) (map[string]string, error) {
+	if len(vars) == 0 {
+		return vars, nil
+	}
+	resolved := make(map[string]string, len(vars))
+	for key, value := range vars {
+		secret, err := resolver.Resolve(ctx, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		resolved[key] = secret
+	}
+	return resolved, nil
+}
+
+// Env returns the RESTIC_* and backend environment variables for the
+// repository. The certificate falls back to defaultCert when the credentials
+// do not name one. Appended to os.Environ() the per-target values take
+// precedence over variables inherited from the process.
+func Env(creds Credentials, defaultCert string) []string {
+	env := []string{fmt.Sprintf("RESTIC_REPOSITORY=%s", creds.Repository)}
+	if creds.Password != "" {
+		env = append(env, fmt.Sprintf("RESTIC_PASSWORD=%s", creds.Password))
+	}
+	if creds.PasswordFile != "" {
+		env = append(env, fmt.Sprintf("RESTIC_PASSWORD_FILE=%s", creds.PasswordFile))
+	}
+	if creds.PasswordCommand != "" {
+		env = append(env, fmt.Sprintf("RESTIC_PASSWORD_COMMAND=%s", creds.PasswordCommand))
+	}
+	cert := creds.CertificateFile
+	if cert == "" {
+		cert = defaultCert
+	}
+	if cert != "" {
+		env = append(env, fmt.Sprintf("RESTIC_CACERT=%s", cert))
+	}
+
+	// The last value of a variable wins, so Secrets override Env
+	env = appendVars(env, creds.Env)
+	env = appendVars(env, creds.Secrets)
+	return env
+}
+
+func appendVars(env []string, vars map[string]string) []string {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", key, vars[key]))
+	}
+	return env
+}
+
+// secretMarkers identify environment variables whose values must not be
+// logged.
+var secretMarkers = []string{"PASSWORD", "SECRET", "TOKEN", "KEY", "SAS", "CREDENTIAL"}
+
+// MaskEnv returns a copy of env with secret values replaced by "***" so it
+// can be logged. Variables listed in secretNames are masked regardless of
+// their name.
+func MaskEnv(env []string, secretNames ...string) []string {
+	masked := make([]string, len(env))
+	for i, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if isSecretVar(key) || slices.Contains(secretNames, key) {
+			kv = key + "=***"
+		}
+		masked[i] = kv
+	}
+	return masked
+}
+
+// MaskArgs returns a copy of args with the values of extended options
+// replaced by "***" so the command line can be logged. Options such as
+// s3.secret-key=... or sftp.command=... may carry credentials.
+func MaskArgs(args []string) []string {
+	masked := slices.Clone(args)
+	for i, arg := range masked {
+		if arg == "--" {
+			break
+		}
+		switch {
+		case i > 0 && (args[i-1] == "-o" || args[i-1] == "--option"):
+			masked[i] = maskOption(arg)
+		case strings.HasPrefix(arg, "-o="), strings.HasPrefix(arg, "--option="):
+			flag, option, _ := strings.Cut(arg, "=")
+			masked[i] = flag + "=" + maskOption(option)
+		}
+	}
+	return masked
+}
+
+func maskOption(option string) string {
+	key, _, _ := strings.Cut(option, "=")
+	return key + "=***"
+}
+
+// Masked returns env masked for logging, hiding every credential value.
+func (c Credentials) Masked(env []string) []string {
+	names := make([]string, 0, len(c.Secrets))
+	for key := range c.Secrets {
+		names = append(names, key)
+	}
+	return MaskEnv(env, names...)
+}
+
+// minRedactLength keeps very short secrets from masking unrelated output.
+const minRedactLength = 4
+
+// Redact replaces the password and credential values in s with "***".
+func (c Credentials) Redact(s string) string {
+	values := []string{c.Password}
+	for _, value := range c.Secrets {
+		values = append(values, value)
+	}
+	for _, value := range values {
+		if len(value) >= minRedactLength {
+			s = strings.ReplaceAll(s, value, "***")
+		}
+	}
+	return s
+}
+
+func isSecretVar(key string) bool {
+	switch key {
+	case "RESTIC_PASSWORD_FILE", "RESTIC_PASSWORD_COMMAND", "GOOGLE_APPLICATION_CREDENTIALS":
+		// Paths and commands, not secrets themselves
+		return false
+	}
+	upper := strings.ToUpper(key)
+	for _, marker := range secretMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
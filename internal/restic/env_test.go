@@ -0,0 +1,52 @@
+package restic
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCredentialsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		creds Credentials
+		ok    bool
+	}{
+		{name: "backend variables", creds: Credentials{Secrets: map[string]string{"AWS_SECRET_ACCESS_KEY": "key"}, Env: map[string]string{"AWS_DEFAULT_REGION": "eu-west-1"}}, ok: true},
+		{name: "options", creds: Credentials{Options: []string{"s3.storage-class=STANDARD_IA"}}, ok: true},
+		{name: "reserved variable", creds: Credentials{Secrets: map[string]string{"RESTIC_PASSWORD": "secret"}}},
+		{name: "invalid name", creds: Credentials{Secrets: map[string]string{"AWS KEY": "key"}}},
+		{name: "preload", creds: Credentials{Secrets: map[string]string{"LD_PRELOAD": "/tmp/evil.so"}}},
+		{name: "library path", creds: Credentials{Env: map[string]string{"ld_library_path": "/tmp"}}},
+		{name: "macOS loader", creds: Credentials{Env: map[string]string{"DYLD_INSERT_LIBRARIES": "/tmp/evil.dylib"}}},
+		{name: "path", creds: Credentials{Secrets: map[string]string{"PATH": "/tmp"}}},
+		{name: "option without value", creds: Credentials{Options: []string{"s3.storage-class"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.creds.Validate(); (err == nil) != tc.ok {
+				t.Errorf("Validate = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestMaskArgs(t *testing.T) {
+	args := []string{
+		"-o", "s3.secret-key=hunter2",
+		"--option", "sftp.command=ssh -i /root/.ssh/backup host",
+		"--option=rest.password=hunter2",
+		"backup", "--host", "db1", "--", "-o", "a=b",
+	}
+	want := []string{
+		"-o", "s3.secret-key=***",
+		"--option", "sftp.command=***",
+		"--option=rest.password=***",
+		"backup", "--host", "db1", "--", "-o", "a=b",
+	}
+	got := MaskArgs(args)
+	if !slices.Equal(got, want) {
+		t.Errorf("MaskArgs = %q, want %q", got, want)
+	}
+	if args[1] != "s3.secret-key=hunter2" {
+		t.Error("MaskArgs changed its argument")
+	}
+}
@@ -0,0 +1,266 @@
+package restic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/secrets"
+)
+
+// forgetTimeoutFactor extends the timeout of forget, which rewrites the
+// index and can take much longer than the read-only commands.
+const forgetTimeoutFactor = 3
+
+// waitDelay bounds how long an interrupted command may take to remove its
+// locks and exit before it is killed, and how long it may keep its output
+// open, e.g. through a child process of a wrapper script.
+const waitDelay = 15 * time.Second
+
+// Exec runs the restic binary.
+type Exec struct {
+	Binary string
+	// CertificateFile is used for repositories that do not name their own.
+	CertificateFile string
+	// Timeout bounds every command; zero means no timeout.
+	Timeout  time.Duration
+	Resolver *secrets.Resolver
+}
+
+// NewExec returns a runner for the restic binary.
+func NewExec(binary, certFile string, timeout time.Duration, resolver *secrets.Resolver) *Exec {
+	return &Exec{Binary: binary, CertificateFile: certFile, Timeout: timeout, Resolver: resolver}
+}
+
+// Snapshots implements Runner.
+func (e *Exec) Snapshots(ctx context.Context, repo Repo) ([]Snapshot, error) {
+	out, err := e.output(ctx, repo, e.Timeout, "snapshots", "--json", "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	if err := json.Unmarshal(out, &snapshots); err != nil {
+		return nil, fmt.Errorf("parse snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+// Ls implements Runner. The command is stopped once limit nodes were read;
+// a limit of zero lists every node.
+func (e *Exec) Ls(ctx context.Context, repo Repo, snapshotID string, limit int) ([]Node, error) {
+	ctx, cancel := e.withTimeout(ctx, e.Timeout)
+	defer cancel()
+	cmd, creds, err := e.command(ctx, repo, "ls", snapshotID, "--json", "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, max(limit, 0))
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if limit > 0 && len(nodes) >= limit {
+			break
+		}
+		var node Node
+		// The first line describes the snapshot and has no path
+		if err := json.Unmarshal(scanner.Bytes(), &node); err != nil || node.Path == "" {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	limited := limit > 0 && len(nodes) >= limit
+	if limited {
+		// Enough nodes; stop restic instead of draining the listing
+		_ = cmd.Process.Kill()
+	}
+	scanErr := scanner.Err()
+
+	if err := cmd.Wait(); err != nil && !limited {
+		return nodes, e.wrap(ctx, creds, "ls", err, stderr.Bytes())
+	}
+	if scanErr != nil && !limited {
+		return nodes, fmt.Errorf("read ls output: %w", scanErr)
+	}
+	return nodes, nil
+}
+
+// Check implements Runner.
+func (e *Exec) Check(ctx context.Context, repo Repo) (string, error) {
+	out, err := e.output(ctx, repo, e.Timeout, "check", "--json", "--no-lock")
+	return strings.TrimSpace(string(out)), err
+}
+
+// Forget implements Runner.
+func (e *Exec) Forget(ctx context.Context, repo Repo, policy Policy) (string, error) {
+	args := append([]string{"forget", "--verbose"}, policy.Args()...)
+	out, err := e.output(ctx, repo, e.Timeout*forgetTimeoutFactor, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// Unlock implements Runner.
+func (e *Exec) Unlock(ctx context.Context, repo Repo, removeAll bool) (string, error) {
+	args := []string{"unlock"}
+	if removeAll {
+		args = append(args, "--remove-all")
+	}
+	out, err := e.output(ctx, repo, e.Timeout, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// Locks implements Runner. Locks removed between listing and reading them
+// are skipped.
+func (e *Exec) Locks(ctx context.Context, repo Repo) ([]Lock, error) {
+	out, err := e.output(ctx, repo, e.Timeout, "list", "locks", "--no-lock")
+	if err != nil {
+		return nil, err
+	}
+	var locks []Lock
+	for _, id := range strings.Fields(string(out)) {
+		data, err := e.output(ctx, repo, e.Timeout, "cat", "lock", id, "--no-lock")
+		if errors.Is(err, ErrTimeout) || ctx.Err() != nil {
+			return locks, err
+		}
+		if err != nil {
+			log.Printf("target %s: read lock %s: %v", repo.Name, id, err)
+			continue
+		}
+		var lock Lock
+		if err := json.Unmarshal(data, &lock); err != nil {
+			return locks, fmt.Errorf("parse lock %s: %w", id, err)
+		}
+		lock.ID = id
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// Stats implements Runner.
+func (e *Exec) Stats(ctx context.Context, repo Repo, mode string) (Stats, error) {
+	var stats Stats
+	out, err := e.output(ctx, repo, e.Timeout, "stats", "--json", "--no-lock", "--mode", mode)
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(out, &stats); err != nil {
+		return stats, fmt.Errorf("parse stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Diff implements Runner.
+func (e *Exec) Diff(ctx context.Context, repo Repo, from, to string) (DiffStats, error) {
+	var stats DiffStats
+	out, err := e.output(ctx, repo, e.Timeout, "diff", "--json", "--no-lock", from, to)
+	if err != nil {
+		return stats, err
+	}
+	// Every change is a line of its own; the summary is the statistics line
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		var msg struct {
+			MessageType string `json:"message_type"`
+			DiffStats
+		}
+		if json.Unmarshal(line, &msg) == nil && msg.MessageType == "statistics" {
+			return msg.DiffStats, nil
+		}
+	}
+	return stats, errors.New("restic diff: no statistics in output")
+}
+
+// output runs a command and returns its stdout.
+func (e *Exec) output(ctx context.Context, repo Repo, timeout time.Duration, args ...string) ([]byte, error) {
+	ctx, cancel := e.withTimeout(ctx, timeout)
+	defer cancel()
+	cmd, creds, err := e.command(ctx, repo, args...)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), e.wrap(ctx, creds, args[0], err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// command resolves the secret references of repo and builds the restic
+// command. References are resolved on every call so rotated secrets are
+// picked up without a restart; the repository's backend environment is
+// merged over the process environment and its extended options are placed
+// before args.
+func (e *Exec) command(ctx context.Context, repo Repo, args ...string) (*exec.Cmd, Credentials, error) {
+	creds, err := Resolve(ctx, e.Resolver, repo.Credentials)
+	if err != nil {
+		return nil, creds, fmt.Errorf("target %s: resolve credentials: %w", repo.Name, err)
+	}
+
+	certFile := creds.CertificateFile
+	if certFile == "" {
+		certFile = e.CertificateFile
+	}
+	if certFile != "" {
+		if _, err := os.Stat(certFile); err != nil {
+			return nil, creds, fmt.Errorf("certificate file %s: %w", certFile, err)
+		}
+	}
+
+	env := Env(creds, e.CertificateFile)
+	args = append(creds.Args(), args...)
+	log.Printf("target %s: executing: %s %s", repo.Name, e.Binary, strings.Join(MaskArgs(args), " "))
+	log.Printf("target %s: env vars: %v", repo.Name, creds.Masked(env))
+
+	cmd := exec.CommandContext(ctx, e.Binary, args...)
+	cmd.Env = append(os.Environ(), env...)
+	// Interrupt rather than kill canceled commands, so restic removes the
+	// locks it holds; it is killed if it does not exit within waitDelay.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = waitDelay
+	return cmd, creds, nil
+}
+
+func (e *Exec) withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// wrap turns the error of a finished command into an *Error.
+func (e *Exec) wrap(ctx context.Context, creds Credentials, command string, err error, stderr []byte) error {
+	resticErr := &Error{
+		Command:  command,
+		ExitCode: -1,
+		Output:   creds.Redact(strings.TrimSpace(string(stderr))),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		resticErr.ExitCode = exitErr.ExitCode()
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		resticErr.Err = ErrTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		resticErr.Err = ErrInterrupted
+	}
+	return resticErr
+}
@@ -0,0 +1,416 @@
+package restic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory Runner for tests and mock mode. Repositories are
+// looked up by name; unknown names get the Default scenario, or a healthy
+// repository with two daily snapshots.
+type Fake struct {
+	mu    sync.Mutex
+	Repos map[string]*FakeRepo
+	// Default is the scenario of repositories without an entry in Repos.
+	Default *ScenarioTarget
+	// Timeout bounds every command like the exec runner's timeout.
+	Timeout time.Duration
+	now     time.Time
+}
+
+// FakeRepo is the state of a repository served by Fake.
+type FakeRepo struct {
+	Repository string
+	Snapshots  []Snapshot
+	// Files is the number of nodes listed per snapshot.
+	Files int
+	// CheckError makes Check fail with this message.
+	CheckError string
+	// Locks are listed by Locks; an exclusive lock makes Check fail until
+	// Unlock removes it.
+	Locks []Lock
+	// Stats and RestoreStats are returned by Stats in raw-data and
+	// restore-size mode; when empty they are derived from the snapshots.
+	Stats        Stats
+	RestoreStats Stats
+	// Delay slows down every command.
+	Delay time.Duration
+	// Timeouts lists commands that block until the context is done.
+	Timeouts map[string]bool
+	// Errors maps commands to the message they fail with.
+	Errors map[string]string
+}
+
+// NewFake returns an empty fake.
+func NewFake() *Fake {
+	return &Fake{Repos: make(map[string]*FakeRepo)}
+}
+
+// NewMockRunner returns the fake used by mock mode, serving the scenario
+// file at path or healthy repositories when path is empty.
+func NewMockRunner(path string, timeout time.Duration) (*Fake, error) {
+	var scenario Scenario
+	if path != "" {
+		var err error
+		if scenario, err = LoadScenario(path); err != nil {
+			return nil, err
+		}
+	}
+	fake := NewScenarioFake(scenario, time.Now())
+	fake.Timeout = timeout
+	return fake, nil
+}
+
+// fakeSnapshot fills in the short ID of s.
+func fakeSnapshot(s Snapshot) Snapshot {
+	s.ShortID = s.ID
+	if len(s.ShortID) > 8 {
+		s.ShortID = s.ShortID[:8]
+	}
+	return s
+}
+
+// fakeSummary returns the backup summary of a snapshot listing files files
+// like Ls, with the amounts multiplied by scale.
+func fakeSummary(files int, scale float64, at time.Time) *SnapshotSummary {
+	n := uint64(float64(files) * scale)
+	return &SnapshotSummary{
+		BackupStart:         at.Add(-time.Minute),
+		BackupEnd:           at,
+		FilesUnmodified:     n,
+		TotalFilesProcessed: n,
+		TotalBytesProcessed: uint64(float64(1024*files*(files+1)/2) * scale),
+	}
+}
+
+// fakeID returns a stable snapshot ID in restic's format.
+func fakeID(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+// Lookup returns the name of the repository whose scenario names the given
+// repository location, or location itself.
+func (f *Fake) Lookup(location string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, repo := range f.Repos {
+		if repo.Repository == location {
+			return name
+		}
+	}
+	return location
+}
+
+// repo returns the state of the named repository, creating it from the
+// default scenario on first use. The caller must hold f.mu.
+func (f *Fake) repo(name string) *FakeRepo {
+	if f.Repos == nil {
+		f.Repos = make(map[string]*FakeRepo)
+	}
+	repo, ok := f.Repos[name]
+	if !ok {
+		now := f.now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		var target ScenarioTarget
+		if f.Default != nil {
+			target = *f.Default
+		}
+		repo = target.repo(name, now)
+		f.Repos[name] = repo
+	}
+	return repo
+}
+
+// begin applies the delay, timeout and error of the scenario to command and
+// returns with f.mu held on success.
+func (f *Fake) begin(ctx context.Context, name, command string) error {
+	f.mu.Lock()
+	state := f.repo(name)
+	delay, hang, failure := state.Delay, state.Timeouts[command], state.Errors[command]
+	f.mu.Unlock()
+
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+	if hang {
+		<-ctx.Done()
+		return fakeContextError(command, ctx)
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return fakeContextError(command, ctx)
+		}
+	}
+	if failure != "" {
+		return fakeError(command, failure)
+	}
+	f.mu.Lock()
+	return nil
+}
+
+func fakeError(command, output string) error {
+	return &Error{Command: command, ExitCode: 1, Err: errors.New("exit status 1"), Output: output}
+}
+
+func fakeContextError(command string, ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = ErrTimeout
+	}
+	return &Error{Command: command, ExitCode: -1, Err: err}
+}
+
+// Snapshots implements Runner.
+func (f *Fake) Snapshots(ctx context.Context, repo Repo) ([]Snapshot, error) {
+	if err := f.begin(ctx, repo.Name, "snapshots"); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	return append([]Snapshot(nil), f.repo(repo.Name).Snapshots...), nil
+}
+
+// Ls implements Runner.
+func (f *Fake) Ls(ctx context.Context, repo Repo, snapshotID string, limit int) ([]Node, error) {
+	if err := f.begin(ctx, repo.Name, "ls"); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	if findSnapshot(state.Snapshots, snapshotID) < 0 {
+		return nil, fakeError("ls", fmt.Sprintf("no matching ID found for prefix %q", snapshotID))
+	}
+
+	count := state.Files
+	if limit > 0 && count > limit {
+		count = limit
+	}
+	nodes := make([]Node, 0, count)
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("file%04d.txt", i)
+		nodes = append(nodes, Node{Path: "/data/" + name, Name: name, Type: "file", Size: int64(1024 * (i + 1))})
+	}
+	return nodes, nil
+}
+
+// Check implements Runner.
+func (f *Fake) Check(ctx context.Context, repo Repo) (string, error) {
+	if err := f.begin(ctx, repo.Name, "check"); err != nil {
+		return "", err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	for _, lock := range state.Locks {
+		if lock.Exclusive {
+			return "", fakeError("check", fmt.Sprintf("unable to create lock in backend: repository is already locked exclusively by PID %d on %s by %s (UID %d, GID %d)\nlock was created at %s (%s ago)\nstorage ID %s",
+				lock.PID, lock.Hostname, lock.Username, lock.UID, lock.GID, lock.Time.Format("2006-01-02 15:04:05"), time.Since(lock.Time).Round(time.Second), lock.ID[:8]))
+		}
+	}
+	if state.CheckError != "" {
+		return "", fakeError("check", state.CheckError)
+	}
+	return "no errors were found", nil
+}
+
+// Forget implements Runner. Snapshots not selected by the policy are
+// removed; an empty policy keeps everything.
+func (f *Fake) Forget(ctx context.Context, repo Repo, policy Policy) (string, error) {
+	if err := f.begin(ctx, repo.Name, "forget"); err != nil {
+		return "", err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	if policy == (Policy{DryRun: policy.DryRun}) {
+		return "no policy was specified, no snapshots will be removed", nil
+	}
+	keep := policy.keep(state.Snapshots)
+	var kept []Snapshot
+	for i, snapshot := range state.Snapshots {
+		if keep[i] {
+			kept = append(kept, snapshot)
+		}
+	}
+	removed := len(state.Snapshots) - len(kept)
+	if policy.DryRun {
+		return fmt.Sprintf("would keep %d snapshots, would remove %d snapshots", len(kept), removed), nil
+	}
+	state.Snapshots = kept
+	return fmt.Sprintf("keep %d snapshots, remove %d snapshots", len(kept), removed), nil
+}
+
+// staleLockAge is the age after which restic unlock considers a lock stale.
+const staleLockAge = 30 * time.Minute
+
+// Unlock implements Runner. Without removeAll only locks older than 30
+// minutes are removed, like restic does for locks of other hosts.
+func (f *Fake) Unlock(ctx context.Context, repo Repo, removeAll bool) (string, error) {
+	if err := f.begin(ctx, repo.Name, "unlock"); err != nil {
+		return "", err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	kept := state.Locks[:0]
+	for _, lock := range state.Locks {
+		if !removeAll && time.Since(lock.Time) < staleLockAge {
+			kept = append(kept, lock)
+		}
+	}
+	removed := len(state.Locks) - len(kept)
+	state.Locks = kept
+	if removeAll {
+		return fmt.Sprintf("%d locks have been removed", removed), nil
+	}
+	return "successfully removed stale locks", nil
+}
+
+// Locks implements Runner.
+func (f *Fake) Locks(ctx context.Context, repo Repo) ([]Lock, error) {
+	if err := f.begin(ctx, repo.Name, "locks"); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	return append([]Lock(nil), f.repo(repo.Name).Locks...), nil
+}
+
+// Stats implements Runner.
+func (f *Fake) Stats(ctx context.Context, repo Repo, mode string) (Stats, error) {
+	if err := f.begin(ctx, repo.Name, "stats"); err != nil {
+		return Stats{}, err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	// Every snapshot lists the same files, see Ls
+	files := uint64(state.Files)
+	snapshotSize := 1024 * files * (files + 1) / 2
+	snapshots := uint64(len(state.Snapshots))
+
+	var stats Stats
+	switch mode {
+	case StatsRawData:
+		stats = state.Stats
+		if stats == (Stats{}) && snapshots > 0 {
+			// Identical snapshots deduplicate to one, compressed by half
+			stats = Stats{
+				TotalSize:              snapshotSize / 2,
+				TotalUncompressedSize:  snapshotSize,
+				CompressionRatio:       2,
+				CompressionSpaceSaving: 50,
+				TotalBlobCount:         files,
+			}
+		}
+	case StatsRestoreSize:
+		stats = state.RestoreStats
+		if stats == (Stats{}) {
+			stats = Stats{TotalSize: snapshotSize * snapshots, TotalFileCount: files * snapshots}
+		}
+	default:
+		return Stats{}, fakeError("stats", fmt.Sprintf("unknown mode %q given", mode))
+	}
+	stats.SnapshotsCount = len(state.Snapshots)
+	return stats, nil
+}
+
+// Diff implements Runner.
+func (f *Fake) Diff(ctx context.Context, repo Repo, from, to string) (DiffStats, error) {
+	if err := f.begin(ctx, repo.Name, "diff"); err != nil {
+		return DiffStats{}, err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	for _, id := range []string{from, to} {
+		if findSnapshot(state.Snapshots, id) < 0 {
+			return DiffStats{}, fakeError("diff", fmt.Sprintf("no matching ID found for prefix %q", id))
+		}
+	}
+	return DiffStats{}, nil
+}
+
+// Backup records a new snapshot of paths. It is not part of Runner; the
+// fake-restic binary uses it to answer the agent's backup commands.
+func (f *Fake) Backup(ctx context.Context, repo Repo, paths, tags []string) (Snapshot, error) {
+	if err := f.begin(ctx, repo.Name, "backup"); err != nil {
+		return Snapshot{}, err
+	}
+	defer f.mu.Unlock()
+	state := f.repo(repo.Name)
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	snapshot := fakeSnapshot(Snapshot{
+		ID:       fakeID(fmt.Sprintf("%s-%d", repo.Name, now.UnixNano())),
+		Time:     now,
+		Hostname: hostname,
+		Paths:    paths,
+		Tags:     tags,
+		Summary:  fakeSummary(state.Files, 1, now),
+	})
+	state.Snapshots = append(state.Snapshots, snapshot)
+	return snapshot, nil
+}
+
+func findSnapshot(snapshots []Snapshot, id string) int {
+	found := -1
+	for i, snapshot := range snapshots {
+		if id == "latest" {
+			if found < 0 || snapshot.Time.After(snapshots[found].Time) {
+				found = i
+			}
+		} else if snapshot.ID == id || snapshot.ShortID == id {
+			return i
+		}
+	}
+	return found
+}
+
+// keep returns the indexes of the snapshots selected by the policy, using
+// the same buckets as restic: the newest snapshot of each of the last n
+// days, weeks and months.
+func (p Policy) keep(snapshots []Snapshot) map[int]bool {
+	order := make([]int, len(snapshots))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return snapshots[order[a]].Time.After(snapshots[order[b]].Time)
+	})
+
+	keep := make(map[int]bool)
+	for i := 0; i < p.KeepLast && i < len(order); i++ {
+		keep[order[i]] = true
+	}
+	for _, rule := range []struct {
+		n      int
+		bucket func(time.Time) string
+	}{
+		{p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.KeepWeekly, func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-%d", y, w) }},
+		{p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	} {
+		last, count := "", 0
+		for _, i := range order {
+			if count >= rule.n {
+				break
+			}
+			if bucket := rule.bucket(snapshots[i].Time); bucket != last {
+				last = bucket
+				keep[i] = true
+				count++
+			}
+		}
+	}
+	return keep
+}
@@ -0,0 +1,231 @@
+package restic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/example/restic-monitor/internal/secrets"
+)
+
+// Runner runs restic commands against a repository. The exec implementation
+// calls the restic binary; Fake serves canned data for tests and mock mode.
+type Runner interface {
+	// Snapshots lists the snapshots of the repository without locking it.
+	Snapshots(ctx context.Context, repo Repo) ([]Snapshot, error)
+	// Ls returns at most limit nodes of a snapshot. When the command times
+	// out the nodes read so far are returned with an error wrapping
+	// ErrTimeout.
+	Ls(ctx context.Context, repo Repo, snapshotID string, limit int) ([]Node, error)
+	// Check verifies the repository structure and returns the output.
+	Check(ctx context.Context, repo Repo) (string, error)
+	// Forget removes snapshots according to policy and returns the output.
+	Forget(ctx context.Context, repo Repo, policy Policy) (string, error)
+	// Unlock removes stale locks, or all locks when removeAll is set, and
+	// returns the output.
+	Unlock(ctx context.Context, repo Repo, removeAll bool) (string, error)
+	// Locks lists the locks of the repository.
+	Locks(ctx context.Context, repo Repo) ([]Lock, error)
+	// Stats returns the statistics of the repository in the given mode,
+	// StatsRawData or StatsRestoreSize.
+	Stats(ctx context.Context, repo Repo, mode string) (Stats, error)
+	// Diff summarises the changes between two snapshots.
+	Diff(ctx context.Context, repo Repo, from, to string) (DiffStats, error)
+}
+
+// RunnerConfig holds the settings of NewRunner.
+type RunnerConfig struct {
+	Binary          string
+	CertificateFile string
+	Timeout         time.Duration
+	// VaultAddr and VaultToken resolve ref+vault:// secret references.
+	VaultAddr  string
+	VaultToken string
+	// Mock serves the scenario file MockScenario, or healthy repositories
+	// when it is empty, instead of running Binary.
+	Mock         bool
+	MockScenario string
+}
+
+// NewRunner returns the runner configured by cfg: the restic binary, or the
+// fake when mock mode is enabled. It is wrapped in a Drainer so shutdown
+// can wait for running commands.
+func NewRunner(cfg RunnerConfig) (Runner, error) {
+	if cfg.Mock {
+		runner, err := NewMockRunner(cfg.MockScenario, cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return NewDrainer(runner), nil
+	}
+	return NewDrainer(NewExec(cfg.Binary, cfg.CertificateFile, cfg.Timeout,
+		secrets.NewResolver(cfg.VaultAddr, cfg.VaultToken))), nil
+}
+
+// Repo names a repository and the credentials to open it. Secret references
+// in the credentials are resolved by the runner.
+type Repo struct {
+	Name string
+	Credentials
+}
+
+// ErrTimeout is wrapped by errors of commands that exceeded their timeout.
+var ErrTimeout = errors.New("timeout")
+
+// ErrInterrupted is wrapped by errors of commands interrupted because their
+// context was canceled, e.g. on shutdown.
+var ErrInterrupted = errors.New("interrupted")
+
+// Error describes a failed restic command.
+type Error struct {
+	Command  string
+	ExitCode int
+	// Output is the trimmed stderr of the command with secrets masked.
+	Output string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("restic %s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("restic %s: %v: %s", e.Command, e.Err, e.Output)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsLocked reports whether err was caused by a locked repository.
+func IsLocked(err error) bool {
+	var resticErr *Error
+	return errors.As(err, &resticErr) && strings.Contains(resticErr.Output, "repository is already locked")
+}
+
+// Snapshot is an entry of "restic snapshots --json".
+type Snapshot struct {
+	ID             string    `json:"id"`
+	ShortID        string    `json:"short_id"`
+	Time           time.Time `json:"time"`
+	Tree           string    `json:"tree,omitempty"`
+	Parent         string    `json:"parent,omitempty"`
+	Hostname       string    `json:"hostname"`
+	Username       string    `json:"username"`
+	Paths          []string  `json:"paths"`
+	Tags           []string  `json:"tags"`
+	ProgramVersion string    `json:"program_version,omitempty"`
+	// Summary is recorded by restic 0.17 and later.
+	Summary *SnapshotSummary `json:"summary,omitempty"`
+}
+
+// SnapshotSummary holds the statistics of the backup run that created a
+// snapshot.
+type SnapshotSummary struct {
+	BackupStart         time.Time `json:"backup_start"`
+	BackupEnd           time.Time `json:"backup_end"`
+	FilesNew            uint64    `json:"files_new"`
+	FilesChanged        uint64    `json:"files_changed"`
+	FilesUnmodified     uint64    `json:"files_unmodified"`
+	DirsNew             uint64    `json:"dirs_new"`
+	DirsChanged         uint64    `json:"dirs_changed"`
+	DirsUnmodified      uint64    `json:"dirs_unmodified"`
+	DataBlobs           int       `json:"data_blobs"`
+	TreeBlobs           int       `json:"tree_blobs"`
+	DataAdded           uint64    `json:"data_added"`
+	DataAddedPacked     uint64    `json:"data_added_packed"`
+	TotalFilesProcessed uint64    `json:"total_files_processed"`
+	TotalBytesProcessed uint64    `json:"total_bytes_processed"`
+}
+
+// Node is a file, directory or other entry of "restic ls --json".
+type Node struct {
+	Path  string `json:"path"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Mtime string `json:"mtime"`
+}
+
+// Lock is a repository lock as printed by "restic cat lock".
+type Lock struct {
+	// ID is the name of the lock file, not part of its content.
+	ID        string    `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Exclusive bool      `json:"exclusive"`
+	Hostname  string    `json:"hostname"`
+	Username  string    `json:"username"`
+	PID       int       `json:"pid"`
+	UID       uint32    `json:"uid,omitempty"`
+	GID       uint32    `json:"gid,omitempty"`
+}
+
+// Policy is a snapshot retention policy for forget. DryRun only reports
+// the snapshots that would be removed.
+type Policy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	DryRun      bool
+}
+
+// Args returns the --keep-* flags of the policy and --dry-run.
+func (p Policy) Args() []string {
+	var args []string
+	if p.DryRun {
+		args = append(args, "--dry-run")
+	}
+	for _, keep := range []struct {
+		flag string
+		n    int
+	}{
+		{"--keep-last", p.KeepLast},
+		{"--keep-daily", p.KeepDaily},
+		{"--keep-weekly", p.KeepWeekly},
+		{"--keep-monthly", p.KeepMonthly},
+	} {
+		if keep.n > 0 {
+			args = append(args, keep.flag, fmt.Sprintf("%d", keep.n))
+		}
+	}
+	return args
+}
+
+// Modes of "restic stats". Raw data counts the deduplicated and compressed
+// blobs stored in the repository; restore size is the size of all snapshots
+// when restored, counting shared files once per snapshot.
+const (
+	StatsRawData     = "raw-data"
+	StatsRestoreSize = "restore-size"
+)
+
+// Stats is the output of "restic stats --json". Only raw-data mode reports
+// the uncompressed size, compression and blob count.
+type Stats struct {
+	TotalSize              uint64  `json:"total_size"`
+	TotalUncompressedSize  uint64  `json:"total_uncompressed_size"`
+	CompressionRatio       float64 `json:"compression_ratio"`
+	TotalBlobCount         uint64  `json:"total_blob_count"`
+	SnapshotsCount         int     `json:"snapshots_count"`
+	TotalFileCount         uint64  `json:"total_file_count"`
+	CompressionSpaceSaving float64 `json:"compression_space_saving"`
+}
+
+// DiffStats is the statistics message of "restic diff --json".
+type DiffStats struct {
+	ChangedFiles int        `json:"changed_files"`
+	Added        DiffCounts `json:"added"`
+	Removed      DiffCounts `json:"removed"`
+}
+
+// DiffCounts counts the entries added or removed between two snapshots.
+type DiffCounts struct {
+	Files     int    `json:"files"`
+	Dirs      int    `json:"dirs"`
+	Others    int    `json:"others"`
+	DataBlobs int    `json:"data_blobs"`
+	TreeBlobs int    `json:"tree_blobs"`
+	Bytes     uint64 `json:"bytes"`
+}
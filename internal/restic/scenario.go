@@ -0,0 +1,275 @@
+package restic
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Scenario describes the repositories served by the fake runner in mock mode
+// and by the fake-restic binary. Durations are strings such as "90s" or "2h".
+//
+//	{
+//	  "default": {"snapshotCount": 3, "interval": "24h", "files": 500},
+//	  "targets": {
+//	    "home":      {"snapshotCount": 30, "interval": "24h", "latestAge": "3h"},
+//	    "bitwarden": {"checkError": "pack 3f4a8b2c is corrupted"},
+//	    "nas":       {"locked": true, "delay": "4s"},
+//	    "offsite":   {"timeout": ["check"], "errors": {"stats": "connection refused"}},
+//	    "legacy":    {"snapshots": [{"id": "0a1b2c3d", "age": "720h", "paths": ["/srv"]}]}
+//	  }
+//	}
+//
+// Targets without an entry use "default"; the fields of an entry override
+// the ones of "default".
+type Scenario struct {
+	Default *ScenarioTarget           `json:"default"`
+	Targets map[string]ScenarioTarget `json:"targets"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, applying each target entry on
+// top of the default.
+func (s *Scenario) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Default json.RawMessage            `json:"default"`
+		Targets map[string]json.RawMessage `json:"targets"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	s.Default = nil
+	if len(raw.Default) > 0 {
+		if err := json.Unmarshal(raw.Default, &s.Default); err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+	}
+	s.Targets = make(map[string]ScenarioTarget, len(raw.Targets))
+	for name, entry := range raw.Targets {
+		// Decode the default again so targets do not share its pointers
+		var target ScenarioTarget
+		if len(raw.Default) > 0 {
+			if err := json.Unmarshal(raw.Default, &target); err != nil {
+				return fmt.Errorf("default: %w", err)
+			}
+		}
+		if err := json.Unmarshal(entry, &target); err != nil {
+			return fmt.Errorf("target %s: %w", name, err)
+		}
+		s.Targets[name] = target
+	}
+	return nil
+}
+
+// ScenarioTarget is the scenario of one repository.
+type ScenarioTarget struct {
+	// Repository matches RESTIC_REPOSITORY in the fake-restic binary; the
+	// target name is used when it is empty.
+	Repository string `json:"repository"`
+	// Snapshots lists explicit snapshots. Otherwise SnapshotCount snapshots
+	// are generated, Interval apart, the newest LatestAge old.
+	Snapshots     []ScenarioSnapshot `json:"snapshots"`
+	SnapshotCount *int               `json:"snapshotCount"`
+	Interval      Duration           `json:"interval"`
+	LatestAge     Duration           `json:"latestAge"`
+	Hostname      string             `json:"hostname"`
+	Paths         []string           `json:"paths"`
+	// Files is the number of nodes listed per snapshot.
+	Files *int `json:"files"`
+	// LatestScale multiplies the file count and size in the backup summary
+	// of the newest generated snapshot, e.g. 0.1 for a missing mount.
+	LatestScale float64 `json:"latestScale"`
+	// CheckError makes check fail with this message.
+	CheckError string `json:"checkError"`
+	// Locked adds an exclusive lock created two hours ago, making check
+	// fail with a lock error until unlock is called.
+	Locked bool `json:"locked"`
+	// Locks lists further locks of the repository.
+	Locks []ScenarioLock `json:"locks"`
+	// Delay slows down every command.
+	Delay Duration `json:"delay"`
+	// Timeout lists commands that hang until they time out.
+	Timeout []string `json:"timeout"`
+	// Errors maps commands to the error they fail with.
+	Errors map[string]string `json:"errors"`
+	// Stats and RestoreStats replace the statistics derived from the
+	// snapshots in raw-data and restore-size mode.
+	Stats        *Stats `json:"stats"`
+	RestoreStats *Stats `json:"restoreStats"`
+}
+
+// ScenarioSnapshot is an explicit snapshot of a scenario.
+type ScenarioSnapshot struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Age      Duration  `json:"age"`
+	Hostname string    `json:"hostname"`
+	Paths    []string  `json:"paths"`
+	Tags     []string  `json:"tags"`
+	// Files and Size replace the backup summary derived from the target.
+	Files *uint64 `json:"files"`
+	Size  *uint64 `json:"size"`
+}
+
+// ScenarioLock is a lock of a scenario repository, created Age ago.
+type ScenarioLock struct {
+	Age       Duration `json:"age"`
+	Exclusive bool     `json:"exclusive"`
+	Hostname  string   `json:"hostname"`
+	Username  string   `json:"username"`
+	PID       int      `json:"pid"`
+}
+
+// Duration is a time.Duration read from a string such as "36h".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"90s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (Scenario, error) {
+	var scenario Scenario
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scenario, fmt.Errorf("read scenario: %w", err)
+	}
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return scenario, fmt.Errorf("parse scenario %s: %w", path, err)
+	}
+	return scenario, nil
+}
+
+// NewScenarioFake returns a fake serving the repositories of scenario, with
+// snapshot ages relative to now.
+func NewScenarioFake(scenario Scenario, now time.Time) *Fake {
+	fake := NewFake()
+	fake.now = now
+	if scenario.Default != nil {
+		fake.Default = scenario.Default
+	}
+	for name, target := range scenario.Targets {
+		fake.Repos[name] = target.repo(name, now)
+	}
+	return fake
+}
+
+// repo builds the fake repository state of the scenario target.
+func (t ScenarioTarget) repo(name string, now time.Time) *FakeRepo {
+	repo := &FakeRepo{
+		Repository: t.Repository,
+		Files:      1234,
+		CheckError: t.CheckError,
+		Delay:      time.Duration(t.Delay),
+		Errors:     t.Errors,
+	}
+	if t.Files != nil {
+		repo.Files = *t.Files
+	}
+	if t.Stats != nil {
+		repo.Stats = *t.Stats
+	}
+	if t.RestoreStats != nil {
+		repo.RestoreStats = *t.RestoreStats
+	}
+	if len(t.Timeout) > 0 {
+		repo.Timeouts = make(map[string]bool, len(t.Timeout))
+		for _, command := range t.Timeout {
+			repo.Timeouts[command] = true
+		}
+	}
+
+	hostname := t.Hostname
+	if hostname == "" {
+		hostname = name
+	}
+
+	locks := t.Locks
+	if t.Locked {
+		locks = append([]ScenarioLock{{Age: Duration(2 * time.Hour), Exclusive: true, PID: 4242}}, locks...)
+	}
+	for i, l := range locks {
+		lock := Lock{
+			ID:        fakeID(fmt.Sprintf("%s-lock-%d", name, i)),
+			Time:      now.Add(-time.Duration(l.Age)),
+			Exclusive: l.Exclusive,
+			Hostname:  l.Hostname,
+			Username:  l.Username,
+			PID:       l.PID,
+		}
+		if lock.Hostname == "" {
+			lock.Hostname = hostname
+		}
+		if lock.Username == "" {
+			lock.Username = "root"
+		}
+		repo.Locks = append(repo.Locks, lock)
+	}
+	paths := t.Paths
+	if len(paths) == 0 {
+		paths = []string{"/data"}
+	}
+
+	if len(t.Snapshots) > 0 {
+		for i, s := range t.Snapshots {
+			snapshot := Snapshot{ID: s.ID, Time: s.Time, Hostname: s.Hostname, Paths: s.Paths, Tags: s.Tags}
+			if snapshot.ID == "" {
+				snapshot.ID = fakeID(fmt.Sprintf("%s-%d", name, i))
+			}
+			if snapshot.Time.IsZero() {
+				snapshot.Time = now.Add(-time.Duration(s.Age))
+			}
+			if snapshot.Hostname == "" {
+				snapshot.Hostname = hostname
+			}
+			if len(snapshot.Paths) == 0 {
+				snapshot.Paths = paths
+			}
+			snapshot.Summary = fakeSummary(repo.Files, 1, snapshot.Time)
+			if s.Files != nil {
+				snapshot.Summary.TotalFilesProcessed = *s.Files
+			}
+			if s.Size != nil {
+				snapshot.Summary.TotalBytesProcessed = *s.Size
+			}
+			repo.Snapshots = append(repo.Snapshots, fakeSnapshot(snapshot))
+		}
+		return repo
+	}
+
+	count, interval, latestAge := 2, 24*time.Hour, 24*time.Hour
+	if t.SnapshotCount != nil {
+		count = *t.SnapshotCount
+	}
+	if t.Interval > 0 {
+		interval = time.Duration(t.Interval)
+	}
+	if t.LatestAge > 0 {
+		latestAge = time.Duration(t.LatestAge)
+	}
+	for i := count - 1; i >= 0; i-- {
+		scale := 1.0
+		if i == 0 && t.LatestScale > 0 {
+			scale = t.LatestScale
+		}
+		at := now.Add(-latestAge - time.Duration(i)*interval)
+		repo.Snapshots = append(repo.Snapshots, fakeSnapshot(Snapshot{
+			ID:       fakeID(fmt.Sprintf("%s-%d", name, i)),
+			Time:     at,
+			Hostname: hostname,
+			Paths:    paths,
+			Summary:  fakeSummary(repo.Files, scale, at),
+		}))
+	}
+	return repo
+}
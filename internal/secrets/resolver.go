@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// refPrefix marks a secret reference. Values without it are literals.
+//
+//	ref+env://NAME                      environment variable of the monitor
+//	ref+file:///path/to/file            file content, trailing newline removed
+//	ref+vault://secret/data/app#field   HashiCorp Vault KV (v1 or v2) field
+const refPrefix = "ref+"
+
+// IsReference reports whether value is a secret reference.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, refPrefix)
+}
+
+// Resolver resolves secret references at command time.
+type Resolver struct {
+	// VaultAddr and VaultToken configure the Vault-compatible HTTP API.
+	VaultAddr  string
+	VaultToken string
+	HTTPClient *http.Client
+}
+
+// NewResolver returns a resolver using the given Vault address and token.
+func NewResolver(vaultAddr, vaultToken string) *Resolver {
+	return &Resolver{
+		VaultAddr:  strings.TrimRight(vaultAddr, "/"),
+		VaultToken: vaultToken,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Resolve returns the secret a reference points to, or value itself when it
+// is not a reference.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+
+	scheme, ref, ok := strings.Cut(strings.TrimPrefix(value, refPrefix), "://")
+	if !ok || ref == "" {
+		return "", fmt.Errorf("malformed secret reference %q", value)
+	}
+
+	switch scheme {
+	case "env":
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("secret reference: environment variable %s is not set", ref)
+		}
+		return secret, nil
+	case "file":
+		data, err := os.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("secret reference: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "vault":
+		return r.resolveVault(ctx, ref)
+	}
+	return "", fmt.Errorf("secret reference: unknown provider %q", scheme)
+}
+
+// resolveVault reads field from the secret at path, e.g.
+// "secret/data/restic/home#password".
+func (r *Resolver) resolveVault(ctx context.Context, ref string) (string, error) {
+	if r == nil || r.VaultAddr == "" {
+		return "", errors.New("secret reference: vault is not configured (VAULT_ADDR)")
+	}
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || field == "" {
+		return "", fmt.Errorf("secret reference: vault reference %q needs a #field", ref)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.VaultAddr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.VaultToken != "" {
+		req.Header.Set("X-Vault-Token", r.VaultToken)
+	}
+
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("secret reference: vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("secret reference: vault %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var payload struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("secret reference: vault %s: %w", path, err)
+	}
+
+	// KV v2 nests the secret in data.data, KV v1 returns it in data
+	data := payload.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+	secret, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret reference: vault %s has no string field %s", path, field)
+	}
+	return secret, nil
+}
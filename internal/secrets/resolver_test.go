@@ -0,0 +1,130 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testVaultToken = "s.test"
+
+// newVault starts a server speaking the KV v2 read API with one secret at
+// secret/data/restic/home.
+func newVault(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"errors":["unsupported operation"]}`, http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/data/restic/home" {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{
+				"data":     map[string]any{"password": "hunter2", "retries": 3},
+				"metadata": map[string]any{"version": 4},
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolveVault(t *testing.T) {
+	srv := newVault(t)
+	r := NewResolver(srv.URL+"/", testVaultToken)
+	ctx := context.Background()
+
+	secret, err := r.Resolve(ctx, "ref+vault://secret/data/restic/home#password")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if secret != "hunter2" {
+		t.Errorf("Resolve = %q, want hunter2", secret)
+	}
+
+	for ref, want := range map[string]string{
+		"ref+vault://secret/data/restic/home#user":    "has no string field user",
+		"ref+vault://secret/data/restic/home#retries": "has no string field retries",
+		"ref+vault://secret/data/restic/home":         "needs a #field",
+		"ref+vault://secret/data/restic/away#user":    "404",
+	} {
+		if _, err := r.Resolve(ctx, ref); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Resolve(%s) = %v, want an error containing %q", ref, err, want)
+		}
+	}
+}
+
+func TestResolveVaultForbidden(t *testing.T) {
+	srv := newVault(t)
+	r := NewResolver(srv.URL, "s.wrong")
+
+	_, err := r.Resolve(context.Background(), "ref+vault://secret/data/restic/home#password")
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Resolve with a wrong token = %v, want a 403 error with the vault message", err)
+	}
+}
+
+func TestResolveVaultNotConfigured(t *testing.T) {
+	r := NewResolver("", "")
+	if _, err := r.Resolve(context.Background(), "ref+vault://secret/data/restic/home#password"); err == nil {
+		t.Error("Resolve without VAULT_ADDR succeeded")
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	t.Setenv("RESTIC_MONITOR_TEST_SECRET", "from env")
+	r := NewResolver("", "")
+	ctx := context.Background()
+
+	secret, err := r.Resolve(ctx, "ref+env://RESTIC_MONITOR_TEST_SECRET")
+	if err != nil || secret != "from env" {
+		t.Errorf("Resolve = %q, %v, want the variable", secret, err)
+	}
+	if _, err := r.Resolve(ctx, "ref+env://RESTIC_MONITOR_TEST_UNSET"); err == nil {
+		t.Error("Resolve of an unset variable succeeded")
+	}
+}
+
+func TestResolveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("from file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver("", "")
+	ctx := context.Background()
+
+	secret, err := r.Resolve(ctx, "ref+file://"+path)
+	if err != nil || secret != "from file" {
+		t.Errorf("Resolve = %q, %v, want the file without the trailing newline", secret, err)
+	}
+	if _, err := r.Resolve(ctx, "ref+file://"+path+".missing"); err == nil {
+		t.Error("Resolve of a missing file succeeded")
+	}
+}
+
+func TestResolveLiterals(t *testing.T) {
+	r := NewResolver("", "")
+	ctx := context.Background()
+
+	if secret, err := r.Resolve(ctx, "plain password"); err != nil || secret != "plain password" {
+		t.Errorf("Resolve of a literal = %q, %v", secret, err)
+	}
+	for _, ref := range []string{"ref+env://", "ref+env", "ref+s3://bucket/key"} {
+		if _, err := r.Resolve(ctx, ref); err == nil {
+			t.Errorf("Resolve(%s) succeeded", ref)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Package secrets encrypts secret values stored in the database with a
+// master key using AES-GCM envelope encryption: every value gets its own
+// random data key, which is itself sealed with the master key.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// prefix marks encrypted values; anything else is treated as plaintext.
+// Plaintext may start with it too, so only a successful Decrypt tells the
+// two apart.
+const prefix = "enc:v1:"
+
+// ErrNoKey is returned when an encrypted value is found but no master key is
+// configured.
+var ErrNoKey = errors.New("value is encrypted but no master key is configured")
+
+// ErrWrongKey is returned when a value was encrypted with a different master
+// key than the configured one.
+var ErrWrongKey = errors.New("value was encrypted with a different master key")
+
+// Cipher encrypts and decrypts values with a master key. A nil *Cipher
+// passes plaintext through and fails on encrypted values.
+type Cipher struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+// New returns a cipher for a 32 byte master key.
+func New(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &Cipher{aead: aead, keyID: hex.EncodeToString(sum[:4])}, nil
+}
+
+// ParseKey decodes a master key given as 64 hex characters or base64.
+func ParseKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if len(encoded) == 64 {
+		if key, err := hex.DecodeString(encoded); err == nil {
+			return key, nil
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("master key must be 32 bytes encoded as hex or base64")
+	}
+	return key, nil
+}
+
+// Load returns the cipher for the key given directly or in keyFile, or nil
+// when neither is set.
+func Load(key, keyFile string) (*Cipher, error) {
+	if key == "" && keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read master key file: %w", err)
+		}
+		key = string(data)
+	}
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return New(raw)
+}
+
+// GenerateKey returns a new random master key encoded as base64.
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// KeyID identifies the master key without revealing it.
+func (c *Cipher) KeyID() string {
+	if c == nil {
+		return ""
+	}
+	return c.keyID
+}
+
+// IsEncrypted reports whether value has the prefix of values produced by
+// Encrypt. Use Sealed to tell them apart from plaintext with that prefix.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Sealed reports whether value decrypts with c. Values that only start with
+// the prefix of encrypted values are plaintext; values sealed with another
+// master key return ErrWrongKey.
+func (c *Cipher) Sealed(value string) (bool, error) {
+	if !IsEncrypted(value) {
+		return false, nil
+	}
+	_, err := c.Decrypt(value)
+	if errors.Is(err, ErrNoKey) || errors.Is(err, ErrWrongKey) {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+// Encrypt seals value, whatever it starts with. Empty values and a nil
+// cipher return value unchanged, except plaintext that Decrypt would take
+// for an encrypted value.
+func (c *Cipher) Encrypt(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	if c == nil {
+		if IsEncrypted(value) {
+			return "", fmt.Errorf("values starting with %q can only be stored with a master key", prefix)
+		}
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealedKey, err := seal(c.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedValue, err := seal(dataAEAD, []byte(value))
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + c.keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedValue), nil
+}
+
+// Decrypt opens a value produced by Encrypt. Plaintext values are returned
+// unchanged so databases written before encryption was enabled keep working.
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if c == nil {
+		return "", ErrNoKey
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	if parts[0] != c.keyID {
+		return "", ErrWrongKey
+	}
+	sealedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decode data key: %w", err)
+	}
+	sealedValue, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("decode value: %w", err)
+	}
+
+	dataKey, err := open(c.aead, sealedKey)
+	if err != nil {
+		return "", fmt.Errorf("open data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(dataAEAD, sealedValue)
+	if err != nil {
+		return "", fmt.Errorf("open value: %w", err)
+	}
+	return string(plain), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
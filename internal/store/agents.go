@@ -0,0 +1,375 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Task types understood by agents.
+const (
+	TaskTypeBackup = "backup"
+	TaskTypeCheck  = "check"
+	TaskTypePrune  = "prune"
+	TaskTypeUnlock = "unlock"
+)
+
+// Task states.
+const (
+	TaskPending   = "pending"
+	TaskLeased    = "leased"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+)
+
+// ErrTaskNotLeased is returned when a result is reported for a task that is
+// not currently leased by the reporting agent.
+var ErrTaskNotLeased = errors.New("task is not leased by this agent")
+
+// ErrAgentExists is returned when an agent registers with the name of an
+// existing agent it may not replace.
+var ErrAgentExists = errors.New("an agent with this name is already registered")
+
+// Agent is a machine that pulls tasks from the orchestrator.
+type Agent struct {
+	ID            uint   `gorm:"primaryKey"`
+	Name          string `gorm:"uniqueIndex;size:255"`
+	Hostname      string
+	OS            string
+	Arch          string
+	Version       string
+	TokenHash     string `gorm:"index"`
+	LastHeartbeat time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Task is a unit of work queued for an agent.
+type Task struct {
+	ID             uint   `gorm:"primaryKey"`
+	AgentID        uint   `gorm:"index"`
+	TargetName     string `gorm:"index"`
+	Type           string
+	Payload        string
+	Status         string `gorm:"index"`
+	Attempts       int
+	MaxAttempts    int
+	TimeoutSeconds int
+	LeaseExpiresAt time.Time
+	ExitCode       int
+	Output         string
+	Error          string
+	Hooks          string // JSON encoded pre/post hook results
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Timeout returns the execution timeout of the task.
+func (t Task) Timeout() time.Duration {
+	return time.Duration(t.TimeoutSeconds) * time.Second
+}
+
+// TaskLog is one line of output streamed by an agent while running a task.
+type TaskLog struct {
+	ID        uint `gorm:"primaryKey"`
+	TaskID    uint `gorm:"index"`
+	Line      string
+	CreatedAt time.Time
+}
+
+// AgentData is used to register or update an agent.
+type AgentData struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Version  string `json:"version"`
+}
+
+// TaskData describes a task to enqueue.
+type TaskData struct {
+	AgentID     uint
+	TargetName  string
+	Type        string
+	Payload     string
+	MaxAttempts int
+	Timeout     time.Duration
+}
+
+// TaskResult is reported by an agent once a task has finished.
+type TaskResult struct {
+	Success  bool
+	ExitCode int
+	Output   string
+	Error    string
+	Hooks    string
+}
+
+// ValidTaskType reports whether the type can be executed by agents.
+func ValidTaskType(taskType string) bool {
+	switch taskType {
+	case TaskTypeBackup, TaskTypeCheck, TaskTypePrune, TaskTypeUnlock:
+		return true
+	}
+	return false
+}
+
+// RegisterAgent creates or updates an agent by name and stores the hash of
+// its new token. An existing agent is only updated when replace allows it,
+// otherwise ErrAgentExists is returned.
+func (s *Store) RegisterAgent(ctx context.Context, data AgentData, tokenHash string, replace func(Agent) bool) (Agent, error) {
+	var agent Agent
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("name = ?", data.Name).First(&agent).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			agent.Name = data.Name
+		case err != nil:
+			return err
+		case !replace(agent):
+			return ErrAgentExists
+		}
+
+		agent.Hostname = data.Hostname
+		agent.OS = data.OS
+		agent.Arch = data.Arch
+		agent.Version = data.Version
+		agent.TokenHash = tokenHash
+		agent.LastHeartbeat = time.Now()
+		return tx.Save(&agent).Error
+	})
+	if err != nil {
+		return Agent{}, err
+	}
+	return agent, nil
+}
+
+// GetAgent returns an agent by ID.
+func (s *Store) GetAgent(ctx context.Context, id uint) (Agent, error) {
+	var agent Agent
+	err := s.db.WithContext(ctx).First(&agent, id).Error
+	return agent, err
+}
+
+// ListAgents returns all registered agents.
+func (s *Store) ListAgents(ctx context.Context) ([]Agent, error) {
+	var agents []Agent
+	err := s.db.WithContext(ctx).
+		Order("name asc").
+		Find(&agents).Error
+	return agents, err
+}
+
+// TouchAgent records a heartbeat for the agent.
+func (s *Store) TouchAgent(ctx context.Context, id uint, at time.Time) error {
+	return s.db.WithContext(ctx).
+		Model(&Agent{}).
+		Where("id = ?", id).
+		Update("last_heartbeat", at).Error
+}
+
+// EnqueueTask adds a pending task for an agent.
+func (s *Store) EnqueueTask(ctx context.Context, data TaskData) (Task, error) {
+	if !ValidTaskType(data.Type) {
+		return Task{}, fmt.Errorf("unknown task type %q", data.Type)
+	}
+	if data.MaxAttempts <= 0 {
+		data.MaxAttempts = 3
+	}
+	if data.Timeout <= 0 {
+		data.Timeout = time.Hour
+	}
+
+	payload, err := s.cipher.Encrypt(data.Payload)
+	if err != nil {
+		return Task{}, err
+	}
+
+	task := Task{
+		AgentID:        data.AgentID,
+		TargetName:     data.TargetName,
+		Type:           data.Type,
+		Payload:        payload,
+		Status:         TaskPending,
+		MaxAttempts:    data.MaxAttempts,
+		TimeoutSeconds: int(data.Timeout / time.Second),
+	}
+	if err := s.db.WithContext(ctx).Create(&task).Error; err != nil {
+		return Task{}, err
+	}
+	task.Payload = data.Payload
+	return task, nil
+}
+
+// GetTask returns a task by ID.
+func (s *Store) GetTask(ctx context.Context, id uint) (Task, error) {
+	var task Task
+	if err := s.db.WithContext(ctx).First(&task, id).Error; err != nil {
+		return task, err
+	}
+	err := s.decryptTask(&task)
+	return task, err
+}
+
+// ListTasks returns the most recent tasks, optionally filtered by agent.
+func (s *Store) ListTasks(ctx context.Context, agentID uint, limit int) ([]Task, error) {
+	query := s.db.WithContext(ctx).Order("id desc")
+	if agentID != 0 {
+		query = query.Where("agent_id = ?", agentID)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var tasks []Task
+	if err := query.Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	for i := range tasks {
+		if err := s.decryptTask(&tasks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return tasks, nil
+}
+
+// LeaseTask hands the oldest pending task of an agent out for execution. The
+// lease lasts for the task timeout plus grace; when it expires without a
+// result the task is re-queued by RequeueExpiredTasks. It returns nil when no
+// task is available.
+func (s *Store) LeaseTask(ctx context.Context, agentID uint, grace time.Duration) (*Task, error) {
+	if _, err := s.RequeueExpiredTasks(ctx, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var leased *Task
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the row so concurrent polls cannot lease the task twice on
+		// PostgreSQL; SQLite serializes writers anyway
+		var task Task
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("agent_id = ? AND status = ?", agentID, TaskPending).
+			Order("id asc").
+			First(&task).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		task.Status = TaskLeased
+		task.Attempts++
+		task.StartedAt = now
+		task.LeaseExpiresAt = now.Add(task.Timeout() + grace)
+		if err := tx.Save(&task).Error; err != nil {
+			return err
+		}
+		if err := s.decryptTask(&task); err != nil {
+			return err
+		}
+		leased = &task
+		return nil
+	})
+	return leased, err
+}
+
+// CompleteTask stores the result of a leased task. Failed tasks are re-queued
+// until they run out of attempts.
+func (s *Store) CompleteTask(ctx context.Context, agentID, taskID uint, result TaskResult) (Task, error) {
+	var task Task
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&task, taskID).Error; err != nil {
+			return err
+		}
+		if task.AgentID != agentID || task.Status != TaskLeased {
+			return ErrTaskNotLeased
+		}
+
+		task.ExitCode = result.ExitCode
+		task.Output = result.Output
+		task.Error = result.Error
+		task.Hooks = result.Hooks
+		task.LeaseExpiresAt = time.Time{}
+		switch {
+		case result.Success:
+			task.Status = TaskSucceeded
+			task.FinishedAt = time.Now()
+		case task.Attempts < task.MaxAttempts:
+			task.Status = TaskPending
+		default:
+			task.Status = TaskFailed
+			task.FinishedAt = time.Now()
+		}
+		if err := tx.Save(&task).Error; err != nil {
+			return err
+		}
+		return s.decryptTask(&task)
+	})
+	return task, err
+}
+
+// RequeueExpiredTasks returns leased tasks whose lease has expired to the
+// queue, or fails them when no attempts are left. It returns the number of
+// tasks touched. Every task is updated only while it is still leased with
+// an expired lease, so a result reported in the meantime is kept.
+func (s *Store) RequeueExpiredTasks(ctx context.Context, now time.Time) (int, error) {
+	var expired []Task
+	err := s.db.WithContext(ctx).
+		Select("id", "attempts", "max_attempts").
+		Where("status = ? AND lease_expires_at < ?", TaskLeased, now).
+		Find(&expired).Error
+	if err != nil {
+		return 0, err
+	}
+
+	requeued := 0
+	for _, task := range expired {
+		updates := map[string]any{
+			"status":           TaskPending,
+			"lease_expires_at": time.Time{},
+			"error":            "lease expired before a result was reported",
+		}
+		if task.Attempts >= task.MaxAttempts {
+			updates["status"] = TaskFailed
+			updates["finished_at"] = now
+		}
+		result := s.db.WithContext(ctx).
+			Model(&Task{}).
+			Where("id = ? AND status = ? AND lease_expires_at < ?", task.ID, TaskLeased, now).
+			Updates(updates)
+		if result.Error != nil {
+			return requeued, result.Error
+		}
+		requeued += int(result.RowsAffected)
+	}
+	return requeued, nil
+}
+
+// AppendTaskLogs stores output lines streamed by an agent for a task.
+func (s *Store) AppendTaskLogs(ctx context.Context, taskID uint, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	logs := make([]TaskLog, 0, len(lines))
+	for _, line := range lines {
+		logs = append(logs, TaskLog{TaskID: taskID, Line: line})
+	}
+	return s.db.WithContext(ctx).Create(&logs).Error
+}
+
+// ListTaskLogs returns the log lines of a task with an ID greater than
+// afterID, oldest first.
+func (s *Store) ListTaskLogs(ctx context.Context, taskID, afterID uint) ([]TaskLog, error) {
+	var logs []TaskLog
+	err := s.db.WithContext(ctx).
+		Where("task_id = ? AND id > ?", taskID, afterID).
+		Order("id asc").
+		Find(&logs).Error
+	return logs, err
+}
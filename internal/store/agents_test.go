@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTasks(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn, WithCipher(testCipher(t)))
+
+		agent, err := s.RegisterAgent(ctx, AgentData{Name: "db1", Hostname: "db1.example.com"}, "hash1", nil)
+		if err != nil {
+			t.Fatalf("RegisterAgent: %v", err)
+		}
+		refuse := func(Agent) bool { return false }
+		if _, err := s.RegisterAgent(ctx, AgentData{Name: "db1"}, "stolen", refuse); !errors.Is(err, ErrAgentExists) {
+			t.Errorf("RegisterAgent of a taken name: %v, want ErrAgentExists", err)
+		}
+		again, err := s.RegisterAgent(ctx, AgentData{Name: "db1", Version: "1.1"}, "hash2", func(existing Agent) bool {
+			return existing.TokenHash == "hash1"
+		})
+		if err != nil {
+			t.Fatalf("RegisterAgent again: %v", err)
+		}
+		if again.ID != agent.ID || again.TokenHash != "hash2" || again.Version != "1.1" {
+			t.Errorf("re-registered agent = %+v, want ID %d with the new token", again, agent.ID)
+		}
+
+		if _, err := s.EnqueueTask(ctx, TaskData{AgentID: agent.ID, Type: "restore"}); err == nil {
+			t.Error("EnqueueTask accepted an unknown type")
+		}
+		task, err := s.EnqueueTask(ctx, TaskData{
+			AgentID:     agent.ID,
+			TargetName:  "db",
+			Type:        TaskTypeBackup,
+			Payload:     `{"password":"secret"}`,
+			MaxAttempts: 2,
+		})
+		if err != nil {
+			t.Fatalf("EnqueueTask: %v", err)
+		}
+		if task.Status != TaskPending || task.Timeout() != time.Hour {
+			t.Errorf("enqueued task = %+v", task)
+		}
+		var stored Task
+		if err := s.db.First(&stored, task.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if stored.Payload == task.Payload {
+			t.Error("payload stored in the clear")
+		}
+
+		leased, err := s.LeaseTask(ctx, agent.ID, time.Minute)
+		if err != nil || leased == nil {
+			t.Fatalf("LeaseTask = %v, %v", leased, err)
+		}
+		if leased.ID != task.ID || leased.Status != TaskLeased || leased.Attempts != 1 || leased.Payload != task.Payload {
+			t.Errorf("leased task = %+v", leased)
+		}
+		if next, err := s.LeaseTask(ctx, agent.ID, time.Minute); err != nil || next != nil {
+			t.Errorf("second LeaseTask = %v, %v, want none", next, err)
+		}
+
+		if _, err := s.CompleteTask(ctx, agent.ID+1, task.ID, TaskResult{Success: true}); !errors.Is(err, ErrTaskNotLeased) {
+			t.Errorf("CompleteTask by another agent: %v, want ErrTaskNotLeased", err)
+		}
+		failed, err := s.CompleteTask(ctx, agent.ID, task.ID, TaskResult{ExitCode: 1, Error: "boom"})
+		if err != nil {
+			t.Fatalf("CompleteTask: %v", err)
+		}
+		if failed.Status != TaskPending {
+			t.Errorf("failed task with attempts left is %s, want pending", failed.Status)
+		}
+
+		if err := s.AppendTaskLogs(ctx, task.ID, []string{"one", "two", "three"}); err != nil {
+			t.Fatalf("AppendTaskLogs: %v", err)
+		}
+		logs, err := s.ListTaskLogs(ctx, task.ID, 0)
+		if err != nil || len(logs) != 3 || logs[0].Line != "one" {
+			t.Fatalf("ListTaskLogs = %+v, %v", logs, err)
+		}
+		if after, err := s.ListTaskLogs(ctx, task.ID, logs[1].ID); err != nil || len(after) != 1 || after[0].Line != "three" {
+			t.Errorf("ListTaskLogs after %d = %+v, %v", logs[1].ID, after, err)
+		}
+
+		if _, err := s.LeaseTask(ctx, agent.ID, -2*time.Hour); err != nil {
+			t.Fatalf("LeaseTask: %v", err)
+		}
+		requeued, err := s.RequeueExpiredTasks(ctx, time.Now())
+		if err != nil || requeued != 1 {
+			t.Fatalf("RequeueExpiredTasks = %d, %v, want 1", requeued, err)
+		}
+		got, err := s.GetTask(ctx, task.ID)
+		if err != nil {
+			t.Fatalf("GetTask: %v", err)
+		}
+		if got.Status != TaskFailed || got.Attempts != 2 || got.Payload != task.Payload {
+			t.Errorf("task after its last lease expired = %+v", got)
+		}
+
+		second, err := s.EnqueueTask(ctx, TaskData{AgentID: agent.ID, TargetName: "db", Type: TaskTypeCheck})
+		if err != nil {
+			t.Fatalf("EnqueueTask: %v", err)
+		}
+		// The result arrives after the lease expired but before the requeue
+		if _, err := s.LeaseTask(ctx, agent.ID, -time.Minute); err != nil {
+			t.Fatalf("LeaseTask: %v", err)
+		}
+		done, err := s.CompleteTask(ctx, agent.ID, second.ID, TaskResult{Success: true, Output: "no errors were found"})
+		if err != nil {
+			t.Fatalf("CompleteTask: %v", err)
+		}
+		if done.Status != TaskSucceeded || done.FinishedAt.IsZero() {
+			t.Errorf("completed task = %+v", done)
+		}
+		if requeued, err := s.RequeueExpiredTasks(ctx, time.Now()); err != nil || requeued != 0 {
+			t.Errorf("RequeueExpiredTasks after the result = %d, %v, want 0", requeued, err)
+		}
+		if got, err := s.GetTask(ctx, second.ID); err != nil || got.Status != TaskSucceeded || got.Output != done.Output {
+			t.Errorf("task after the requeue = %+v, %v, want the result kept", got, err)
+		}
+
+		tasks, err := s.ListTasks(ctx, agent.ID, 1)
+		if err != nil || len(tasks) != 1 || tasks[0].ID != second.ID {
+			t.Errorf("ListTasks = %+v, %v, want the newest task", tasks, err)
+		}
+	})
+}
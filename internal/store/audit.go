@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Audit outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// ActorSystem is the actor of background actions.
+const ActorSystem = "system"
+
+// AuditEntry records a state-changing request or background action.
+type AuditEntry struct {
+	ID    uint      `gorm:"primaryKey"`
+	Time  time.Time `gorm:"index"`
+	Actor string    `gorm:"index"`
+	// Source is the client address; ForwardedFor is the X-Forwarded-For
+	// header as sent, which is only trustworthy behind a known proxy.
+	Source       string
+	ForwardedFor string
+	Action       string `gorm:"index"`
+	Target       string `gorm:"index"`
+	Method       string
+	Path         string
+	// Parameters holds the JSON encoded parameters of the action.
+	Parameters string
+	Outcome    string `gorm:"index"`
+	StatusCode int
+	Error      string
+	DurationMs int64
+}
+
+// AuditData captures an audit entry.
+type AuditData struct {
+	Time         time.Time
+	Actor        string
+	Source       string
+	ForwardedFor string
+	Action       string
+	Target       string
+	Method       string
+	Path         string
+	Parameters   map[string]any
+	Outcome      string
+	StatusCode   int
+	Error        string
+	Duration     time.Duration
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+	Offset  int
+}
+
+// RecordAudit stores an audit entry.
+func (s *Store) RecordAudit(ctx context.Context, data AuditData) (AuditEntry, error) {
+	params, err := encodeField(data.Parameters)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+	entry := AuditEntry{
+		Time:         data.Time,
+		Actor:        data.Actor,
+		Source:       data.Source,
+		ForwardedFor: data.ForwardedFor,
+		Action:       data.Action,
+		Target:       data.Target,
+		Method:       data.Method,
+		Path:         data.Path,
+		Parameters:   params,
+		Outcome:      data.Outcome,
+		StatusCode:   data.StatusCode,
+		Error:        data.Error,
+		DurationMs:   data.Duration.Milliseconds(),
+	}
+	err = s.db.WithContext(ctx).Create(&entry).Error
+	return entry, err
+}
+
+// ListAudit returns the matching audit entries, newest first, and the
+// number of matching entries before Limit and Offset.
+func (s *Store) ListAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, int64, error) {
+	query := s.db.WithContext(ctx).Model(&AuditEntry{})
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Target != "" {
+		query = query.Where("target = ?", filter.Target)
+	}
+	if filter.Outcome != "" {
+		query = query.Where("outcome = ?", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("time >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("time < ?", filter.Until)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	query = query.Order("time desc, id desc")
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+	var entries []AuditEntry
+	err := query.Find(&entries).Error
+	return entries, total, err
+}
+
+// AuditParameters decodes the parameters of the entry.
+func (e AuditEntry) AuditParameters() (map[string]any, error) {
+	var params map[string]any
+	err := decodeField(e.Parameters, &params)
+	return params, err
+}
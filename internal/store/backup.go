@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupPagesPerStep is the number of pages copied at a time, so writers
+// are only held up briefly during a backup.
+const backupPagesPerStep = 256
+
+// Backup writes a consistent copy of a SQLite database to dest while the
+// monitor keeps running, using the SQLite online backup API. dest must not
+// exist; the copy is written next to it and renamed once complete.
+// PostgreSQL databases are backed up with pg_dump instead.
+func (s *Store) Backup(ctx context.Context, dest string) error {
+	if s.Dialect() != "sqlite" {
+		return fmt.Errorf("online backup supports SQLite only, back up %s databases with pg_dump", s.Dialect())
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp := dest + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := s.backupTo(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("backup database: %w", err)
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (s *Store) backupTo(ctx context.Context, path string) error {
+	srcDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destDB, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			dest, ok := destDriver.(*sqlite3.SQLiteConn)
+			src, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("unexpected SQLite driver")
+			}
+			backup, err := dest.Backup("main", src, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(backupPagesPerStep)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					backup.Close()
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	})
+}
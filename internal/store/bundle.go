@@ -0,0 +1,304 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/example/restic-monitor/internal/secrets"
+	"gorm.io/gorm"
+)
+
+// BundleVersion is the format version of exported bundles. Import accepts
+// bundles up to this version.
+const BundleVersion = 1
+
+// How the secrets of a bundle are stored: the passwords and credential
+// values of targets and the password hashes of users.
+const (
+	// SecretsExcluded leaves secrets out; import keeps the stored ones.
+	SecretsExcluded = "excluded"
+	// SecretsEncrypted seals every secret with a master key, see KeyID.
+	SecretsEncrypted = "encrypted"
+	// SecretsPlain exports secrets in plaintext.
+	SecretsPlain = "plain"
+)
+
+// Bundle is a portable export of the configuration stored in the
+// database: targets with their retention and unlock policies, and users
+// with their roles. Statuses, history and tokens are not included.
+type Bundle struct {
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version"`
+	ExportedAt    time.Time `json:"exported_at"`
+	Secrets       string    `json:"secrets"`
+	// KeyID identifies the master key of encrypted bundles.
+	KeyID   string       `json:"key_id,omitempty"`
+	Targets []TargetData `json:"targets"`
+	Users   []BundleUser `json:"users"`
+}
+
+// BundleUser is a user of a bundle.
+type BundleUser struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+	Role         string   `json:"role"`
+	Targets      []string `json:"targets,omitempty"`
+	Disabled     bool     `json:"disabled"`
+}
+
+// ImportResult summarizes an import.
+type ImportResult struct {
+	Targets int `json:"targets"`
+	Users   int `json:"users"`
+	// WithoutSecrets lists new targets and users of a bundle without
+	// secrets; they need a password or credentials before they work.
+	WithoutSecrets []string `json:"withoutSecrets,omitempty"`
+}
+
+// ExportBundle exports targets and users with their secrets handled as
+// mode says. Encrypted bundles are sealed with key, or with the master key
+// of the store if key is nil.
+func (s *Store) ExportBundle(ctx context.Context, mode string, key *secrets.Cipher) (Bundle, error) {
+	if key == nil {
+		key = s.cipher
+	}
+	seal := func(value string) (string, error) { return value, nil }
+	switch mode {
+	case SecretsPlain:
+	case SecretsExcluded:
+		seal = func(string) (string, error) { return "", nil }
+	case SecretsEncrypted:
+		if key == nil {
+			return Bundle{}, errors.New("encrypted export requires a master key")
+		}
+		seal = key.Encrypt
+	default:
+		return Bundle{}, fmt.Errorf("unknown secrets mode %q", mode)
+	}
+
+	version, err := s.CurrentVersion(ctx)
+	if err != nil {
+		return Bundle{}, err
+	}
+	bundle := Bundle{
+		Version:       BundleVersion,
+		SchemaVersion: version,
+		ExportedAt:    time.Now().UTC(),
+		Secrets:       mode,
+		Targets:       []TargetData{},
+		Users:         []BundleUser{},
+	}
+	if mode == SecretsEncrypted {
+		bundle.KeyID = key.KeyID()
+	}
+
+	targets, err := s.ListTargets(ctx)
+	if err != nil {
+		return Bundle{}, err
+	}
+	for _, target := range targets {
+		data, err := target.Data()
+		if err != nil {
+			return Bundle{}, err
+		}
+		if data.Password, err = seal(data.Password); err != nil {
+			return Bundle{}, err
+		}
+		for name, value := range data.Credentials {
+			if data.Credentials[name], err = seal(value); err != nil {
+				return Bundle{}, err
+			}
+		}
+		bundle.Targets = append(bundle.Targets, data)
+	}
+
+	users, err := s.ListUsers(ctx)
+	if err != nil {
+		return Bundle{}, err
+	}
+	for _, user := range users {
+		names, err := user.TargetNames()
+		if err != nil {
+			return Bundle{}, fmt.Errorf("decode targets of user %s: %w", user.Username, err)
+		}
+		hash, err := seal(user.PasswordHash)
+		if err != nil {
+			return Bundle{}, err
+		}
+		bundle.Users = append(bundle.Users, BundleUser{
+			Username:     user.Username,
+			PasswordHash: hash,
+			Role:         user.Role,
+			Targets:      names,
+			Disabled:     user.Disabled,
+		})
+	}
+	return bundle, nil
+}
+
+// Data returns the target in the form of targets.json with decrypted
+// secrets. Variables of targets saved with env are returned in Credentials.
+func (t Target) Data() (TargetData, error) {
+	creds, err := t.ResticCredentials()
+	if err != nil {
+		return TargetData{}, err
+	}
+	data := TargetData{
+		Name:            t.Name,
+		Repository:      t.Repository,
+		Password:        t.Password,
+		PasswordFile:    t.PasswordFile,
+		PasswordCommand: t.PasswordCommand,
+		CertificateFile: t.CertificateFile,
+		Credentials:     mergeEnv(creds.Secrets, creds.Env),
+		Options:         creds.Options,
+		Disabled:        t.Disabled,
+		KeepLast:        t.KeepLast,
+		KeepDaily:       t.KeepDaily,
+		KeepWeekly:      t.KeepWeekly,
+		KeepMonthly:     t.KeepMonthly,
+	}
+	if t.AutoUnlockAfter > 0 {
+		data.AutoUnlockAfter = t.AutoUnlockAfter.String()
+	}
+	return data, nil
+}
+
+// ImportBundle creates or updates the targets and users of bundle in one
+// transaction; nothing else is removed. Encrypted bundles are opened with
+// key, or with the master key of the store if key is nil. Without secrets
+// in the bundle the stored ones are kept.
+func (s *Store) ImportBundle(ctx context.Context, bundle Bundle, key *secrets.Cipher) (ImportResult, error) {
+	var result ImportResult
+	if key == nil {
+		key = s.cipher
+	}
+	if bundle.Version < 1 || bundle.Version > BundleVersion {
+		return result, fmt.Errorf("unsupported bundle version %d, expected 1 to %d", bundle.Version, BundleVersion)
+	}
+	open := func(value string) (string, error) { return value, nil }
+	switch bundle.Secrets {
+	case SecretsPlain, SecretsExcluded:
+	case SecretsEncrypted:
+		if key == nil {
+			return result, fmt.Errorf("bundle is encrypted with key %s, a key is required", bundle.KeyID)
+		}
+		if key.KeyID() != bundle.KeyID {
+			return result, fmt.Errorf("bundle is encrypted with key %s, not %s", bundle.KeyID, key.KeyID())
+		}
+		open = key.Decrypt
+	default:
+		return result, fmt.Errorf("unknown secrets mode %q", bundle.Secrets)
+	}
+
+	for i, data := range bundle.Targets {
+		var err error
+		if data.Password, err = open(data.Password); err != nil {
+			return result, fmt.Errorf("target %s password: %w", data.Name, err)
+		}
+		for name, value := range data.Credentials {
+			if data.Credentials[name], err = open(value); err != nil {
+				return result, fmt.Errorf("target %s credential %s: %w", data.Name, name, err)
+			}
+		}
+		if err := ValidateTarget(data); err != nil {
+			return result, fmt.Errorf("target %q: %w", data.Name, err)
+		}
+		bundle.Targets[i] = data
+	}
+	for i, user := range bundle.Users {
+		if !ValidRole(user.Role) {
+			return result, fmt.Errorf("user %s: unknown role %q", user.Username, user.Role)
+		}
+		var err error
+		if bundle.Users[i].PasswordHash, err = open(user.PasswordHash); err != nil {
+			return result, fmt.Errorf("user %s password hash: %w", user.Username, err)
+		}
+	}
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, data := range bundle.Targets {
+			if bundle.Secrets == SecretsExcluded {
+				var kept bool
+				var err error
+				if data, kept, err = s.keepTargetSecrets(tx, data); err != nil {
+					return err
+				}
+				needsSecret := len(data.Credentials) > 0 || data.PasswordFile == "" && data.PasswordCommand == ""
+				if !kept && needsSecret {
+					result.WithoutSecrets = append(result.WithoutSecrets, "target "+data.Name)
+				}
+			}
+			if err := s.upsertTarget(tx, data); err != nil {
+				return err
+			}
+			result.Targets++
+		}
+		for _, data := range bundle.Users {
+			created, err := importUser(tx, data)
+			if err != nil {
+				return fmt.Errorf("user %s: %w", data.Username, err)
+			}
+			if created && data.PasswordHash == "" {
+				result.WithoutSecrets = append(result.WithoutSecrets, "user "+data.Username)
+			}
+			result.Users++
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportResult{}, err
+	}
+	return result, nil
+}
+
+// keepTargetSecrets fills the excluded secrets of data from the stored
+// target. It returns false for new targets.
+func (s *Store) keepTargetSecrets(tx *gorm.DB, data TargetData) (TargetData, bool, error) {
+	var stored Target
+	err := tx.Where("name = ?", data.Name).First(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return data, false, nil
+	} else if err != nil {
+		return data, false, err
+	}
+	if err := s.decryptTarget(&stored); err != nil {
+		return data, false, err
+	}
+	storedData, err := stored.Data()
+	if err != nil {
+		return data, false, err
+	}
+
+	data.Password = storedData.Password
+	for name := range data.Credentials {
+		data.Credentials[name] = storedData.Credentials[name]
+	}
+	return data, true, nil
+}
+
+// importUser creates or updates a user; an empty password hash keeps the
+// stored one. It reports whether the user was created.
+func importUser(tx *gorm.DB, data BundleUser) (bool, error) {
+	var user User
+	err := tx.Where("username = ?", data.Username).First(&user).Error
+	created := errors.Is(err, gorm.ErrRecordNotFound)
+	if err != nil && !created {
+		return false, err
+	}
+	targets, err := encodeField(data.Targets)
+	if err != nil {
+		return false, err
+	}
+
+	user.Username = data.Username
+	if data.PasswordHash != "" {
+		user.PasswordHash = data.PasswordHash
+	}
+	user.Role = data.Role
+	user.Targets = targets
+	user.Disabled = data.Disabled
+	return created, tx.Save(&user).Error
+}
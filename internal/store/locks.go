@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/example/restic-monitor/internal/restic"
+)
+
+// MinAutoUnlockAfter is the shortest automatic unlock threshold. restic
+// refreshes the locks of running commands every few minutes, so older locks
+// belong to commands that died.
+const MinAutoUnlockAfter = 30 * time.Minute
+
+func parseAutoUnlockAfter(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("auto_unlock_after: %w", err)
+	}
+	if d < MinAutoUnlockAfter {
+		return 0, fmt.Errorf("auto_unlock_after must be at least %s", MinAutoUnlockAfter)
+	}
+	return d, nil
+}
+
+// UnlockEvent records the removal of repository locks.
+type UnlockEvent struct {
+	ID         uint   `gorm:"primaryKey"`
+	TargetName string `gorm:"index"`
+	// Automatic is set for unlocks of the stale lock policy.
+	Automatic bool
+	RemoveAll bool
+	// Locks holds the JSON encoded locks present before the unlock.
+	Locks     string
+	Output    string
+	Error     string
+	CreatedAt time.Time
+}
+
+// UnlockData captures an unlock.
+type UnlockData struct {
+	TargetName string
+	Automatic  bool
+	RemoveAll  bool
+	Locks      []restic.Lock
+	Output     string
+	Error      string
+}
+
+// RecordUnlock stores an unlock event.
+func (s *Store) RecordUnlock(ctx context.Context, data UnlockData) (UnlockEvent, error) {
+	locks, err := encodeField(data.Locks)
+	if err != nil {
+		return UnlockEvent{}, err
+	}
+	event := UnlockEvent{
+		TargetName: data.TargetName,
+		Automatic:  data.Automatic,
+		RemoveAll:  data.RemoveAll,
+		Locks:      locks,
+		Output:     data.Output,
+		Error:      data.Error,
+	}
+	err = s.db.WithContext(ctx).Create(&event).Error
+	return event, err
+}
+
+// ListUnlockEvents returns the newest unlock events of a target.
+func (s *Store) ListUnlockEvents(ctx context.Context, name string, limit int) ([]UnlockEvent, error) {
+	var events []UnlockEvent
+	query := s.db.WithContext(ctx).
+		Where("target_name = ?", name).
+		Order("id desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&events).Error
+	return events, err
+}
+
+// UnlockedLocks decodes the locks present before the unlock.
+func (e UnlockEvent) UnlockedLocks() ([]restic.Lock, error) {
+	var locks []restic.Lock
+	err := decodeField(e.Locks, &locks)
+	return locks, err
+}
@@ -0,0 +1,378 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is a versioned change of the database schema. Up and Down run
+// in a transaction. Migrations never use the models of the store, which
+// keep changing, but their own copies of the affected tables.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// migrations lists all schema changes in order. Never edit a released
+// migration; add a new one instead.
+var migrations = []Migration{
+	{Version: 1, Name: "baseline", Up: baselineUp, Down: baselineDown},
+}
+
+// Migrations returns all known migrations in order.
+func Migrations() []Migration {
+	return migrations
+}
+
+// LatestVersion returns the schema version the store is written for.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion records an applied migration.
+type SchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName keeps the table name independent of the naming strategy.
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// AppliedMigrations returns the applied migrations in order.
+func (s *Store) AppliedMigrations(ctx context.Context) ([]SchemaVersion, error) {
+	tx := s.db.WithContext(ctx)
+	if err := tx.AutoMigrate(&SchemaVersion{}); err != nil {
+		return nil, fmt.Errorf("create schema_version table: %w", err)
+	}
+	var applied []SchemaVersion
+	err := tx.Order("version asc").Find(&applied).Error
+	return applied, err
+}
+
+// CurrentVersion returns the version of the newest applied migration, or
+// zero for an empty database.
+func (s *Store) CurrentVersion(ctx context.Context) (int, error) {
+	applied, err := s.AppliedMigrations(ctx)
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+// MigrateUp applies the pending migrations up to version, or all of them
+// when version is zero, and returns the applied migrations.
+func (s *Store) MigrateUp(ctx context.Context, version int) ([]Migration, error) {
+	if version == 0 {
+		version = LatestVersion()
+	}
+	current, err := s.CurrentVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than the supported version %d", current, LatestVersion())
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > version {
+			continue
+		}
+		err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the applied migrations newer than version and
+// returns the reverted migrations. Version zero reverts all of them, which
+// drops every table.
+func (s *Store) MigrateDown(ctx context.Context, version int) ([]Migration, error) {
+	current, err := s.CurrentVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than the supported version %d", current, LatestVersion())
+	}
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= version {
+			continue
+		}
+		if m.Down == nil {
+			return reverted, fmt.Errorf("migration %d (%s) cannot be reverted", m.Version, m.Name)
+		}
+		err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaVersion{}, "version = ?", m.Version).Error
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("revert migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// checkSchema fails unless all migrations are applied.
+func (s *Store) checkSchema(ctx context.Context) error {
+	current, err := s.CurrentVersion(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current < LatestVersion():
+		return fmt.Errorf("%w: version %d, expected %d", ErrSchemaOutdated, current, LatestVersion())
+	case current > LatestVersion():
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", current, LatestVersion())
+	}
+	return nil
+}
+
+// ErrSchemaOutdated is returned by New when migrations are pending and
+// automatic migration is disabled.
+var ErrSchemaOutdated = errors.New("database schema is outdated, run migrate-up")
+
+// The baseline tables as of version 1. Databases created before versioned
+// migrations were created by gorm's AutoMigrate from the same definitions,
+// so the baseline only adds what older releases lack.
+
+type v1BackupStatus struct {
+	ID               uint   `gorm:"primaryKey"`
+	Name             string `gorm:"uniqueIndex"`
+	Repository       string
+	LatestBackup     time.Time
+	LatestSnapshotID string
+	SnapshotCount    int
+	FileCount        int
+	Health           bool
+	Status           string
+	Components       string
+	StatusMessage    string
+	CheckedAt        time.Time
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (v1BackupStatus) TableName() string { return "backup_statuses" }
+
+type v1SnapshotFile struct {
+	ID             uint `gorm:"primaryKey"`
+	BackupStatusID uint `gorm:"index"`
+	Path           string
+	Name           string
+	Type           string
+	Size           int64
+}
+
+func (v1SnapshotFile) TableName() string { return "snapshot_files" }
+
+type v1Target struct {
+	ID              uint   `gorm:"primaryKey"`
+	Name            string `gorm:"uniqueIndex;size:255"`
+	Repository      string
+	Password        string
+	PasswordFile    string
+	PasswordCommand string
+	CertificateFile string
+	Credentials     string
+	Env             string
+	Options         string
+	Disabled        bool
+	AutoUnlockAfter time.Duration
+	KeepLast        int
+	KeepDaily       int
+	KeepWeekly      int
+	KeepMonthly     int
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (v1Target) TableName() string { return "targets" }
+
+type v1Agent struct {
+	ID            uint   `gorm:"primaryKey"`
+	Name          string `gorm:"uniqueIndex;size:255"`
+	Hostname      string
+	OS            string
+	Arch          string
+	Version       string
+	TokenHash     string `gorm:"index"`
+	LastHeartbeat time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (v1Agent) TableName() string { return "agents" }
+
+type v1Task struct {
+	ID             uint   `gorm:"primaryKey"`
+	AgentID        uint   `gorm:"index"`
+	TargetName     string `gorm:"index"`
+	Type           string
+	Payload        string
+	Status         string `gorm:"index"`
+	Attempts       int
+	MaxAttempts    int
+	TimeoutSeconds int
+	LeaseExpiresAt time.Time
+	ExitCode       int
+	Output         string
+	Error          string
+	Hooks          string
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (v1Task) TableName() string { return "tasks" }
+
+type v1TaskLog struct {
+	ID        uint `gorm:"primaryKey"`
+	TaskID    uint `gorm:"index"`
+	Line      string
+	CreatedAt time.Time
+}
+
+func (v1TaskLog) TableName() string { return "task_logs" }
+
+type v1RepositoryStats struct {
+	ID               uint   `gorm:"primaryKey"`
+	TargetName       string `gorm:"index:idx_repository_stats_target_time"`
+	SnapshotCount    int
+	RawSize          uint64
+	UncompressedSize uint64
+	CompressionRatio float64
+	BlobCount        uint64
+	RestoreSize      uint64
+	RestoreFileCount uint64
+	CollectedAt      time.Time `gorm:"index:idx_repository_stats_target_time"`
+	CreatedAt        time.Time
+}
+
+func (v1RepositoryStats) TableName() string { return "repository_stats" }
+
+type v1SnapshotWarning struct {
+	ID           uint   `gorm:"primaryKey"`
+	TargetName   string `gorm:"uniqueIndex:idx_snapshot_warning;size:255"`
+	SnapshotID   string `gorm:"uniqueIndex:idx_snapshot_warning;size:64"`
+	Metric       string `gorm:"uniqueIndex:idx_snapshot_warning;size:16"`
+	SnapshotTime time.Time
+	Value        uint64
+	Baseline     uint64
+	Ratio        float64
+	Message      string
+	CreatedAt    time.Time
+}
+
+func (v1SnapshotWarning) TableName() string { return "snapshot_warnings" }
+
+type v1UnlockEvent struct {
+	ID         uint   `gorm:"primaryKey"`
+	TargetName string `gorm:"index"`
+	Automatic  bool
+	RemoveAll  bool
+	Locks      string
+	Output     string
+	Error      string
+	CreatedAt  time.Time
+}
+
+func (v1UnlockEvent) TableName() string { return "unlock_events" }
+
+type v1User struct {
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"uniqueIndex;size:255"`
+	PasswordHash string
+	Role         string
+	Targets      string
+	Disabled     bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1APIToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	Name       string `gorm:"size:255"`
+	Prefix     string `gorm:"index;size:32"`
+	TokenHash  string
+	Scopes     string
+	CreatedBy  string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+func (v1APIToken) TableName() string { return "api_tokens" }
+
+type v1Session struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex;size:64"`
+	Username  string `gorm:"index"`
+	Role      string
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+func (v1Session) TableName() string { return "sessions" }
+
+type v1AuditEntry struct {
+	ID           uint      `gorm:"primaryKey"`
+	Time         time.Time `gorm:"index"`
+	Actor        string    `gorm:"index"`
+	Source       string
+	ForwardedFor string
+	Action       string `gorm:"index"`
+	Target       string `gorm:"index"`
+	Method       string
+	Path         string
+	Parameters   string
+	Outcome      string `gorm:"index"`
+	StatusCode   int
+	Error        string
+	DurationMs   int64
+}
+
+func (v1AuditEntry) TableName() string { return "audit_entries" }
+
+func baselineTables() []any {
+	return []any{
+		&v1BackupStatus{}, &v1SnapshotFile{}, &v1Target{}, &v1Agent{}, &v1Task{}, &v1TaskLog{},
+		&v1RepositoryStats{}, &v1SnapshotWarning{}, &v1UnlockEvent{}, &v1User{}, &v1APIToken{},
+		&v1Session{}, &v1AuditEntry{},
+	}
+}
+
+func baselineUp(tx *gorm.DB) error {
+	return tx.AutoMigrate(baselineTables()...)
+}
+
+func baselineDown(tx *gorm.DB) error {
+	return tx.Migrator().DropTable(baselineTables()...)
+}
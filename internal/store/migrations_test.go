@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s, err := Open(dsn)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer closeStore(s)
+
+		if err := s.checkSchema(ctx); !errors.Is(err, ErrSchemaOutdated) {
+			t.Fatalf("checkSchema on an empty database: %v, want ErrSchemaOutdated", err)
+		}
+
+		applied, err := s.MigrateUp(ctx, 0)
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		if len(applied) != len(Migrations()) {
+			t.Errorf("MigrateUp applied %d migrations, want %d", len(applied), len(Migrations()))
+		}
+		if err := s.checkSchema(ctx); err != nil {
+			t.Errorf("checkSchema after MigrateUp: %v", err)
+		}
+		if version, err := s.CurrentVersion(ctx); err != nil || version != LatestVersion() {
+			t.Errorf("CurrentVersion = %d, %v, want %d", version, err, LatestVersion())
+		}
+		for _, table := range []any{&Target{}, &Task{}, &APIToken{}, &User{}} {
+			if !s.db.Migrator().HasTable(table) {
+				t.Errorf("table of %T missing after MigrateUp", table)
+			}
+		}
+
+		if applied, err := s.MigrateUp(ctx, 0); err != nil || len(applied) != 0 {
+			t.Errorf("second MigrateUp applied %d migrations, %v", len(applied), err)
+		}
+
+		reverted, err := s.MigrateDown(ctx, 0)
+		if err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+		if len(reverted) != len(Migrations()) {
+			t.Errorf("MigrateDown reverted %d migrations, want %d", len(reverted), len(Migrations()))
+		}
+		if s.db.Migrator().HasTable(&Target{}) {
+			t.Error("targets table kept after MigrateDown")
+		}
+		if err := s.checkSchema(ctx); !errors.Is(err, ErrSchemaOutdated) {
+			t.Errorf("checkSchema after MigrateDown: %v, want ErrSchemaOutdated", err)
+		}
+	})
+}
+
+func TestCheckSchemaNewerDatabase(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn)
+
+		newer := SchemaVersion{Version: LatestVersion() + 1, Name: "future", AppliedAt: time.Now()}
+		if err := s.db.Create(&newer).Error; err != nil {
+			t.Fatal(err)
+		}
+		err := s.checkSchema(ctx)
+		if err == nil || errors.Is(err, ErrSchemaOutdated) {
+			t.Errorf("checkSchema = %v, want a newer schema error", err)
+		}
+		if _, err := s.MigrateUp(ctx, 0); err == nil {
+			t.Error("MigrateUp accepted a newer schema")
+		}
+		if _, err := s.MigrateDown(ctx, 0); err == nil {
+			t.Error("MigrateDown accepted a newer schema")
+		}
+		if err := s.db.Delete(&newer).Error; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNewWithoutAutoMigrate(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		if _, err := New(dsn, WithAutoMigrate(false)); !errors.Is(err, ErrSchemaOutdated) {
+			t.Fatalf("New on an empty database: %v, want ErrSchemaOutdated", err)
+		}
+		newTestStore(t, dsn)
+		newTestStore(t, dsn, WithAutoMigrate(false))
+	})
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/example/restic-monitor/internal/secrets"
+	"gorm.io/gorm"
+)
+
+// EncryptPlaintextSecrets encrypts secret fields that were stored before a
+// master key was configured. Values that decrypt with the key are left
+// untouched; anything else, including plaintext that merely starts with the
+// prefix of encrypted values, is encrypted.
+func (s *Store) EncryptPlaintextSecrets(ctx context.Context) error {
+	if s.cipher == nil {
+		return nil
+	}
+	return s.reencrypt(ctx, func(value string) (string, bool, error) {
+		sealed, err := s.cipher.Sealed(value)
+		if err != nil || sealed {
+			return value, false, err
+		}
+		encrypted, err := s.cipher.Encrypt(value)
+		return encrypted, true, err
+	})
+}
+
+// RotateSecrets decrypts every secret field with the current master key,
+// encrypts it with next and makes next the active key. Passing a nil cipher
+// stores the secrets in plaintext again.
+func (s *Store) RotateSecrets(ctx context.Context, next *secrets.Cipher) error {
+	err := s.reencrypt(ctx, func(value string) (string, bool, error) {
+		plain, err := s.cipher.Decrypt(value)
+		if err != nil {
+			return value, false, err
+		}
+		converted, err := next.Encrypt(plain)
+		return converted, true, err
+	})
+	if err != nil {
+		return err
+	}
+	s.cipher = next
+	return nil
+}
+
+// reencrypt rewrites the non-empty secret fields in a single transaction.
+// convert returns the new value of a field and whether it changed; it must
+// fail on values encrypted with another key, so a wrong master key is
+// reported at once.
+func (s *Store) reencrypt(ctx context.Context, convert func(string) (string, bool, error)) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var targets []Target
+		if err := tx.Select("id", "name", "password", "credentials").Find(&targets).Error; err != nil {
+			return err
+		}
+		for _, target := range targets {
+			for column, value := range map[string]string{"password": target.Password, "credentials": target.Credentials} {
+				if value == "" {
+					continue
+				}
+				converted, changed, err := convert(value)
+				if err != nil {
+					return fmt.Errorf("target %s %s: %w", target.Name, column, err)
+				}
+				if !changed {
+					continue
+				}
+				if err := tx.Model(&Target{}).Where("id = ?", target.ID).Update(column, converted).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		var tasks []Task
+		if err := tx.Select("id", "payload").Find(&tasks).Error; err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.Payload == "" {
+				continue
+			}
+			payload, changed, err := convert(task.Payload)
+			if err != nil {
+				return fmt.Errorf("task %d: %w", task.ID, err)
+			}
+			if !changed {
+				continue
+			}
+			if err := tx.Model(&Task{}).Where("id = ?", task.ID).Update("payload", payload).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) decryptTask(task *Task) error {
+	payload, err := s.cipher.Decrypt(task.Payload)
+	if err != nil {
+		return fmt.Errorf("decrypt payload of task %d: %w", task.ID, err)
+	}
+	task.Payload = payload
+	return nil
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Session is a dashboard login through OpenID Connect. The cookie holds a
+// random token of which only the hash is stored.
+type Session struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex;size:64"`
+	Username  string `gorm:"index"`
+	Role      string
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// SessionData captures a session to create.
+type SessionData struct {
+	Username string
+	Role     string
+	TTL      time.Duration
+}
+
+// CreateSession stores a session by the hash of its token.
+func (s *Store) CreateSession(ctx context.Context, data SessionData, tokenHash string) (Session, error) {
+	session := Session{
+		TokenHash: tokenHash,
+		Username:  data.Username,
+		Role:      data.Role,
+		ExpiresAt: time.Now().Add(data.TTL),
+	}
+	err := s.db.WithContext(ctx).Create(&session).Error
+	return session, err
+}
+
+// GetSession returns the unexpired session with the token hash; ok is false
+// when there is none.
+func (s *Store) GetSession(ctx context.Context, tokenHash string, now time.Time) (Session, bool, error) {
+	var sessions []Session
+	err := s.db.WithContext(ctx).
+		Where("token_hash = ? AND expires_at > ?", tokenHash, now).
+		Limit(1).
+		Find(&sessions).Error
+	if err != nil || len(sessions) == 0 {
+		return Session{}, false, err
+	}
+	return sessions[0], true, nil
+}
+
+// DeleteSession removes the session with the token hash.
+func (s *Store) DeleteSession(ctx context.Context, tokenHash string) error {
+	return s.db.WithContext(ctx).Where("token_hash = ?", tokenHash).Delete(&Session{}).Error
+}
+
+// DeleteExpiredSessions removes sessions that expired before now.
+func (s *Store) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	result := s.db.WithContext(ctx).Where("expires_at <= ?", now).Delete(&Session{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RepositoryStats is one sample of the size of a repository, combining
+// "restic stats" in raw-data and restore-size mode.
+type RepositoryStats struct {
+	ID            uint   `gorm:"primaryKey"`
+	TargetName    string `gorm:"index:idx_repository_stats_target_time"`
+	SnapshotCount int
+	// RawSize is the size of the deduplicated and compressed data stored in
+	// the repository, UncompressedSize the same data before compression.
+	RawSize          uint64
+	UncompressedSize uint64
+	CompressionRatio float64
+	BlobCount        uint64
+	// RestoreSize and RestoreFileCount describe all snapshots restored.
+	RestoreSize      uint64
+	RestoreFileCount uint64
+	CollectedAt      time.Time `gorm:"index:idx_repository_stats_target_time"`
+	CreatedAt        time.Time
+}
+
+// DedupRatio is the restore size divided by the uncompressed stored size:
+// how many times each stored byte is referenced by the snapshots. The raw
+// size is used for repositories without compression, which do not report an
+// uncompressed size. It is zero when the repository is empty.
+func (s RepositoryStats) DedupRatio() float64 {
+	stored := s.UncompressedSize
+	if stored == 0 {
+		stored = s.RawSize
+	}
+	if stored == 0 {
+		return 0
+	}
+	return float64(s.RestoreSize) / float64(stored)
+}
+
+// StatsData captures a repository statistics sample.
+type StatsData struct {
+	TargetName       string
+	SnapshotCount    int
+	RawSize          uint64
+	UncompressedSize uint64
+	CompressionRatio float64
+	BlobCount        uint64
+	RestoreSize      uint64
+	RestoreFileCount uint64
+	CollectedAt      time.Time
+}
+
+// SaveRepositoryStats appends a statistics sample for a target.
+func (s *Store) SaveRepositoryStats(ctx context.Context, data StatsData) error {
+	stats := RepositoryStats{
+		TargetName:       data.TargetName,
+		SnapshotCount:    data.SnapshotCount,
+		RawSize:          data.RawSize,
+		UncompressedSize: data.UncompressedSize,
+		CompressionRatio: data.CompressionRatio,
+		BlobCount:        data.BlobCount,
+		RestoreSize:      data.RestoreSize,
+		RestoreFileCount: data.RestoreFileCount,
+		CollectedAt:      data.CollectedAt,
+	}
+	return s.db.WithContext(ctx).Create(&stats).Error
+}
+
+// LatestRepositoryStats returns the newest sample of a target. The zero
+// value and no error are returned when none was collected yet.
+func (s *Store) LatestRepositoryStats(ctx context.Context, name string) (RepositoryStats, error) {
+	var stats RepositoryStats
+	err := s.db.WithContext(ctx).
+		Where("target_name = ?", name).
+		Order("collected_at desc").
+		First(&stats).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return RepositoryStats{}, nil
+	}
+	return stats, err
+}
+
+// ListRepositoryStats returns the samples of a target collected at or after
+// since, oldest first. A positive limit keeps only the newest samples.
+func (s *Store) ListRepositoryStats(ctx context.Context, name string, since time.Time, limit int) ([]RepositoryStats, error) {
+	var stats []RepositoryStats
+	query := s.db.WithContext(ctx).
+		Where("target_name = ? AND collected_at >= ?", name, since).
+		Order("collected_at desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Find(&stats).Error; err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(stats)-1; i < j; i, j = i+1, j-1 {
+		stats[i], stats[j] = stats[j], stats[i]
+	}
+	return stats, nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status levels of a target and of its components, from best to worst.
+// StatusDisabled is only used for the overall status of disabled targets.
+const (
+	StatusOK       = "ok"
+	StatusUnknown  = "unknown"
+	StatusWarning  = "warning"
+	StatusCritical = "critical"
+	StatusDisabled = "disabled"
+)
+
+// Status components evaluated on every check.
+const (
+	ComponentReachability = "reachability"
+	ComponentIntegrity    = "integrity"
+	ComponentFreshness    = "freshness"
+	ComponentLock         = "lock"
+)
+
+// Component is the result of one aspect of a target's status.
+type Component struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+var statusRank = map[string]int{
+	StatusOK:       0,
+	StatusUnknown:  1,
+	StatusWarning:  2,
+	StatusCritical: 3,
+}
+
+// WorstStatus returns the worst level of components, or StatusUnknown when
+// there are none.
+func WorstStatus(components []Component) string {
+	if len(components) == 0 {
+		return StatusUnknown
+	}
+	worst := StatusOK
+	for _, component := range components {
+		if statusRank[component.Status] > statusRank[worst] {
+			worst = component.Status
+		}
+	}
+	return worst
+}
+
+// StatusComponents decodes the component results of the status. Rows
+// written before components were recorded have none.
+func (s BackupStatus) StatusComponents() ([]Component, error) {
+	var components []Component
+	err := decodeField(s.Components, &components)
+	return components, err
+}
+
+// Freshness rates the age of the latest snapshot: a warning once it is
+// older than warnAge and critical once older than criticalAge. A zero age
+// disables that level.
+func Freshness(latestBackup, now time.Time, warnAge, criticalAge time.Duration) Component {
+	component := Component{Name: ComponentFreshness, Status: StatusOK}
+	if latestBackup.IsZero() {
+		component.Status = StatusCritical
+		component.Message = "no snapshots"
+		return component
+	}
+	age := now.Sub(latestBackup).Round(time.Minute)
+	switch {
+	case criticalAge > 0 && age > criticalAge:
+		component.Status = StatusCritical
+		component.Message = fmt.Sprintf("latest snapshot is %s old (limit %s)", age, criticalAge)
+	case warnAge > 0 && age > warnAge:
+		component.Status = StatusWarning
+		component.Message = fmt.Sprintf("latest snapshot is %s old (limit %s)", age, warnAge)
+	}
+	return component
+}
+
+// SetComponent replaces the component of the same name and updates the
+// overall status. Statuses without components are left unchanged.
+func (s *BackupStatus) SetComponent(component Component) error {
+	components, err := s.StatusComponents()
+	if err != nil || len(components) == 0 {
+		return err
+	}
+	for i := range components {
+		if components[i].Name == component.Name {
+			components[i] = component
+		}
+	}
+	if s.Components, err = encodeField(components); err != nil {
+		return err
+	}
+	s.Status = WorstStatus(components)
+	return nil
+}
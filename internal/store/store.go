@@ -2,15 +2,44 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
+	"github.com/example/restic-monitor/internal/config"
+	"github.com/example/restic-monitor/internal/restic"
+	"github.com/example/restic-monitor/internal/secrets"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 type Store struct {
-	db *gorm.DB
+	db          *gorm.DB
+	cipher      *secrets.Cipher
+	autoMigrate bool
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithCipher encrypts secret fields (repository passwords, task payloads)
+// with the given master key before they are written to the database.
+func WithCipher(c *secrets.Cipher) Option {
+	return func(s *Store) {
+		s.cipher = c
+	}
+}
+
+// WithAutoMigrate controls whether New applies pending migrations. When
+// disabled, New fails with ErrSchemaOutdated instead.
+func WithAutoMigrate(enabled bool) Option {
+	return func(s *Store) {
+		s.autoMigrate = enabled
+	}
 }
 
 // Target represents a Restic repository to monitor.
@@ -20,8 +49,19 @@ type Target struct {
 	Repository      string
 	Password        string
 	PasswordFile    string
+	PasswordCommand string
 	CertificateFile string
-	Disabled        bool
+	// Credentials holds the JSON encoded backend credentials (environment
+	// variable name to value or secret reference).
+	Credentials string
+	// Env and Options hold the JSON encoded backend settings and extended
+	// "-o" options.
+	Env      string
+	Options  string
+	Disabled bool
+	// AutoUnlockAfter removes all locks once every lock is older than this;
+	// zero disables automatic unlocking.
+	AutoUnlockAfter time.Duration
 	// Prune policy
 	KeepLast    int
 	KeepDaily   int
@@ -31,6 +71,57 @@ type Target struct {
 	UpdatedAt   time.Time
 }
 
+// ResticCredentials returns the repository credentials, backend environment
+// and options of the target. Secret references are not resolved.
+func (t Target) ResticCredentials() (restic.Credentials, error) {
+	creds := restic.Credentials{
+		Repository:      t.Repository,
+		Password:        t.Password,
+		PasswordFile:    t.PasswordFile,
+		PasswordCommand: t.PasswordCommand,
+		CertificateFile: t.CertificateFile,
+	}
+	if err := decodeField(t.Credentials, &creds.Secrets); err != nil {
+		return creds, fmt.Errorf("decode credentials of target %s: %w", t.Name, err)
+	}
+	if err := decodeField(t.Env, &creds.Env); err != nil {
+		return creds, fmt.Errorf("decode env of target %s: %w", t.Name, err)
+	}
+	if err := decodeField(t.Options, &creds.Options); err != nil {
+		return creds, fmt.Errorf("decode options of target %s: %w", t.Name, err)
+	}
+	return creds, nil
+}
+
+// ResticRepo returns the target as a repository for a restic.Runner.
+func (t Target) ResticRepo() (restic.Repo, error) {
+	creds, err := t.ResticCredentials()
+	return restic.Repo{Name: t.Name, Credentials: creds}, err
+}
+
+// decodeField unmarshals a JSON encoded column, leaving v untouched when the
+// column is empty.
+func decodeField(encoded string, v any) error {
+	if encoded == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(encoded), v)
+}
+
+// encodeField marshals v for a JSON encoded column; empty values are stored
+// as an empty string.
+func encodeField(v any) (string, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	switch string(encoded) {
+	case "null", "{}", "[]":
+		return "", nil
+	}
+	return string(encoded), nil
+}
+
 type SnapshotFile struct {
 	ID             uint `gorm:"primaryKey"`
 	BackupStatusID uint `gorm:"index"`
@@ -49,10 +140,13 @@ type BackupStatus struct {
 	SnapshotCount    int
 	FileCount        int
 	Health           bool
-	StatusMessage    string
-	CheckedAt        time.Time
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+	// Status is the overall level, the worst of Components (JSON encoded).
+	Status        string
+	Components    string
+	StatusMessage string
+	CheckedAt     time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 type StatusData struct {
@@ -63,6 +157,7 @@ type StatusData struct {
 	SnapshotCount    int
 	FileCount        int
 	Health           bool
+	Components       []Component
 	StatusMessage    string
 	CheckedAt        time.Time
 	FileListPath     string
@@ -75,32 +170,89 @@ type SnapshotFileData struct {
 	Size int64
 }
 
-// TargetData is used to seed repository rows from JSON.
-type TargetData struct {
-	Name            string `json:"name"`
-	Repository      string `json:"repository"`
-	Password        string `json:"password"`
-	PasswordFile    string `json:"password_file"`
-	CertificateFile string `json:"certificate_file"`
-	Disabled        bool   `json:"disabled"`
-	// Prune policy
-	KeepLast    int `json:"keep_last"`
-	KeepDaily   int `json:"keep_daily"`
-	KeepWeekly  int `json:"keep_weekly"`
-	KeepMonthly int `json:"keep_monthly"`
+// TargetData is used to seed repository rows from targets.json or the
+// targets of the configuration file.
+type TargetData = config.Target
+
+// ValidateTarget checks the target's name, backend settings and unlock
+// threshold.
+func ValidateTarget(d TargetData) error {
+	if d.Name == "" {
+		return errors.New("name is required")
+	}
+	if d.Repository == "" {
+		return errors.New("repository is required")
+	}
+	settings := restic.Credentials{Secrets: d.Credentials, Env: d.Env, Options: d.Options}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if _, err := parseAutoUnlockAfter(d.AutoUnlockAfter); err != nil {
+		return err
+	}
+	for _, keep := range []int{d.KeepLast, d.KeepDaily, d.KeepWeekly, d.KeepMonthly} {
+		if keep < 0 {
+			return errors.New("keep values must not be negative")
+		}
+	}
+	return nil
 }
 
-func New(dsn string) (*Store, error) {
-	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+// New opens the database, brings its schema up to date and encrypts
+// plaintext secrets if a cipher is configured.
+func New(dsn string, opts ...Option) (*Store, error) {
+	s, err := Open(dsn, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.AutoMigrate(&BackupStatus{}, &SnapshotFile{}, &Target{}); err != nil {
+	ctx := context.Background()
+	if s.autoMigrate {
+		applied, err := s.MigrateUp(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range applied {
+			log.Printf("applied database migration %d (%s)", m.Version, m.Name)
+		}
+	} else if err := s.checkSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.EncryptPlaintextSecrets(ctx); err != nil {
+		return nil, fmt.Errorf("encrypt stored secrets: %w", err)
+	}
+
+	return s, nil
+}
+
+// Open connects to the database without touching the schema, for
+// migrations. DSNs starting with postgres:// or postgresql:// select
+// PostgreSQL; anything else is a SQLite file name or URI.
+func Open(dsn string, opts ...Option) (*Store, error) {
+	db, err := gorm.Open(dialector(dsn), &gorm.Config{})
+	if err != nil {
 		return nil, err
 	}
 
-	return &Store{db: db}, nil
+	s := &Store{db: db, autoMigrate: true}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+func dialector(dsn string) gorm.Dialector {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgres.Open(dsn)
+	}
+	return sqlite.Open(strings.TrimPrefix(dsn, "sqlite://"))
+}
+
+// Dialect returns the name of the database backend, "sqlite" or
+// "postgres".
+func (s *Store) Dialect() string {
+	return s.db.Dialector.Name()
 }
 
 func (s *Store) SaveStatus(ctx context.Context, data StatusData) error {
@@ -121,6 +273,10 @@ func (s *Store) SaveStatus(ctx context.Context, data StatusData) error {
 	status.SnapshotCount = data.SnapshotCount
 	status.FileCount = data.FileCount
 	status.Health = data.Health
+	status.Status = WorstStatus(data.Components)
+	if status.Components, err = encodeField(data.Components); err != nil {
+		return fmt.Errorf("encode status components: %w", err)
+	}
 	status.StatusMessage = data.StatusMessage
 	status.CheckedAt = data.CheckedAt
 
@@ -168,26 +324,7 @@ func (s *Store) UpsertTargets(ctx context.Context, targets []TargetData) error {
 		if input.Name == "" {
 			continue
 		}
-
-		var target Target
-		err := tx.Where("name = ?", input.Name).First(&target).Error
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			target.Name = input.Name
-		} else if err != nil {
-			return err
-		}
-
-		target.Repository = input.Repository
-		target.Password = input.Password
-		target.PasswordFile = input.PasswordFile
-		target.CertificateFile = input.CertificateFile
-		target.Disabled = input.Disabled
-		target.KeepLast = input.KeepLast
-		target.KeepDaily = input.KeepDaily
-		target.KeepWeekly = input.KeepWeekly
-		target.KeepMonthly = input.KeepMonthly
-
-		if err := tx.Save(&target).Error; err != nil {
+		if err := s.upsertTarget(tx, input); err != nil {
 			return err
 		}
 	}
@@ -195,13 +332,96 @@ func (s *Store) UpsertTargets(ctx context.Context, targets []TargetData) error {
 	return nil
 }
 
-// ListTargets returns all configured Restic targets.
+// upsertTarget inserts or updates one target with tx.
+func (s *Store) upsertTarget(tx *gorm.DB, input TargetData) error {
+	input.Credentials = mergeEnv(input.Credentials, input.Env)
+	input.Env = nil
+	settings := restic.Credentials{Secrets: input.Credentials, Env: input.Env, Options: input.Options}
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("target %s: %w", input.Name, err)
+	}
+	autoUnlockAfter, err := parseAutoUnlockAfter(input.AutoUnlockAfter)
+	if err != nil {
+		return fmt.Errorf("target %s: %w", input.Name, err)
+	}
+
+	var target Target
+	err = tx.Where("name = ?", input.Name).First(&target).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		target.Name = input.Name
+	} else if err != nil {
+		return err
+	}
+
+	password, err := s.cipher.Encrypt(input.Password)
+	if err != nil {
+		return err
+	}
+	credentials, err := encodeField(input.Credentials)
+	if err != nil {
+		return err
+	}
+	if credentials, err = s.cipher.Encrypt(credentials); err != nil {
+		return err
+	}
+	env, err := encodeField(input.Env)
+	if err != nil {
+		return err
+	}
+	options, err := encodeField(input.Options)
+	if err != nil {
+		return err
+	}
+
+	target.Repository = input.Repository
+	target.Password = password
+	target.PasswordFile = input.PasswordFile
+	target.PasswordCommand = input.PasswordCommand
+	target.CertificateFile = input.CertificateFile
+	target.Credentials = credentials
+	target.Env = env
+	target.Options = options
+	target.Disabled = input.Disabled
+	target.AutoUnlockAfter = autoUnlockAfter
+	target.KeepLast = input.KeepLast
+	target.KeepDaily = input.KeepDaily
+	target.KeepWeekly = input.KeepWeekly
+	target.KeepMonthly = input.KeepMonthly
+
+	return tx.Save(&target).Error
+}
+
+// mergeEnv returns credentials with the variables of env it does not set
+// itself; credentials take precedence.
+func mergeEnv(credentials, env map[string]string) map[string]string {
+	if len(env) == 0 {
+		return credentials
+	}
+	merged := make(map[string]string, len(credentials)+len(env))
+	for key, value := range env {
+		merged[key] = value
+	}
+	for key, value := range credentials {
+		merged[key] = value
+	}
+	return merged
+}
+
+// ListTargets returns all configured Restic targets with decrypted secrets.
 func (s *Store) ListTargets(ctx context.Context) ([]Target, error) {
 	var targets []Target
 	err := s.db.WithContext(ctx).
 		Order("name asc").
 		Find(&targets).Error
-	return targets, err
+	if err != nil {
+		return nil, err
+	}
+	for i := range targets {
+		if err := s.decryptTarget(&targets[i]); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
 }
 
 func (s *Store) ToggleTargetDisabled(ctx context.Context, name string) error {
@@ -212,3 +432,61 @@ func (s *Store) ToggleTargetDisabled(ctx context.Context, name string) error {
 	target.Disabled = !target.Disabled
 	return s.db.WithContext(ctx).Save(&target).Error
 }
+
+// ErrTargetNotFound is returned for unknown target names.
+var ErrTargetNotFound = errors.New("target not found")
+
+// DeleteTarget removes a target with its status and snapshot file lists
+// or returns ErrTargetNotFound. Stats, warnings and unlock history are
+// kept.
+func (s *Store) DeleteTarget(ctx context.Context, name string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("name = ?", name).Delete(&Target{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTargetNotFound
+		}
+		var status BackupStatus
+		err := tx.Where("name = ?", name).First(&status).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := tx.Where("backup_status_id = ?", status.ID).Delete(&SnapshotFile{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&status).Error
+	})
+}
+
+// GetTarget returns a configured Restic target by name with decrypted
+// secrets.
+func (s *Store) GetTarget(ctx context.Context, name string) (Target, error) {
+	var target Target
+	err := s.db.WithContext(ctx).
+		Where("name = ?", name).
+		First(&target).Error
+	if err != nil {
+		return target, err
+	}
+	err = s.decryptTarget(&target)
+	return target, err
+}
+
+func (s *Store) decryptTarget(target *Target) error {
+	password, err := s.cipher.Decrypt(target.Password)
+	if err != nil {
+		return fmt.Errorf("decrypt password of target %s: %w", target.Name, err)
+	}
+	target.Password = password
+
+	credentials, err := s.cipher.Decrypt(target.Credentials)
+	if err != nil {
+		return fmt.Errorf("decrypt credentials of target %s: %w", target.Name, err)
+	}
+	target.Credentials = credentials
+	return nil
+}
@@ -0,0 +1,281 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/example/restic-monitor/internal/secrets"
+	"gorm.io/gorm"
+)
+
+// postgresDSNEnv names the PostgreSQL database the tests also run against.
+// The database is wiped with MigrateDown before and after every test.
+const postgresDSNEnv = "RESTIC_MONITOR_TEST_POSTGRES_DSN"
+
+// forEachDialect runs test against a fresh SQLite database and, when
+// postgresDSNEnv is set, against PostgreSQL.
+func forEachDialect(t *testing.T, test func(t *testing.T, dsn string)) {
+	t.Helper()
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, filepath.Join(t.TempDir(), "store.db"))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(postgresDSNEnv)
+		if dsn == "" {
+			t.Skipf("%s not set", postgresDSNEnv)
+		}
+		wipe(t, dsn)
+		t.Cleanup(func() { wipe(t, dsn) })
+		test(t, dsn)
+	})
+}
+
+// wipe drops every table of the database.
+func wipe(t *testing.T, dsn string) {
+	t.Helper()
+	s, err := Open(dsn)
+	if err != nil {
+		t.Fatalf("open %s: %v", dsn, err)
+	}
+	defer closeStore(s)
+	if _, err := s.MigrateDown(context.Background(), 0); err != nil {
+		t.Fatalf("wipe: %v", err)
+	}
+	if err := s.db.Migrator().DropTable(&SchemaVersion{}); err != nil {
+		t.Fatalf("wipe: %v", err)
+	}
+}
+
+// newTestStore returns a migrated store.
+func newTestStore(t *testing.T, dsn string, opts ...Option) *Store {
+	t.Helper()
+	s, err := New(dsn, opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { closeStore(s) })
+	return s
+}
+
+func closeStore(s *Store) {
+	if db, err := s.db.DB(); err == nil {
+		db.Close()
+	}
+}
+
+func testCipher(t *testing.T) *secrets.Cipher {
+	t.Helper()
+	key, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := secrets.Load(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cipher
+}
+
+func TestTargets(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn, WithCipher(testCipher(t)))
+
+		err := s.UpsertTargets(ctx, []TargetData{
+			{
+				Name:            "b2",
+				Repository:      "b2:bucket:/repo",
+				Password:        "secret",
+				Credentials:     map[string]string{"B2_ACCOUNT_KEY": "key"},
+				AutoUnlockAfter: "2h",
+				KeepDaily:       7,
+			},
+			{Name: "local", Repository: "/srv/restic", PasswordFile: "/etc/restic/password"},
+			{Repository: "/ignored"},
+		})
+		if err != nil {
+			t.Fatalf("UpsertTargets: %v", err)
+		}
+
+		targets, err := s.ListTargets(ctx)
+		if err != nil {
+			t.Fatalf("ListTargets: %v", err)
+		}
+		if len(targets) != 2 || targets[0].Name != "b2" || targets[1].Name != "local" {
+			t.Fatalf("ListTargets = %+v, want b2 and local", targets)
+		}
+
+		target, err := s.GetTarget(ctx, "b2")
+		if err != nil {
+			t.Fatalf("GetTarget: %v", err)
+		}
+		if target.Password != "secret" || target.KeepDaily != 7 || target.AutoUnlockAfter.String() != "2h0m0s" {
+			t.Errorf("GetTarget = %+v", target)
+		}
+		data, err := target.Data()
+		if err != nil {
+			t.Fatalf("Data: %v", err)
+		}
+		if data.Credentials["B2_ACCOUNT_KEY"] != "key" {
+			t.Errorf("credentials = %v", data.Credentials)
+		}
+
+		var stored Target
+		if err := s.db.Where("name = ?", "b2").First(&stored).Error; err != nil {
+			t.Fatal(err)
+		}
+		if !secrets.IsEncrypted(stored.Password) || !secrets.IsEncrypted(stored.Credentials) {
+			t.Errorf("secrets stored in the clear: password %q, credentials %q", stored.Password, stored.Credentials)
+		}
+
+		data.Repository = "b2:bucket:/moved"
+		data.Password = "rotated"
+		if err := s.UpsertTargets(ctx, []TargetData{data}); err != nil {
+			t.Fatalf("UpsertTargets update: %v", err)
+		}
+		target, err = s.GetTarget(ctx, "b2")
+		if err != nil {
+			t.Fatalf("GetTarget: %v", err)
+		}
+		if target.ID != stored.ID || target.Repository != "b2:bucket:/moved" || target.Password != "rotated" {
+			t.Errorf("updated target = %+v", target)
+		}
+
+		if err := s.ToggleTargetDisabled(ctx, "local"); err != nil {
+			t.Fatalf("ToggleTargetDisabled: %v", err)
+		}
+		if target, err := s.GetTarget(ctx, "local"); err != nil || !target.Disabled {
+			t.Errorf("local after toggle = %+v, %v", target, err)
+		}
+
+		if err := s.SaveStatus(ctx, StatusData{Name: "local", Repository: "/srv/restic"}); err != nil {
+			t.Fatalf("SaveStatus: %v", err)
+		}
+		if err := s.DeleteTarget(ctx, "local"); err != nil {
+			t.Fatalf("DeleteTarget: %v", err)
+		}
+		if _, err := s.GetTarget(ctx, "local"); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("GetTarget after delete: %v, want record not found", err)
+		}
+		if _, err := s.GetStatus(ctx, "local"); err == nil {
+			t.Error("status of deleted target kept")
+		}
+		if err := s.DeleteTarget(ctx, "local"); !errors.Is(err, ErrTargetNotFound) {
+			t.Errorf("DeleteTarget twice: %v, want ErrTargetNotFound", err)
+		}
+	})
+}
+
+func TestUpsertTargetsMergesEnv(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn)
+
+		err := s.UpsertTargets(ctx, []TargetData{{
+			Name:        "s3",
+			Repository:  "s3:s3.amazonaws.com/bucket/restic",
+			Password:    "secret",
+			Credentials: map[string]string{"AWS_SECRET_ACCESS_KEY": "key", "AWS_DEFAULT_REGION": "eu-west-1"},
+			Env:         map[string]string{"AWS_DEFAULT_REGION": "eu-central-1", "AWS_PROFILE": "backup"},
+		}})
+		if err != nil {
+			t.Fatalf("UpsertTargets: %v", err)
+		}
+		target, err := s.GetTarget(ctx, "s3")
+		if err != nil {
+			t.Fatalf("GetTarget: %v", err)
+		}
+		creds, err := target.ResticCredentials()
+		if err != nil {
+			t.Fatalf("ResticCredentials: %v", err)
+		}
+		if len(creds.Env) != 0 {
+			t.Errorf("env = %v, want it merged into the credentials", creds.Env)
+		}
+		want := map[string]string{"AWS_SECRET_ACCESS_KEY": "key", "AWS_DEFAULT_REGION": "eu-west-1", "AWS_PROFILE": "backup"}
+		if len(creds.Secrets) != len(want) {
+			t.Errorf("credentials = %v, want %v", creds.Secrets, want)
+		}
+		for key, value := range want {
+			if creds.Secrets[key] != value {
+				t.Errorf("credential %s = %q, want %q", key, creds.Secrets[key], value)
+			}
+		}
+	})
+}
+
+func TestUpsertTargetsRejectsInvalidSettings(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn)
+
+		err := s.UpsertTargets(ctx, []TargetData{{Name: "bad", Repository: "/repo", AutoUnlockAfter: "soon"}})
+		if err == nil {
+			t.Fatal("UpsertTargets accepted an invalid auto unlock threshold")
+		}
+		if targets, err := s.ListTargets(ctx); err != nil || len(targets) != 0 {
+			t.Errorf("ListTargets = %+v, %v, want none", targets, err)
+		}
+	})
+}
+
+func TestEncryptPlaintextSecrets(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		lookalike := "enc:v1:hunter2"
+
+		plain := newTestStore(t, dsn)
+		if err := plain.UpsertTargets(ctx, []TargetData{{Name: "home", Repository: "/srv/restic/home", Password: lookalike}}); err == nil {
+			t.Error("UpsertTargets stored a password looking encrypted without a master key")
+		}
+		// A database written before passwords with the prefix were refused
+		if err := plain.UpsertTargets(ctx, []TargetData{{Name: "home", Repository: "/srv/restic/home", Password: "secret"}}); err != nil {
+			t.Fatalf("UpsertTargets: %v", err)
+		}
+		if err := plain.db.Model(&Target{}).Where("name = ?", "home").Update("password", lookalike).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		cipher := testCipher(t)
+		s := newTestStore(t, dsn, WithCipher(cipher))
+		stored := func(name string) string {
+			t.Helper()
+			var target Target
+			if err := s.db.Where("name = ?", name).First(&target).Error; err != nil {
+				t.Fatal(err)
+			}
+			if sealed, err := cipher.Sealed(target.Password); err != nil || !sealed {
+				t.Errorf("password of %s stored as %q, want it encrypted", name, target.Password)
+			}
+			return target.Password
+		}
+		if target, err := s.GetTarget(ctx, "home"); err != nil || target.Password != lookalike {
+			t.Errorf("GetTarget = %+v, %v, want the plaintext password", target, err)
+		}
+		sealed := stored("home")
+
+		if err := s.UpsertTargets(ctx, []TargetData{{Name: "away", Repository: "/srv/restic/away", Password: lookalike}}); err != nil {
+			t.Fatalf("UpsertTargets: %v", err)
+		}
+		stored("away")
+		if target, err := s.GetTarget(ctx, "away"); err != nil || target.Password != lookalike {
+			t.Errorf("GetTarget = %+v, %v, want the plaintext password", target, err)
+		}
+
+		if err := s.EncryptPlaintextSecrets(ctx); err != nil {
+			t.Fatalf("EncryptPlaintextSecrets: %v", err)
+		}
+		if again := stored("home"); again != sealed {
+			t.Error("EncryptPlaintextSecrets encrypted an encrypted password again")
+		}
+		if err := newTestStore(t, dsn).EncryptPlaintextSecrets(ctx); err != nil {
+			t.Fatalf("EncryptPlaintextSecrets without a key: %v", err)
+		}
+		if _, err := New(dsn, WithCipher(testCipher(t))); !errors.Is(err, secrets.ErrWrongKey) {
+			t.Errorf("New with another key: %v, want ErrWrongKey", err)
+		}
+	})
+}
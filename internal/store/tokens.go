@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes of API tokens.
+const (
+	// ScopeReadStatus allows reading status, stats, snapshots, locks and tasks.
+	ScopeReadStatus = "read:status"
+	// ScopeWritePrune allows pruning repositories.
+	ScopeWritePrune = "write:prune"
+	// ScopeWriteUnlock allows unlocking repositories.
+	ScopeWriteUnlock = "write:unlock"
+	// ScopeWriteCheck allows triggering checks.
+	ScopeWriteCheck = "write:check"
+	// ScopeWriteTargets allows adding and removing targets.
+	ScopeWriteTargets = "write:targets"
+	// ScopeAgent allows registering agents.
+	ScopeAgent = "agent"
+)
+
+// Scopes lists the known token scopes.
+var Scopes = []string{ScopeReadStatus, ScopeWritePrune, ScopeWriteUnlock, ScopeWriteCheck, ScopeWriteTargets, ScopeAgent}
+
+// ErrTokenNotFound is returned for unknown token IDs.
+var ErrTokenNotFound = errors.New("token not found")
+
+// tokenTouchInterval limits how often the last use of a token is written.
+const tokenTouchInterval = time.Minute
+
+// APIToken is a named bearer token for scripts. Only the hash of the token
+// is stored; Prefix identifies it in listings and for the lookup.
+type APIToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"size:255"`
+	Prefix    string `gorm:"index;size:32"`
+	TokenHash string
+	// Scopes holds the JSON encoded scopes of the token.
+	Scopes     string
+	CreatedBy  string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+// TokenScopes decodes the scopes of the token.
+func (t APIToken) TokenScopes() ([]string, error) {
+	var scopes []string
+	err := decodeField(t.Scopes, &scopes)
+	return scopes, err
+}
+
+// Active reports whether the token is neither revoked nor expired at now.
+func (t APIToken) Active(now time.Time) bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+	return t.ExpiresAt == nil || now.Before(*t.ExpiresAt)
+}
+
+// TokenData captures a token to create. ExpiresIn is a duration such as
+// "720h"; empty means the token does not expire.
+type TokenData struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"`
+}
+
+func (d TokenData) expiresAt(now time.Time) (*time.Time, error) {
+	if d.ExpiresIn == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(d.ExpiresIn)
+	if err != nil {
+		return nil, fmt.Errorf("expires_in: %w", err)
+	}
+	if ttl <= 0 {
+		return nil, errors.New("expires_in must be positive")
+	}
+	at := now.Add(ttl)
+	return &at, nil
+}
+
+func (d TokenData) validate() error {
+	if strings.TrimSpace(d.Name) == "" {
+		return errors.New("token name required")
+	}
+	if len(d.Scopes) == 0 {
+		return errors.New("at least one scope required")
+	}
+	for _, scope := range d.Scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q (%s)", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+// CreateAPIToken stores a token by the hash of its secret.
+func (s *Store) CreateAPIToken(ctx context.Context, data TokenData, prefix, tokenHash, createdBy string) (APIToken, error) {
+	if err := data.validate(); err != nil {
+		return APIToken{}, err
+	}
+	expiresAt, err := data.expiresAt(time.Now())
+	if err != nil {
+		return APIToken{}, err
+	}
+	scopes, err := encodeField(data.Scopes)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	token := APIToken{
+		Name:      data.Name,
+		Prefix:    prefix,
+		TokenHash: tokenHash,
+		Scopes:    scopes,
+		CreatedBy: createdBy,
+		ExpiresAt: expiresAt,
+	}
+	err = s.db.WithContext(ctx).Create(&token).Error
+	return token, err
+}
+
+// FindAPITokens returns the tokens with the given prefix; the caller
+// compares the hashes.
+func (s *Store) FindAPITokens(ctx context.Context, prefix string) ([]APIToken, error) {
+	var tokens []APIToken
+	err := s.db.WithContext(ctx).
+		Where("prefix = ?", prefix).
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// ListAPITokens returns all tokens, newest first, including revoked and
+// expired ones.
+func (s *Store) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	var tokens []APIToken
+	err := s.db.WithContext(ctx).
+		Order("id desc").
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// TouchAPIToken records the use of a token at most once per minute.
+func (s *Store) TouchAPIToken(ctx context.Context, token APIToken, now time.Time) error {
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < tokenTouchInterval {
+		return nil
+	}
+	return s.db.WithContext(ctx).
+		Model(&APIToken{}).
+		Where("id = ?", token.ID).
+		Update("last_used_at", now).Error
+}
+
+// RevokeAPIToken marks a token as revoked. Revoking twice keeps the first
+// revocation time.
+func (s *Store) RevokeAPIToken(ctx context.Context, id uint) (APIToken, error) {
+	var token APIToken
+	if err := s.db.WithContext(ctx).Limit(1).Find(&token, id).Error; err != nil {
+		return APIToken{}, err
+	}
+	if token.ID == 0 {
+		return APIToken{}, ErrTokenNotFound
+	}
+	if token.RevokedAt != nil {
+		return token, nil
+	}
+	now := time.Now()
+	token.RevokedAt = &now
+	err := s.db.WithContext(ctx).Model(&token).Update("revoked_at", now).Error
+	return token, err
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn)
+
+		if _, err := s.CreateAPIToken(ctx, TokenData{Name: "ci", Scopes: []string{"write:all"}}, "p", "h", "admin"); err == nil {
+			t.Error("CreateAPIToken accepted an unknown scope")
+		}
+		if _, err := s.CreateAPIToken(ctx, TokenData{Name: "ci", Scopes: []string{ScopeReadStatus}, ExpiresIn: "-1h"}, "p", "h", "admin"); err == nil {
+			t.Error("CreateAPIToken accepted a negative expiry")
+		}
+
+		token, err := s.CreateAPIToken(ctx, TokenData{
+			Name:      "ci",
+			Scopes:    []string{ScopeReadStatus, ScopeWritePrune},
+			ExpiresIn: "24h",
+		}, "rm_abcd", "hash", "admin")
+		if err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+		if token.ExpiresAt == nil || !token.Active(time.Now()) || token.Active(time.Now().Add(25*time.Hour)) {
+			t.Errorf("token expiry = %v", token.ExpiresAt)
+		}
+		if _, err := s.CreateAPIToken(ctx, TokenData{Name: "other", Scopes: []string{ScopeAgent}}, "rm_efgh", "hash2", "admin"); err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+
+		found, err := s.FindAPITokens(ctx, "rm_abcd")
+		if err != nil || len(found) != 1 || found[0].ID != token.ID {
+			t.Fatalf("FindAPITokens = %+v, %v", found, err)
+		}
+		scopes, err := found[0].TokenScopes()
+		if err != nil || len(scopes) != 2 || scopes[1] != ScopeWritePrune {
+			t.Errorf("TokenScopes = %v, %v", scopes, err)
+		}
+
+		now := time.Now()
+		if err := s.TouchAPIToken(ctx, found[0], now); err != nil {
+			t.Fatalf("TouchAPIToken: %v", err)
+		}
+		found, err = s.FindAPITokens(ctx, "rm_abcd")
+		if err != nil || found[0].LastUsedAt == nil {
+			t.Fatalf("last use not recorded: %+v, %v", found, err)
+		}
+
+		revoked, err := s.RevokeAPIToken(ctx, token.ID)
+		if err != nil || revoked.Active(time.Now()) {
+			t.Fatalf("RevokeAPIToken = %+v, %v", revoked, err)
+		}
+		again, err := s.RevokeAPIToken(ctx, token.ID)
+		if err != nil || again.RevokedAt.Sub(*revoked.RevokedAt).Abs() > time.Millisecond {
+			t.Errorf("second revocation = %v, %v, want %v", again.RevokedAt, err, revoked.RevokedAt)
+		}
+		if _, err := s.RevokeAPIToken(ctx, token.ID+100); !errors.Is(err, ErrTokenNotFound) {
+			t.Errorf("RevokeAPIToken of an unknown token: %v, want ErrTokenNotFound", err)
+		}
+
+		tokens, err := s.ListAPITokens(ctx)
+		if err != nil || len(tokens) != 2 || tokens[0].Name != "other" || tokens[1].RevokedAt == nil {
+			t.Errorf("ListAPITokens = %+v, %v", tokens, err)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roles of users, from least to most privileged. Viewers read status,
+// operators also unlock, prune and queue tasks, admins also manage users
+// and agents.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAllows reports whether role grants the permissions of required.
+func RoleAllows(role, required string) bool {
+	return ValidRole(role) && roleRank[role] >= roleRank[required]
+}
+
+// MinPasswordLength is the shortest accepted user password.
+const MinPasswordLength = 8
+
+// ErrUserNotFound is returned for unknown usernames.
+var ErrUserNotFound = errors.New("user not found")
+
+// User is a person or script allowed to use the API.
+type User struct {
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"uniqueIndex;size:255"`
+	PasswordHash string
+	Role         string
+	// Targets holds the JSON encoded names of the targets the user may
+	// access; empty means all targets.
+	Targets   string
+	Disabled  bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TargetNames returns the targets the user is scoped to, or nil for all.
+func (u User) TargetNames() ([]string, error) {
+	var names []string
+	err := decodeField(u.Targets, &names)
+	return names, err
+}
+
+// UserData captures a user to create or update. An empty Password keeps
+// the current password on update.
+type UserData struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Role     string   `json:"role"`
+	Targets  []string `json:"targets"`
+	Disabled bool     `json:"disabled"`
+}
+
+func (d UserData) validate(create bool) error {
+	if d.Username == "" || strings.ContainsAny(d.Username, ":/ ") {
+		return fmt.Errorf("invalid username %q", d.Username)
+	}
+	if !ValidRole(d.Role) {
+		return fmt.Errorf("unknown role %q (viewer, operator or admin)", d.Role)
+	}
+	if (create || d.Password != "") && len(d.Password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	if slices.Contains(d.Targets, "") {
+		return errors.New("empty target name")
+	}
+	return nil
+}
+
+// CreateUser adds a user with a hashed password.
+func (s *Store) CreateUser(ctx context.Context, data UserData) (User, error) {
+	if err := data.validate(true); err != nil {
+		return User{}, err
+	}
+	hash, err := HashPassword(data.Password)
+	if err != nil {
+		return User{}, err
+	}
+	targets, err := encodeField(data.Targets)
+	if err != nil {
+		return User{}, err
+	}
+
+	var count int64
+	if err := s.db.WithContext(ctx).Model(&User{}).Where("username = ?", data.Username).Count(&count).Error; err != nil {
+		return User{}, err
+	}
+	if count > 0 {
+		return User{}, fmt.Errorf("user %s already exists", data.Username)
+	}
+
+	user := User{
+		Username:     data.Username,
+		PasswordHash: hash,
+		Role:         data.Role,
+		Targets:      targets,
+		Disabled:     data.Disabled,
+	}
+	err = s.db.WithContext(ctx).Create(&user).Error
+	return user, err
+}
+
+// UpdateUser changes the role, targets, disabled flag and, when given, the
+// password of a user.
+func (s *Store) UpdateUser(ctx context.Context, data UserData) (User, error) {
+	if err := data.validate(false); err != nil {
+		return User{}, err
+	}
+	user, err := s.GetUser(ctx, data.Username)
+	if err != nil {
+		return User{}, err
+	}
+	if data.Password != "" {
+		if user.PasswordHash, err = HashPassword(data.Password); err != nil {
+			return User{}, err
+		}
+	}
+	if user.Targets, err = encodeField(data.Targets); err != nil {
+		return User{}, err
+	}
+	user.Role = data.Role
+	user.Disabled = data.Disabled
+	err = s.db.WithContext(ctx).Save(&user).Error
+	return user, err
+}
+
+// GetUser returns the user with the given username or ErrUserNotFound.
+func (s *Store) GetUser(ctx context.Context, username string) (User, error) {
+	var users []User
+	err := s.db.WithContext(ctx).
+		Where("username = ?", username).
+		Limit(1).
+		Find(&users).Error
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) == 0 {
+		return User{}, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+// ListUsers returns all users ordered by username.
+func (s *Store) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := s.db.WithContext(ctx).
+		Order("username asc").
+		Find(&users).Error
+	return users, err
+}
+
+// CountUsers returns the number of users; with none, the API falls back to
+// the AUTH_* settings.
+func (s *Store) CountUsers(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&User{}).Count(&count).Error
+	return count, err
+}
+
+// DeleteUser removes a user.
+func (s *Store) DeleteUser(ctx context.Context, username string) error {
+	result := s.db.WithContext(ctx).Where("username = ?", username).Delete(&User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Password hashes are PBKDF2-HMAC-SHA256 in the form
+// "pbkdf2-sha256$<iterations>$<salt>$<key>" with base64 salt and key.
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordSaltLen    = 16
+	passwordKeyLen     = 32
+)
+
+// HashPassword returns a salted hash of password.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether password matches hash.
+func VerifyPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, dsn string) {
+		ctx := context.Background()
+		s := newTestStore(t, dsn)
+
+		if _, err := s.CreateUser(ctx, UserData{Username: "alice", Password: "short", Role: RoleViewer}); err == nil {
+			t.Error("CreateUser accepted a short password")
+		}
+		if _, err := s.CreateUser(ctx, UserData{Username: "alice", Password: "long enough", Role: "root"}); err == nil {
+			t.Error("CreateUser accepted an unknown role")
+		}
+
+		alice, err := s.CreateUser(ctx, UserData{Username: "alice", Password: "long enough", Role: RoleOperator, Targets: []string{"db"}})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if !VerifyPassword(alice.PasswordHash, "long enough") || VerifyPassword(alice.PasswordHash, "wrong password") {
+			t.Error("password hash does not verify")
+		}
+		if _, err := s.CreateUser(ctx, UserData{Username: "alice", Password: "long enough", Role: RoleViewer}); err == nil {
+			t.Error("CreateUser accepted a duplicate username")
+		}
+		if _, err := s.CreateUser(ctx, UserData{Username: "bob", Password: "long enough", Role: RoleAdmin}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+
+		got, err := s.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		names, err := got.TargetNames()
+		if err != nil || len(names) != 1 || names[0] != "db" {
+			t.Errorf("TargetNames = %v, %v", names, err)
+		}
+
+		updated, err := s.UpdateUser(ctx, UserData{Username: "alice", Role: RoleViewer, Disabled: true})
+		if err != nil {
+			t.Fatalf("UpdateUser: %v", err)
+		}
+		if updated.Role != RoleViewer || !updated.Disabled || updated.PasswordHash != alice.PasswordHash {
+			t.Errorf("updated user = %+v, want the password kept", updated)
+		}
+		if names, _ := updated.TargetNames(); names != nil {
+			t.Errorf("targets after update = %v, want all", names)
+		}
+		if _, err := s.UpdateUser(ctx, UserData{Username: "carol", Role: RoleViewer}); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("UpdateUser of an unknown user: %v, want ErrUserNotFound", err)
+		}
+
+		users, err := s.ListUsers(ctx)
+		if err != nil || len(users) != 2 || users[0].Username != "alice" {
+			t.Errorf("ListUsers = %+v, %v", users, err)
+		}
+		if count, err := s.CountUsers(ctx); err != nil || count != 2 {
+			t.Errorf("CountUsers = %d, %v, want 2", count, err)
+		}
+
+		if err := s.DeleteUser(ctx, "alice"); err != nil {
+			t.Fatalf("DeleteUser: %v", err)
+		}
+		if _, err := s.GetUser(ctx, "alice"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("GetUser after delete: %v, want ErrUserNotFound", err)
+		}
+		if err := s.DeleteUser(ctx, "alice"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("DeleteUser twice: %v, want ErrUserNotFound", err)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Snapshot metrics compared against the rolling baseline.
+const (
+	MetricFiles = "files"
+	MetricSize  = "size"
+)
+
+// SnapshotWarning flags a snapshot whose file count or size deviates from
+// the snapshots before it.
+type SnapshotWarning struct {
+	ID           uint   `gorm:"primaryKey"`
+	TargetName   string `gorm:"uniqueIndex:idx_snapshot_warning;size:255"`
+	SnapshotID   string `gorm:"uniqueIndex:idx_snapshot_warning;size:64"`
+	Metric       string `gorm:"uniqueIndex:idx_snapshot_warning;size:16"`
+	SnapshotTime time.Time
+	Value        uint64
+	Baseline     uint64
+	Ratio        float64
+	Message      string
+	CreatedAt    time.Time
+}
+
+// WarningData captures an anomaly found in a snapshot.
+type WarningData struct {
+	SnapshotID   string
+	SnapshotTime time.Time
+	Metric       string
+	Value        uint64
+	Baseline     uint64
+	Ratio        float64
+	Message      string
+}
+
+// ReplaceSnapshotWarnings sets the current warnings of a target. Warnings
+// already recorded keep their creation time, the ones missing from warnings
+// are removed. It returns the warnings that were not recorded before.
+func (s *Store) ReplaceSnapshotWarnings(ctx context.Context, name string, warnings []WarningData) ([]SnapshotWarning, error) {
+	var created []SnapshotWarning
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing []SnapshotWarning
+		if err := tx.Where("target_name = ?", name).Find(&existing).Error; err != nil {
+			return err
+		}
+		type key struct{ snapshot, metric string }
+		keep := make(map[key]bool, len(warnings))
+		for _, data := range warnings {
+			keep[key{data.SnapshotID, data.Metric}] = true
+		}
+		known := make(map[key]bool, len(existing))
+		for _, warning := range existing {
+			k := key{warning.SnapshotID, warning.Metric}
+			if !keep[k] {
+				if err := tx.Delete(&warning).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			known[k] = true
+		}
+
+		for _, data := range warnings {
+			if known[key{data.SnapshotID, data.Metric}] {
+				continue
+			}
+			warning := SnapshotWarning{
+				TargetName:   name,
+				SnapshotID:   data.SnapshotID,
+				Metric:       data.Metric,
+				SnapshotTime: data.SnapshotTime,
+				Value:        data.Value,
+				Baseline:     data.Baseline,
+				Ratio:        data.Ratio,
+				Message:      data.Message,
+			}
+			if err := tx.Create(&warning).Error; err != nil {
+				return err
+			}
+			created = append(created, warning)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// ListSnapshotWarnings returns the current warnings of a target, newest
+// snapshot first.
+func (s *Store) ListSnapshotWarnings(ctx context.Context, name string) ([]SnapshotWarning, error) {
+	var warnings []SnapshotWarning
+	err := s.db.WithContext(ctx).
+		Where("target_name = ?", name).
+		Order("snapshot_time desc, metric asc").
+		Find(&warnings).Error
+	return warnings, err
+}